@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"log"
+	"net"
+)
+
+// 批量收发UDP报文时每批的最大报文数
+const udpBatchSize = 64
+
+// ipv4.PacketConn与ipv6.PacketConn共有的批量读写方法
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// 批量收发UDP报文的监听器，Linux下使用recvmmsg/sendmmsg减少高并发时的系统调用次数，
+// 其它平台上逐个收发报文。用于替代dns.Server的UDP监听
+type batchServer struct {
+	conn    *net.UDPConn
+	batch   batchConn
+	handler dns.Handler
+	out     chan ipv4.Message
+}
+
+// 读取客户端请求，每个请求在单独的goroutine中处理
+func (s *batchServer) readLoop() error {
+	msgs := make([]ipv4.Message, udpBatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, dns.DefaultMsgSize)}
+	}
+	for {
+		n, err := s.batch.ReadBatch(msgs, 0)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		for _, msg := range msgs[:n] {
+			if msg.N >= dns.DefaultMsgSize || msg.N < 12 { // 填满缓冲区的报文可能已被截断，不足报文头长度的报文无效
+				continue
+			}
+			packet := make([]byte, msg.N)
+			copy(packet, msg.Buffers[0][:msg.N])
+			go s.serve(packet, msg.Addr)
+		}
+	}
+}
+
+// 合并已排队的响应，批量写入
+func (s *batchServer) writeLoop() {
+	batch := make([]ipv4.Message, 0, udpBatchSize)
+	for msg := range s.out {
+		batch = append(batch[:0], msg)
+		for drained := false; !drained && len(batch) < udpBatchSize; {
+			select {
+			case msg = <-s.out:
+				batch = append(batch, msg)
+			default:
+				drained = true
+			}
+		}
+		for pending := batch; len(pending) > 0; {
+			n, err := s.batch.WriteBatch(pending, 0)
+			if err != nil {
+				log.Printf("[ERROR] write udp batch error: %v\n", err)
+				break
+			}
+			pending = pending[n:]
+		}
+	}
+}
+
+// 解包并处理单个请求，行为与dns.Server一致：忽略无法解包的报文及响应报文，校验TSIG签名
+func (s *batchServer) serve(packet []byte, addr net.Addr) {
+	request := new(dns.Msg)
+	if err := request.Unpack(packet); err != nil || request.Response {
+		return // 不响应无效报文，避免被用于反射放大
+	}
+	w := &batchWriter{server: s, remote: addr}
+	if t := request.IsTsig(); t != nil {
+		w.tsigStatus = dns.TsigVerifyWithProvider(packet, tsigProvider{}, "", false)
+		w.tsigRequestMAC = t.MAC
+	}
+	s.handler.ServeDNS(w, request)
+}
+
+// 批量监听器的dns.ResponseWriter实现，响应经由writeLoop批量发送
+type batchWriter struct {
+	server         *batchServer
+	remote         net.Addr
+	tsigStatus     error
+	tsigTimersOnly bool
+	tsigRequestMAC string
+}
+
+func (w *batchWriter) LocalAddr() net.Addr  { return w.server.conn.LocalAddr() }
+func (w *batchWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *batchWriter) Close() error         { return nil }
+func (w *batchWriter) TsigStatus() error    { return w.tsigStatus }
+func (w *batchWriter) TsigTimersOnly(b bool) {
+	w.tsigTimersOnly = b
+}
+func (w *batchWriter) Hijack() {}
+
+func (w *batchWriter) WriteMsg(msg *dns.Msg) (err error) {
+	var data []byte
+	if t := msg.IsTsig(); t != nil {
+		data, w.tsigRequestMAC, err = dns.TsigGenerateWithProvider(msg, tsigProvider{}, w.tsigRequestMAC, w.tsigTimersOnly)
+	} else {
+		data, err = msg.Pack()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *batchWriter) Write(data []byte) (int, error) {
+	w.server.out <- ipv4.Message{Buffers: [][]byte{data}, Addr: w.remote}
+	return len(data), nil
+}
+
+// 创建批量收发的UDP监听器
+func newBatchServer(conn *net.UDPConn, handler dns.Handler) *batchServer {
+	s := &batchServer{conn: conn, handler: handler, out: make(chan ipv4.Message, udpBatchSize*4)}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		s.batch = ipv6.NewPacketConn(conn)
+	} else {
+		s.batch = ipv4.NewPacketConn(conn)
+	}
+	return s
+}
+
+// 开始处理请求，监听出错时返回
+func (s *batchServer) serveUDP() error {
+	go s.writeLoop()
+	return s.readLoop()
+}
+
+// 使用批量收发的UDP监听器处理请求，开始监听后调用started，出错时返回
+func listenBatchUDP(addr string, handler dns.Handler, started func()) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	if started != nil {
+		started()
+	}
+	return newBatchServer(conn, handler).serveUDP()
+}
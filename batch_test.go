@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchServer(t *testing.T) {
+	// 分别测试ipv4及双栈监听
+	for _, ip := range []net.IP{net.ParseIP("127.0.0.1"), nil} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+		assert.Equal(t, err, nil)
+		handler := dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(request)
+			rr, _ := dns.NewRR(request.Question[0].Name + " 0 IN A 1.2.3.4")
+			r.Answer = append(r.Answer, rr)
+			_ = w.WriteMsg(r)
+		})
+		go func() { _ = newBatchServer(conn, handler).serveUDP() }()
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		server := "127.0.0.1:" + strconv.Itoa(port)
+		// 并发请求均收到对应的响应
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				request := new(dns.Msg)
+				request.SetQuestion("ip.cn.", dns.TypeA)
+				client := &dns.Client{Timeout: time.Second}
+				r, _, err := client.Exchange(request, server)
+				assert.Equal(t, err, nil)
+				if assert.True(t, r != nil) {
+					assert.Equal(t, r.Id, request.Id)
+					assert.Equal(t, len(r.Answer), 1)
+				}
+			}()
+		}
+		wg.Wait()
+		_ = conn.Close()
+	}
+}
+
+func FuzzBatchServe(f *testing.F) {
+	secret := "c2VjcmV0"
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	raw, _ := request.Pack()
+	f.Add(raw)
+	request.SetTsig("key.", dns.HmacSHA256, 300, time.Now().Unix())
+	raw, _, _ = dns.TsigGenerate(request, secret, "", false)
+	f.Add(raw)
+	// 仅校验解包及TSIG处理，不写入响应
+	snapshot.Store(&config.Config{TsigSecrets: map[string]string{"key.": secret}})
+	s := &batchServer{handler: dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) { _ = w.TsigStatus() })}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s.serve(data, addr)
+	})
+}
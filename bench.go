@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 压测使用的查询
+type benchQuery struct {
+	name  string
+	qtype uint16
+}
+
+// 读取查询列表，每行格式为"域名 [记录类型]"，记录类型默认为A
+func readBenchQueries(filename string) (queries []benchQuery, err error) {
+	var file *os.File
+	if file, err = os.Open(filename); err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		query := benchQuery{name: dns.Fqdn(fields[0]), qtype: dns.TypeA}
+		if len(fields) > 1 {
+			var ok bool
+			if query.qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+				return nil, fmt.Errorf("unknown query type: %s", fields[1])
+			}
+		}
+		queries = append(queries, query)
+	}
+	return queries, scanner.Err()
+}
+
+// 生成随机子域名，用于测试缓存未命中的情况
+func randomBenchQuery(domain string) benchQuery {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	buf := make([]byte, 12)
+	for i := range buf {
+		buf[i] = letters[rand.Intn(len(letters))]
+	}
+	return benchQuery{name: dns.Fqdn(string(buf) + "." + domain), qtype: dns.TypeA}
+}
+
+// 返回已排序耗时的百分位数
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// bench子命令：按目标QPS向运行中的ts-dns发送查询，并输出延迟分布
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("s", "127.0.0.1:53", "target dns server address")
+	file := fs.String("f", "", "query list file, each line is \"name [type]\"")
+	random := fs.String("random", "", "query random subdomains of this domain instead of a list")
+	total := fs.Int("n", 10000, "total number of queries")
+	qps := fs.Int("qps", 1000, "target queries per second, 0 for unlimited")
+	workers := fs.Int("workers", 16, "number of concurrent workers, at least 1")
+	timeout := fs.Duration("timeout", 2*time.Second, "query timeout")
+	_ = fs.Parse(args)
+
+	var queries []benchQuery
+	if *random == "" {
+		var err error
+		if *file == "" {
+			queries = []benchQuery{{name: "www.qq.com.", qtype: dns.TypeA}}
+		} else if queries, err = readBenchQueries(*file); err != nil {
+			fmt.Fprintf(os.Stderr, "read query list error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(queries) == 0 {
+			fmt.Fprintln(os.Stderr, "query list is empty")
+			os.Exit(1)
+		}
+	}
+
+	next := func(i int) benchQuery {
+		if *random != "" {
+			return randomBenchQuery(*random)
+		}
+		return queries[i%len(queries)]
+	}
+	start := time.Now()
+	latencies, failed, err := benchmark(*server, next, *total, *qps, *workers, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("queries: %d, failed: %d, elapsed: %v, qps: %.1f\n",
+		*total, failed, elapsed, float64(*total)/elapsed.Seconds())
+	fmt.Printf("latency p50: %v, p90: %v, p99: %v, max: %v\n", percentile(latencies, 0.5),
+		percentile(latencies, 0.9), percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// 使用workers个并发客户端按目标QPS（0为不限制）向server发送total个查询，第i个查询由next生成。
+// 返回成功查询的耗时（已排序）及失败的查询数
+func benchmark(server string, next func(i int) benchQuery, total, qps, workers int,
+	timeout time.Duration) (latencies []time.Duration, failed int, err error) {
+	if workers < 1 {
+		return nil, 0, fmt.Errorf("invalid workers: %d", workers)
+	}
+	jobs := make(chan benchQuery, workers)
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := &dns.Client{Net: "udp", Timeout: timeout}
+			for query := range jobs {
+				msg := new(dns.Msg)
+				msg.SetQuestion(query.name, query.qtype)
+				_, rtt, err := client.Exchange(msg, server)
+				mux.Lock()
+				if err != nil {
+					failed++
+				} else {
+					latencies = append(latencies, rtt)
+				}
+				mux.Unlock()
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if qps > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(qps))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; i < total; i++ {
+		if tick != nil {
+			<-tick
+		}
+		jobs <- next(i)
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies, failed, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+// 启动应答固定A记录的UDP服务器
+func startUpstream(t *testing.T, ip string) (addr string, stop func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+		r := new(dns.Msg).SetReply(request)
+		rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A " + ip)
+		r.Answer = append(r.Answer, rr)
+		_ = w.WriteMsg(r)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	return conn.LocalAddr().String(), func() { _ = srv.Shutdown() }
+}
+
+func TestBenchmark(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	next := func(i int) benchQuery { return benchQuery{name: "ip.cn.", qtype: dns.TypeA} }
+	latencies, failed, err := benchmark(addr, next, 20, 0, 4, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, failed, 0)
+	assert.Equal(t, len(latencies), 20)
+	assert.True(t, latencies[0] <= latencies[19])
+	// 并发数小于1时报错，不会阻塞
+	for _, workers := range []int{0, -1} {
+		_, _, err = benchmark(addr, next, 20, 0, workers, time.Second)
+		assert.NotEqual(t, err, nil)
+	}
+}
@@ -0,0 +1,137 @@
+package blocklist
+
+import (
+	"fmt"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	MinRefresh    = time.Minute
+	RetryInterval = time.Minute // 首次加载失败后的重试间隔
+)
+
+// 每日生效的时间段，如"22:00-07:00"，结束时间早于开始时间时跨越零点，结束时间为00:00时至当天结束
+type Window struct {
+	start int // 自零点起的分钟数
+	end   int
+}
+
+// 判断时间是否处于时间段内
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start <= w.end {
+		return w.start <= minute && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// 解析"HH:MM-HH:MM"格式的时间段
+func ParseWindow(text string) (w Window, err error) {
+	var h1, m1, h2, m2 int
+	if _, err = fmt.Sscanf(text, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return w, fmt.Errorf("invalid schedule %q: %v", text, err)
+	}
+	for _, v := range [][2]int{{h1, m1}, {h2, m2}} {
+		if v[0] < 0 || v[0] >= 24 || v[1] < 0 || v[1] >= 60 {
+			return w, fmt.Errorf("invalid schedule %q", text)
+		}
+	}
+	return Window{start: h1*60 + m1, end: h2*60 + m2}, nil
+}
+
+// 分类屏蔽列表（如成人、赌博、恶意软件），支持定时刷新、按客户端及时间段生效
+type Blocklist struct {
+	Name    string
+	Clients *ipset.RamSet // 生效的客户端，为nil时对所有客户端生效
+	Windows []Window      // 生效的时间段，为空时全天生效
+	load    func() ([]byte, error)
+	refresh time.Duration
+	mux     *sync.Mutex
+	rules   *Rules
+	loaded  time.Time
+	loading bool
+	pending bool // 尚未成功加载，按RetryInterval重试
+}
+
+// 判断屏蔽列表在当前时间对目标客户端是否生效
+func (b *Blocklist) Active(ip net.IP, now time.Time) bool {
+	if b.Clients != nil && !b.Clients.Contain(ip) {
+		return false
+	}
+	return b.Scheduled(now)
+}
+
+// 判断当前时间是否在生效时段内，未设置时段时始终生效
+func (b *Blocklist) Scheduled(now time.Time) bool {
+	if len(b.Windows) == 0 {
+		return true
+	}
+	for _, w := range b.Windows {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断域名是否被屏蔽，列表过期时在后台刷新
+func (b *Blocklist) Match(domain string) bool {
+	b.mux.Lock()
+	interval := b.refresh
+	if b.pending {
+		interval = RetryInterval
+	}
+	if interval > 0 && !b.loading && time.Since(b.loaded) >= interval {
+		b.loading = true
+		go b.reload()
+	}
+	rules := b.rules
+	b.mux.Unlock()
+	return rules.Match(domain)
+}
+
+func (b *Blocklist) reload() {
+	raw, err := b.load()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.loading, b.loaded = false, time.Now()
+	if err != nil { // 刷新失败时保留已有规则
+		log.Printf("[ERROR] refresh blocklist %s error: %v\n", b.Name, err)
+		return
+	}
+	if raw != nil { // 内容未变更时raw为nil
+		b.rules, b.pending = ParseRules(string(raw)), false
+	}
+}
+
+// 创建屏蔽列表，load用于读取hosts、域名列表或AdGuard/ABP格式的列表内容，refresh为0时不刷新
+func New(name string, load func() ([]byte, error), refresh time.Duration) (b *Blocklist, err error) {
+	var raw []byte
+	if raw, err = load(); err != nil {
+		return nil, err
+	}
+	if refresh > 0 && refresh < MinRefresh {
+		refresh = MinRefresh
+	}
+	b = &Blocklist{Name: name, load: load, refresh: refresh, mux: new(sync.Mutex), loaded: time.Now()}
+	b.rules = ParseRules(string(raw))
+	return b, nil
+}
+
+// 同New，但首次加载失败时以空列表启动，并在查询时于后台每隔RetryInterval重试直至成功
+func NewRetry(name string, load func() ([]byte, error), refresh time.Duration) *Blocklist {
+	b, err := New(name, load, refresh)
+	if err == nil {
+		return b
+	}
+	log.Printf("[WARNING] load blocklist %s error, start with empty list and retry later: %v\n", name, err)
+	if refresh > 0 && refresh < MinRefresh {
+		refresh = MinRefresh
+	}
+	return &Blocklist{Name: name, load: load, refresh: refresh, mux: new(sync.Mutex), loaded: time.Now(),
+		rules: ParseRules(""), pending: true}
+}
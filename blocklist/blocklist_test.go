@@ -0,0 +1,81 @@
+package blocklist
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	_, err := ParseWindow("22:00")
+	assert.NotEqual(t, err, nil)
+	_, err = ParseWindow("22:60-07:00")
+	assert.NotEqual(t, err, nil)
+	// 小时不超过23
+	_, err = ParseWindow("18:00-24:00")
+	assert.NotEqual(t, err, nil)
+	_, err = ParseWindow("24:30-07:00")
+	assert.NotEqual(t, err, nil)
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	w, err := ParseWindow("08:30-17:00")
+	assert.Equal(t, err, nil)
+	assert.True(t, w.Contains(day.Add(9*time.Hour)))
+	assert.False(t, w.Contains(day.Add(17*time.Hour)))
+	// 跨越零点
+	w, _ = ParseWindow("22:00-07:00")
+	assert.True(t, w.Contains(day.Add(23*time.Hour)))
+	assert.True(t, w.Contains(day.Add(6*time.Hour)))
+	assert.False(t, w.Contains(day.Add(12*time.Hour)))
+	// 结束时间为00:00时至当天结束
+	w, err = ParseWindow("18:00-00:00")
+	assert.Equal(t, err, nil)
+	assert.True(t, w.Contains(day.Add(23*time.Hour+59*time.Minute)))
+	assert.False(t, w.Contains(day.Add(time.Minute)))
+	w, _ = ParseWindow("23:59-00:00")
+	assert.True(t, w.Contains(day.Add(23*time.Hour+59*time.Minute)))
+}
+
+func TestBlocklist(t *testing.T) {
+	_, err := New("fail", func() ([]byte, error) { return nil, errors.New("fail") }, 0)
+	assert.NotEqual(t, err, nil)
+	text := "# comment\n0.0.0.0 ads.example.com\n127.0.0.1 track.example.com\n||bad.com^\n"
+	b, err := New("ads", func() ([]byte, error) { return []byte(text), nil }, 0)
+	assert.Equal(t, err, nil)
+	assert.True(t, b.Match("ads.example.com."))
+	assert.True(t, b.Match("track.example.com."))
+	assert.True(t, b.Match("www.bad.com."))
+	assert.False(t, b.Match("example.com."))
+	// 按客户端、时间段生效
+	ip, now := net.ParseIP("192.168.1.2"), time.Now()
+	assert.True(t, b.Active(ip, now))
+	b.Clients = ipset.NewRamSetByText("192.168.2.0/24")
+	assert.False(t, b.Active(ip, now))
+	b.Clients = nil
+	b.Windows = []Window{{start: 0, end: 0}}
+	assert.False(t, b.Active(ip, now))
+}
+
+func TestBlocklistRetry(t *testing.T) {
+	fail := true
+	load := func() ([]byte, error) {
+		if fail {
+			return nil, errors.New("fail")
+		}
+		return []byte("||bad.com^"), nil
+	}
+	// 首次加载失败时以空列表启动
+	b := NewRetry("ads", load, 0)
+	assert.False(t, b.Match("bad.com."))
+	// 到达重试间隔后在后台重新加载
+	fail = false
+	b.loaded = time.Now().Add(-RetryInterval)
+	b.Match("")
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, b.Match("bad.com."))
+	b.mux.Lock()
+	assert.False(t, b.pending)
+	b.mux.Unlock()
+}
@@ -0,0 +1,204 @@
+package blocklist
+
+import (
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 规则类型，important规则优先于例外规则，例外规则优先于普通规则
+const (
+	ruleBlock uint8 = 1 << iota
+	ruleAllow
+	ruleImportantBlock
+	ruleImportantAllow
+)
+
+// 作用于特定客户端、记录类型或改写应答的修饰符，无法按屏蔽列表整体生效，含有这些修饰符的规则被忽略
+var scopedModifiers = map[string]bool{"client": true, "ctag": true, "dnstype": true, "dnsrewrite": true,
+	"denyallow": true, "domain": true}
+
+// hosts文件中的常见本机条目，不作为屏蔽规则
+var localHosts = map[string]bool{"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true, "0.0.0.0": true}
+
+// 域名或含通配符的域名
+var domainReg = regexp.MustCompile(`^[a-z0-9_*-]+(\.[a-z0-9_*-]+)+$`)
+
+type regRule struct {
+	regex *regexp.Regexp
+	flag  uint8
+}
+
+// 屏蔽规则集，支持AdGuard/AdBlock Plus过滤规则、hosts文件及Pi-hole域名列表：
+//
+//	||example.com^：屏蔽域名及其子域名
+//	|example.com^、example.com、0.0.0.0 example.com：仅屏蔽该域名
+//	*.example.com、/regex/：通配符及正则表达式
+//	@@前缀为例外规则，$important修饰符提升优先级，$badfilter修饰符禁用相同的规则
+type Rules struct {
+	exact  map[string]uint8
+	suffix map[string]uint8
+	regs   []regRule
+}
+
+// 返回规则数量
+func (rules *Rules) Len() int {
+	return len(rules.exact) + len(rules.suffix) + len(rules.regs)
+}
+
+// 判断域名是否被屏蔽
+func (rules *Rules) Match(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	flag := rules.exact[domain]
+	for suffix := domain; suffix != ""; {
+		flag |= rules.suffix[suffix]
+		i := strings.Index(suffix, ".")
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	for _, reg := range rules.regs {
+		if flag&reg.flag == 0 && reg.regex.MatchString(domain) {
+			flag |= reg.flag
+		}
+	}
+	switch {
+	case flag&ruleImportantAllow != 0:
+		return false
+	case flag&ruleImportantBlock != 0:
+		return true
+	case flag&ruleAllow != 0:
+		return false
+	}
+	return flag&ruleBlock != 0
+}
+
+// 将一行过滤规则拆分为模式及修饰符，返回的key用于匹配$badfilter规则
+func splitRule(line string) (pattern string, modifiers map[string]bool, key string) {
+	pattern, modifiers = line, map[string]bool{}
+	// 正则表达式中可能含有$，仅当$位于末尾的/之后时视为修饰符
+	if i := strings.LastIndex(line, "$"); i >= 0 && !(strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/")) {
+		pattern = line[:i]
+		for _, m := range strings.Split(line[i+1:], ",") {
+			if m = strings.TrimSpace(strings.ToLower(m)); m != "" {
+				if j := strings.Index(m, "="); j >= 0 {
+					m = m[:j]
+				}
+				modifiers[m] = true
+			}
+		}
+	}
+	var names []string
+	for m := range modifiers {
+		if m != "badfilter" {
+			names = append(names, m)
+		}
+	}
+	sort.Strings(names)
+	return pattern, modifiers, pattern + "$" + strings.Join(names, ",")
+}
+
+// 将通配符模式转为正则表达式，prefix、suffix为首尾的额外匹配条件
+func wildcard(pattern, prefix, suffix string) (*regexp.Regexp, error) {
+	expr := strings.Replace(regexp.QuoteMeta(pattern), `\*`, `.*`, -1)
+	return regexp.Compile(prefix + expr + suffix)
+}
+
+// 添加一条规则，无法识别的规则被忽略
+func (rules *Rules) add(pattern string, flag uint8) {
+	var suffix bool
+	switch {
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/"):
+		if regex, err := regexp.Compile(pattern[1 : len(pattern)-1]); err == nil {
+			rules.regs = append(rules.regs, regRule{regex: regex, flag: flag})
+		}
+		return
+	case strings.HasPrefix(pattern, "||"):
+		pattern, suffix = pattern[2:], true
+	case strings.HasPrefix(pattern, "|"):
+		pattern = pattern[1:]
+	}
+	pattern = strings.ToLower(strings.TrimRight(pattern, "^|."))
+	if !domainReg.MatchString(pattern) {
+		return
+	}
+	if strings.Contains(pattern, "*") {
+		prefix := "^"
+		if suffix {
+			prefix = `^(.*\.)?`
+		}
+		if regex, err := wildcard(pattern, prefix, "$"); err == nil {
+			rules.regs = append(rules.regs, regRule{regex: regex, flag: flag})
+		}
+	} else if suffix {
+		rules.suffix[pattern] |= flag
+	} else {
+		rules.exact[pattern] |= flag
+	}
+}
+
+// 解析屏蔽列表内容，各行可混合使用AdGuard/AdBlock Plus规则、hosts格式及纯域名
+func ParseRules(text string) *Rules {
+	type rule struct {
+		pattern string
+		flag    uint8
+		key     string
+	}
+	var list []rule
+	disabled := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue // 忽略空行、注释行及类型声明
+		}
+		if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") ||
+			strings.Contains(line, "#$#") {
+			continue // 忽略元素隐藏等网页过滤规则
+		}
+		if i := strings.Index(line, " #"); i > 0 {
+			line = strings.TrimSpace(line[:i]) // 移除行尾注释
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && net.ParseIP(fields[0]) != nil { // hosts格式，一行可包含多个域名
+			for _, host := range fields[1:] {
+				if host = strings.ToLower(host); !localHosts[host] {
+					list = append(list, rule{pattern: "|" + host, flag: ruleBlock})
+				}
+			}
+			continue
+		}
+		flag := ruleBlock
+		if strings.HasPrefix(line, "@@") {
+			line, flag = line[2:], ruleAllow
+		}
+		pattern, modifiers, key := splitRule(line)
+		if flag == ruleAllow {
+			key = "@@" + key
+		}
+		if modifiers["badfilter"] {
+			disabled[key] = true
+			continue
+		}
+		scoped := false
+		for m := range modifiers {
+			scoped = scoped || scopedModifiers[strings.TrimPrefix(m, "~")]
+		}
+		if scoped {
+			continue
+		}
+		if modifiers["important"] {
+			flag <<= 2
+		}
+		list = append(list, rule{pattern: pattern, flag: flag, key: key})
+	}
+	rules := &Rules{exact: map[string]uint8{}, suffix: map[string]uint8{}}
+	for _, r := range list {
+		if r.key == "" || !disabled[r.key] {
+			rules.add(r.pattern, r.flag)
+		}
+	}
+	return rules
+}
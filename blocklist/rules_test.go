@@ -0,0 +1,42 @@
+package blocklist
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	text := `[Adblock Plus 2.0]
+! AdGuard
+||ads.com^
+||track.com^$third-party
+@@||good.ads.com^
+||cdn.com^$important
+@@||img.cdn.com^
+@@||safe.cdn.com^$important
+||*.wild.net^
+/^ad[0-9]+\.regex\.org$/
+||client.com^$client=192.168.1.2
+||bad.org^
+||bad.org^$badfilter
+example.com##.banner
+# Pi-hole
+0.0.0.0 host.com host2.com # comment
+127.0.0.1 localhost
+:: ipv6.com
+plain.com
+`
+	rules := ParseRules(text)
+	for domain, blocked := range map[string]bool{
+		"ads.com.": true, "www.ads.com.": true, "good.ads.com.": false, "a.good.ads.com.": false,
+		// 网页过滤修饰符不影响域名匹配，important规则优先于例外规则
+		"track.com.": true, "cdn.com.": true, "img.cdn.com.": true, "safe.cdn.com.": false,
+		"a.wild.net.": true, "wild.net.": false,
+		"ad12.regex.org.": true, "ad.regex.org.": false,
+		"client.com.": false, "bad.org.": false, "example.com.": false, "localhost.": false,
+		"host.com.": true, "HOST2.com.": true, "www.host.com.": false, "ipv6.com.": true,
+		"plain.com.": true, "www.plain.com.": false,
+	} {
+		assert.Equal(t, rules.Match(domain), blocked, domain)
+	}
+}
@@ -3,54 +3,199 @@ package cache
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"math/rand"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// 获取dns请求或响应extra中的subnet字符串，格式为"Address/SourceNetmask"
-func getSubnet(extra []dns.RR) string {
+// 获取dns请求或响应extra中的ECS，不存在时返回nil
+func getSubnet(extra []dns.RR) *dns.EDNS0_SUBNET {
 	for _, extra := range extra {
 		switch extra.(type) {
 		case *dns.OPT:
 			for _, opt := range extra.(*dns.OPT).Option {
 				switch opt.(type) {
 				case *dns.EDNS0_SUBNET:
-					subOpt := opt.(*dns.EDNS0_SUBNET)
-					return fmt.Sprintf("%s/%d", subOpt.Address, subOpt.SourceNetmask)
+					return opt.(*dns.EDNS0_SUBNET)
 				}
 			}
 		}
 	}
-	return ""
+	return nil
+}
+
+// 获取ECS的subnet字符串，格式为"Address/SourceNetmask"。scope小于源前缀长度时按scope截取地址，
+// 使作用域内的客户端共用缓存；scope小于0时使用源前缀长度
+func subnetString(subnet *dns.EDNS0_SUBNET, scope int) string {
+	if scope >= 0 && scope < int(subnet.SourceNetmask) {
+		bits := 8 * len(subnet.Address)
+		if masked := subnet.Address.Mask(net.CIDRMask(scope, bits)); masked != nil {
+			return fmt.Sprintf("%s/%d", masked, scope)
+		}
+	}
+	return fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask)
+}
+
+// 缓存的响应，及返回时记录TTL的限制范围（所属组的min_ttl/max_ttl），不影响缓存时间
+type entry struct {
+	msg      *dns.Msg
+	min, max uint32
 }
 
+// ClampTTL 将响应中记录的TTL限制在[min, max]范围内，max为0时不限制上限
+func ClampTTL(r *dns.Msg, min, max uint32) {
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl < min {
+				header.Ttl = min
+			}
+			if max > 0 && header.Ttl > max {
+				header.Ttl = max
+			}
+		}
+	}
+}
+
+// 每条缓存除报文外的额外内存占用（缓存键、map条目等）的估算值
+const entryOverhead = 128
+
+// 每条记录解包后在报文长度之外的额外内存占用（结构体头部、接口等）的估算值
+const rrOverhead = 64
+
+// 缓存响应占用内存的估算值
+func msgSize(r *dns.Msg) int {
+	return r.Len() + rrOverhead*(len(r.Answer)+len(r.Ns)+len(r.Extra))
+}
+
+// 返回过期响应（RFC 8767）时使用的TTL
+const staleAnswerTTL = 30
+
+// 缓存查找的结果
+const (
+	Miss     = iota
+	Hit      // 未过期
+	Expiring // 未过期但剩余时间不足原缓存时间的10%，应在后台刷新
+	Stale    // 已过期但在serve_stale_ttl内，已返回TTL为30秒的响应，应在后台刷新
+)
+
 type DNSCache struct {
-	ttlMap *TTLMap
-	size   int
-	minTTL time.Duration
-	maxTTL time.Duration
+	ttlMap   *TTLMap
+	size     int
+	maxBytes int  // 缓存占用内存的上限（字节），为0时仅限制条数
+	rotate   bool // 命中时是否随机排列A/AAAA记录
+	minTTL   time.Duration
+	maxTTL   time.Duration
+	negTTL   time.Duration // NXDOMAIN及无应答的NOERROR响应的最长缓存时间，为0时不缓存
+	failTTL  time.Duration // SERVFAIL响应的缓存时间，为0时不缓存
+	prefetch bool          // 为true时即将过期的记录返回Expiring
+	staleTTL time.Duration // 过期后继续保留并返回的时间，为0时不返回过期的记录
+	mux      sync.Mutex
+	inflight map[string]bool      // 正在后台刷新的缓存键
+	prefix   string               // 分区内缓存键的前缀
+	parts    map[string]*DNSCache // 已创建的分区
 }
 
-func (cache *DNSCache) Get(request *dns.Msg) *dns.Msg {
-	question, extra := request.Question[0], request.Extra
-	cacheKey := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
-	if subnet := getSubnet(extra); subnet != "" {
-		cacheKey += "." + subnet
+// 生成缓存键。DO、CD标志不同的请求分别缓存，避免向DNSSEC验证端返回缺少签名记录的响应。
+// scope为响应中ECS的作用域前缀长度，小于0时使用请求的源前缀长度
+func cacheKey(request *dns.Msg, scope int) string {
+	question := request.Question[0]
+	key := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
+	if subnet := getSubnet(request.Extra); subnet != nil {
+		key += "." + subnetString(subnet, scope)
+	}
+	if opt := request.IsEdns0(); opt != nil && opt.Do() {
+		key += ".do"
 	}
-	if cacheHit, ok := cache.ttlMap.Get(cacheKey); ok {
-		return cacheHit.(*dns.Msg)
+	if request.CheckingDisabled {
+		key += ".cd"
+	}
+	return key
+}
+
+// 请求的缓存键，ECS按请求的源前缀长度区分
+func Key(request *dns.Msg) string {
+	return cacheKey(request, -1)
+}
+
+// 获取缓存的响应。每次返回缓存响应的副本，调用方可直接修改。cache为nil时不缓存
+func (cache *DNSCache) Get(request *dns.Msg) *dns.Msg {
+	if r, status := cache.Lookup(request); status != Stale {
+		return r
 	}
 	return nil
 }
 
-func (cache *DNSCache) Set(request *dns.Msg, r *dns.Msg) {
-	question, extra := request.Question[0], request.Extra
-	if cache.ttlMap.Len() >= cache.size || r == nil || len(r.Answer) <= 0 {
-		return
+// 同Get，并返回查找结果。开启serve_stale_ttl时可返回已过期的响应
+func (cache *DNSCache) Lookup(request *dns.Msg) (*dns.Msg, int) {
+	if cache == nil {
+		return nil, Miss
+	}
+	cacheHit, expire, ok := cache.ttlMap.GetExpire(cache.prefix + cacheKey(request, -1))
+	if subnet := getSubnet(request.Extra); !ok && subnet != nil {
+		// 按上游响应的ECS作用域查找同一作用域内其它客户端的缓存
+		scope, found := cache.ttlMap.Get(cache.prefix + scopeKey(request))
+		if found && scope.(int) < int(subnet.SourceNetmask) {
+			cacheHit, expire, ok = cache.ttlMap.GetExpire(cache.prefix + cacheKey(request, scope.(int)))
+		}
+	}
+	if !ok {
+		return nil, Miss
 	}
-	cacheKey := question.Name + strconv.FormatInt(int64(question.Qtype), 10)
-	if subnet := getSubnet(extra); subnet != "" {
-		cacheKey += "." + subnet
+	hit := cacheHit.(*entry)
+	r := hit.msg.Copy()
+	if cache.rotate {
+		rotateAddrs(r)
+	}
+	remain := time.Until(expire) - cache.staleTTL
+	if remain <= 0 {
+		for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+			for _, rr := range section {
+				if header := rr.Header(); header.Rrtype != dns.TypeOPT {
+					header.Ttl = staleAnswerTTL
+				}
+			}
+		}
+		return r, Stale
+	}
+	expiring := cache.prefetch && remain < cache.expiry(r)/10
+	if hit.min > 0 || hit.max > 0 {
+		ClampTTL(r, hit.min, hit.max)
+	}
+	if expiring {
+		return r, Expiring
+	}
+	return r, Hit
+}
+
+// 开始在后台刷新请求对应的缓存，同一请求正在刷新时返回false；刷新结束后调用RefreshDone
+func (cache *DNSCache) StartRefresh(request *dns.Msg) bool {
+	key := cacheKey(request, -1)
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if cache.inflight[key] {
+		return false
+	}
+	cache.inflight[key] = true
+	return true
+}
+
+func (cache *DNSCache) RefreshDone(request *dns.Msg) {
+	cache.mux.Lock()
+	delete(cache.inflight, cacheKey(request, -1))
+	cache.mux.Unlock()
+}
+
+// 响应的缓存时间：应答记录的最小TTL，限制在[minTTL, maxTTL]范围内；无应答记录时见negativeExpiry
+func (cache *DNSCache) expiry(r *dns.Msg) time.Duration {
+	if len(r.Answer) == 0 {
+		return cache.negativeExpiry(r)
 	}
 	var ex = cache.maxTTL
 	for _, answer := range r.Answer {
@@ -61,11 +206,137 @@ func (cache *DNSCache) Set(request *dns.Msg, r *dns.Msg) {
 	if ex < cache.minTTL {
 		ex = cache.minTTL
 	}
-	cache.ttlMap.Set(cacheKey, r, ex)
+	return ex
+}
+
+// 否定响应的缓存时间（RFC 2308）：NXDOMAIN及NOERROR响应为negative_ttl，authority中有SOA时不超过SOA的TTL及
+// minimum；SERVFAIL响应为servfail_ttl；其它响应不缓存
+func (cache *DNSCache) negativeExpiry(r *dns.Msg) time.Duration {
+	switch r.Rcode {
+	case dns.RcodeServerFailure:
+		return cache.failTTL
+	case dns.RcodeNameError, dns.RcodeSuccess:
+		ex := cache.negTTL
+		for _, rr := range r.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				if d := time.Duration(ttl) * time.Second; d < ex {
+					ex = d
+				}
+			}
+		}
+		return ex
+	}
+	return 0
+}
+
+// 缓存响应，条数或内存占用达到上限时淘汰最久未访问的记录
+func (cache *DNSCache) Set(request *dns.Msg, r *dns.Msg) {
+	cache.SetClamped(request, r, 0, 0)
+}
+
+// 同Set，但返回缓存的响应时将记录的TTL限制在[min, max]范围内（max为0时不限制上限）。
+// 缓存时间仍按上游的TTL计算，避免min过大时长期返回过期的地址
+func (cache *DNSCache) SetClamped(request *dns.Msg, r *dns.Msg, min, max uint32) {
+	if cache == nil || cache.size <= 0 || r == nil {
+		return
+	}
+	ex := cache.expiry(r)
+	if ex <= 0 { // 未开启否定缓存
+		return
+	}
+	ex += cache.staleTTL
+	msg := r.Copy() // 避免调用方修改已缓存的响应
+	scope := -1
+	if subnet, answer := getSubnet(request.Extra), getSubnet(r.Extra); subnet != nil && answer != nil &&
+		answer.Family == subnet.Family && answer.SourceScope < subnet.SourceNetmask {
+		scope = int(answer.SourceScope)
+	}
+	key := cache.prefix + cacheKey(request, scope)
+	size := msgSize(msg) + len(key) + entryOverhead
+	if !cache.ttlMap.SetLimited(key, &entry{msg: msg, min: min, max: max}, ex, size, cache.size, cache.maxBytes) {
+		return
+	}
+	if scope >= 0 { // 记录作用域前缀长度，供同一作用域内的其它客户端查找
+		cache.ttlMap.SetLimited(cache.prefix+scopeKey(request), scope, ex, entryOverhead, cache.size, cache.maxBytes)
+	}
+}
+
+// 生成记录ECS作用域前缀长度的缓存键
+func scopeKey(request *dns.Msg) string {
+	question := request.Question[0]
+	return question.Name + strconv.FormatInt(int64(question.Qtype), 10) + ".scope"
+}
+
+// SetMaxBytes 限制缓存占用内存的近似上限（字节），为0时仅限制条数
+func (cache *DNSCache) SetMaxBytes(maxBytes int) {
+	cache.maxBytes = maxBytes
+}
+
+// SetNegativeTTL 设置否定缓存的时间：negative为NXDOMAIN及无应答NOERROR响应的最长缓存时间，servfail为SERVFAIL响应的
+// 缓存时间，为0时不缓存对应的响应
+func (cache *DNSCache) SetNegativeTTL(negative, servfail time.Duration) {
+	cache.negTTL, cache.failTTL = negative, servfail
+}
+
+// SetPrefetch 设置是否在记录即将过期时由Lookup返回Expiring，供调用方在后台刷新
+func (cache *DNSCache) SetPrefetch(prefetch bool) {
+	cache.prefetch = prefetch
+}
+
+// SetServeStale 设置记录过期后继续保留并返回的时间（RFC 8767），为0时不返回过期的记录
+func (cache *DNSCache) SetServeStale(staleTTL time.Duration) {
+	cache.staleTTL = staleTTL
+}
+
+// 返回名为name的缓存分区，与cache共用存储、条数及内存上限，缓存键互不冲突，用于已指定组的请求。
+// 分区复制创建时cache的配置，须在配置完成后调用。cache为nil或name为空时返回cache
+func (cache *DNSCache) Partition(name string) *DNSCache {
+	if cache == nil || name == "" {
+		return cache
+	}
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+	if part, ok := cache.parts[name]; ok {
+		return part
+	}
+	part := &DNSCache{ttlMap: cache.ttlMap, size: cache.size, maxBytes: cache.maxBytes, rotate: cache.rotate,
+		minTTL: cache.minTTL, maxTTL: cache.maxTTL, negTTL: cache.negTTL, failTTL: cache.failTTL,
+		prefetch: cache.prefetch, staleTTL: cache.staleTTL, inflight: map[string]bool{},
+		prefix: cache.prefix + name + "/"}
+	if cache.parts == nil {
+		cache.parts = map[string]*DNSCache{}
+	}
+	cache.parts[name] = part
+	return part
+}
+
+// SetRotate 设置缓存命中时是否随机排列同名的A/AAAA记录，使仅使用首个地址的客户端分散访问多个地址（同BIND/dnsmasq的rotate）
+func (cache *DNSCache) SetRotate(rotate bool) {
+	cache.rotate = rotate
+}
+
+// 随机排列应答中同名同类型的A/AAAA记录，其它记录（如CNAME）的位置不变
+func rotateAddrs(r *dns.Msg) {
+	positions := map[string][]int{}
+	for i, rr := range r.Answer {
+		if header := rr.Header(); header.Rrtype == dns.TypeA || header.Rrtype == dns.TypeAAAA {
+			key := strings.ToLower(header.Name) + strconv.Itoa(int(header.Rrtype))
+			positions[key] = append(positions[key], i)
+		}
+	}
+	for _, index := range positions {
+		rand.Shuffle(len(index), func(i, j int) {
+			r.Answer[index[i]], r.Answer[index[j]] = r.Answer[index[j]], r.Answer[index[i]]
+		})
+	}
 }
 
 func NewDNSCache(size int, minTTL, maxTTL time.Duration) (c *DNSCache) {
-	c = &DNSCache{size: size, minTTL: minTTL, maxTTL: maxTTL}
+	c = &DNSCache{size: size, minTTL: minTTL, maxTTL: maxTTL, inflight: map[string]bool{}}
 	c.ttlMap = NewTTLMap(time.Minute)
 	return
 }
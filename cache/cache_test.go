@@ -1,8 +1,10 @@
 package cache
 
 import (
+	"bytes"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"testing"
 	"time"
 )
@@ -24,14 +26,231 @@ func TestGetDNSCache(t *testing.T) {
 	cache = NewDNSCache(1, time.Second, time.Second)
 	cache.Set(request1, resp)
 	assert.True(t, cache.Get(request1) != nil)
-	// 插入失败
+	// 已满时淘汰最久未访问的记录
 	cache.Set(request2, resp)
 	assert.True(t, cache.ttlMap.Len() == 1)
+	assert.True(t, cache.Get(request1) == nil)
+	assert.True(t, cache.Get(request2) != nil)
 	// 1秒钟后缓存失效
 	time.Sleep(time.Second)
-	assert.True(t, cache.Get(request1) == nil)
+	assert.True(t, cache.Get(request2) == nil)
 	assert.True(t, cache.ttlMap.Len() == 0)
 	cache.Set(request2, resp)
 	assert.True(t, cache.ttlMap.Len() == 1)
 	assert.True(t, cache.Get(request2) != nil)
+
+	// DO标志不同的请求分别缓存
+	request3 := request1.Copy()
+	request3.SetEdns0(4096, true)
+	cache = NewDNSCache(2, time.Second, time.Second)
+	cache.Set(request1, resp)
+	assert.True(t, cache.Get(request3) == nil)
+	cache.Set(request3, resp)
+	assert.True(t, cache.Get(request3) != nil)
+}
+
+func TestCacheClamped(t *testing.T) {
+	request, resp := &dns.Msg{}, &dns.Msg{}
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	cache := NewDNSCache(10, 0, time.Hour)
+	cache.SetClamped(request, resp, 300, 0)
+	// 返回的响应按范围调整TTL，缓存时间仍为上游的TTL
+	assert.Equal(t, cache.Get(request).Answer[0].Header().Ttl, uint32(300))
+	_, expire, _ := cache.ttlMap.GetExpire(cacheKey(request, -1))
+	assert.True(t, time.Until(expire) <= time.Minute)
+	// 限制范围随快照导出
+	var buf bytes.Buffer
+	_, err := cache.Dump(&buf)
+	assert.Equal(t, err, nil)
+	imported := NewDNSCache(10, 0, time.Hour)
+	_, err = imported.Load(&buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, imported.Get(request).Answer[0].Header().Ttl, uint32(300))
+	cache.SetClamped(request, resp, 0, 10)
+	assert.Equal(t, cache.Get(request).Answer[0].Header().Ttl, uint32(10))
+	assert.Equal(t, resp.Answer[0].Header().Ttl, uint32(60)) // 不修改调用方的响应
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	resp := &dns.Msg{}
+	rr, _ := dns.NewRR("ip.cn. 0 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	cache := NewDNSCache(100, time.Second, time.Second)
+	request := &dns.Msg{}
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	cache.Set(request, resp)
+	entry := cache.ttlMap.Size()
+	assert.True(t, entry > entryOverhead)
+	// 超出内存上限时淘汰最久未访问的记录
+	cache = NewDNSCache(100, time.Second, time.Second)
+	cache.SetMaxBytes(entry*2 + 32)
+	query := func(name string) *dns.Msg {
+		request := &dns.Msg{}
+		request.SetQuestion(name, dns.TypeA)
+		return request
+	}
+	cache.Set(query("a.ip.cn."), resp)
+	cache.Set(query("b.ip.cn."), resp)
+	assert.True(t, cache.Get(query("a.ip.cn.")) != nil)
+	cache.Set(query("c.ip.cn."), resp)
+	assert.Equal(t, cache.ttlMap.Len(), 2)
+	assert.True(t, cache.ttlMap.Size() <= entry*2+32)
+	assert.True(t, cache.Get(query("a.ip.cn.")) != nil)
+	assert.True(t, cache.Get(query("b.ip.cn.")) == nil)
+	// 覆盖时扣除旧记录的大小，不因此淘汰其它记录
+	size := cache.ttlMap.Size()
+	cache.Set(query("c.ip.cn."), resp)
+	assert.Equal(t, cache.ttlMap.Len(), 2)
+	assert.Equal(t, cache.ttlMap.Size(), size)
+	// 单条记录超出上限时不缓存
+	cache.SetMaxBytes(entry - 1)
+	cache.Set(query("d.ip.cn."), resp)
+	assert.True(t, cache.Get(query("d.ip.cn.")) == nil)
+	// 覆盖已有记录时不重复计算
+	m := NewTTLMap(time.Minute)
+	m.SetSized("a", 1, time.Second, 10)
+	m.SetSized("a", 1, time.Second, 10)
+	m.SetSized("b", 1, 0, 5)
+	assert.Equal(t, m.Size(), 15)
+	_, ok := m.Get("b") // 过期记录被删除
+	assert.False(t, ok)
+	assert.Equal(t, m.Size(), 10)
+}
+
+func TestCachePartition(t *testing.T) {
+	request, resp := &dns.Msg{}, &dns.Msg{}
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	cache := NewDNSCache(2, time.Minute, time.Hour)
+	part := cache.Partition("dirty")
+	assert.True(t, cache.Partition("dirty") == part)
+	assert.True(t, cache.Partition("") == cache)
+	// 分区与其它分区的缓存互不影响，共用条数上限
+	part.Set(request, resp)
+	assert.True(t, cache.Get(request) == nil)
+	assert.True(t, cache.Partition("clean").Get(request) == nil)
+	assert.True(t, part.Get(request) != nil)
+	cache.Set(request, resp)
+	assert.Equal(t, cache.ttlMap.Len(), 2)
+	var none *DNSCache
+	assert.True(t, none.Partition("dirty") == nil)
+}
+
+func TestCacheSubnetScope(t *testing.T) {
+	query := func(addr string) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion("ip.cn.", dns.TypeA)
+		request.SetEdns0(4096, false)
+		opt := request.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1,
+			SourceNetmask: 24, Address: net.ParseIP(addr).To4()})
+		return request
+	}
+	reply := func(request *dns.Msg, scope uint8) *dns.Msg {
+		resp := new(dns.Msg).SetReply(request)
+		rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+		resp.Answer = append(resp.Answer, rr)
+		resp.SetEdns0(4096, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1,
+			SourceNetmask: 24, SourceScope: scope, Address: net.ParseIP("1.2.3.0").To4()})
+		return resp
+	}
+	// 作用域与源前缀长度一致时仅同一子网命中
+	cache := NewDNSCache(16, time.Minute, time.Minute)
+	cache.Set(query("1.2.3.0"), reply(query("1.2.3.0"), 24))
+	assert.True(t, cache.Get(query("1.2.3.0")) != nil)
+	assert.True(t, cache.Get(query("1.2.4.0")) == nil)
+	// 作用域为16时同一/16内的客户端共用缓存
+	cache = NewDNSCache(16, time.Minute, time.Minute)
+	cache.Set(query("1.2.3.0"), reply(query("1.2.3.0"), 16))
+	assert.True(t, cache.Get(query("1.2.4.0")) != nil)
+	assert.True(t, cache.Get(query("1.3.3.0")) == nil)
+	// 作用域为0时适用于所有客户端
+	cache.Set(query("1.2.3.0"), reply(query("1.2.3.0"), 0))
+	assert.True(t, cache.Get(query("8.8.8.0")) != nil)
+}
+
+func TestCacheRotate(t *testing.T) {
+	request, resp := new(dns.Msg), new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	resp.SetReply(request)
+	for _, text := range []string{"ip.cn. 60 IN CNAME cdn.ip.cn.", "cdn.ip.cn. 60 IN A 1.1.1.1",
+		"cdn.ip.cn. 60 IN A 1.1.1.2", "cdn.ip.cn. 60 IN A 1.1.1.3"} {
+		rr, _ := dns.NewRR(text)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	cache := NewDNSCache(16, time.Minute, time.Minute)
+	cache.Set(request, resp)
+	assert.Equal(t, cache.Get(request).Answer[1].(*dns.A).A.String(), "1.1.1.1")
+	cache.SetRotate(true)
+	firsts := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		r := cache.Get(request)
+		assert.Equal(t, r.Answer[0].Header().Rrtype, dns.TypeCNAME) // CNAME位置不变
+		assert.Equal(t, len(r.Answer), 4)
+		firsts[r.Answer[1].(*dns.A).A.String()] = true
+	}
+	assert.Equal(t, len(firsts), 3)
+}
+
+func TestCacheLookup(t *testing.T) {
+	request, resp := &dns.Msg{}, &dns.Msg{}
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 1 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	cache := NewDNSCache(4, 0, time.Hour)
+	cache.SetPrefetch(true)
+	cache.SetServeStale(time.Second)
+	cache.Set(request, resp)
+	_, status := cache.Lookup(request)
+	assert.Equal(t, status, Hit)
+	// 剩余时间不足10%时需要刷新
+	time.Sleep(950 * time.Millisecond)
+	_, status = cache.Lookup(request)
+	assert.Equal(t, status, Expiring)
+	// 过期后在serve_stale_ttl内返回TTL为30秒的响应
+	time.Sleep(100 * time.Millisecond)
+	r, status := cache.Lookup(request)
+	assert.Equal(t, status, Stale)
+	assert.Equal(t, r.Answer[0].Header().Ttl, uint32(staleAnswerTTL))
+	assert.True(t, cache.Get(request) == nil)
+	time.Sleep(time.Second)
+	_, status = cache.Lookup(request)
+	assert.Equal(t, status, Miss)
+	// 同一请求同时只有一个刷新
+	assert.True(t, cache.StartRefresh(request))
+	assert.False(t, cache.StartRefresh(request))
+	cache.RefreshDone(request)
+	assert.True(t, cache.StartRefresh(request))
+}
+
+func TestNegativeCache(t *testing.T) {
+	request := &dns.Msg{}
+	request.SetQuestion("not-exists.ip.cn.", dns.TypeA)
+	nxdomain := new(dns.Msg).SetRcode(request, dns.RcodeNameError)
+	servfail := new(dns.Msg).SetRcode(request, dns.RcodeServerFailure)
+	refused := new(dns.Msg).SetRcode(request, dns.RcodeRefused)
+	// 默认不缓存否定响应
+	cache := NewDNSCache(4, time.Minute, time.Hour)
+	cache.Set(request, nxdomain)
+	assert.True(t, cache.Get(request) == nil)
+	// 无SOA时使用negative_ttl，有SOA时不超过SOA的TTL及minimum
+	cache.SetNegativeTTL(time.Minute, 0)
+	assert.Equal(t, cache.expiry(nxdomain), time.Minute)
+	soa, _ := dns.NewRR("ip.cn. 600 IN SOA ns.ip.cn. admin.ip.cn. 1 3600 600 86400 30")
+	nxdomain.Ns = append(nxdomain.Ns, soa)
+	assert.Equal(t, cache.expiry(nxdomain), 30*time.Second)
+	cache.Set(request, nxdomain)
+	assert.Equal(t, cache.Get(request).Rcode, dns.RcodeNameError)
+	// SERVFAIL使用servfail_ttl，其它rcode不缓存
+	assert.Equal(t, cache.expiry(servfail), time.Duration(0))
+	cache.SetNegativeTTL(time.Minute, 5*time.Second)
+	assert.Equal(t, cache.expiry(servfail), 5*time.Second)
+	assert.Equal(t, cache.expiry(refused), time.Duration(0))
+	cache.Set(request, refused)
+	assert.Equal(t, cache.Get(request).Rcode, dns.RcodeNameError)
 }
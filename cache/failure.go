@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strings"
+	"time"
+)
+
+// 上游查询失败缓存：记录上游服务器对某个查询超时，在ttl内跳过向该服务器发送相同的查询，
+// 避免对故障域名的重复查询每次都等待完整的超时时间
+type FailureCache struct {
+	ttlMap *TTLMap
+	ttl    time.Duration
+}
+
+// 生成缓存键，upstream为上游服务器对象的指针
+func failureKey(upstream interface{}, question dns.Question) string {
+	return fmt.Sprintf("%p/%s/%d", upstream, strings.ToLower(question.Name), question.Qtype)
+}
+
+// 判断上游服务器近期是否对该查询失败过
+func (f *FailureCache) Failed(upstream interface{}, question dns.Question) bool {
+	_, ok := f.ttlMap.Get(failureKey(upstream, question))
+	return ok
+}
+
+// 记录上游服务器对该查询失败
+func (f *FailureCache) Add(upstream interface{}, question dns.Question) {
+	f.ttlMap.Set(failureKey(upstream, question), true, f.ttl)
+}
+
+func NewFailureCache(ttl time.Duration) *FailureCache {
+	return &FailureCache{ttlMap: NewTTLMap(time.Minute), ttl: ttl}
+}
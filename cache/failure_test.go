@@ -0,0 +1,25 @@
+package cache
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFailureCache(t *testing.T) {
+	f := NewFailureCache(100 * time.Millisecond)
+	up1, up2 := new(int), new(int)
+	question := dns.Question{Name: "ip.cn.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	assert.False(t, f.Failed(up1, question))
+	f.Add(up1, question)
+	assert.True(t, f.Failed(up1, question))
+	// 不影响其它上游、其它查询
+	assert.False(t, f.Failed(up2, question))
+	assert.False(t, f.Failed(up1, dns.Question{Name: "ip.cn.", Qtype: dns.TypeAAAA}))
+	// 域名不区分大小写
+	assert.True(t, f.Failed(up1, dns.Question{Name: "IP.cn.", Qtype: dns.TypeA}))
+	// 过期后恢复
+	time.Sleep(150 * time.Millisecond)
+	assert.False(t, f.Failed(up1, question))
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"time"
+)
+
+// 快照格式版本，缓存键或格式变更时递增，使旧快照失效
+const snapshotVersion = 1
+
+// 缓存快照中的一条记录，过期时间为绝对时间，导入时只保留未过期的记录
+type snapshotEntry struct {
+	Key    string
+	Msg    []byte // 打包后的响应，为空时为ECS作用域记录
+	Scope  int
+	Expire time.Time
+	// 返回时记录TTL的限制范围，见SetClamped
+	MinTTL uint32
+	MaxTTL uint32
+}
+
+type snapshot struct {
+	Version int
+	Entries []snapshotEntry
+}
+
+// 将所有未过期的缓存写入快照，返回写入的响应数。cache为nil时写入空快照
+func (cache *DNSCache) Dump(w io.Writer) (n int, err error) {
+	snap := snapshot{Version: snapshotVersion}
+	if cache == nil {
+		return 0, gob.NewEncoder(w).Encode(&snap)
+	}
+	cache.ttlMap.Range(func(key string, value interface{}, expire time.Time) {
+		item := snapshotEntry{Key: key, Expire: expire}
+		switch value := value.(type) {
+		case *entry:
+			packed, err := value.msg.Pack()
+			if err != nil {
+				return
+			}
+			item.Msg, item.MinTTL, item.MaxTTL = packed, value.min, value.max
+			n++
+		case int:
+			item.Scope = value
+		}
+		snap.Entries = append(snap.Entries, item)
+	})
+	if err = gob.NewEncoder(w).Encode(&snap); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// 将响应中记录的TTL限制为不超过剩余的缓存时间，使导入的响应反映导出后经过的时间
+func capTTL(r *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT && header.Ttl > ttl {
+				header.Ttl = ttl
+			}
+		}
+	}
+}
+
+// 从快照导入缓存，跳过已过期的记录，记录的TTL按剩余缓存时间调整，超出条数或内存上限时停止导入，返回导入的响应数
+func (cache *DNSCache) Load(r io.Reader) (n int, err error) {
+	var snap snapshot
+	if err = gob.NewDecoder(r).Decode(&snap); err != nil {
+		return 0, fmt.Errorf("decode snapshot error: %v", err)
+	}
+	if snap.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version: %d", snap.Version)
+	}
+	if cache == nil {
+		return 0, nil
+	}
+	now := time.Now()
+	for _, item := range snap.Entries {
+		ex := item.Expire.Sub(now)
+		if ex <= 0 {
+			continue
+		}
+		if cache.ttlMap.Len() >= cache.size {
+			break
+		}
+		if item.Msg == nil {
+			cache.ttlMap.SetSized(item.Key, item.Scope, ex, entryOverhead)
+			continue
+		}
+		msg := new(dns.Msg)
+		if msg.Unpack(item.Msg) != nil {
+			continue
+		}
+		capTTL(msg, uint32((ex+time.Second-1)/time.Second))
+		size := msgSize(msg) + len(item.Key) + entryOverhead
+		if cache.maxBytes > 0 && cache.ttlMap.Size()+size > cache.maxBytes {
+			break
+		}
+		cache.ttlMap.SetSized(item.Key, &entry{msg: msg, min: item.MinTTL, max: item.MaxTTL}, ex, size)
+		n++
+	}
+	return n, nil
+}
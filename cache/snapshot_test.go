@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	resp := &dns.Msg{}
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	request1, request2 := &dns.Msg{}, &dns.Msg{}
+	request1.SetQuestion("ip.cn.", dns.TypeA)
+	request2.SetQuestion("ip.cn.", dns.TypeAAAA)
+	// ECS作用域记录随缓存一起导出
+	opt := &dns.EDNS0_SUBNET{Family: 1, Address: []byte{1, 2, 3, 4}, SourceNetmask: 24}
+	request2.Extra = append(request2.Extra, &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+		Option: []dns.EDNS0{opt}})
+	scoped := resp.Copy()
+	scoped.Extra = []dns.RR{&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT},
+		Option: []dns.EDNS0{&dns.EDNS0_SUBNET{Family: 1, Address: []byte{1, 2, 3, 4}, SourceNetmask: 24,
+			SourceScope: 16}}}}
+
+	cache := NewDNSCache(10, time.Minute, time.Hour)
+	cache.Set(request1, resp)
+	cache.Set(request2, scoped)
+	var buf bytes.Buffer
+	n, err := cache.Dump(&buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 2)
+
+	imported := NewDNSCache(10, time.Minute, time.Hour)
+	n, err = imported.Load(bytes.NewReader(buf.Bytes()))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, imported.Get(request1).Answer[0].String(), rr.String())
+	other := request2.Copy()
+	other.Extra[0].(*dns.OPT).Option[0].(*dns.EDNS0_SUBNET).Address = []byte{1, 2, 4, 4}
+	assert.True(t, imported.Get(other) != nil)
+	// TTL按剩余缓存时间调整
+	long := resp.Copy()
+	long.Answer[0].Header().Ttl = 600
+	short := NewDNSCache(10, time.Minute, 2*time.Minute)
+	short.Set(request1, long)
+	var shortBuf bytes.Buffer
+	_, _ = short.Dump(&shortBuf)
+	imported = NewDNSCache(10, time.Minute, time.Hour)
+	_, _ = imported.Load(&shortBuf)
+	assert.Equal(t, imported.Get(request1).Answer[0].Header().Ttl, uint32(120))
+	// 超出条数上限时停止导入
+	n, _ = NewDNSCache(1, time.Minute, time.Hour).Load(bytes.NewReader(buf.Bytes()))
+	assert.True(t, n <= 1)
+	// 格式错误
+	_, err = imported.Load(bytes.NewReader([]byte("invalid")))
+	assert.NotEqual(t, err, nil)
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
@@ -12,51 +13,109 @@ const (
 type item struct {
 	value  interface{}
 	expire int64
+	size   int
+	elem   *list.Element
 }
 
 type TTLMap struct {
 	itemMap map[string]*item
 	mux     *sync.RWMutex
+	size    int        // 所有记录的大小之和
+	order   *list.List // 按最近访问排列的缓存键，表尾为最久未访问
 }
 
 func (m *TTLMap) Set(key string, value interface{}, ex time.Duration) {
+	m.SetSized(key, value, ex, 0)
+}
+
+// 同Set，并记录该记录占用的大小（字节），用于统计Size
+func (m *TTLMap) SetSized(key string, value interface{}, ex time.Duration, size int) {
+	m.SetLimited(key, value, ex, size, 0, 0)
+}
+
+// 同SetSized，写入后记录数超出maxLen或大小之和超出maxSize时依次淘汰最久未访问的记录（覆盖的旧记录不计入），
+// 为0时不限制。记录本身超出maxSize时不写入并返回false
+func (m *TTLMap) SetLimited(key string, value interface{}, ex time.Duration, size, maxLen, maxSize int) bool {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	m.itemMap[key] = &item{value: value, expire: time.Now().Add(ex).UnixNano()}
+	m.remove(key)
+	if maxSize > 0 && size > maxSize {
+		return false
+	}
+	for m.order.Len() > 0 && (maxLen > 0 && len(m.itemMap) >= maxLen || maxSize > 0 && m.size+size > maxSize) {
+		m.remove(m.order.Back().Value.(string))
+	}
+	m.itemMap[key] = &item{value: value, expire: time.Now().Add(ex).UnixNano(), size: size, elem: m.order.PushFront(key)}
+	m.size += size
+	return true
+}
+
+// 删除记录，调用方需持有写锁
+func (m *TTLMap) remove(key string) {
+	if old, ok := m.itemMap[key]; ok {
+		m.size -= old.size
+		m.order.Remove(old.elem)
+		delete(m.itemMap, key)
+	}
 }
 
 func (m *TTLMap) Get(key string) (interface{}, bool) {
-	// get item, using read lock
-	m.mux.RLock()
+	value, _, ok := m.GetExpire(key)
+	return value, ok
+}
+
+// 同Get，并返回记录的过期时间。命中时记录移至访问顺序的表头
+func (m *TTLMap) GetExpire(key string) (interface{}, time.Time, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	value, ok := m.itemMap[key]
-	m.mux.RUnlock()
-	if !ok || time.Now().UnixNano() >= value.expire {
-		// delete item, use write lock
-		m.mux.Lock()
-		delete(m.itemMap, key)
-		m.mux.Unlock()
-		return nil, false
+	if !ok {
+		return nil, time.Time{}, false
 	}
-	return value.value, true
+	if time.Now().UnixNano() >= value.expire {
+		m.remove(key)
+		return nil, time.Time{}, false
+	}
+	m.order.MoveToFront(value.elem)
+	return value.value, time.Unix(0, value.expire), true
 }
 
-func (m TTLMap) Len() int {
+// 遍历所有未过期的记录，遍历期间持有读锁，fn中不能修改TTLMap
+func (m *TTLMap) Range(fn func(key string, value interface{}, expire time.Time)) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	now := time.Now().UnixNano()
+	for key, item := range m.itemMap {
+		if now < item.expire {
+			fn(key, item.value, time.Unix(0, item.expire))
+		}
+	}
+}
+
+func (m *TTLMap) Len() int {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 	return len(m.itemMap)
 }
 
+// 所有记录的大小之和（字节）
+func (m *TTLMap) Size() int {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.size
+}
+
 func NewTTLMap(cleanTick time.Duration) (m *TTLMap) {
 	if cleanTick < MinCleanTick {
 		cleanTick = MinCleanTick
 	}
-	m = &TTLMap{itemMap: map[string]*item{}, mux: new(sync.RWMutex)}
+	m = &TTLMap{itemMap: map[string]*item{}, mux: new(sync.RWMutex), order: list.New()}
 	go func() {
 		for range time.Tick(cleanTick) {
 			m.mux.Lock()
 			for key, item := range m.itemMap {
 				if time.Now().UnixNano() >= item.expire {
-					delete(m.itemMap, key)
+					m.remove(key)
 				}
 			}
 			m.mux.Unlock()
@@ -25,3 +25,22 @@ func TestNewTTLMap(t *testing.T) {
 	time.Sleep(time.Millisecond * 500)
 	assert.Equal(t, ttlMap.Len(), 0) //
 }
+
+func TestTTLMapLimited(t *testing.T) {
+	m := NewTTLMap(time.Minute)
+	assert.True(t, m.SetLimited("a", 1, time.Minute, 10, 2, 0))
+	assert.True(t, m.SetLimited("b", 2, time.Minute, 10, 2, 0))
+	_, _ = m.Get("a")
+	// 超出条数上限时淘汰最久未访问的记录
+	assert.True(t, m.SetLimited("c", 3, time.Minute, 10, 2, 0))
+	_, ok := m.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, m.Len(), 2)
+	// 超出大小上限时淘汰多条记录
+	assert.True(t, m.SetLimited("d", 4, time.Minute, 25, 0, 30))
+	assert.Equal(t, m.Len(), 1)
+	assert.Equal(t, m.Size(), 25)
+	assert.False(t, m.SetLimited("e", 5, time.Minute, 31, 0, 30))
+	_, ok = m.Get("d")
+	assert.True(t, ok)
+}
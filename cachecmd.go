@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/wolf-joe/ts-dns/config"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 按配置文件确定控制接口的地址及token，server、token不为空时优先使用
+func controlTarget(cfgPath, server, token string) (addr, secret string, err error) {
+	if server == "" || token == "" {
+		var raw []byte
+		if raw, err = ioutil.ReadFile(cfgPath); err != nil {
+			return "", "", err
+		}
+		tomlConfig, err := decodeConfig(string(raw))
+		if err != nil {
+			return "", "", err
+		}
+		if server == "" {
+			server = tomlConfig.Control.Listen
+		}
+		if token == "" {
+			if token, err = config.ReadSecret(tomlConfig.Control.Token); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	if server == "" {
+		return "", "", fmt.Errorf("control listen address is not configured")
+	}
+	if host, port, err := net.SplitHostPort(server); err == nil && (host == "" || host == "0.0.0.0" || host == "::") {
+		server = net.JoinHostPort("127.0.0.1", port) // 监听所有地址时连接本机
+	}
+	return "http://" + server, token, nil
+}
+
+// cache子命令：经控制接口将运行中实例的缓存导出为快照文件，或将快照导入另一实例（如升级后预热缓存）
+func runCache(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: ts-dns cache export [-c config] [-s control] [-token token] [-o output]")
+		fmt.Fprintln(os.Stderr, "       ts-dns cache import [-c config] [-s control] [-token token] <snapshot>")
+	}
+	if len(args) == 0 || args[0] != "export" && args[0] != "import" {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path, used to locate the control api")
+	server := fs.String("s", "", "control api address, e.g. 127.0.0.1:5380")
+	token := fs.String("token", "", "control api token")
+	output := fs.String("o", "", "output file, stdout if empty")
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	positional := parseQueryArgs(fs, args[1:])
+	if args[0] == "import" && len(positional) != 1 || args[0] == "export" && len(positional) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	addr, secret, err := controlTarget(*cfgPath, *server, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "locate control api error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var body io.Reader
+	method := http.MethodGet
+	if args[0] == "import" {
+		data, err := readInput(positional[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read snapshot error: %v\n", err)
+			os.Exit(1)
+		}
+		method, body = http.MethodPut, bytes.NewReader(data)
+	}
+	req, _ := http.NewRequest(method, addr+"/cache", body)
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "request control api error: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s cache error: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	if args[0] == "export" {
+		if err = writeOutput(*output, string(data)); err != nil {
+			fmt.Fprintf(os.Stderr, "write snapshot error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s entries exported\n", resp.Header.Get("X-Cache-Entries"))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s entries imported\n", resp.Header.Get("X-Cache-Entries"))
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlTarget(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cachecmd")
+	defer func() { _ = os.RemoveAll(dir) }()
+	cfgPath := filepath.Join(dir, "ts-dns.toml")
+	_ = ioutil.WriteFile(cfgPath, []byte("[control]\nlisten = \":5380\"\ntoken = \"secret\"\n"), 0644)
+	addr, token, err := controlTarget(cfgPath, "", "")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addr, "http://127.0.0.1:5380")
+	assert.Equal(t, token, "secret")
+	// 命令行参数优先
+	addr, token, err = controlTarget(cfgPath, "10.0.0.1:5380", "other")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addr, "http://10.0.0.1:5380")
+	assert.Equal(t, token, "other")
+	_, _, err = controlTarget(filepath.Join(dir, "missing.toml"), "", "")
+	assert.NotEqual(t, err, nil)
+	_ = ioutil.WriteFile(cfgPath, []byte("listen = \":53\"\n"), 0644)
+	_, _, err = controlTarget(cfgPath, "", "")
+	assert.NotEqual(t, err, nil)
+}
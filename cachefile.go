@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/wolf-joe/ts-dns/config"
+	"log"
+	"os"
+	"time"
+)
+
+// 启动时从cache.file导入缓存快照，文件不存在时忽略
+func loadCacheFile(c *config.Config) {
+	if c.CacheFile == "" {
+		return
+	}
+	file, err := os.Open(c.CacheFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Printf("[ERROR] open cache file error: %v\n", err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+	n, err := c.Cache.Load(file)
+	if err != nil {
+		log.Printf("[ERROR] load cache file error: %v\n", err)
+		return
+	}
+	log.Printf("[INFO] loaded %d cached responses from %s\n", n, c.CacheFile)
+}
+
+// 将缓存快照写入cache.file，先写入临时文件再替换，避免退出时写入一半的文件
+func saveCacheFile(c *config.Config) error {
+	if c.CacheFile == "" {
+		return nil
+	}
+	tmp := c.CacheFile + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = c.Cache.Dump(file); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.CacheFile)
+}
+
+// 每隔cache.save_interval保存一次缓存快照，每次按当前配置读取文件路径及间隔
+func cacheSaveLoop() {
+	last := time.Now()
+	for ; ; time.Sleep(time.Minute) {
+		c := currentConfig()
+		if c.CacheFile == "" || c.CacheSaveInterval <= 0 || time.Since(last) < c.CacheSaveInterval {
+			continue
+		}
+		last = time.Now()
+		if err := saveCacheFile(c); err != nil {
+			log.Printf("[ERROR] save cache file error: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cachefile")
+	defer os.RemoveAll(dir)
+	request, resp := new(dns.Msg), new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	resp.Answer = append(resp.Answer, rr)
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	c.Cache.Set(request, resp)
+	// 未配置文件时不保存
+	assert.Equal(t, saveCacheFile(c), nil)
+	c.CacheFile = filepath.Join(dir, "cache.dat")
+	loadCacheFile(c) // 文件不存在时忽略
+	assert.Equal(t, saveCacheFile(c), nil)
+	_, err := os.Stat(c.CacheFile + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+	// 重启后导入
+	nc := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), CacheFile: c.CacheFile}
+	loadCacheFile(nc)
+	assert.Equal(t, nc.Cache.Get(request).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 目录不存在时保存失败
+	c.CacheFile = filepath.Join(dir, "missing", "cache.dat")
+	assert.NotEqual(t, saveCacheFile(c), nil)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/wolf-joe/ts-dns/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// 检查证书文件是否变更的最短间隔
+const certCheckInterval = 10 * time.Second
+
+// 证书文件的热重载：文件修改时间变化时重新加载，加载失败时继续使用已有证书
+type certLoader struct {
+	certFile string
+	keyFile  string
+	mux      sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time // 已加载证书的文件修改时间
+	checked  time.Time
+}
+
+// 获取两个文件中较晚的修改时间
+func (l *certLoader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{l.certFile, l.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// 用于tls.Config.GetCertificate，按需重新加载证书
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if now := time.Now(); l.cert == nil || now.Sub(l.checked) >= certCheckInterval {
+		l.checked = now
+		modified, err := l.modTime()
+		if err == nil && (l.cert == nil || modified.After(l.modified)) {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(l.certFile, l.keyFile); err == nil {
+				l.cert, l.modified = &cert, modified
+			}
+		}
+		if err != nil {
+			if l.cert == nil {
+				return nil, err
+			}
+			log.Printf("[ERROR] reload certificate error: %v\n", err)
+		}
+	}
+	return l.cert, nil
+}
+
+// 生成加密监听器（DoH、DoT）共用的TLS配置：指定acme_domains时通过ACME（如Let's Encrypt）自动申请及续期证书，
+// 否则使用证书文件并在文件变更时热重载；均未指定时返回nil。指定acme_http时同时返回HTTP-01验证服务，退出时需关闭
+func listenerTLSConfig(c *config.Config) (*tls.Config, *http.Server, error) {
+	if len(c.ACMEDomains) > 0 {
+		manager := &autocert.Manager{Prompt: autocert.AcceptTOS, HostPolicy: autocert.HostWhitelist(c.ACMEDomains...),
+			Cache: autocert.DirCache(c.ACMECache), Email: c.ACMEEmail}
+		var srv *http.Server
+		if c.ACMEHTTP != "" { // 通过HTTP-01验证，否则仅在TLS监听器上通过TLS-ALPN-01验证
+			ln, err := net.Listen("tcp", c.ACMEHTTP)
+			if err != nil {
+				return nil, nil, err
+			}
+			srv = &http.Server{Handler: manager.HTTPHandler(nil)}
+			log.Printf("[WARNING] Listen on %s/acme\n", c.ACMEHTTP)
+			go func() {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Printf("[ERROR] listen acme http error: %v\n", err)
+				}
+			}()
+		}
+		return manager.TLSConfig(), srv, nil
+	}
+	if c.DoHCert == "" {
+		return nil, nil, nil
+	}
+	loader := &certLoader{certFile: c.DoHCert, keyFile: c.DoHKey}
+	if _, err := loader.GetCertificate(nil); err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{GetCertificate: loader.GetCertificate}, nil, nil
+}
+
+// 生成DoT监听器的TLS配置，ALPN协商为dot（RFC 7858），使用ACME时保留TLS-ALPN-01验证
+func dotTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	protos := []string{"dot"}
+	for _, proto := range tlsConfig.NextProtos {
+		if proto == acme.ALPNProto {
+			protos = append(protos, proto)
+		}
+	}
+	tlsConfig.NextProtos = protos
+	return tlsConfig
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 生成自签名证书并写入文件
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: name},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, err, nil)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestCertLoader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cert")
+	defer func() { _ = os.RemoveAll(dir) }()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	_, _, err := listenerTLSConfig(&config.Config{DoHCert: certFile, DoHKey: keyFile})
+	assert.NotEqual(t, err, nil)
+	writeCert(t, certFile, keyFile, "v1")
+	tlsConfig, _, err := listenerTLSConfig(&config.Config{DoHCert: certFile, DoHKey: keyFile})
+	assert.Equal(t, err, nil)
+	loader := &certLoader{certFile: certFile, keyFile: keyFile}
+	commonName := func(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+		cert, err := getCertificate(nil)
+		assert.Equal(t, err, nil)
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+	assert.Equal(t, commonName(tlsConfig.GetCertificate), "v1")
+	assert.Equal(t, commonName(loader.GetCertificate), "v1")
+	// 文件变更且超过检查间隔后重新加载
+	writeCert(t, certFile, keyFile, "v2")
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	assert.Equal(t, commonName(loader.GetCertificate), "v1")
+	loader.checked = time.Time{}
+	assert.Equal(t, commonName(loader.GetCertificate), "v2")
+	// 加载失败时继续使用已有证书
+	_ = ioutil.WriteFile(keyFile, []byte("invalid"), 0600)
+	_ = os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+	loader.checked = time.Time{}
+	assert.Equal(t, commonName(loader.GetCertificate), "v2")
+	// 未配置证书时使用HTTP
+	tlsConfig, _, err = listenerTLSConfig(&config.Config{})
+	assert.True(t, tlsConfig == nil && err == nil)
+	tlsConfig, srv, _ := listenerTLSConfig(&config.Config{ACMEDomains: []string{"dns.example.com"}, ACMECache: dir})
+	assert.True(t, tlsConfig.GetCertificate != nil && srv == nil)
+	// DoT使用dot协议，保留TLS-ALPN-01验证
+	assert.Equal(t, dotTLSConfig(tlsConfig).NextProtos, []string{"dot", "acme-tls/1"})
+	assert.Equal(t, len(tlsConfig.NextProtos), 3)
+}
+
+func TestACMEHTTP(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "acme")
+	defer func() { _ = os.RemoveAll(dir) }()
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	c := &config.Config{ACMEDomains: []string{"dns.example.com"}, ACMECache: dir, ACMEHTTP: addr}
+	_, srv, err := listenerTLSConfig(c)
+	assert.Equal(t, err, nil)
+	resp, err := http.Get("http://" + addr + "/.well-known/acme-challenge/unknown")
+	assert.Equal(t, err, nil)
+	_ = resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden) // 127.0.0.1不在acme_domains中
+	// 监听地址被占用时返回错误，关闭后可重新监听
+	_, _, err = listenerTLSConfig(c)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, srv.Close(), nil)
+	_, srv, err = listenerTLSConfig(c)
+	assert.Equal(t, err, nil)
+	_ = srv.Close()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// 经各组的上游服务器查询domain并输出结果，返回查询失败的上游数量
+func checkUpstreams(c *config.Config, domain string, w io.Writer) (failed int) {
+	var names []string
+	for name := range c.GroupMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, caller := range c.GroupMap[name].Callers {
+			request := new(dns.Msg)
+			request.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+			start := time.Now()
+			r, err := caller.Call(request)
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "[%s] %v: FAILED %v\n", name, caller, err)
+				continue
+			}
+			fmt.Fprintf(w, "[%s] %v: %s %v\n", name, caller, dns.RcodeToString[r.Rcode],
+				time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return failed
+}
+
+// check子命令：校验配置文件及其引用的规则、hosts、区域等文件，指定-upstream时测试各组上游的连通性，有错误时以非零状态退出
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path")
+	upstream := fs.Bool("upstream", false, "query each upstream to check reachability")
+	domain := fs.String("domain", "www.baidu.com", "test domain used with -upstream")
+	_ = fs.Parse(args)
+
+	c, err := newQueryConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("config %s ok: %d groups\n", *cfgPath, len(c.GroupMap))
+	if *upstream {
+		if failed := checkUpstreams(c, *domain, os.Stdout); failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d upstreams unreachable\n", failed)
+			os.Exit(1)
+		}
+	}
+}
+
+// 域名的处理方式
+type matchResult struct {
+	Stage  string // 处理阶段，同query子命令输出的trace
+	Group  string // 所属组，在本地应答时为空
+	Reason string
+}
+
+// 按处理链各阶段的顺序判断域名的处理方式及所属组，不查询上游。由clean组响应决定的情况（cnip、gfwlist）在Reason中说明
+func explainMatch(c *config.Config, name string, client net.IP) matchResult {
+	name = dns.Fqdn(name)
+	request := new(dns.Msg)
+	request.SetQuestion(name, dns.TypeA)
+	ctx := &middleware.Context{Request: request, ClientIP: client}
+	assignClient(c, ctx)
+	if z := findZone(c, name); z != nil {
+		return matchResult{"local", "", "match zone " + z.Origin}
+	}
+	if forward := findForward(c, name); forward != nil {
+		return matchResult{"local", forward.Group, "forward " + forward.Zone}
+	}
+	if list := matchBlocklist(c, ctx); list != "" {
+		return matchResult{"block", "", fmt.Sprintf("match blocklist '%s'", list)}
+	}
+	if target := hostsCNAME(c, name); target != "" {
+		return matchResult{"hosts", "", "match hosts cname " + target}
+	}
+	if hostsRecord(c, name, false) != "" || hostsRecord(c, name, true) != "" {
+		return matchResult{"hosts", "", "match hosts"}
+	}
+	if ctx.Group != "" {
+		return matchResult{"route", ctx.Group, "assigned by device profile or client_rules"}
+	}
+	if zone := hosts.SpecialZone(name); zone != "" && !c.ForwardSpecial {
+		return matchResult{"route", "", "special-use domain " + zone}
+	}
+	if group, ok := c.Control.Group(name); ok {
+		return matchResult{"route", group, "control"}
+	}
+	if group := ruleGroup(c, name); group != "" {
+		if block := c.GroupMap[group].Block; block != "" {
+			return matchResult{"route", group, "rules, block group: " + block}
+		}
+		return matchResult{"route", group, "rules"}
+	}
+	if c.GFWMatcher != nil {
+		if blocked, ok := c.GFWMatcher.Match(name); ok && blocked {
+			return matchResult{"route", "dirty", "in gfwlist, unless the clean answer contains only cn ips"}
+		}
+	}
+	reason := "not in gfwlist, dirty if clean fails"
+	if c.VerifyCNIP {
+		reason += " or its answer contains no cn ip"
+	}
+	return matchResult{"route", "clean", reason}
+}
+
+// match子命令：按配置文件判断域名匹配的hosts、规则及所属组，不查询上游
+func runMatch(args []string) {
+	fs := flag.NewFlagSet("match", flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path")
+	client := fs.String("client", "127.0.0.1", "client ip used for device profiles, client_rules and blocklists")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ts-dns match [options] <name>...")
+		fs.PrintDefaults()
+	}
+	names := parseQueryArgs(fs, args)
+	if len(names) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c, err := newQueryConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, name := range names {
+		result := explainMatch(c, name, net.ParseIP(*client))
+		group := result.Group
+		if group == "" {
+			group = "-"
+		}
+		fmt.Printf("%s\tgroup: %s\tstage: %s\treason: %s\n", dns.Fqdn(name), group, result.Stage, result.Reason)
+	}
+}
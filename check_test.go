@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckUpstreams(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	c := &config.Config{GroupMap: map[string]config.Group{
+		"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: addr}}},
+		"dirty": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: "127.0.0.1:1", Timeout: 100 * time.Millisecond}}},
+	}}
+	var buf bytes.Buffer
+	assert.Equal(t, checkUpstreams(c, "ip.cn", &buf), 1)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.True(t, strings.HasPrefix(lines[0], "[clean] udp://"+addr+": NOERROR"))
+	assert.True(t, strings.HasPrefix(lines[1], "[dirty] udp://127.0.0.1:1: FAILED"))
+}
+
+func TestExplainMatch(t *testing.T) {
+	c := &config.Config{
+		GroupMap: map[string]config.Group{
+			"clean": {Matcher: matcher.NewABPByText("")},
+			"dirty": {Matcher: matcher.NewABPByText("")},
+			"work":  {Matcher: matcher.NewABPByText("||company.com")},
+		},
+		GFWMatcher:   matcher.NewABPByText("||google.com"),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader("10.0.0.5 nas.lan")},
+		Forwards:     []config.Forward{{Zone: "corp.", Group: "work"}},
+	}
+	c.ClientRules, _ = parseClientRules([]string{"10.8.0.0/24 -> dirty"}, c.GroupMap)
+	client := net.ParseIP("127.0.0.1")
+	for name, expected := range map[string]matchResult{
+		"nas.lan":         {"hosts", "", "match hosts"},
+		"a.corp":          {"local", "work", "forward corp."},
+		"www.company.com": {"route", "work", "rules"},
+		"www.google.com":  {"route", "dirty", "in gfwlist, unless the clean answer contains only cn ips"},
+		"www.baidu.com":   {"route", "clean", "not in gfwlist, dirty if clean fails"},
+		"localhost":       {"route", "", "special-use domain localhost."},
+	} {
+		assert.Equal(t, explainMatch(c, name, client), expected)
+	}
+	result := explainMatch(c, "www.baidu.com", net.ParseIP("10.8.0.2"))
+	assert.Equal(t, result.Group, "dirty")
+}
@@ -1,25 +1,195 @@
 package config
 
 import (
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/blocklist"
 	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/control"
+	"github.com/wolf-joe/ts-dns/device"
+	"github.com/wolf-joe/ts-dns/dns64"
+	"github.com/wolf-joe/ts-dns/dnssec"
+	"github.com/wolf-joe/ts-dns/docker"
+	"github.com/wolf-joe/ts-dns/edns"
+	"github.com/wolf-joe/ts-dns/failover"
+	"github.com/wolf-joe/ts-dns/fakeip"
 	"github.com/wolf-joe/ts-dns/hosts"
 	"github.com/wolf-joe/ts-dns/ipset"
+	"github.com/wolf-joe/ts-dns/logger"
 	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"github.com/wolf-joe/ts-dns/notify"
 	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
+	"github.com/wolf-joe/ts-dns/ratelimit"
+	"github.com/wolf-joe/ts-dns/zone"
+	"net"
+	"time"
 )
 
 type Config struct {
 	Cache        *cache.DNSCache
+	Failures     *cache.FailureCache // 上游查询失败缓存，为nil时不缓存
+	Flight       *middleware.Flight  // 合并缓存未命中的并发相同查询，为nil时不合并
 	Listen       string
-	GFWMatcher   *matcher.ABPlus
-	CNIPs        *ipset.RamSet
+	UDPBatch     bool // 为true时UDP监听使用批量收发（Linux下为recvmmsg/sendmmsg）
+	UDPWorkers   int  // 使用SO_REUSEPORT打开的UDP监听器数量，为0时仅打开一个监听器
+	GFWMatcher   matcher.DomainMatcher
+	CNIPs        ipset.Matcher
+	CNIPCountry  string        // cnip为RIR统计文件或mmdb格式时读取的国家/地区代码
+	VerifyCNIP   bool          // 为true时不在gfwlist中且clean组响应中无中国ip的域名转由dirty组解析
+	BogusIPs     *ipset.RamSet // 已知的劫持/污染地址，包含这些地址的响应将被丢弃
 	HostsReaders []hosts.Reader
+	HostsTTL     uint32       // hosts生成的记录的TTL，为0时不缓存
+	Zones        []*zone.Zone // 本地权威区域，按区域名称长度降序排列
+	UpdatePolicy string       // 本地权威区域是否接受动态更新
 	GroupMap     map[string]Group
+	Pipeline     middleware.Handler // 查询处理链，由内置处理阶段及插件组成
+	LogWriter    *logger.Writer
+	QueryLogger  *querylog.Logger // 结构化查询日志，为nil时不输出
+	Notifier     *notify.Notifier // 告警通知，为nil时不通知
+	QueryLog     bool
+	CookieSecret *edns.CookieSecret // 为nil时不处理客户端的DNS Cookie
+	RRL          *ratelimit.RRL     // 为nil时不限制响应速率
+	Limiter      *ratelimit.Limiter // 为nil时不限制并发处理的请求数
+	// 客户端查询速率限制，为nil时不限制；超出速率时按LimitAction处理
+	ClientLimit *ratelimit.ClientLimiter
+	LimitAction string
+	// 客户端访问控制，为nil时不限制
+	AllowedClients *ipset.RamSet
+	DeniedClients  *ipset.RamSet
+	ACLAction      string // 拒绝访问时的处理方式
+	DenyTTL        uint32 // 拒绝查询的处理方式为zero时返回的记录的TTL
+	PrivatePTR     string // 私有地址反向查询转发的目标组，为空时在本地应答
+	ForwardSpecial bool   // 为true时localhost、.onion等特殊用途域名照常转发
+	ResolveCNAME   bool   // 为true时上游仅返回CNAME时自行查询CNAME目标
+	BlockedQtypes  map[uint16]bool
+	SafeSearch     bool          // 强制搜索引擎使用安全搜索
+	SafeClients    *ipset.RamSet // 强制安全搜索的客户端，为nil时对所有客户端生效
+	Blocklists     []*blocklist.Blocklist
+	Forwards       []Forward
+	ClientRules    []ClientRule      // 按客户端地址指定的组，按配置顺序匹配
+	TsigSecrets    map[string]string // TSIG密钥名称（小写FQDN）到base64编码密钥的映射
+	EDNSAllowed    map[uint16]bool   // 允许转发至上游的客户端EDNS0 option
+	AutoECS        bool              // 存在ecs = "auto"的组，需由客户端地址派生ECS
+	BlockAction    string            // 查询被禁止的记录类型时的处理方式
+	LowMemory      bool              // 低内存模式，减小缓存及缓冲区
+	GCPercent      int               // GOGC，为0时使用默认值
+	MemoryLimit    int64             // 软内存上限（字节），为0时不限制
+	FakeIP         *fakeip.Pool      // 虚假ip地址池，为nil时不启用fake-ip模式
+	FakeIPTTL      uint32            // 虚假ip应答的TTL
+	// 区域名称到允许用于动态更新的TSIG密钥名称的映射，列出的区域仅接受这些密钥签名的更新
+	UpdateKeys   map[string]map[string]bool
+	Docker       *docker.Reader  // Docker容器名称解析，为nil时不启用，同时包含在HostsReaders中
+	Control      *control.Server // WebSocket控制接口，为nil时不启用
+	ControlToken string          // 控制接口的token，替换配置时写入复用的Control
+	Search       []string        // 查询名称的搜索域（小写FQDN），为空时不扩展
+	Ndots        int             // 点号少于ndots的名称优先按搜索域扩展
+	DoHListen    string          // DoH服务端的监听地址，为空时不启用，修改后需重启生效
+	DoTListen    string          // DoT服务端的监听地址，使用DoH服务端的证书，为空时不启用
+	DoHCert      string          // DoH服务端的证书文件，为空时使用HTTP
+	DoHKey       string
+	DoHPaths     map[string]string // DoH请求路径到组名的映射，组名为空时按分组规则确定
+	DoHProxies   *ipset.RamSet     // 可信的反向代理地址，经其转发的DoH请求按Forwarded/X-Forwarded-For确定客户端地址
+	ACMEDomains  []string          // 通过ACME自动申请证书的域名，不为空时忽略DoHCert
+	ACMEEmail    string
+	ACMECache    string // 保存ACME账户及证书的目录
+	ACMEHTTP     string // HTTP-01验证的监听地址，为空时仅使用TLS-ALPN-01验证
+	DoHClients   []DoHClient
+	DoHAuth      bool          // 为true时DoH服务端拒绝未认证的请求
+	Devices      *device.Table // 按MAC地址或主机名识别的设备配置，为nil时不启用
+	LocalDomains []string      // 本地域名（小写FQDN），用于扩展单标签名称及hosts中的主机名
+	EDNSSize     uint16        // 向客户端声明的UDP缓冲区大小，同时为UDP响应的大小上限，为0时使用4096
+	UpstreamSize uint16        // 向上游声明的UDP缓冲区大小上限，为0时使用4096
+	// 可经控制接口上传的规则数据（gfwlist、cnip、blocklist/名称）到文件路径的映射
+	RuleFiles map[string]string
+	Text      string // 生成该配置的配置文件内容，重新读取规则文件时使用
+	// 客户端TCP连接的空闲超时时间，请求携带edns-tcp-keepalive时在响应中声明，为0时使用10秒
+	TCPIdle time.Duration
+	MaxHops int // 请求经ts-dns实例转发的最大跳数，超出时拒绝，为0时使用默认值
+	// 启动时预取的域名列表文件，为空时不预取；预取间隔为0时仅在启动时预取
+	PrefetchFile     string
+	PrefetchInterval time.Duration
+	// 缓存快照文件，启动时导入、退出时保存，为空时不保存；保存间隔为0时仅在退出时保存
+	CacheFile         string
+	CacheSaveInterval time.Duration
 }
 
+// DoH服务端的认证客户端，通过Bearer token、Basic认证（密码为token）或"/dns-query/<token>"形式的路径认证。
+// 认证通过的客户端不受allowed_clients限制
+type DoHClient struct {
+	Name     string
+	Token    string
+	Group    string        // 该客户端使用的组，为空时按请求路径确定
+	Networks *ipset.RamSet // 允许使用该token的来源地址，为nil时不限制
+}
+
+// 条件转发：域名属于Zone时直接转发至Group组，不经过分组规则及gfwlist判断
+type Forward struct {
+	Zone  string // 小写FQDN
+	Group string
+}
+
+// 来源地址属于Clients的请求使用Group解析
+type ClientRule struct {
+	Clients *net.IPNet
+	Group   string
+}
+
+// 本地权威区域接受动态更新（RFC 2136）的条件
+const (
+	UpdateNone = ""     // 不接受动态更新
+	UpdateTSIG = "tsig" // 仅接受TSIG签名有效的动态更新
+	UpdateAny  = "any"  // 接受所有通过访问控制的客户端的动态更新
+)
+
+// 拒绝查询时的处理方式
+const (
+	DenyDrop     = "drop"     // 不返回响应
+	DenyRefused  = "refused"  // 返回REFUSED
+	DenyNXDomain = "nxdomain" // 返回NXDOMAIN
+	DenyZero     = "zero"     // A/AAAA查询返回0.0.0.0/::，其它查询返回空响应
+	DenyEmpty    = "empty"    // 返回空的NOERROR响应
+)
+
 type Group struct {
 	Callers  []outbound.Caller
 	Matcher  *matcher.ABPlus
+	Lists    []matcher.DomainMatcher // 从文件、远程地址加载的规则列表，优先级低于Matcher
+	Block    string                  // 非空时为屏蔽组，匹配的域名按该方式应答（同BlockAction），不转发至上游
 	IPSet    *ipset.IPSet
 	IPSetTTL int
+	IPSet6   *ipset.IPSet      // ipv6地址写入的ipset（family inet6）
+	NFTSet   *ipset.NFTSet     // ipv4地址写入的nftables集合，超时时间同IPSetTTL
+	NFTSet6  *ipset.NFTSet     // ipv6地址写入的nftables集合
+	DNSSEC   *dnssec.Validator // 为nil时不进行DNSSEC验证
+	NoAAAA   bool              // 为true时AAAA查询直接返回空的NOERROR响应
+	// 为true时向上游请求DNSSEC验证并信任其返回的AD标志，上游应为经加密连接访问的验证解析器
+	TrustAD bool
+	// 转发时设置的ECS，覆盖客户端携带的ECS，为nil时不修改
+	ECS *dns.EDNS0_SUBNET
+	// 为true时转发由客户端地址派生的ECS（客户端未携带ECS时）
+	AutoECS bool
+	// AAAA查询无AAAA记录时由A记录合成（DNS64），为nil时不合成
+	DNS64 *dns64.Synthesizer
+	// 该组域名禁止查询的记录类型
+	BlockedQtypes map[uint16]bool
+	// 查询该组禁止的记录类型时的处理方式，为空时使用全局的BlockAction
+	BlockAction string
+	// 视为有效响应的rcode，为nil时接受所有rcode；其它rcode的响应将被丢弃并尝试下一个dns服务器
+	AcceptRcodes map[int]bool
+	RejectEmpty  bool // 为true时丢弃无应答记录的NOERROR响应
+	StripECH     bool // 为true时移除HTTPS/SVCB记录中的ech参数
+	Parallel     bool // 为true时同时向所有dns服务器发送请求，使用首个通过校验的响应
+	Compare      bool // 为true时同时发送请求并等待所有响应，使用多数dns服务器一致的响应
+	FakeIP       bool // 为true时该组域名的A查询返回虚假ip，AAAA及HTTPS/SVCB查询返回空响应
+	// 返回给客户端的记录TTL范围，为0时不限制
+	MinTTL uint32
+	MaxTTL uint32
+	// 同时向该组发送的最大查询数，为nil时不限制
+	Limiter *ratelimit.Limiter
+	// 该组不可用时依次改用的备用组，及该组的可用状态（未配置备用组时为nil）
+	Failover []string
+	State    *failover.State
+	// 组内上游的健康状态及选择策略，为nil时按配置顺序查询
+	Balancer *failover.Balancer
 }
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 上游地址列表中引用预设的前缀，如"preset:alidns"
+const PresetPrefix = "preset:"
+
+// 公共dns服务的预设地址
+type Preset struct {
+	DNS       []string // UDP服务器
+	DoT       []string // ip:port@serverName格式的DoT服务器
+	DoH       string   // DoH服务器地址
+	Bootstrap []string // DoH服务器域名对应的ip，避免依赖系统解析
+}
+
+var presets = map[string]Preset{
+	"alidns": {DNS: []string{"223.5.5.5", "223.6.6.6"},
+		DoT:       []string{"223.5.5.5:853@dns.alidns.com", "223.6.6.6:853@dns.alidns.com"},
+		DoH:       "https://dns.alidns.com/dns-query",
+		Bootstrap: []string{"223.5.5.5", "223.6.6.6"}},
+	"dnspod": {DNS: []string{"119.29.29.29", "119.28.28.28"},
+		DoT:       []string{"1.12.12.12:853@dot.pub", "120.53.53.53:853@dot.pub"},
+		DoH:       "https://doh.pub/dns-query",
+		Bootstrap: []string{"1.12.12.12", "120.53.53.53"}},
+	"cloudflare": {DNS: []string{"1.1.1.1", "1.0.0.1"},
+		DoT:       []string{"1.1.1.1:853@cloudflare-dns.com", "1.0.0.1:853@cloudflare-dns.com"},
+		DoH:       "https://cloudflare-dns.com/dns-query",
+		Bootstrap: []string{"1.1.1.1", "1.0.0.1"}},
+	"google": {DNS: []string{"8.8.8.8", "8.8.4.4"},
+		DoT:       []string{"8.8.8.8:853@dns.google", "8.8.4.4:853@dns.google"},
+		DoH:       "https://dns.google/dns-query",
+		Bootstrap: []string{"8.8.8.8", "8.8.4.4"}},
+	"quad9": {DNS: []string{"9.9.9.9", "149.112.112.112"},
+		DoT:       []string{"9.9.9.9:853@dns.quad9.net", "149.112.112.112:853@dns.quad9.net"},
+		DoH:       "https://dns.quad9.net/dns-query",
+		Bootstrap: []string{"9.9.9.9", "149.112.112.112"}},
+}
+
+// 获取"preset:name"格式的地址对应的预设，addr不是预设引用时ok为false
+func LookupPreset(addr string) (preset Preset, ok bool, err error) {
+	if !strings.HasPrefix(addr, PresetPrefix) {
+		return preset, false, nil
+	}
+	name := strings.ToLower(addr[len(PresetPrefix):])
+	if preset, ok = presets[name]; !ok {
+		return preset, false, fmt.Errorf("unknown preset: %s", name)
+	}
+	return preset, true, nil
+}
+
+// 展开地址列表中的预设引用，pick用于选取预设中对应协议的地址
+func ExpandPresets(addrs []string, pick func(preset Preset) []string) (expanded []string, err error) {
+	for _, addr := range addrs {
+		preset, ok, err := LookupPreset(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			expanded = append(expanded, pick(preset)...)
+		} else {
+			expanded = append(expanded, addr)
+		}
+	}
+	return expanded, nil
+}
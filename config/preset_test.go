@@ -0,0 +1,21 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExpandPresets(t *testing.T) {
+	pickDNS := func(preset Preset) []string { return preset.DNS }
+	addrs, err := ExpandPresets([]string{"preset:AliDNS", "114.114.114.114"}, pickDNS)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, addrs, []string{"223.5.5.5", "223.6.6.6", "114.114.114.114"})
+	_, err = ExpandPresets([]string{"preset:unknown"}, pickDNS)
+	assert.NotEqual(t, err, nil)
+	preset, ok, _ := LookupPreset("preset:cloudflare")
+	assert.True(t, ok)
+	assert.Equal(t, preset.DoH, "https://cloudflare-dns.com/dns-query")
+	_, ok, err = LookupPreset("1.1.1.1")
+	assert.False(t, ok)
+	assert.Equal(t, err, nil)
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 远程配置源，基于ETag轮询配置文件变更，并在本地保留一份缓存
+type RemoteSource struct {
+	URL       string
+	CacheFile string // 本地缓存文件路径，远程获取失败时使用，为空时不缓存
+	client    *http.Client
+	etag      string
+}
+
+// 从远程获取配置内容，changed为false代表配置未变更
+func (s *RemoteSource) Fetch() (raw []byte, changed bool, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, s.URL, nil); err != nil {
+		return nil, false, err
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	var resp *http.Response
+	if resp, err = s.client.Do(req); err != nil {
+		return nil, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, s.URL)
+	}
+	if raw, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, false, err
+	}
+	s.etag = resp.Header.Get("ETag")
+	// 写入本地缓存，失败时不影响本次获取结果
+	if s.CacheFile != "" {
+		if err := ioutil.WriteFile(s.CacheFile, raw, 0644); err != nil {
+			log.Printf("[WARNING] write remote config cache error: %v\n", err)
+		}
+	}
+	return raw, true, nil
+}
+
+// 获取配置内容，远程获取失败时读取本地缓存
+func (s *RemoteSource) Load() (raw []byte, err error) {
+	if raw, _, err = s.Fetch(); err == nil {
+		return raw, nil
+	}
+	if s.CacheFile == "" {
+		return nil, err
+	}
+	log.Printf("[WARNING] fetch remote config error, fallback to %s: %v\n", s.CacheFile, err)
+	return ioutil.ReadFile(s.CacheFile)
+}
+
+func NewRemoteSource(url, cacheFile string, timeout time.Duration) *RemoteSource {
+	return &RemoteSource{URL: url, CacheFile: cacheFile, client: &http.Client{Timeout: timeout}}
+}
+
+// 经代理（如socks5）访问远程地址，不使用环境变量中的HTTP代理
+func (s *RemoteSource) SetDialer(dialer proxy.Dialer) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}
+	s.client.Transport = transport
+}
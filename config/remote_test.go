@@ -0,0 +1,49 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRemoteSource(t *testing.T) {
+	content, etag := "listen = \":53\"", `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	filename := "go_test_remote_cache"
+	src := NewRemoteSource(server.URL, filename, time.Second)
+	// 首次获取
+	raw, err := src.Load()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(raw), content)
+	cached, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, string(cached), content)
+	// 配置未变更
+	raw, changed, err := src.Fetch()
+	assert.Equal(t, err, nil)
+	assert.False(t, changed)
+	// 配置变更
+	etag = `"v2"`
+	raw, changed, err = src.Fetch()
+	assert.True(t, changed)
+	assert.Equal(t, string(raw), content)
+	// 远程失效时读取本地缓存
+	server.Close()
+	raw, err = src.Load()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(raw), content)
+	// 无本地缓存时失败
+	_ = os.Remove(filename)
+	raw, err = src.Load()
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// 读取resolv.conf中的search域名列表及ndots选项，ndots未指定时为1。返回的域名为小写FQDN
+func ReadResolvConf(filename string) (search []string, ndots int, err error) {
+	var raw []byte
+	if raw, err = ioutil.ReadFile(filename); err != nil {
+		return nil, 0, err
+	}
+	ndots = 1
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "search", "domain": // 两者同时出现时以最后出现的为准
+			search = nil
+			for _, domain := range fields[1:] {
+				if domain = strings.Trim(strings.ToLower(domain), "."); domain != "" {
+					search = append(search, domain+".")
+				}
+			}
+		case "options":
+			for _, option := range fields[1:] {
+				if strings.HasPrefix(option, "ndots:") {
+					if n, err := strconv.Atoi(option[6:]); err == nil && n >= 0 {
+						ndots = n
+					}
+				}
+			}
+		}
+	}
+	if ndots > 15 { // 与glibc的上限一致
+		ndots = 15
+	}
+	return search, ndots, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadResolvConf(t *testing.T) {
+	_, _, err := ReadResolvConf("go_test_not_exists")
+	assert.NotEqual(t, err, nil)
+	filename := "go_test_resolv.conf"
+	defer func() { _ = os.Remove(filename) }()
+	text := "# kubelet\nnameserver 10.96.0.10\nsearch default.svc.Cluster.Local. svc.cluster.local\noptions ndots:5 timeout:1\n"
+	_ = ioutil.WriteFile(filename, []byte(text), 0644)
+	search, ndots, err := ReadResolvConf(filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, search, []string{"default.svc.cluster.local.", "svc.cluster.local."})
+	assert.Equal(t, ndots, 5)
+	_ = ioutil.WriteFile(filename, []byte("domain lan\n"), 0644)
+	search, ndots, _ = ReadResolvConf(filename)
+	assert.Equal(t, search, []string{"lan."})
+	assert.Equal(t, ndots, 1)
+}
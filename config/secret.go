@@ -0,0 +1,20 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// 解析敏感配置项。以"@"开头的值视为文件引用（如"@/etc/ts-dns/socks5.secret"），
+// 返回该文件去掉首尾空白后的内容，以免凭证明文保存在主配置文件中
+func ReadSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, "@") {
+		return value, nil
+	}
+	raw, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", fmt.Errorf("read secret file error: %v", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadSecret(t *testing.T) {
+	// 普通值原样返回
+	val, err := ReadSecret("127.0.0.1:1080")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, "127.0.0.1:1080")
+	// 文件不存在
+	filename := "go_test_secret_file"
+	_, err = ReadSecret("@" + filename)
+	assert.NotEqual(t, err, nil)
+	// 读取文件内容
+	_ = ioutil.WriteFile(filename, []byte(" user:pass@127.0.0.1:1080 \n"), 0600)
+	val, err = ReadSecret("@" + filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, val, "user:pass@127.0.0.1:1080")
+	_ = os.Remove(filename)
+}
@@ -0,0 +1,486 @@
+package control
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 每个订阅连接缓存的事件数，写入过慢时丢弃新事件
+const eventBuffer = 256
+
+// 上传规则数据的最大长度
+const maxUpload = 64 << 20
+
+// 上传的规则数据名称未配置时Upload返回的错误
+var ErrUnknownRules = errors.New("unknown rules")
+
+// 客户端发送的命令
+type Command struct {
+	ID     int    `json:"id"`
+	Op     string `json:"op"` // subscribe/unsubscribe/add_rule/remove_rule/list_rules/trace/untrace/replay
+	Rule   string `json:"rule,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Qtype  string `json:"qtype,omitempty"`  // replay命令的记录类型，为空时为A
+	Client string `json:"client,omitempty"` // trace命令仅跟踪该客户端的查询；replay命令模拟的客户端ip
+}
+
+// 命令的执行结果
+type Result struct {
+	Type  string            `json:"type"` // 固定为result
+	ID    int               `json:"id"`
+	Error string            `json:"error,omitempty"`
+	Rules map[string]string `json:"rules,omitempty"`
+	Trace *TraceEvent       `json:"trace,omitempty"` // replay命令的处理过程
+}
+
+// 推送给订阅者的查询事件
+type Event struct {
+	Type    string    `json:"type"` // 固定为query
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Name    string    `json:"name"`
+	Qtype   string    `json:"qtype"`
+	Group   string    `json:"group"`
+	Rcode   string    `json:"rcode"` // 未响应时为空
+	Answer  []string  `json:"answer"`
+	Elapsed float64   `json:"elapsed"`           // 毫秒
+	Blocked string    `json:"blocked,omitempty"` // 命中的屏蔽列表名称
+}
+
+// 根据查询及响应生成查询事件
+func NewEvent(client net.IP, question dns.Question, group string, r *dns.Msg, elapsed time.Duration) Event {
+	event := Event{Type: "query", Time: time.Now(), Client: client.String(), Name: question.Name,
+		Qtype: dns.TypeToString[question.Qtype], Group: group, Elapsed: elapsed.Seconds() * 1000}
+	if r != nil {
+		event.Rcode = dns.RcodeToString[r.Rcode]
+		for _, rr := range r.Answer {
+			event.Answer = append(event.Answer, rr.String())
+		}
+	}
+	return event
+}
+
+// 推送给跟踪者的查询处理过程
+type TraceEvent struct {
+	Type  string                 `json:"type"` // 固定为trace
+	Query Event                  `json:"query"`
+	Steps []middleware.TraceStep `json:"steps"`
+}
+
+// 根据查询、响应及处理过程生成跟踪事件
+func NewTraceEvent(event Event, trace *middleware.Trace) TraceEvent {
+	return TraceEvent{Type: "trace", Query: event, Steps: trace.Steps()}
+}
+
+// 跟踪条件：域名及其子域名（为空时匹配所有域名）、客户端ip（为空时匹配所有客户端）
+type traceFilter struct {
+	domain string
+	client string
+}
+
+func (f traceFilter) match(domain string, client net.IP) bool {
+	if f.client != "" && f.client != client.String() {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	return f.domain == "" || domain == f.domain || strings.HasSuffix(domain, "."+f.domain)
+}
+
+// WebSocket控制接口：向订阅的连接实时推送查询事件及指定查询的处理过程，并接受动态分组规则的增删。
+// 动态规则优先于配置文件中的规则，重载配置后保留。
+// 另可通过"PUT /rules/<名称>"上传gfwlist等规则数据，校验通过后写入文件并生效；通过"GET/PUT /cache"导出/导入缓存快照
+type Server struct {
+	Groups func(name string) bool // 判断组是否存在，用于校验add_rule命令
+	Upload func(name string, data []byte) error
+	// 导出/导入DNS缓存快照，用于"GET /cache"及"PUT /cache"，返回响应数
+	DumpCache func(w io.Writer) (int, error)
+	LoadCache func(r io.Reader) (int, error)
+	// 执行并跟踪一次查询，用于replay命令；group不为空时经由指定组解析
+	Replay   func(name string, qtype uint16, client net.IP, group string) TraceEvent
+	listen   string
+	addr     string
+	token    atomic.Value // string
+	server   *http.Server
+	ln       net.Listener
+	mux      sync.RWMutex
+	rules    map[string]string // 域名（小写，无末尾点号）到组名的映射，匹配域名及其子域名
+	subs     map[chan interface{}]bool
+	tracers  map[chan interface{}]traceFilter
+	conns    map[*websocket.Conn]bool
+	watchers int32
+	tracing  int32
+}
+
+// 判断是否有订阅者，无订阅者时无需生成查询事件
+func (s *Server) Watching() bool {
+	return s != nil && atomic.LoadInt32(&s.watchers) > 0
+}
+
+// 向所有订阅者推送事件
+func (s *Server) Publish(event Event) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for ch := range s.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// 判断是否有跟踪者关注该查询，需要时才记录处理过程
+func (s *Server) Tracing(domain string, client net.IP) bool {
+	if s == nil || atomic.LoadInt32(&s.tracing) <= 0 {
+		return false
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, filter := range s.tracers {
+		if filter.match(domain, client) {
+			return true
+		}
+	}
+	return false
+}
+
+// 向关注该查询的跟踪者推送处理过程
+func (s *Server) PublishTrace(event TraceEvent) {
+	client := net.ParseIP(event.Query.Client)
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for ch, filter := range s.tracers {
+		if filter.match(event.Query.Name, client) {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) trace(ch chan interface{}, filter traceFilter, on bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.tracers[ch]; !ok && on {
+		atomic.AddInt32(&s.tracing, 1)
+	} else if ok && !on {
+		atomic.AddInt32(&s.tracing, -1)
+	}
+	if on {
+		s.tracers[ch] = filter
+	} else {
+		delete(s.tracers, ch)
+	}
+}
+
+// 查找域名匹配的动态规则，返回目标组
+func (s *Server) Group(domain string) (group string, ok bool) {
+	if s == nil {
+		return "", false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if len(s.rules) == 0 {
+		return "", false
+	}
+	for suffix := domain; ; {
+		if group, ok = s.rules[suffix]; ok {
+			return group, true
+		}
+		i := strings.Index(suffix, ".")
+		if i < 0 {
+			return "", false
+		}
+		suffix = suffix[i+1:]
+	}
+}
+
+func (s *Server) subscribe(ch chan interface{}, on bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if on && !s.subs[ch] {
+		s.subs[ch] = true
+		atomic.AddInt32(&s.watchers, 1)
+	} else if !on && s.subs[ch] {
+		delete(s.subs, ch)
+		atomic.AddInt32(&s.watchers, -1)
+	}
+}
+
+// 执行命令
+func (s *Server) execute(cmd Command, ch chan interface{}) (result Result) {
+	result = Result{Type: "result", ID: cmd.ID}
+	rule := strings.ToLower(strings.Trim(cmd.Rule, "."))
+	switch cmd.Op {
+	case "subscribe", "unsubscribe":
+		s.subscribe(ch, cmd.Op == "subscribe")
+	case "add_rule":
+		if rule == "" {
+			result.Error = "rule cannot be empty"
+		} else if s.Groups != nil && !s.Groups(cmd.Group) {
+			result.Error = "unknown group: " + cmd.Group
+		} else {
+			s.mux.Lock()
+			s.rules[rule] = cmd.Group
+			s.mux.Unlock()
+		}
+	case "remove_rule":
+		s.mux.Lock()
+		delete(s.rules, rule)
+		s.mux.Unlock()
+	case "trace", "untrace":
+		s.trace(ch, traceFilter{domain: rule, client: cmd.Client}, cmd.Op == "trace")
+	case "replay":
+		qtype, ok := dns.TypeA, true
+		if cmd.Qtype != "" {
+			qtype, ok = dns.StringToType[strings.ToUpper(cmd.Qtype)]
+		}
+		client := net.ParseIP(cmd.Client)
+		if cmd.Client == "" {
+			client = net.IPv4(127, 0, 0, 1)
+		}
+		switch {
+		case rule == "":
+			result.Error = "rule cannot be empty"
+		case !ok:
+			result.Error = "unknown qtype: " + cmd.Qtype
+		case client == nil:
+			result.Error = "invalid client: " + cmd.Client
+		case cmd.Group != "" && s.Groups != nil && !s.Groups(cmd.Group):
+			result.Error = "unknown group: " + cmd.Group
+		case s.Replay == nil:
+			result.Error = "replay is not supported"
+		default:
+			event := s.Replay(dns.Fqdn(rule), qtype, client, cmd.Group)
+			result.Trace = &event
+		}
+	case "list_rules":
+		s.mux.RLock()
+		result.Rules = make(map[string]string, len(s.rules))
+		for rule, group := range s.rules {
+			result.Rules[rule] = group
+		}
+		s.mux.RUnlock()
+	default:
+		result.Error = "unknown op: " + cmd.Op
+	}
+	return result
+}
+
+// 处理WebSocket连接：由单独的goroutine写入事件及命令结果，当前goroutine读取命令
+func (s *Server) serve(ws *websocket.Conn) {
+	ch, done := make(chan interface{}, eventBuffer), make(chan struct{})
+	s.mux.Lock()
+	s.conns[ws] = true
+	s.mux.Unlock()
+	defer func() {
+		s.subscribe(ch, false)
+		s.trace(ch, traceFilter{}, false)
+		s.mux.Lock()
+		delete(s.conns, ws)
+		s.mux.Unlock()
+		close(done)
+		_ = ws.Close()
+	}()
+	go func() {
+		for {
+			select {
+			case msg := <-ch:
+				if err := websocket.JSON.Send(ws, msg); err != nil {
+					_ = ws.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	for {
+		var cmd Command
+		if err := websocket.JSON.Receive(ws, &cmd); err != nil {
+			return
+		}
+		result := s.execute(cmd, ch)
+		select {
+		case ch <- result:
+		case <-done:
+			return
+		}
+	}
+}
+
+// 校验请求中的token，支持"Authorization: Bearer <token>"及"?token=<token>"两种形式。
+// 未设置token时拒绝浏览器中其它网页发起的跨域请求
+func (s *Server) authorized(req *http.Request) bool {
+	expected := s.token.Load().(string)
+	if expected == "" {
+		return sameOrigin(req)
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[7:]
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+// 处理规则数据的上传请求，路径为/rules/<名称>
+func (s *Server) upload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut && req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxUpload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/rules/")
+	if s.Upload == nil {
+		err = ErrUnknownRules
+	} else {
+		err = s.Upload(name, data)
+	}
+	switch {
+	case err == ErrUnknownRules:
+		http.Error(w, "unknown rules: "+name, http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("[WARNING] rules %s uploaded from %s\n", name, req.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// 处理缓存快照的导出（GET）及导入（PUT/POST）请求，响应数通过X-Cache-Entries响应头返回
+func (s *Server) cache(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		if s.DumpCache == nil {
+			http.Error(w, "cache not available", http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		n, err := s.DumpCache(&buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Cache-Entries", strconv.Itoa(n))
+		_, _ = w.Write(buf.Bytes())
+	case http.MethodPut, http.MethodPost:
+		if s.LoadCache == nil {
+			http.Error(w, "cache not available", http.StatusNotFound)
+			return
+		}
+		n, err := s.LoadCache(http.MaxBytesReader(w, req.Body, maxUpload))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[WARNING] %d cache entries imported from %s\n", n, req.RemoteAddr)
+		w.Header().Set("X-Cache-Entries", strconv.Itoa(n))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 判断请求是否来自非浏览器客户端或同源页面：携带Origin时须与Host一致，且Host须为ip或localhost，
+// 避免网页经DNS重绑定以自身域名访问本接口
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, req.Host) {
+		return false
+	}
+	host := u.Hostname()
+	return strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil
+}
+
+// 判断重载配置时能否复用该Server，监听地址不变即可复用，token由SetToken替换
+func (s *Server) Reusable(listen string) bool {
+	return s.listen == listen
+}
+
+// 替换校验的token，已建立的WebSocket连接不受影响
+func (s *Server) SetToken(token string) {
+	s.token.Store(token)
+}
+
+// 停止监听，断开所有连接
+func (s *Server) Close() {
+	_ = s.server.Close()
+	_ = s.ln.Close() // Serve尚未开始时http.Server不会关闭监听
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for ws := range s.conns { // 已升级为WebSocket的连接不受http.Server管理
+		_ = ws.Close()
+	}
+}
+
+// 在listen地址上启动控制接口，WebSocket路径为/ws。token为空时不校验
+func New(listen, token string) (s *Server, err error) {
+	var ln net.Listener
+	if ln, err = net.Listen("tcp", listen); err != nil {
+		return nil, err
+	}
+	s = &Server{listen: listen, addr: ln.Addr().String(), ln: ln, rules: map[string]string{},
+		subs: map[chan interface{}]bool{}, tracers: map[chan interface{}]traceFilter{}, conns: map[*websocket.Conn]bool{}}
+	s.SetToken(token)
+	// 由authorized鉴权及校验Origin，websocket.Server不再校验，以便非浏览器客户端连接
+	ws := websocket.Server{Handler: s.serve, Handshake: func(*websocket.Config, *http.Request) error { return nil }}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, req *http.Request) {
+		if !s.authorized(req) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ws.ServeHTTP(w, req)
+	})
+	mux.HandleFunc("/rules/", func(w http.ResponseWriter, req *http.Request) {
+		if !s.authorized(req) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.upload(w, req)
+	})
+	mux.HandleFunc("/cache", func(w http.ResponseWriter, req *http.Request) {
+		if !s.authorized(req) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.cache(w, req)
+	})
+	s.server = &http.Server{Handler: mux}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] control server error: %v\n", err)
+		}
+	}()
+	return s, nil
+}
+
+// 返回实际监听的地址
+func (s *Server) Addr() string {
+	return s.addr
+}
@@ -0,0 +1,216 @@
+package control
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	s, err := New("127.0.0.1:0", "secret")
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	s.Groups = func(name string) bool { return name == "dirty" }
+	url := "ws://" + s.Addr() + "/ws"
+	_, err = websocket.Dial(url, "", "http://localhost/")
+	assert.NotEqual(t, err, nil)
+	ws, err := websocket.Dial(url+"?token=secret", "", "http://localhost/")
+	assert.Equal(t, err, nil)
+	call := func(cmd Command) (result Result) {
+		assert.Equal(t, websocket.JSON.Send(ws, cmd), nil)
+		assert.Equal(t, websocket.JSON.Receive(ws, &result), nil)
+		return
+	}
+	// 动态规则
+	assert.Equal(t, call(Command{ID: 1, Op: "add_rule", Rule: "Example.com.", Group: "unknown"}).Error,
+		"unknown group: unknown")
+	assert.Equal(t, call(Command{ID: 2, Op: "add_rule", Rule: "Example.com.", Group: "dirty"}).ID, 2)
+	group, ok := s.Group("www.example.com.")
+	assert.True(t, ok)
+	assert.Equal(t, group, "dirty")
+	assert.Equal(t, call(Command{Op: "list_rules"}).Rules, map[string]string{"example.com": "dirty"})
+	call(Command{Op: "remove_rule", Rule: "example.com"})
+	_, ok = s.Group("example.com.")
+	assert.False(t, ok)
+	assert.NotEqual(t, call(Command{Op: "unknown"}).Error, "")
+	// 订阅查询事件
+	assert.False(t, s.Watching())
+	call(Command{Op: "subscribe"})
+	assert.True(t, s.Watching())
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	r := new(dns.Msg).SetReply(request)
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.2.3.4")
+	r.Answer = append(r.Answer, rr)
+	s.Publish(NewEvent(net.ParseIP("127.0.0.1"), request.Question[0], "clean", r, time.Millisecond))
+	var event Event
+	assert.Equal(t, websocket.JSON.Receive(ws, &event), nil)
+	assert.Equal(t, event.Name, "ip.cn.")
+	assert.Equal(t, event.Qtype, "A")
+	assert.Equal(t, event.Rcode, "NOERROR")
+	assert.Equal(t, event.Answer, []string{rr.String()})
+	// 关闭后断开连接
+	s.Close()
+	assert.NotEqual(t, websocket.JSON.Receive(ws, &event), nil)
+	var nilServer *Server
+	assert.False(t, nilServer.Watching())
+	_, ok = nilServer.Group("ip.cn.")
+	assert.False(t, ok)
+}
+
+func TestSameOrigin(t *testing.T) {
+	s, err := New("127.0.0.1:0", "")
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	url := "ws://" + s.Addr() + "/ws"
+	// 未设置token时拒绝其它网页的跨域连接
+	_, err = websocket.Dial(url, "", "http://evil.example.com/")
+	assert.NotEqual(t, err, nil)
+	ws, err := websocket.Dial(url, "", "http://"+s.Addr())
+	assert.Equal(t, err, nil)
+	_ = ws.Close()
+	req, _ := http.NewRequest(http.MethodPost, "http://"+s.Addr()+"/rules/gfwlist", strings.NewReader("rules"))
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, err, nil)
+	_ = resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+	// 经DNS重绑定以域名访问
+	req, _ = http.NewRequest(http.MethodGet, "http://"+s.Addr()+"/ws", nil)
+	req.Host = "evil.example.com:5380"
+	req.Header.Set("Origin", "http://evil.example.com:5380")
+	assert.False(t, sameOrigin(req))
+	req.Header.Del("Origin")
+	assert.True(t, sameOrigin(req))
+}
+
+func TestUpload(t *testing.T) {
+	s, err := New("127.0.0.1:0", "secret")
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	uploaded := map[string]string{}
+	s.Upload = func(name string, data []byte) error {
+		switch {
+		case name != "gfwlist":
+			return ErrUnknownRules
+		case len(data) == 0:
+			return errors.New("no valid rules in gfwlist")
+		}
+		uploaded[name] = string(data)
+		return nil
+	}
+	put := func(path, token, body string) int {
+		req, _ := http.NewRequest(http.MethodPut, "http://"+s.Addr()+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, put("/rules/gfwlist", "wrong", "rules"), http.StatusUnauthorized)
+	assert.Equal(t, put("/rules/geosite", "secret", "rules"), http.StatusNotFound)
+	assert.Equal(t, put("/rules/gfwlist", "secret", ""), http.StatusBadRequest)
+	assert.Equal(t, len(uploaded), 0)
+	assert.Equal(t, put("/rules/gfwlist", "secret", "rules"), http.StatusNoContent)
+	assert.Equal(t, uploaded["gfwlist"], "rules")
+	resp, err := http.Get("http://" + s.Addr() + "/rules/gfwlist?token=secret")
+	assert.Equal(t, err, nil)
+	_ = resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	s, err := New("127.0.0.1:0", "secret")
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	do := func(method, token, body string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, "http://"+s.Addr()+"/cache", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		data, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp, string(data)
+	}
+	resp, _ := do(http.MethodGet, "secret", "")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	var loaded string
+	s.DumpCache = func(w io.Writer) (int, error) {
+		_, err := w.Write([]byte("snapshot"))
+		return 2, err
+	}
+	s.LoadCache = func(r io.Reader) (int, error) {
+		data, _ := ioutil.ReadAll(r)
+		if loaded = string(data); loaded == "" {
+			return 0, errors.New("decode snapshot error")
+		}
+		return 3, nil
+	}
+	resp, _ = do(http.MethodGet, "wrong", "")
+	assert.Equal(t, resp.StatusCode, http.StatusUnauthorized)
+	resp, body := do(http.MethodGet, "secret", "")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("X-Cache-Entries"), "2")
+	assert.Equal(t, body, "snapshot")
+	resp, _ = do(http.MethodPut, "secret", "snapshot")
+	assert.Equal(t, resp.StatusCode, http.StatusNoContent)
+	assert.Equal(t, resp.Header.Get("X-Cache-Entries"), "3")
+	assert.Equal(t, loaded, "snapshot")
+	resp, _ = do(http.MethodPut, "secret", "")
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	resp, _ = do(http.MethodDelete, "secret", "")
+	assert.Equal(t, resp.StatusCode, http.StatusMethodNotAllowed)
+}
+
+func TestTrace(t *testing.T) {
+	s, err := New("127.0.0.1:0", "")
+	assert.Equal(t, err, nil)
+	defer s.Close()
+	s.Replay = func(name string, qtype uint16, client net.IP, group string) TraceEvent {
+		trace := middleware.NewTrace()
+		trace.Add("route", "match group '"+group+"' (assigned)")
+		return NewTraceEvent(Event{Name: name, Qtype: dns.TypeToString[qtype], Client: client.String()}, trace)
+	}
+	ws, err := websocket.Dial("ws://"+s.Addr()+"/ws", "", "http://"+s.Addr())
+	assert.Equal(t, err, nil)
+	call := func(cmd Command) (result Result) {
+		assert.Equal(t, websocket.JSON.Send(ws, cmd), nil)
+		assert.Equal(t, websocket.JSON.Receive(ws, &result), nil)
+		return
+	}
+	// 重放查询
+	result := call(Command{Op: "replay", Rule: "ip.cn", Qtype: "AAAA", Group: "dirty"})
+	assert.Equal(t, result.Error, "")
+	assert.Equal(t, result.Trace.Query.Name, "ip.cn.")
+	assert.Equal(t, result.Trace.Query.Qtype, "AAAA")
+	assert.Equal(t, result.Trace.Steps[0].Detail, "match group 'dirty' (assigned)")
+	assert.NotEqual(t, call(Command{Op: "replay", Rule: "ip.cn", Qtype: "unknown"}).Error, "")
+	// 按域名及客户端跟踪查询
+	assert.False(t, s.Tracing("www.ip.cn.", net.ParseIP("10.0.0.1")))
+	call(Command{Op: "trace", Rule: "ip.cn", Client: "10.0.0.1"})
+	assert.True(t, s.Tracing("www.ip.cn.", net.ParseIP("10.0.0.1")))
+	assert.False(t, s.Tracing("www.ip.cn.", net.ParseIP("10.0.0.2")))
+	assert.False(t, s.Tracing("google.com.", net.ParseIP("10.0.0.1")))
+	trace := middleware.NewTrace()
+	trace.Add("cache", "hit cache")
+	s.PublishTrace(NewTraceEvent(Event{Name: "google.com.", Client: "10.0.0.1"}, trace))
+	s.PublishTrace(NewTraceEvent(Event{Name: "www.ip.cn.", Client: "10.0.0.1"}, trace))
+	var event TraceEvent
+	assert.Equal(t, websocket.JSON.Receive(ws, &event), nil)
+	assert.Equal(t, event.Type, "trace")
+	assert.Equal(t, event.Query.Name, "www.ip.cn.")
+	assert.Equal(t, event.Steps[0].Stage, "cache")
+	call(Command{Op: "untrace"})
+	assert.False(t, s.Tracing("www.ip.cn.", net.ParseIP("10.0.0.1")))
+	var nilServer *Server
+	assert.False(t, nilServer.Tracing("ip.cn.", nil))
+}
@@ -0,0 +1,185 @@
+package device
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 重新读取ARP表、IPv6邻居表及DHCP租约文件的最短间隔
+const refreshInterval = 10 * time.Second
+
+// 设备配置，按MAC地址或DHCP主机名匹配客户端，避免DHCP分配的ip变化后配置失效
+type Profile struct {
+	Name       string
+	Group      string   // 该设备使用的组，为空时按分组规则确定
+	Blocklists []string // 对该设备生效的屏蔽列表，为nil时按各列表的clients配置
+	SafeSearch *bool    // 是否对该设备强制安全搜索，为nil时按safe_search_clients配置
+}
+
+// 判断屏蔽列表是否对该设备生效
+func (p *Profile) UsesBlocklist(name string) bool {
+	for _, list := range p.Blocklists {
+		if list == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 客户端ip对应的MAC地址及主机名
+type neighbor struct {
+	mac      string
+	hostname string
+}
+
+// 设备表：通过ARP表（如/proc/net/arp）、IPv6邻居表（ip -6 neigh）及dnsmasq格式的DHCP租约文件识别客户端对应的设备配置
+type Table struct {
+	arpFile   string
+	leaseFile string
+	neighCmd  []string // 输出IPv6邻居表的命令，为空时不读取
+	byMAC     map[string]*Profile
+	byHost    map[string]*Profile
+	mux       sync.Mutex
+	neighbors map[string]neighbor
+	loaded    time.Time
+	loading   bool
+}
+
+// 添加设备配置，macs、hostnames中任一项匹配时生效
+func (t *Table) Add(profile *Profile, macs, hostnames []string) error {
+	for _, mac := range macs {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return err
+		}
+		t.byMAC[hw.String()] = profile
+	}
+	for _, hostname := range hostnames {
+		t.byHost[strings.ToLower(hostname)] = profile
+	}
+	return nil
+}
+
+// 读取ARP表、IPv6邻居表及DHCP租约文件，文件不存在或命令执行失败时忽略
+func (t *Table) read() map[string]neighbor {
+	neighbors := map[string]neighbor{}
+	if raw, err := ioutil.ReadFile(t.leaseFile); t.leaseFile != "" && err == nil {
+		// 格式为"过期时间 MAC(ipv6租约为IAID) ip 主机名 客户端ID"，主机名未知时为"*"
+		for _, line := range strings.Split(string(raw), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || net.ParseIP(fields[2]) == nil {
+				continue
+			}
+			var n neighbor
+			if hw, err := net.ParseMAC(fields[1]); err == nil {
+				n.mac = hw.String()
+			}
+			if fields[3] != "*" {
+				n.hostname = strings.ToLower(fields[3])
+			}
+			neighbors[net.ParseIP(fields[2]).String()] = n
+		}
+	}
+	if raw, err := ioutil.ReadFile(t.arpFile); t.arpFile != "" && err == nil {
+		// 格式为"ip HW类型 标志 MAC 掩码 网卡"，首行为表头
+		for _, line := range strings.Split(string(raw), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || net.ParseIP(fields[0]) == nil || fields[2] == "0x0" {
+				continue // 忽略表头及未完成解析的条目
+			}
+			hw, err := net.ParseMAC(fields[3])
+			if err != nil {
+				continue
+			}
+			ip := net.ParseIP(fields[0]).String()
+			n := neighbors[ip]
+			n.mac = hw.String()
+			neighbors[ip] = n
+		}
+	}
+	for ip, mac := range t.readNeigh() {
+		n := neighbors[ip]
+		n.mac = mac
+		neighbors[ip] = n
+	}
+	return neighbors
+}
+
+// 读取IPv6邻居表，格式为"ip dev 网卡 lladdr MAC [router] 状态"，无lladdr的条目（如FAILED）未完成解析
+func (t *Table) readNeigh() map[string]string {
+	if len(t.neighCmd) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, t.neighCmd[0], t.neighCmd[1:]...).Output()
+	if err != nil {
+		return nil
+	}
+	macs := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		for i := 1; i < len(fields)-1; i++ {
+			if fields[i] != "lladdr" {
+				continue
+			}
+			if hw, err := net.ParseMAC(fields[i+1]); err == nil {
+				macs[net.ParseIP(fields[0]).String()] = hw.String()
+			}
+			break
+		}
+	}
+	return macs
+}
+
+// 在后台重新读取邻居信息，避免在查询路径上读取文件及执行命令
+func (t *Table) refresh() {
+	neighbors := t.read()
+	t.mux.Lock()
+	t.neighbors, t.loaded, t.loading = neighbors, time.Now(), false
+	t.mux.Unlock()
+}
+
+// 查找客户端ip对应的设备配置，MAC地址优先于主机名，无匹配时返回nil
+func (t *Table) Match(ip net.IP) *Profile {
+	if t == nil || ip == nil {
+		return nil
+	}
+	t.mux.Lock()
+	if !t.loading && time.Since(t.loaded) >= refreshInterval {
+		t.loading = true
+		go t.refresh()
+	}
+	n, ok := t.neighbors[ip.String()]
+	t.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	if profile := t.byMAC[n.mac]; n.mac != "" && profile != nil {
+		return profile
+	}
+	if n.hostname != "" {
+		return t.byHost[n.hostname]
+	}
+	return nil
+}
+
+// 创建设备表并读取邻居信息，arpFile为ARP表路径，leaseFile为DHCP租约文件路径，为空时不读取。
+// 读取ARP表时同时经"ip -6 neigh"读取IPv6邻居表
+func NewTable(arpFile, leaseFile string) *Table {
+	t := &Table{arpFile: arpFile, leaseFile: leaseFile, byMAC: map[string]*Profile{},
+		byHost: map[string]*Profile{}}
+	if arpFile != "" {
+		t.neighCmd = []string{"ip", "-6", "neigh", "show"}
+	}
+	t.neighbors, t.loaded = t.read(), time.Now()
+	return t
+}
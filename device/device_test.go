@@ -0,0 +1,83 @@
+package device
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "device")
+	defer func() { _ = os.RemoveAll(dir) }()
+	arpFile, leaseFile := filepath.Join(dir, "arp"), filepath.Join(dir, "leases")
+	arp := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         AA:BB:CC:DD:EE:01     *        br-lan
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        br-lan
+`
+	leases := `1600000000 aa:bb:cc:dd:ee:02 192.168.1.12 Kids-iPad 01:aa:bb:cc:dd:ee:02
+1600000000 aa:bb:cc:dd:ee:03 192.168.1.13 * *
+duid 00:01:00:01:aa:bb:cc:dd:ee:ff
+1600000000 1234 fd00::12 kids-ipad *
+`
+	_ = ioutil.WriteFile(arpFile, []byte(arp), 0644)
+	_ = ioutil.WriteFile(leaseFile, []byte(leases), 0644)
+	table := NewTable(arpFile, leaseFile)
+	tv, kid := &Profile{Name: "tv"}, &Profile{Name: "kid", Blocklists: []string{"adult"}}
+	assert.NotEqual(t, table.Add(tv, []string{"invalid"}, nil), nil)
+	assert.Equal(t, table.Add(tv, []string{"aa:bb:cc:dd:ee:01"}, nil), nil)
+	assert.Equal(t, table.Add(kid, nil, []string{"kids-ipad"}), nil)
+
+	assert.True(t, table.Match(net.ParseIP("192.168.1.10")) == tv)
+	assert.True(t, table.Match(net.ParseIP("192.168.1.12")) == kid)
+	assert.True(t, table.Match(net.ParseIP("fd00::12")) == kid)
+	assert.True(t, table.Match(net.ParseIP("192.168.1.11")) == nil)
+	assert.True(t, table.Match(net.ParseIP("192.168.1.13")) == nil)
+	assert.True(t, kid.UsesBlocklist("adult"))
+	assert.False(t, tv.UsesBlocklist("adult"))
+	// 客户端ip变化后重新读取
+	_ = ioutil.WriteFile(arpFile, []byte("IP address HW type Flags HW address Mask Device\n"+
+		"192.168.1.20 0x1 0x2 aa:bb:cc:dd:ee:01 * br-lan\n"), 0644)
+	table.mux.Lock()
+	table.loaded = time.Time{}
+	table.mux.Unlock()
+	// 在后台重新读取，读取完成前使用原有信息
+	assert.True(t, table.Match(net.ParseIP("192.168.1.20")) == nil)
+	waitRefresh(table)
+	assert.True(t, table.Match(net.ParseIP("192.168.1.20")) == tv)
+	assert.True(t, table.Match(net.ParseIP("192.168.1.10")) == nil)
+	var nilTable *Table
+	assert.True(t, nilTable.Match(net.ParseIP("192.168.1.20")) == nil)
+}
+
+// 等待后台读取完成
+func waitRefresh(table *Table) {
+	for i := 0; i < 100; i++ {
+		table.mux.Lock()
+		loading := table.loading
+		table.mux.Unlock()
+		if !loading {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	table := NewTable("", "")
+	table.neighCmd = []string{"printf", "%s\\n", "fe80::20 dev br-lan lladdr aa:bb:cc:dd:ee:01 router REACHABLE",
+		"fe80::21 dev br-lan FAILED", "2001:db8::22 dev br-lan lladdr AA:BB:CC:DD:EE:02 STALE"}
+	tv, phone := &Profile{Name: "tv"}, &Profile{Name: "phone"}
+	_ = table.Add(tv, []string{"aa:bb:cc:dd:ee:01"}, nil)
+	_ = table.Add(phone, []string{"aa:bb:cc:dd:ee:02"}, nil)
+	table.neighbors = table.read()
+	assert.True(t, table.Match(net.ParseIP("fe80::20")) == tv)
+	assert.True(t, table.Match(net.ParseIP("2001:db8::22")) == phone)
+	assert.True(t, table.Match(net.ParseIP("fe80::21")) == nil)
+	// 命令执行失败时忽略
+	table.neighCmd = []string{"false"}
+	assert.Equal(t, len(table.read()), 0)
+}
@@ -0,0 +1,174 @@
+package dns64
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用于发现NAT64前缀的域名（RFC 7050），其A记录为知名地址192.0.0.170、192.0.0.171
+const DiscoveryName = "ipv4only.arpa."
+
+var wellKnownIPs = []net.IP{net.IPv4(192, 0, 0, 170), net.IPv4(192, 0, 0, 171)}
+
+// 自动发现模式下重新检测前缀的间隔范围，及检测失败时的重试间隔
+const (
+	minRecheck = time.Minute
+	maxRecheck = time.Hour
+	retryDelay = time.Minute
+)
+
+// DNS64地址合成（RFC 6147）的NAT64前缀。前缀为"auto"时通过ipv4only.arpa自动发现，
+// 并按应答的TTL定期重新检测，以适应不同网络的前缀
+type Synthesizer struct {
+	auto     bool
+	mux      sync.Mutex
+	prefix   *net.IPNet // 当前前缀，自动发现模式下未发现前缀时为nil
+	checkAt  time.Time  // 下次检测前缀的时间
+	checking bool
+}
+
+// 创建合成器，prefix为"auto"或长度为32、40、48、56、64、96的IPv6前缀（RFC 6052）
+func New(prefix string) (*Synthesizer, error) {
+	if strings.EqualFold(prefix, "auto") {
+		return &Synthesizer{auto: true}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix: %s", prefix)
+	}
+	if ones, _ := ipNet.Mask.Size(); !validLength(ones) {
+		return nil, fmt.Errorf("NAT64 prefix length must be 32, 40, 48, 56, 64 or 96: %s", prefix)
+	}
+	return &Synthesizer{prefix: ipNet}, nil
+}
+
+func validLength(ones int) bool {
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// 返回当前的NAT64前缀，无可用前缀时返回nil。自动发现模式下到达检测时间时通过discover查询ipv4only.arpa的
+// AAAA记录（discover返回nil表示查询失败）：尚未获得前缀时同步检测，否则在后台检测并暂时使用原前缀
+func (s *Synthesizer) Prefix(discover func(request *dns.Msg) *dns.Msg) *net.IPNet {
+	s.mux.Lock()
+	prefix := s.prefix
+	if !s.auto || s.checking || time.Now().Before(s.checkAt) {
+		s.mux.Unlock()
+		return prefix
+	}
+	s.checking = true
+	s.mux.Unlock()
+	if prefix != nil {
+		go s.check(discover)
+		return prefix
+	}
+	return s.check(discover)
+}
+
+// 检测NAT64前缀：查询失败时保留原前缀并稍后重试，应答中无NAT64地址时视为当前网络不支持NAT64
+func (s *Synthesizer) check(discover func(request *dns.Msg) *dns.Msg) *net.IPNet {
+	request := new(dns.Msg)
+	request.SetQuestion(DiscoveryName, dns.TypeAAAA)
+	r := discover(request)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.checking = false
+	if r == nil {
+		s.checkAt = time.Now().Add(retryDelay)
+		return s.prefix
+	}
+	prefix, ttl := Discover(r)
+	recheck := time.Duration(ttl) * time.Second
+	if prefix == nil {
+		recheck = retryDelay
+	} else if recheck < minRecheck {
+		recheck = minRecheck
+	} else if recheck > maxRecheck {
+		recheck = maxRecheck
+	}
+	if prefix.String() != s.prefix.String() {
+		if prefix != nil {
+			log.Printf("[INFO] discovered NAT64 prefix %s\n", prefix)
+		} else {
+			log.Printf("[WARNING] no NAT64 prefix found via %s\n", DiscoveryName)
+		}
+	}
+	s.prefix, s.checkAt = prefix, time.Now().Add(recheck)
+	return prefix
+}
+
+// 从ipv4only.arpa的AAAA应答中找出嵌入了知名地址的NAT64前缀（RFC 7050），同时返回该记录的TTL。未找到时返回nil
+func Discover(r *dns.Msg) (prefix *net.IPNet, ttl uint32) {
+	for _, answer := range r.Answer {
+		rr, ok := answer.(*dns.AAAA)
+		if !ok || rr.AAAA.To4() != nil {
+			continue
+		}
+		for _, ones := range []int{96, 64, 56, 48, 40, 32} {
+			ip := Extract(rr.AAAA, ones)
+			for _, known := range wellKnownIPs {
+				if ip.Equal(known) {
+					mask := net.CIDRMask(ones, 128)
+					return &net.IPNet{IP: rr.AAAA.Mask(mask), Mask: mask}, rr.Hdr.Ttl
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+// 按RFC 6052返回IPv4地址在指定长度前缀的IPv6地址中所占的字节位置，跳过第64-71位
+func positions(ones int) (pos []int) {
+	for i := ones / 8; len(pos) < net.IPv4len; i++ {
+		if i != 8 {
+			pos = append(pos, i)
+		}
+	}
+	return pos
+}
+
+// 将IPv4地址嵌入NAT64前缀，得到合成的IPv6地址
+func Embed(prefix *net.IPNet, ip net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip4, ip6 := ip.To4(), make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+	for i, p := range positions(ones) {
+		ip6[p] = ip4[i]
+	}
+	return ip6
+}
+
+// 从合成的IPv6地址中取出指定前缀长度下嵌入的IPv4地址
+func Extract(ip net.IP, ones int) net.IP {
+	ip4 := make(net.IP, net.IPv4len)
+	for i, p := range positions(ones) {
+		ip4[i] = ip[p]
+	}
+	return ip4
+}
+
+// 由A查询的响应为AAAA查询合成响应：A记录替换为嵌入前缀的AAAA记录，保留CNAME等其它记录
+func Synthesize(prefix *net.IPNet, request, a *dns.Msg) *dns.Msg {
+	r := new(dns.Msg).SetReply(request)
+	r.Rcode, r.RecursionAvailable, r.Ns = a.Rcode, a.RecursionAvailable, a.Ns
+	for _, answer := range a.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: Embed(prefix, rr.A)})
+		case *dns.RRSIG: // 合成的记录无法通过验证，不保留签名
+		default:
+			r.Answer = append(r.Answer, dns.Copy(answer))
+		}
+	}
+	return r
+}
@@ -0,0 +1,85 @@
+package dns64
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEmbed(t *testing.T) {
+	// RFC 6052 2.4节的示例
+	ip := net.ParseIP("192.0.2.33")
+	for prefix, expected := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	} {
+		_, ipNet, _ := net.ParseCIDR(prefix)
+		ip6 := Embed(ipNet, ip)
+		assert.Equal(t, ip6.String(), expected)
+		ones, _ := ipNet.Mask.Size()
+		assert.Equal(t, Extract(ip6, ones).String(), "192.0.2.33")
+	}
+}
+
+func TestSynthesizer(t *testing.T) {
+	_, err := New("64:ff9b::/97")
+	assert.NotEqual(t, err, nil)
+	_, err = New("10.0.0.0/8")
+	assert.NotEqual(t, err, nil)
+	s, err := New("64:ff9b::/96")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s.Prefix(nil).String(), "64:ff9b::/96")
+
+	// 按RFC 7050发现前缀
+	reply := func(request *dns.Msg, answers ...string) *dns.Msg {
+		r := new(dns.Msg).SetReply(request)
+		for _, answer := range answers {
+			rr, _ := dns.NewRR(answer)
+			r.Answer = append(r.Answer, rr)
+		}
+		return r
+	}
+	calls, answer := 0, "ipv4only.arpa. 600 IN AAAA 2001:db8:122:344:c0:0:aa00:0"
+	discover := func(request *dns.Msg) *dns.Msg {
+		calls++
+		assert.Equal(t, request.Question[0].Name, DiscoveryName)
+		if answer == "" {
+			return nil
+		}
+		return reply(request, answer)
+	}
+	s, _ = New("auto")
+	assert.Equal(t, s.Prefix(discover).String(), "2001:db8:122:344::/64")
+	assert.Equal(t, s.Prefix(discover).String(), "2001:db8:122:344::/64")
+	assert.Equal(t, calls, 1)
+	assert.True(t, s.checkAt.After(time.Now().Add(9*time.Minute))) // 按应答的TTL重新检测
+	// 到达检测时间后重新发现，查询失败时保留原前缀
+	answer = ""
+	s.checkAt = time.Now()
+	assert.Equal(t, s.check(discover).String(), "2001:db8:122:344::/64")
+	// 网络更换后使用新的前缀，应答无NAT64地址时不再合成
+	answer = "ipv4only.arpa. 30 IN AAAA 64:ff9b::c000:ab"
+	assert.Equal(t, s.check(discover).String(), "64:ff9b::/96")
+	assert.True(t, s.checkAt.After(time.Now().Add(minRecheck-time.Second)))
+	answer = "ipv4only.arpa. 30 IN AAAA 2001:db8::1"
+	assert.Equal(t, s.check(discover), (*net.IPNet)(nil))
+	prefix, _ := Discover(new(dns.Msg))
+	assert.Equal(t, prefix, (*net.IPNet)(nil))
+
+	// 由A响应合成AAAA响应
+	request := new(dns.Msg)
+	request.SetQuestion("www.example.com.", dns.TypeAAAA)
+	a := reply(request, "www.example.com. 60 IN CNAME example.com.", "example.com. 30 IN A 192.0.2.33")
+	_, ipNet, _ := net.ParseCIDR("64:ff9b::/96")
+	r := Synthesize(ipNet, request, a)
+	assert.Equal(t, r.Question[0].Qtype, dns.TypeAAAA)
+	assert.Equal(t, len(r.Answer), 2)
+	assert.Equal(t, r.Answer[0].Header().Rrtype, dns.TypeCNAME)
+	assert.Equal(t, r.Answer[1].String(), "example.com.\t30\tIN\tAAAA\t64:ff9b::c000:221")
+}
@@ -0,0 +1,153 @@
+package dnssec
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 根区信任锚（KSK-2017）
+const RootAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// RFC 5011规定的新密钥等待时间
+const HoldDown = 30 * 24 * time.Hour
+
+// 信任锚状态
+const (
+	stateValid   = "valid"
+	statePending = "pending"
+	stateRevoked = "revoked"
+)
+
+type anchor struct {
+	rr        dns.RR // *dns.DS或*dns.DNSKEY
+	state     string
+	firstSeen time.Time
+}
+
+// 判断DNSKEY是否与信任锚对应
+func (a *anchor) match(key *dns.DNSKEY) bool {
+	switch rr := a.rr.(type) {
+	case *dns.DS:
+		ds := key.ToDS(rr.DigestType)
+		return ds != nil && rr.KeyTag == ds.KeyTag && strings.EqualFold(rr.Digest, ds.Digest)
+	case *dns.DNSKEY:
+		return rr.Algorithm == key.Algorithm && rr.PublicKey == key.PublicKey
+	}
+	return false
+}
+
+// 根区信任锚集合，按RFC 5011自动跟踪根区KSK轮转并持久化至文件
+type TrustAnchors struct {
+	mux      *sync.Mutex
+	filename string
+	anchors  []*anchor
+}
+
+// 返回与DNSKEY对应的有效信任锚是否存在
+func (t *TrustAnchors) Trusted(key *dns.DNSKEY) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, a := range t.anchors {
+		if a.state == stateValid && a.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 根据已验证的根区DNSKEY集合更新信任锚：新出现的SEP密钥进入等待期，
+// 等待期满后转为有效；设置了REVOKE标志的密钥被撤销
+func (t *TrustAnchors) Observe(keys []*dns.DNSKEY, now time.Time) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	changed := false
+	for _, key := range keys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+		if key.Flags&dns.REVOKE != 0 {
+			// 撤销密钥的公钥与原密钥一致，但KeyTag不同
+			orig := *key
+			orig.Flags &^= dns.REVOKE
+			for _, a := range t.anchors {
+				if a.state != stateRevoked && a.match(&orig) {
+					a.state, changed = stateRevoked, true
+				}
+			}
+			continue
+		}
+		var found *anchor
+		for _, a := range t.anchors {
+			if a.match(key) {
+				found = a
+				break
+			}
+		}
+		switch {
+		case found == nil:
+			t.anchors = append(t.anchors, &anchor{rr: key, state: statePending, firstSeen: now})
+			changed = true
+		case found.state == statePending && now.Sub(found.firstSeen) >= HoldDown:
+			found.state, changed = stateValid, true
+		}
+	}
+	if changed {
+		if err := t.save(); err != nil {
+			log.Printf("[ERROR] save trust anchors error: %v\n", err)
+		}
+	}
+}
+
+// 将信任锚写入文件，每行格式为"状态 首次出现时间戳 记录"
+func (t *TrustAnchors) save() error {
+	if t.filename == "" {
+		return nil
+	}
+	var lines []string
+	for _, a := range t.anchors {
+		lines = append(lines, fmt.Sprintf("%s %d %s", a.state, a.firstSeen.Unix(), a.rr.String()))
+	}
+	return ioutil.WriteFile(t.filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// 创建信任锚集合。filename为空或文件不存在时使用内置根区信任锚
+func NewTrustAnchors(filename string) (t *TrustAnchors, err error) {
+	t = &TrustAnchors{mux: new(sync.Mutex), filename: filename}
+	var raw []byte
+	if filename != "" {
+		if raw, err = ioutil.ReadFile(filename); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		arr := strings.SplitN(line, " ", 3)
+		if len(arr) != 3 {
+			return nil, fmt.Errorf("invalid trust anchor: %s", line)
+		}
+		var ts int64
+		if ts, err = strconv.ParseInt(arr[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid trust anchor: %s", line)
+		}
+		var rr dns.RR
+		if rr, err = dns.NewRR(arr[2]); err != nil {
+			return nil, fmt.Errorf("invalid trust anchor: %v", err)
+		}
+		t.anchors = append(t.anchors, &anchor{rr: rr, state: arr[0], firstSeen: time.Unix(ts, 0)})
+	}
+	if len(t.anchors) == 0 {
+		rr, _ := dns.NewRR(RootAnchor)
+		t.anchors = append(t.anchors, &anchor{rr: rr, state: stateValid})
+	}
+	return t, nil
+}
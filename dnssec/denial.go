@@ -0,0 +1,126 @@
+package dnssec
+
+import (
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// 按规范顺序（RFC 4034 6.1）比较两个域名：自右向左逐个比较小写标签
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// 判断NSEC记录是否覆盖name（name位于所有者名称与下一名称之间）
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) >= 0 { // 区域中的最后一条NSEC，下一名称为区域顶点
+		return canonicalCompare(name, owner) > 0 && dns.IsSubDomain(next, name)
+	}
+	return canonicalCompare(name, owner) > 0 && canonicalCompare(name, next) < 0
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// name与other共同的最长上级域名
+func commonAncestor(name, other string) string {
+	a, b := dns.SplitDomainName(strings.ToLower(name)), dns.SplitDomainName(strings.ToLower(other))
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return dns.Fqdn(strings.Join(a[len(a)-n:], "."))
+}
+
+// 判断NSEC记录是否证明name不存在及name处无qtype类型的记录（RFC 4035 5.4）
+func nsecDenies(name string, qtype uint16, nxdomain bool, nsecs []*dns.NSEC) bool {
+	for _, nsec := range nsecs {
+		if !nxdomain && strings.EqualFold(nsec.Hdr.Name, name) {
+			return !hasType(nsec.TypeBitMap, qtype) && !hasType(nsec.TypeBitMap, dns.TypeCNAME)
+		}
+	}
+	for _, nsec := range nsecs {
+		if !nsecCovers(nsec, name) {
+			continue
+		}
+		if !nxdomain { // 空的非终端名称：下一名称为name的下级域名
+			return dns.IsSubDomain(name, nsec.NextDomain)
+		}
+		// 最近的存在的上级域名处同样不能有通配符
+		encloser := commonAncestor(name, nsec.Hdr.Name)
+		if other := commonAncestor(name, nsec.NextDomain); dns.CountLabel(other) > dns.CountLabel(encloser) {
+			encloser = other
+		}
+		wildcard := "*." + encloser
+		for _, other := range nsecs {
+			if nsecCovers(other, wildcard) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 判断NSEC3记录是否证明name不存在及name处无qtype类型的记录（RFC 5155 8.4-8.6）
+func nsec3Denies(name string, qtype uint16, nxdomain bool, nsec3s []*dns.NSEC3) bool {
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(name) {
+				return !hasType(nsec3.TypeBitMap, qtype) && !hasType(nsec3.TypeBitMap, dns.TypeCNAME)
+			}
+		}
+	}
+	// 最近上级域名证明：存在匹配上级域名的记录，及覆盖其下一级名称的记录
+	matches := func(name string, cover bool) *dns.NSEC3 {
+		for _, nsec3 := range nsec3s {
+			if cover && nsec3.Cover(name) || !cover && nsec3.Match(name) {
+				return nsec3
+			}
+		}
+		return nil
+	}
+	labels := dns.SplitDomainName(name)
+	for i := 1; i < len(labels)+1; i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if matches(encloser, false) == nil {
+			continue
+		}
+		next := matches(dns.Fqdn(strings.Join(labels[i-1:], ".")), true)
+		if next == nil {
+			return false
+		}
+		if !nxdomain { // 仅DS查询可由opt-out证明
+			return qtype == dns.TypeDS && next.Flags&1 == 1
+		}
+		return matches("*."+encloser, true) != nil
+	}
+	return false
+}
+
+// 判断否定应答的授权部分是否证明了qname不存在（nxdomain）或qname处无qtype类型的记录
+func provesDenial(name string, qtype uint16, nxdomain bool, ns []dns.RR) bool {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return len(nsecs) > 0 && nsecDenies(name, qtype, nxdomain, nsecs) ||
+		len(nsec3s) > 0 && nsec3Denies(name, qtype, nxdomain, nsec3s)
+}
@@ -0,0 +1,416 @@
+package dnssec
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/cache"
+	"strings"
+	"time"
+)
+
+// 验证结果
+type Result int
+
+const (
+	Insecure Result = iota // 未签名且已证明无需签名
+	Secure                 // 签名链完整有效
+	Bogus                  // 签名无效或被剥离
+)
+
+func (r Result) String() string {
+	switch r {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// 向上游查询DNSKEY、DS记录的函数
+type Exchanger func(request *dns.Msg) (r *dns.Msg, err error)
+
+var errNoKey = errors.New("no valid DNSKEY")
+
+// DNSSEC验证器，从根区信任锚出发逐级验证签名链
+type Validator struct {
+	anchors  *TrustAnchors
+	exchange Exchanger
+	keyCache *cache.TTLMap // 已验证的区域DNSKEY集合
+	dsCache  *cache.TTLMap // 已验证的区域委派信息（*delegation）
+}
+
+// 区域在上级区域中的委派信息：已验证的DS记录，或已证明的未签名委派
+type delegation struct {
+	ds       []*dns.DS
+	insecure bool
+}
+
+// 按名称、类型对记录分组，忽略RRSIG记录
+func splitRRSets(rrs []dns.RR) (sets [][]dns.RR, sigs []*dns.RRSIG) {
+	index := map[string]int{}
+	for _, rr := range rrs {
+		switch rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, rr.(*dns.RRSIG))
+			continue
+		case *dns.OPT:
+			continue
+		}
+		hdr := rr.Header()
+		key := strings.ToLower(hdr.Name) + "/" + dns.TypeToString[hdr.Rrtype]
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+		} else {
+			index[key] = len(sets)
+			sets = append(sets, []dns.RR{rr})
+		}
+	}
+	return
+}
+
+// 查找覆盖目标记录集的签名
+func coveringSigs(rrset []dns.RR, sigs []*dns.RRSIG) (matched []*dns.RRSIG) {
+	hdr := rrset[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered == hdr.Rrtype && strings.EqualFold(sig.Header().Name, hdr.Name) {
+			matched = append(matched, sig)
+		}
+	}
+	return
+}
+
+// 使用给定密钥验证记录集签名
+func verifyWithKeys(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) error {
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if err := sig.Verify(key, rrset); err == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no valid signature for %s/%s", rrset[0].Header().Name,
+		dns.TypeToString[rrset[0].Header().Rrtype])
+}
+
+func (v *Validator) query(name string, qtype uint16) (r *dns.Msg, err error) {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	request.SetEdns0(4096, true)
+	request.CheckingDisabled = true
+	if r, err = v.exchange(request); err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("empty response for %s/%s", name, dns.TypeToString[qtype])
+	}
+	return r, nil
+}
+
+// 获取区域已验证的DNSKEY列表
+func (v *Validator) zoneKeys(zone string, depth int) (keys []*dns.DNSKEY, err error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if cached, ok := v.keyCache.Get(zone); ok {
+		return cached.([]*dns.DNSKEY), nil
+	}
+	if depth > 16 {
+		return nil, fmt.Errorf("chain of trust too long for %s", zone)
+	}
+	r, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	ttl := uint32(3600)
+	for _, rr := range r.Answer {
+		switch rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr.(*dns.DNSKEY))
+			rrset = append(rrset, rr)
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		case *dns.RRSIG:
+			sigs = append(sigs, rr.(*dns.RRSIG))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errNoKey
+	}
+	// 找到被信任锚或上级区域DS记录认可的密钥
+	var trusted []*dns.DNSKEY
+	now := time.Now()
+	if zone == "." {
+		for _, key := range keys {
+			if v.anchors.Trusted(key) {
+				trusted = append(trusted, key)
+			}
+		}
+	} else {
+		dsList, err := v.dsRecords(zone, depth)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			for _, ds := range dsList {
+				if kds := key.ToDS(ds.DigestType); kds != nil && kds.KeyTag == ds.KeyTag &&
+					strings.EqualFold(kds.Digest, ds.Digest) {
+					trusted = append(trusted, key)
+				}
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no trusted DNSKEY for %s", zone)
+	}
+	if err = verifyWithKeys(rrset, sigs, trusted, now); err != nil {
+		return nil, err
+	}
+	if zone == "." {
+		v.anchors.Observe(keys, now)
+	}
+	v.keyCache.Set(zone, keys, time.Duration(ttl)*time.Second)
+	return keys, nil
+}
+
+// 查询并验证区域的DS记录，无DS记录时验证否定应答并判断是否为未签名的委派。结果按记录的TTL缓存
+func (v *Validator) delegationOf(zone string, depth int) (*delegation, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if cached, ok := v.dsCache.Get(zone); ok {
+		return cached.(*delegation), nil
+	}
+	r, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	d, ttl := &delegation{}, uint32(3600)
+	sets, sigs := splitRRSets(r.Answer)
+	for _, rrset := range sets {
+		if _, ok := rrset[0].(*dns.DS); !ok {
+			continue
+		}
+		sig := coveringSigs(rrset, sigs)
+		if len(sig) == 0 {
+			return nil, fmt.Errorf("unsigned DS for %s", zone)
+		}
+		if err = v.verifyRRSet(rrset, sig, depth+1); err != nil {
+			return nil, err
+		}
+		for _, rr := range rrset {
+			d.ds = append(d.ds, rr.(*dns.DS))
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if len(d.ds) == 0 {
+		// 否定应答本身必须拥有有效签名
+		nsSets, nsSigs := splitRRSets(r.Ns)
+		var denial []dns.RR
+		for _, rrset := range nsSets {
+			switch rrset[0].(type) {
+			case *dns.NSEC, *dns.NSEC3:
+				if err = v.verifyRRSet(rrset, coveringSigs(rrset, nsSigs), depth+1); err != nil {
+					return nil, err
+				}
+				denial = append(denial, rrset...)
+			}
+			if rrset[0].Header().Ttl < ttl {
+				ttl = rrset[0].Header().Ttl
+			}
+		}
+		d.insecure = provesInsecure(zone, denial)
+	}
+	v.dsCache.Set(zone, d, time.Duration(ttl)*time.Second)
+	return d, nil
+}
+
+// 获取区域在上级区域中已验证的DS记录
+func (v *Validator) dsRecords(zone string, depth int) ([]*dns.DS, error) {
+	d, err := v.delegationOf(zone, depth)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.ds) == 0 {
+		return nil, fmt.Errorf("no DS for %s", zone)
+	}
+	return d.ds, nil
+}
+
+// 验证记录集的签名，签名者必须是记录所在区域或其上级区域
+func (v *Validator) verifyRRSet(rrset []dns.RR, sigs []*dns.RRSIG, depth int) (err error) {
+	name := rrset[0].Header().Name
+	for _, sig := range sigs {
+		signer := sig.SignerName
+		if !dns.IsSubDomain(signer, name) {
+			continue
+		}
+		if rrset[0].Header().Rrtype == dns.TypeDS && strings.EqualFold(signer, name) {
+			continue // DS记录必须由上级区域签名
+		}
+		var keys []*dns.DNSKEY
+		if keys, err = v.zoneKeys(signer, depth); err != nil {
+			continue
+		}
+		if err = verifyWithKeys(rrset, []*dns.RRSIG{sig}, keys, time.Now()); err == nil {
+			return nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no usable signature for %s", name)
+	}
+	return err
+}
+
+// 判断否定应答中的NSEC/NSEC3记录是否证明name处为未签名的委派
+func provesInsecure(name string, ns []dns.RR) bool {
+	for _, rr := range ns {
+		switch rr.(type) {
+		case *dns.NSEC:
+			nsec := rr.(*dns.NSEC)
+			if strings.EqualFold(nsec.Header().Name, name) &&
+				hasType(nsec.TypeBitMap, dns.TypeNS) && !hasType(nsec.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+		case *dns.NSEC3:
+			nsec3 := rr.(*dns.NSEC3)
+			if nsec3.Match(name) {
+				if hasType(nsec3.TypeBitMap, dns.TypeNS) && !hasType(nsec3.TypeBitMap, dns.TypeDS) {
+					return true
+				}
+			} else if nsec3.Cover(name) && nsec3.Flags&1 == 1 { // opt-out
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 对未签名的记录，自上而下检查name的各级上级域名，若存在已证明的未签名委派则视为Insecure
+func (v *Validator) checkUnsigned(name string) Result {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		d, err := v.delegationOf(strings.Join(labels[i:], "."), 0)
+		if err != nil {
+			return Bogus
+		}
+		if len(d.ds) > 0 {
+			continue // 该区域已签名，继续检查下一级
+		}
+		if d.insecure {
+			return Insecure
+		}
+	}
+	return Bogus
+}
+
+// 否定应答所否定的名称：应答部分的CNAME链的终点，无CNAME时为查询名称
+func deniedName(r *dns.Msg) string {
+	name := r.Question[0].Name
+	for i := 0; i < len(r.Answer); i++ {
+		for _, rr := range r.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				name = cname.Target
+				break
+			}
+		}
+	}
+	return name
+}
+
+// 验证响应中应答部分及授权部分的签名。已签名的否定应答（NXDOMAIN及无应答的NOERROR）须由NSEC/NSEC3记录
+// 证明名称或记录类型不存在，否则视为Bogus
+func (v *Validator) Validate(r *dns.Msg) (result Result, err error) {
+	if r == nil || len(r.Question) == 0 {
+		return Bogus, errors.New("empty response")
+	}
+	result, validated := Secure, 0
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		sets, sigs := splitRRSets(section)
+		for _, rrset := range sets {
+			matched := coveringSigs(rrset, sigs)
+			if _, ok := rrset[0].(*dns.NS); ok && len(matched) == 0 {
+				continue // 委派中的NS记录不签名
+			}
+			if len(matched) == 0 {
+				name := rrset[0].Header().Name
+				if v.checkUnsigned(name) == Bogus {
+					return Bogus, fmt.Errorf("missing signature for %s", name)
+				}
+				result = Insecure
+				continue
+			}
+			if err = v.verifyRRSet(rrset, matched, 0); err != nil {
+				return Bogus, err
+			}
+			validated++
+		}
+	}
+	if validated == 0 && result == Secure { // 无任何记录，需证明该域名无需签名
+		name := r.Question[0].Name
+		if v.checkUnsigned(name) == Bogus {
+			return Bogus, fmt.Errorf("missing signature for %s", name)
+		}
+		result = Insecure
+	}
+	nxdomain := r.Rcode == dns.RcodeNameError
+	if result == Secure && (nxdomain || r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0) {
+		name := deniedName(r)
+		if !provesDenial(name, r.Question[0].Qtype, nxdomain, r.Ns) {
+			return Bogus, fmt.Errorf("missing denial of existence for %s", name)
+		}
+	}
+	return result, nil
+}
+
+// 创建DNSSEC验证器
+func NewValidator(anchors *TrustAnchors, exchange Exchanger) *Validator {
+	return &Validator{anchors: anchors, exchange: exchange, keyCache: cache.NewTTLMap(time.Minute),
+		dsCache: cache.NewTTLMap(time.Minute)}
+}
+
+// 判断记录是否为DNSSEC相关记录
+func isDNSSECRecord(rr dns.RR) bool {
+	switch rr.Header().Rrtype {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+// 返回去掉RRSIG/NSEC/NSEC3记录的响应副本，用于回复未设置DO标志的客户端；无需修改时返回原响应
+func Strip(r *dns.Msg, qtype uint16) *dns.Msg {
+	if r == nil {
+		return r
+	}
+	found := false
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			if isDNSSECRecord(rr) && rr.Header().Rrtype != qtype {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return r
+	}
+	filter := func(rrs []dns.RR) (res []dns.RR) {
+		for _, rr := range rrs {
+			if !isDNSSECRecord(rr) || rr.Header().Rrtype == qtype {
+				res = append(res, rr)
+			}
+		}
+		return
+	}
+	r = r.Copy()
+	r.Answer, r.Ns = filter(r.Answer), filter(r.Ns)
+	return r
+}
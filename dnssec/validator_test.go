@@ -0,0 +1,165 @@
+package dnssec
+
+import (
+	"crypto"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(name string) *testZone {
+	key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+	priv, _ := key.Generate(256)
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(rrset ...dns.RR) []dns.RR {
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG,
+		Class: dns.ClassINET, Ttl: 3600}, Algorithm: z.key.Algorithm, SignerName: z.key.Hdr.Name,
+		KeyTag: z.key.KeyTag(), Inception: uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix())}
+	_ = sig.Sign(z.priv, rrset)
+	return append(rrset, sig)
+}
+
+func newRR(s string) dns.RR {
+	rr, _ := dns.NewRR(s)
+	return rr
+}
+
+// 构造根区、example.区及对应的模拟上游
+func newTestValidator(t *testing.T) (*Validator, *testZone, map[string][]dns.RR) {
+	root, child := newTestZone("."), newTestZone("example.")
+	data := map[string][]dns.RR{
+		"./DNSKEY":        root.sign(root.key),
+		"example./DS":     root.sign(child.key.ToDS(dns.SHA256)),
+		"example./DNSKEY": child.sign(child.key),
+	}
+	exchange := func(request *dns.Msg) (*dns.Msg, error) {
+		q := request.Question[0]
+		r := new(dns.Msg)
+		r.SetReply(request)
+		r.Answer = data[q.Name+"/"+dns.TypeToString[q.Qtype]]
+		return r, nil
+	}
+	filename := "go_test_trust_anchors"
+	_ = ioutil.WriteFile(filename, []byte("valid 0 "+root.key.ToDS(dns.SHA256).String()+"\n"), 0644)
+	anchors, err := NewTrustAnchors(filename)
+	_ = os.Remove(filename)
+	assert.Equal(t, err, nil)
+	return NewValidator(anchors, exchange), child, data
+}
+
+func TestValidate(t *testing.T) {
+	v, child, _ := newTestValidator(t)
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.", dns.TypeA)
+	// 签名有效
+	r.Answer = child.sign(newRR("www.example. 300 IN A 1.2.3.4"))
+	result, err := v.Validate(r)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, result, Secure)
+	// 记录被篡改
+	r.Answer[0].(*dns.A).A = newRR("www.example. 300 IN A 5.6.7.8").(*dns.A).A
+	result, err = v.Validate(r)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, result, Bogus)
+	// 签名被剥离
+	r.Answer = r.Answer[:1]
+	result, _ = v.Validate(r)
+	assert.Equal(t, result, Bogus)
+	// 非信任的签名者
+	other := newTestZone("example.")
+	r.Answer = other.sign(newRR("www.example. 300 IN A 1.2.3.4"))
+	result, _ = v.Validate(r)
+	assert.Equal(t, result, Bogus)
+}
+
+func TestValidateDenial(t *testing.T) {
+	v, child, data := newTestValidator(t)
+	soa := child.sign(newRR("example. 300 IN SOA ns.example. admin.example. 1 7200 3600 1209600 300"))
+	negative := func(name string, qtype uint16, rcode int, ns ...dns.RR) (Result, error) {
+		r := new(dns.Msg)
+		r.SetQuestion(name, qtype)
+		r.Rcode, r.Ns = rcode, append(append([]dns.RR{}, soa...), ns...)
+		return v.Validate(r)
+	}
+	// 缺少NSEC/NSEC3证明的否定应答
+	result, err := negative("none.example.", dns.TypeA, dns.RcodeNameError)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, result, Bogus)
+	// NSEC证明名称及通配符不存在
+	nsec := child.sign(newRR("example. 300 IN NSEC mail.example. SOA NS RRSIG NSEC DNSKEY"))
+	result, _ = negative("none.example.", dns.TypeA, dns.RcodeNameError, nsec...)
+	assert.Equal(t, result, Bogus) // none.example.不在example.与mail.example.之间
+	nsec = child.sign(newRR("mail.example. 300 IN NSEC www.example. A RRSIG NSEC"))
+	apex := child.sign(newRR("example. 300 IN NSEC mail.example. SOA NS RRSIG NSEC DNSKEY"))
+	result, err = negative("none.example.", dns.TypeA, dns.RcodeNameError, append(nsec, apex...)...)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, result, Secure)
+	result, _ = negative("none.example.", dns.TypeA, dns.RcodeNameError, nsec...)
+	assert.Equal(t, result, Bogus) // 未证明*.example.不存在
+	// NSEC证明记录类型不存在
+	result, _ = negative("mail.example.", dns.TypeAAAA, dns.RcodeSuccess, nsec...)
+	assert.Equal(t, result, Secure)
+	result, _ = negative("mail.example.", dns.TypeA, dns.RcodeSuccess, nsec...)
+	assert.Equal(t, result, Bogus)
+	// NSEC3最近上级域名证明
+	hash := dns.HashName("example.", dns.SHA1, 0, "")
+	nsec3 := child.sign(newRR("" + hash + ".example. 300 IN NSEC3 1 0 0 - " + hash + " SOA NS RRSIG DNSKEY NSEC3PARAM"))
+	result, err = negative("none.example.", dns.TypeA, dns.RcodeNameError, nsec3...)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, result, Secure)
+	result, _ = negative("example.", dns.TypeTXT, dns.RcodeSuccess, nsec3...)
+	assert.Equal(t, result, Secure)
+	result, _ = negative("example.", dns.TypeSOA, dns.RcodeSuccess, nsec3...)
+	assert.Equal(t, result, Bogus)
+	// DS记录在缓存期间不再查询
+	delete(data, "example./DS")
+	_, err = v.dsRecords("example.", 0)
+	assert.Equal(t, err, nil)
+}
+
+func TestStrip(t *testing.T) {
+	_, child, _ := newTestValidator(t)
+	r := new(dns.Msg)
+	r.Answer = child.sign(newRR("www.example. 300 IN A 1.2.3.4"))
+	stripped := Strip(r, dns.TypeA)
+	assert.Equal(t, len(stripped.Answer), 1)
+	assert.Equal(t, len(r.Answer), 2) // 原响应不变
+	assert.True(t, Strip(stripped, dns.TypeA) == stripped)
+	assert.Equal(t, len(Strip(r, dns.TypeRRSIG).Answer), 2)
+}
+
+func TestTrustAnchors(t *testing.T) {
+	anchors, err := NewTrustAnchors("")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(anchors.anchors), 1)
+	// 新密钥需等待HoldDown后才被信任
+	newKey := newTestZone(".").key
+	now := time.Now()
+	anchors.Observe([]*dns.DNSKEY{newKey}, now)
+	assert.False(t, anchors.Trusted(newKey))
+	anchors.Observe([]*dns.DNSKEY{newKey}, now.Add(HoldDown))
+	assert.True(t, anchors.Trusted(newKey))
+	// 撤销密钥
+	revoked := *newKey
+	revoked.Flags |= dns.REVOKE
+	anchors.Observe([]*dns.DNSKEY{&revoked}, now.Add(HoldDown))
+	assert.False(t, anchors.Trusted(newKey))
+	// 无效文件
+	filename := "go_test_trust_anchors"
+	_ = ioutil.WriteFile(filename, []byte("valid x . IN A 1.1.1.1"), 0644)
+	_, err = NewTrustAnchors(filename)
+	assert.NotEqual(t, err, nil)
+	_ = os.Remove(filename)
+}
@@ -0,0 +1,190 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 事件流中断后重新连接的间隔
+const retryInterval = 5 * time.Second
+
+// 容器列表接口返回的容器信息
+type container struct {
+	Names           []string
+	Labels          map[string]string
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string
+			GlobalIPv6Address string
+		}
+	}
+}
+
+// 通过Docker API解析容器名称及compose服务名称，如"web.docker"、"db.myproject.docker"。
+// 启动时读取容器列表，之后在容器启动、停止等事件发生时刷新
+type Reader struct {
+	socket string
+	suffix string
+	client *http.Client
+	reader atomic.Value // *hosts.TextReader
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// 获取hostname对应的ip地址，如不存在则返回空串
+func (r *Reader) IP(hostname string, ipv6 bool) string {
+	return r.textReader().IP(strings.ToLower(hostname), ipv6)
+}
+
+// 生成hostname对应的dns记录，如不存在则返回空串
+func (r *Reader) Record(hostname string, ipv6 bool) string {
+	return r.textReader().Record(strings.ToLower(hostname), ipv6)
+}
+
+// 获取ip对应的首个容器名称，如不存在则返回空串
+func (r *Reader) Hostname(ip string) string {
+	return r.textReader().Hostname(ip)
+}
+
+// 获取hostname的别名目标，容器名称无别名，总是返回空串
+func (r *Reader) CNAME(hostname string) string {
+	return ""
+}
+
+// 获取hostname的TXT记录内容，容器名称无TXT记录，总是返回nil
+func (r *Reader) TXT(hostname string) []string {
+	return nil
+}
+
+func (r *Reader) textReader() *hosts.TextReader {
+	return r.reader.Load().(*hosts.TextReader)
+}
+
+// 判断重载配置时能否复用该Reader
+func (r *Reader) Reusable(socket, suffix string) bool {
+	return r.socket == socket && r.suffix == strings.Trim(suffix, ".")
+}
+
+// 停止监听容器事件
+func (r *Reader) Close() {
+	r.cancel()
+}
+
+// 读取容器列表并生成hosts记录
+func (r *Reader) refresh() error {
+	req, _ := http.NewRequest(http.MethodGet, "http://docker/containers/json", nil)
+	resp, err := r.client.Do(req.WithContext(r.ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("list containers error: status %d", resp.StatusCode)
+	}
+	var containers []container
+	if err = json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return err
+	}
+	var lines []string
+	for _, c := range containers {
+		var names []string
+		for _, name := range c.Names {
+			names = append(names, strings.TrimPrefix(name, "/"))
+		}
+		if service := c.Labels["com.docker.compose.service"]; service != "" {
+			names = append(names, service)
+			if project := c.Labels["com.docker.compose.project"]; project != "" {
+				names = append(names, service+"."+project)
+			}
+		}
+		// 按网络名称排序，使用首个网络的地址
+		var networks []string
+		for network := range c.NetworkSettings.Networks {
+			networks = append(networks, network)
+		}
+		sort.Strings(networks)
+		var ipv4, ipv6 string
+		for _, network := range networks {
+			settings := c.NetworkSettings.Networks[network]
+			if ipv4 == "" {
+				ipv4 = settings.IPAddress
+			}
+			if ipv6 == "" {
+				ipv6 = settings.GlobalIPv6Address
+			}
+		}
+		for _, name := range names {
+			hostname := strings.ToLower(name + "." + r.suffix)
+			for _, ip := range []string{ipv4, ipv6} {
+				if ip != "" {
+					lines = append(lines, ip+" "+hostname)
+				}
+			}
+		}
+	}
+	r.reader.Store(hosts.NewTextReader(strings.Join(lines, "\n")))
+	return nil
+}
+
+// 监听容器事件，事件发生时刷新容器列表，事件流中断时重新连接
+func (r *Reader) watch() {
+	filters := url.QueryEscape(`{"type":["container"]}`)
+	for r.ctx.Err() == nil {
+		req, _ := http.NewRequest(http.MethodGet, "http://docker/events?filters="+filters, nil)
+		resp, err := r.client.Do(req.WithContext(r.ctx))
+		if err == nil {
+			// 重新连接期间可能遗漏事件
+			if err = r.refresh(); err != nil {
+				log.Printf("[ERROR] refresh docker containers error: %v\n", err)
+			}
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				var event struct{ Action string }
+				if err = decoder.Decode(&event); err != nil {
+					break
+				}
+				if strings.HasPrefix(event.Action, "exec_") || strings.HasPrefix(event.Action, "health_status") {
+					continue // 忽略不影响地址的事件
+				}
+				if err = r.refresh(); err != nil {
+					log.Printf("[ERROR] refresh docker containers error: %v\n", err)
+				}
+			}
+			_ = resp.Body.Close()
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		log.Printf("[ERROR] watch docker events error: %v\n", err)
+		select {
+		case <-r.ctx.Done():
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// 连接socket对应的Docker API，容器名称加上suffix后缀（如"docker"）作为域名
+func New(socket, suffix string) (r *Reader, err error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}}
+	r = &Reader{socket: socket, suffix: strings.Trim(suffix, "."), client: &http.Client{Transport: transport}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if err = r.refresh(); err != nil {
+		r.cancel()
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
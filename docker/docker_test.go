@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const containers = `[{"Names":["/web"],"Labels":{"com.docker.compose.service":"app","com.docker.compose.project":"blog"},
+"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2","GlobalIPv6Address":"fd00::2"}}}}]`
+
+func TestReader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "docker")
+	defer func() { _ = os.RemoveAll(dir) }()
+	socket := filepath.Join(dir, "docker.sock")
+	_, err := New(socket, "docker")
+	assert.NotEqual(t, err, nil)
+
+	var started int32
+	events := make(chan string)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/json":
+			if atomic.LoadInt32(&started) == 0 {
+				_, _ = w.Write([]byte(containers))
+			} else {
+				_, _ = w.Write([]byte(`[{"Names":["/db"],"NetworkSettings":{"Networks":{"br":{"IPAddress":"172.18.0.3"}}}}]`))
+			}
+		case "/events":
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case action := <-events:
+					_, _ = w.Write([]byte(`{"Type":"container","Action":"` + action + `"}` + "\n"))
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+	}))
+	server.Listener, _ = net.Listen("unix", socket)
+	server.Start()
+	defer server.Close()
+
+	r, err := New(socket, ".docker.")
+	assert.Equal(t, err, nil)
+	defer r.Close()
+	assert.Equal(t, r.IP("web.docker", false), "172.17.0.2")
+	assert.Equal(t, r.IP("WEB.docker", true), "fd00::2")
+	assert.Equal(t, r.Record("app.blog.docker", false), "app.blog.docker 0 IN A 172.17.0.2")
+	assert.Equal(t, r.IP("app.docker", false), "172.17.0.2")
+	assert.Equal(t, r.Hostname("172.17.0.2"), "web.docker")
+	assert.True(t, r.Reusable(socket, "docker"))
+	assert.False(t, r.Reusable(socket, "local"))
+	// 容器事件发生后刷新
+	atomic.StoreInt32(&started, 1)
+	events <- "start"
+	for i := 0; i < 100 && r.IP("db.docker", false) == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, r.IP("db.docker", false), "172.18.0.3")
+	assert.Equal(t, r.IP("web.docker", false), "")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DoH服务端（RFC 8484）：解析GET/POST请求中的DNS报文，交由handler处理。
+// 请求路径对应的组由配置中的doh_server.paths指定，为空时按分组规则及gfwlist确定；认证客户端指定的组优先
+type dohServer struct {
+	handler dns.Handler
+}
+
+func (s *dohServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c := currentConfig()
+	group, ok := c.DoHPaths[req.URL.Path]
+	var token string
+	if !ok { // "/dns-query/<token>"形式的路径
+		dir, id := path.Split(req.URL.Path)
+		if group, ok = c.DoHPaths[strings.TrimSuffix(dir, "/")]; !ok || id == "" {
+			http.NotFound(w, req)
+			return
+		}
+		token = id
+	}
+	if auth := req.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = auth[7:]
+	} else if _, password, ok := req.BasicAuth(); token == "" && ok {
+		token = password
+	}
+	writer := &dohWriter{local: req.Context().Value(http.LocalAddrContextKey), group: group}
+	if host, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		p, _ := strconv.Atoi(port)
+		writer.remote = &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+		// 经可信的反向代理转发时使用代理声明的客户端地址
+		if c.DoHProxies != nil && c.DoHProxies.Contain(writer.remote.(*net.TCPAddr).IP) {
+			if ip := forwardedIP(req, c.DoHProxies); ip != nil {
+				writer.remote = &net.TCPAddr{IP: ip}
+			}
+		}
+	}
+	if token != "" {
+		if writer.client = findDoHClient(c, token); writer.client == nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if writer.client.Networks != nil && !writer.client.Networks.Contain(remoteIP(writer)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if writer.client.Group != "" {
+			writer.group = writer.client.Group
+		}
+	} else if c.DoHAuth {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ts-dns"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var packet []byte
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+		packet, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packet, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	request := new(dns.Msg)
+	if err != nil || len(packet) == 0 || request.Unpack(packet) != nil || request.Response || len(request.Question) != 1 {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	s.handler.ServeDNS(writer, request)
+	if writer.msg == nil {
+		http.Error(w, "no response", http.StatusServiceUnavailable)
+		return
+	}
+	data, err := writer.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(httpMaxAge(writer.msg)), 10))
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(data)
+}
+
+// 响应的HTTP缓存时间（RFC 8484）：应答中的最小TTL；无应答时为authority部分SOA记录的TTL及MINIMUM中的较小值，
+// 无SOA记录（如SERVFAIL）时为0
+func httpMaxAge(r *dns.Msg) uint32 {
+	if len(r.Answer) > 0 {
+		minTTL := r.Answer[0].Header().Ttl
+		for _, rr := range r.Answer {
+			if rr.Header().Ttl < minTTL {
+				minTTL = rr.Header().Ttl
+			}
+		}
+		return minTTL
+	}
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl
+			}
+			return soa.Hdr.Ttl
+		}
+	}
+	return 0
+}
+
+// 按Forwarded（RFC 7239）或X-Forwarded-For请求头获取客户端地址：从右至左跳过可信的代理，取首个不可信的地址。
+// 请求头缺失或地址无效时返回nil
+func forwardedIP(req *http.Request, trusted *ipset.RamSet) net.IP {
+	var hops []string
+	if values := req.Header.Values("Forwarded"); len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+	} else {
+		hops = strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	}
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.Trim(strings.TrimSpace(hops[i]), `"`)
+		if host, _, err := net.SplitHostPort(hop); err == nil { // 可能带有端口，如"[2001:db8::1]:4711"
+			hop = host
+		}
+		if ip = net.ParseIP(strings.Trim(hop, "[]")); ip == nil || !trusted.Contain(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// 查找token对应的认证客户端
+func findDoHClient(c *config.Config, token string) *config.DoHClient {
+	for i, client := range c.DoHClients {
+		if subtle.ConstantTimeCompare([]byte(client.Token), []byte(token)) == 1 {
+			return &c.DoHClients[i]
+		}
+	}
+	return nil
+}
+
+// DoH请求的dns.ResponseWriter实现，记录响应供ServeHTTP写回。不支持TSIG
+type dohWriter struct {
+	local  interface{}
+	remote net.Addr
+	group  string            // 请求路径或认证客户端指定的组
+	client *config.DoHClient // 认证通过的客户端，为nil时未认证
+	msg    *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	addr, _ := w.local.(net.Addr)
+	return addr
+}
+func (w *dohWriter) RemoteAddr() net.Addr  { return w.remote }
+func (w *dohWriter) Close() error          { return nil }
+func (w *dohWriter) TsigStatus() error     { return dns.ErrSecret }
+func (w *dohWriter) TsigTimersOnly(_ bool) {}
+func (w *dohWriter) Hijack()               {}
+
+func (w *dohWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *dohWriter) Write(data []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = msg
+	return len(data), nil
+}
+
+// 启动DoH服务端并在开始监听后调用started，tlsConfig为nil（未指定证书及ACME域名）时使用HTTP，供反向代理转发
+func serveDoH(c *config.Config, tlsConfig *tls.Config, started func()) error {
+	srv := &http.Server{Addr: c.DoHListen, Handler: &dohServer{handler: &handler{}}, TLSConfig: tlsConfig}
+	log.Printf("[WARNING] Listen on %s/doh\n", c.DoHListen)
+	ln, err := net.Listen("tcp", c.DoHListen)
+	if err != nil {
+		return err
+	}
+	if started != nil {
+		started()
+	}
+	if tlsConfig == nil {
+		return srv.Serve(ln)
+	}
+	return srv.ServeTLS(ln, "", "")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDoHServer(t *testing.T) {
+	clean, stopClean := startUpstream(t, "1.1.1.1")
+	defer stopClean()
+	dirty, stopDirty := startUpstream(t, "2.2.2.2")
+	defer stopDirty()
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GroupMap: map[string]config.Group{
+		"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: clean}}},
+		"dirty": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: dirty}}},
+	}, DoHPaths: map[string]string{"/dns-query/clean": "clean", "/dns-query/dirty": "dirty"}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	server := httptest.NewServer(&dohServer{handler: &handler{}})
+	defer server.Close()
+
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 按请求路径选择组，结果写入该组的缓存分区
+	for i := 0; i < 2; i++ {
+		for path, ip := range map[string]string{"/dns-query/clean": "1.1.1.1", "/dns-query/dirty": "2.2.2.2"} {
+			caller := &outbound.DoHCaller{Url: server.URL + path}
+			r, err := caller.Call(request)
+			assert.Equal(t, err, nil)
+			if assert.True(t, r != nil && len(r.Answer) == 1) {
+				assert.Equal(t, r.Answer[0].(*dns.A).A.String(), ip)
+			}
+		}
+	}
+	assert.True(t, c.Cache.Get(request) == nil)
+	// GET请求
+	packed, _ := request.Pack()
+	resp, err := http.Get(server.URL + "/dns-query/dirty?dns=" + base64.RawURLEncoding.EncodeToString(packed))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Cache-Control"), "max-age=60")
+	_ = resp.Body.Close()
+	// 未配置的路径、无效请求
+	resp, _ = http.Get(server.URL + "/dns-query")
+	assert.Equal(t, resp.StatusCode, http.StatusNotFound)
+	resp, _ = http.Get(server.URL + "/dns-query/clean?dns=AAAA")
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+	resp, _ = http.Post(server.URL+"/dns-query/clean", "text/plain", nil)
+	assert.Equal(t, resp.StatusCode, http.StatusUnsupportedMediaType)
+}
+
+func TestDoHAuth(t *testing.T) {
+	clean, stopClean := startUpstream(t, "1.1.1.1")
+	defer stopClean()
+	dirty, stopDirty := startUpstream(t, "2.2.2.2")
+	defer stopDirty()
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GroupMap: map[string]config.Group{
+		"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: clean}}},
+		"dirty": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: dirty}}},
+	}, DoHPaths: map[string]string{"/dns-query": "clean"}, ACLAction: config.DenyRefused,
+		AllowedClients: ipset.NewRamSetByText("10.0.0.0/8"),
+		DoHClients: []config.DoHClient{{Name: "phone", Token: "secret", Group: "dirty"},
+			{Name: "laptop", Token: "remote", Networks: ipset.NewRamSetByText("10.0.0.0/8")}}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	server := httptest.NewServer(&dohServer{handler: &handler{}})
+	defer server.Close()
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	packed, _ := request.Pack()
+	query := func(path string, auth func(req *http.Request)) (int, *dns.Msg) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(packed))
+		req.Header.Set("Content-Type", "application/dns-message")
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := ioutil.ReadAll(resp.Body)
+		r := new(dns.Msg)
+		if r.Unpack(body) != nil {
+			r = nil
+		}
+		return resp.StatusCode, r
+	}
+	// 未认证的请求受allowed_clients限制
+	status, r := query("/dns-query", nil)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, r.Rcode, dns.RcodeRefused)
+	// 通过路径、Bearer token、Basic认证，并使用客户端指定的组
+	for _, auth := range []struct {
+		path string
+		auth func(req *http.Request)
+	}{
+		{"/dns-query/secret", nil},
+		{"/dns-query", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }},
+		{"/dns-query", func(req *http.Request) { req.SetBasicAuth("phone", "secret") }},
+	} {
+		status, r = query(auth.path, auth.auth)
+		assert.Equal(t, status, http.StatusOK)
+		if assert.True(t, r != nil && len(r.Answer) == 1) {
+			assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "2.2.2.2")
+		}
+	}
+	status, _ = query("/dns-query/invalid", nil)
+	assert.Equal(t, status, http.StatusUnauthorized)
+	status, _ = query("/dns-query/remote", nil) // 来源地址不在允许范围内
+	assert.Equal(t, status, http.StatusForbidden)
+	c.DoHAuth = true
+	status, _ = query("/dns-query", nil)
+	assert.Equal(t, status, http.StatusUnauthorized)
+}
+
+func TestDoHForwarded(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GroupMap: map[string]config.Group{
+		"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: addr}}},
+	}, DoHPaths: map[string]string{"/dns-query": "clean"}, ACLAction: config.DenyRefused,
+		AllowedClients: ipset.NewRamSetByText("10.0.0.0/8")}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	server := httptest.NewServer(&dohServer{handler: &handler{}})
+	defer server.Close()
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	packed, _ := request.Pack()
+	query := func(key, value string) *dns.Msg {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/dns-query", bytes.NewReader(packed))
+		req.Header.Set("Content-Type", "application/dns-message")
+		req.Header.Set(key, value)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Equal(t, err, nil)
+		defer func() { _ = resp.Body.Close() }()
+		body, _ := ioutil.ReadAll(resp.Body)
+		r := new(dns.Msg)
+		assert.Equal(t, r.Unpack(body), nil)
+		return r
+	}
+	// 未配置可信代理时忽略请求头
+	assert.Equal(t, query("X-Forwarded-For", "10.0.0.1").Rcode, dns.RcodeRefused)
+	c.DoHProxies = ipset.NewRamSetByText("127.0.0.1\n192.168.0.0/16")
+	assert.Equal(t, query("X-Forwarded-For", "10.0.0.1").Rcode, dns.RcodeSuccess)
+	assert.Equal(t, query("X-Forwarded-For", "10.0.0.1, 8.8.8.8, 192.168.1.1").Rcode, dns.RcodeRefused)
+	assert.Equal(t, query("Forwarded", `for="[2001:db8::1]:4711", for=10.0.0.1;proto=https`).Rcode,
+		dns.RcodeSuccess)
+	assert.Equal(t, query("Forwarded", "for=unknown").Rcode, dns.RcodeRefused)
+}
+
+func TestHTTPMaxAge(t *testing.T) {
+	r := new(dns.Msg)
+	assert.Equal(t, httpMaxAge(r), uint32(0))
+	soa, _ := dns.NewRR("cn. 600 IN SOA a.dns.cn. root.cnnic.cn. 1 7200 3600 2419200 300")
+	r.Ns = append(r.Ns, soa)
+	assert.Equal(t, httpMaxAge(r), uint32(300))
+	soa.(*dns.SOA).Minttl = 1200
+	assert.Equal(t, httpMaxAge(r), uint32(600))
+	rr, _ := dns.NewRR("ip.cn. 60 IN A 1.1.1.1")
+	r.Answer = append(r.Answer, rr)
+	assert.Equal(t, httpMaxAge(r), uint32(60))
+}
@@ -0,0 +1,103 @@
+package edns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// RFC 7873规定的客户端Cookie长度（字节）
+const ClientCookieLen = 8
+
+// 服务端Cookie的有效期
+const CookieLifetime = time.Hour
+
+// 获取消息中的Cookie，返回十六进制编码的客户端Cookie及服务端Cookie；无有效Cookie时ok为false
+func GetCookie(msg *dns.Msg) (client, server string, ok bool) {
+	option, _ := FindOption(msg, dns.EDNS0COOKIE).(*dns.EDNS0_COOKIE)
+	if option == nil {
+		return "", "", false
+	}
+	cookie := strings.ToLower(option.Cookie)
+	// 客户端Cookie固定8字节，服务端Cookie为8至32字节
+	if length := len(cookie) / 2; length != ClientCookieLen && (length < 16 || length > 40) {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(cookie); err != nil {
+		return "", "", false
+	}
+	return cookie[:ClientCookieLen*2], cookie[ClientCookieLen*2:], true
+}
+
+// 设置消息中的Cookie
+func SetCookie(msg *dns.Msg, client, server string) {
+	SetOption(msg, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + server})
+}
+
+// 生成随机的客户端Cookie
+func NewClientCookie() string {
+	buf := make([]byte, ClientCookieLen)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// 服务端Cookie生成器，Cookie格式为：版本(1) + 保留(3) + 时间戳(4) + HMAC(8)
+type CookieSecret struct {
+	secret []byte
+}
+
+func (s *CookieSecret) hash(client string, ip net.IP, header []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	raw, _ := hex.DecodeString(client)
+	mac.Write(raw)
+	mac.Write(header)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	mac.Write(ip)
+	return mac.Sum(nil)[:8]
+}
+
+// 为客户端Cookie及客户端地址生成服务端Cookie
+func (s *CookieSecret) ServerCookie(client string, ip net.IP, now time.Time) string {
+	header := make([]byte, 8)
+	header[0] = 1
+	binary.BigEndian.PutUint32(header[4:], uint32(now.Unix()))
+	return hex.EncodeToString(append(header, s.hash(client, ip, header)...))
+}
+
+// 判断服务端Cookie是否由本进程生成且未过期
+func (s *CookieSecret) Valid(client, server string, ip net.IP, now time.Time) bool {
+	raw, err := hex.DecodeString(server)
+	if err != nil || len(raw) != 16 || raw[0] != 1 {
+		return false
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint32(raw[4:8])), 0)
+	if now.Sub(ts) > CookieLifetime || ts.Sub(now) > 5*time.Minute {
+		return false
+	}
+	return hmac.Equal(raw[8:], s.hash(client, ip, raw[:8]))
+}
+
+// 生成使用指定密钥（十六进制编码，至少16字节）的服务端Cookie生成器，多台服务器共用密钥时可互相识别Cookie
+func ParseCookieSecret(text string) (*CookieSecret, error) {
+	secret, err := hex.DecodeString(text)
+	if err != nil || len(secret) < 16 {
+		return nil, fmt.Errorf("invalid cookie secret: require at least 16 bytes in hex")
+	}
+	return &CookieSecret{secret: secret}, nil
+}
+
+// 生成使用随机密钥的服务端Cookie生成器
+func NewCookieSecret() *CookieSecret {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return &CookieSecret{secret: secret}
+}
@@ -0,0 +1,97 @@
+package edns
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// EDNS0 option名称到option code的映射
+var optionCodes = map[string]uint16{
+	"LLQ": dns.EDNS0LLQ, "UL": dns.EDNS0UL, "NSID": dns.EDNS0NSID, "DAU": dns.EDNS0DAU,
+	"DHU": dns.EDNS0DHU, "N3U": dns.EDNS0N3U, "SUBNET": dns.EDNS0SUBNET, "EXPIRE": dns.EDNS0EXPIRE,
+	"COOKIE": dns.EDNS0COOKIE, "TCP-KEEPALIVE": dns.EDNS0TCPKEEPALIVE, "PADDING": dns.EDNS0PADDING,
+}
+
+// 解析EDNS0 option名称，支持"SUBNET"、"8"两种格式
+func ParseOptionCode(name string) (uint16, error) {
+	if code, ok := optionCodes[strings.ToUpper(name)]; ok {
+		return code, nil
+	}
+	code, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown edns option: %s", name)
+	}
+	return uint16(code), nil
+}
+
+// 移除消息中不在allow内的EDNS0 option，并将超过maxSize的UDP缓冲区大小限制为maxSize
+func Sanitize(msg *dns.Msg, allow map[uint16]bool, maxSize uint16) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		if allow[option.Option()] {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	if opt.UDPSize() > maxSize {
+		opt.SetUDPSize(maxSize)
+	}
+}
+
+// 获取消息中指定类型的EDNS0 option，不存在时返回nil
+func FindOption(msg *dns.Msg, code uint16) dns.EDNS0 {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == code {
+				return option
+			}
+		}
+	}
+	return nil
+}
+
+// 移除消息中指定类型的EDNS0 option，返回是否有option被移除
+func RemoveOption(msg *dns.Msg, code uint16) (removed bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		if option.Option() == code {
+			removed = true
+		} else {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	return
+}
+
+// 设置消息中的EDNS0 option，替换已有的同类option；消息中无OPT记录时自动添加
+func SetOption(msg *dns.Msg, option dns.EDNS0) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt = msg.IsEdns0()
+	}
+	RemoveOption(msg, option.Option())
+	opt.Option = append(opt.Option, option)
+}
+
+// 移除消息中的OPT记录
+func RemoveOPT(msg *dns.Msg) {
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,166 @@
+package edns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOption(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ip.cn.", dns.TypeA)
+	assert.True(t, FindOption(msg, dns.EDNS0NSID) == nil)
+	assert.False(t, RemoveOption(msg, dns.EDNS0NSID))
+	// 自动添加OPT记录
+	SetOption(msg, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	assert.True(t, FindOption(msg, dns.EDNS0NSID) != nil)
+	// 替换已有option
+	SetOption(msg, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "01"})
+	assert.Equal(t, len(msg.IsEdns0().Option), 1)
+	assert.True(t, RemoveOption(msg, dns.EDNS0NSID))
+	assert.Equal(t, len(msg.IsEdns0().Option), 0)
+	RemoveOPT(msg)
+	assert.True(t, msg.IsEdns0() == nil)
+}
+
+func TestCookie(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ip.cn.", dns.TypeA)
+	_, _, ok := GetCookie(msg)
+	assert.False(t, ok)
+	// 仅客户端Cookie
+	client := NewClientCookie()
+	SetCookie(msg, client, "")
+	c, s, ok := GetCookie(msg)
+	assert.True(t, ok)
+	assert.Equal(t, c, client)
+	assert.Equal(t, s, "")
+	// 无效长度
+	SetCookie(msg, client[:4], "")
+	_, _, ok = GetCookie(msg)
+	assert.False(t, ok)
+	// 服务端Cookie
+	secret, ip, now := NewCookieSecret(), net.ParseIP("192.168.1.1"), time.Now()
+	server := secret.ServerCookie(client, ip, now)
+	SetCookie(msg, client, server)
+	c, s, ok = GetCookie(msg)
+	assert.True(t, ok)
+	assert.True(t, secret.Valid(c, s, ip, now))
+	assert.False(t, secret.Valid(c, s, net.ParseIP("192.168.1.2"), now))
+	assert.False(t, secret.Valid(NewClientCookie(), s, ip, now))
+	assert.False(t, secret.Valid(c, s, ip, now.Add(2*CookieLifetime)))
+	assert.False(t, NewCookieSecret().Valid(c, s, ip, now))
+}
+
+func TestPad(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ip.cn.", dns.TypeA)
+	for i := 0; i < 2; i++ { // 重复填充时替换已有padding
+		assert.Equal(t, Pad(msg, QueryPaddingBlock), nil)
+		raw, _ := msg.Pack()
+		assert.Equal(t, len(raw)%QueryPaddingBlock, 0)
+	}
+	assert.Equal(t, len(msg.IsEdns0().Option), 1)
+}
+
+func TestSanitize(t *testing.T) {
+	code, err := ParseOptionCode("subnet")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, code, uint16(dns.EDNS0SUBNET))
+	code, _ = ParseOptionCode("65001")
+	assert.Equal(t, code, uint16(65001))
+	_, err = ParseOptionCode("unknown")
+	assert.NotEqual(t, err, nil)
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("ip.cn.", dns.TypeA)
+	Sanitize(msg, nil, dns.DefaultMsgSize) // 无OPT记录
+	msg.SetEdns0(65535, true)
+	SetOption(msg, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+	SetOption(msg, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, Address: net.ParseIP("1.2.3.0")})
+	Sanitize(msg, map[uint16]bool{dns.EDNS0SUBNET: true}, dns.DefaultMsgSize)
+	assert.True(t, FindOption(msg, dns.EDNS0NSID) == nil)
+	assert.True(t, FindOption(msg, dns.EDNS0SUBNET) != nil)
+	assert.Equal(t, msg.IsEdns0().UDPSize(), uint16(dns.DefaultMsgSize))
+	assert.True(t, msg.IsEdns0().Do())
+}
+
+func TestEchoSubnet(t *testing.T) {
+	request, r := new(dns.Msg), new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	r.SetReply(request)
+	// 本地应答的作用域前缀长度为0
+	SetOption(request, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		Address: net.ParseIP("1.2.3.0").To4()})
+	EchoSubnet(request, r)
+	assert.Equal(t, GetSubnet(r).Address.String(), "1.2.3.0")
+	assert.Equal(t, GetSubnet(r).SourceNetmask, uint8(24))
+	assert.Equal(t, GetSubnet(r).SourceScope, uint8(0))
+	// 保留上游响应的作用域前缀长度，地址为当前请求的地址
+	SetOption(r, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		SourceScope: 16, Address: net.ParseIP("5.6.7.0").To4()})
+	EchoSubnet(request, r)
+	assert.Equal(t, GetSubnet(r).Address.String(), "1.2.3.0")
+	assert.Equal(t, GetSubnet(r).SourceScope, uint8(16))
+	// 请求中无ECS时移除
+	RemoveOption(request, dns.EDNS0SUBNET)
+	EchoSubnet(request, r)
+	assert.True(t, GetSubnet(r) == nil)
+}
+
+func TestParseSubnet(t *testing.T) {
+	_, err := ParseSubnet("1.2.3.4")
+	assert.NotEqual(t, err, nil)
+	subnet, _ := ParseSubnet("1.2.3.4/24")
+	assert.Equal(t, subnet.Family, uint16(1))
+	assert.Equal(t, subnet.Address.String(), "1.2.3.0")
+	assert.Equal(t, subnet.SourceNetmask, uint8(24))
+	subnet, _ = ParseSubnet("2001:db8::1/48")
+	assert.Equal(t, subnet.Family, uint16(2))
+	assert.Equal(t, subnet.Address.String(), "2001:db8::")
+	// 由客户端地址派生，内网地址不派生
+	assert.Equal(t, ClientSubnet(net.ParseIP("8.8.4.4")).Address.String(), "8.8.4.0")
+	subnet = ClientSubnet(net.ParseIP("2400:3200::1:2"))
+	assert.Equal(t, subnet.Address.String(), "2400:3200::")
+	assert.Equal(t, subnet.SourceNetmask, uint8(DerivedMaskV6))
+	for _, ip := range []string{"192.168.1.2", "127.0.0.1", "fe80::1", "fd00::1"} {
+		assert.True(t, ClientSubnet(net.ParseIP(ip)) == nil)
+	}
+	assert.True(t, ClientSubnet(nil) == nil)
+}
+
+func TestKeepalive(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("ip.cn.", dns.TypeA)
+	_, ok, _ := GetKeepalive(msg)
+	assert.False(t, ok)
+	// 打包后重新解析
+	unpack := func(msg *dns.Msg) *dns.Msg {
+		buf, err := msg.Pack()
+		assert.Equal(t, err, nil)
+		r := new(dns.Msg)
+		assert.Equal(t, r.Unpack(buf), nil)
+		return r
+	}
+	SetKeepalive(msg, -1)
+	timeout, ok, err := GetKeepalive(unpack(msg))
+	assert.Equal(t, err, nil)
+	assert.True(t, ok)
+	assert.True(t, timeout < 0)
+	SetKeepalive(msg, 10*time.Second)
+	timeout, _, _ = GetKeepalive(unpack(msg))
+	assert.Equal(t, timeout, 10*time.Second)
+	SetKeepalive(msg, 24*time.Hour)
+	timeout, _, _ = GetKeepalive(unpack(msg))
+	assert.Equal(t, timeout, 0xffff*100*time.Millisecond)
+	// 长度错误
+	SetOption(msg, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{1}})
+	_, ok, err = GetKeepalive(msg)
+	assert.True(t, ok)
+	assert.NotEqual(t, err, nil)
+	SetOption(msg, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 5})
+	timeout, _, _ = GetKeepalive(msg)
+	assert.Equal(t, timeout, 500*time.Millisecond)
+}
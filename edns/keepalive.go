@@ -0,0 +1,50 @@
+package edns
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// edns-tcp-keepalive超时时间的单位（RFC 7828）
+const keepaliveUnit = 100 * time.Millisecond
+
+// 获取消息中的edns-tcp-keepalive option（RFC 7828），ok为false时消息不含该option；未携带超时时间时timeout小于0。
+// miekg/dns将收到的该option解析为EDNS0_TCP_KEEPALIVE，不区分未携带超时时间及超时时间为0，均视为未携带；设置时按EDNS0_LOCAL打包
+func GetKeepalive(msg *dns.Msg) (timeout time.Duration, ok bool, err error) {
+	var data []byte
+	switch option := FindOption(msg, dns.EDNS0TCPKEEPALIVE).(type) {
+	case nil:
+		return 0, false, nil
+	case *dns.EDNS0_LOCAL:
+		data = option.Data
+	case *dns.EDNS0_TCP_KEEPALIVE:
+		if option.Timeout == 0 {
+			return -1, true, nil
+		}
+		return time.Duration(option.Timeout) * keepaliveUnit, true, nil
+	}
+	switch len(data) {
+	case 0:
+		return -1, true, nil
+	case 2:
+		return time.Duration(binary.BigEndian.Uint16(data)) * keepaliveUnit, true, nil
+	default:
+		return 0, true, errors.New("invalid edns-tcp-keepalive length")
+	}
+}
+
+// 设置消息中的edns-tcp-keepalive option，timeout小于0时不携带超时时间；超时时间按100毫秒取整，最大为6553.5秒
+func SetKeepalive(msg *dns.Msg, timeout time.Duration) {
+	var data []byte
+	if timeout >= 0 {
+		units := timeout / keepaliveUnit
+		if units > 0xffff {
+			units = 0xffff
+		}
+		data = make([]byte, 2)
+		binary.BigEndian.PutUint16(data, uint16(units))
+	}
+	SetOption(msg, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data})
+}
@@ -0,0 +1,25 @@
+package edns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// RFC 8467推荐的请求及响应填充块大小
+const (
+	QueryPaddingBlock    = 128
+	ResponsePaddingBlock = 468
+)
+
+// 使用EDNS0 Padding（RFC 7830）将消息填充至block字节的整数倍，消息中无OPT记录时自动添加
+func Pad(msg *dns.Msg, block int) error {
+	padding := &dns.EDNS0_PADDING{Padding: []byte{}}
+	SetOption(msg, padding)
+	raw, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	if remain := len(raw) % block; remain > 0 {
+		padding.Padding = make([]byte, block-remain)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package edns
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// 获取消息中的ECS（RFC 7871），不存在时返回nil
+func GetSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	subnet, _ := FindOption(msg, dns.EDNS0SUBNET).(*dns.EDNS0_SUBNET)
+	return subnet
+}
+
+// 按请求中的ECS设置返回给客户端的响应：地址及源前缀长度与请求一致，作用域前缀长度取自上游响应，
+// 响应中无ECS（如本地应答、上游不支持ECS）时为0，表示结果适用于所有客户端。请求中无ECS时移除响应中的ECS
+func EchoSubnet(request, r *dns.Msg) {
+	query := GetSubnet(request)
+	if query == nil {
+		RemoveOption(r, dns.EDNS0SUBNET)
+		return
+	}
+	echo := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: query.Family,
+		SourceNetmask: query.SourceNetmask, Address: query.Address}
+	if answer := GetSubnet(r); answer != nil && answer.Family == query.Family {
+		echo.SourceScope = answer.SourceScope
+	}
+	SetOption(r, echo)
+}
+
+// 请求中的ECS由客户端地址派生时携带的标记（位于本地/实验用途范围），仅在本服务器内部使用，不转发至上游
+const DerivedSubnet uint16 = 65054
+
+// 派生ECS时使用的源前缀长度（RFC 7871建议值）
+const (
+	DerivedMaskV4 = 24
+	DerivedMaskV6 = 56
+)
+
+// 解析"地址/前缀长度"格式的子网为ECS，地址按前缀长度截取
+func ParseSubnet(cidr string) (*dns.EDNS0_SUBNET, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, _ := ipNet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(ones), Address: ipNet.IP}
+	if ip := ipNet.IP.To4(); ip != nil {
+		subnet.Family, subnet.Address = 1, ip
+	} else {
+		subnet.Family = 2
+	}
+	return subnet, nil
+}
+
+// 由客户端地址派生ECS，ipv4取/24，ipv6取/56。内网、环回等非公网地址返回nil，避免向上游泄露无意义的地址
+func ClientSubnet(ip net.IP) *dns.EDNS0_SUBNET {
+	if ip == nil || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: DerivedMaskV4,
+			Address: ip4.Mask(net.CIDRMask(DerivedMaskV4, 32))}
+	}
+	return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 2, SourceNetmask: DerivedMaskV6,
+		Address: ip.Mask(net.CIDRMask(DerivedMaskV6, 128))}
+}
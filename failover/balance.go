@@ -0,0 +1,152 @@
+package failover
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 组内上游的选择策略
+const (
+	Sequential     = "sequential"      // 按配置顺序
+	RoundRobin     = "round_robin"     // 轮流作为首选
+	Fastest        = "fastest"         // 按平均延迟从低到高
+	RandomWeighted = "random-weighted" // 按权重随机排序
+)
+
+// 上游连续失败后的退避时间，每次失败翻倍，不超过maxBackoff
+const (
+	minBackoff = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// 单个上游的统计
+type upstreamStat struct {
+	latency  time.Duration // 成功查询延迟的指数加权移动平均，为0时尚未测得
+	failures int           // 连续失败次数
+	retryAt  time.Time     // 退避结束的时间
+	weight   int
+}
+
+// 组内上游的被动健康检查及选择策略：按策略排列上游，连续失败的上游在指数退避期间排在最后
+type Balancer struct {
+	policy string
+	mux    sync.Mutex
+	stats  []upstreamStat
+	next   int // round_robin下次的首选上游
+	rand   *rand.Rand
+}
+
+// 判断选择策略是否受支持
+func ValidPolicy(policy string) bool {
+	switch policy {
+	case Sequential, RoundRobin, Fastest, RandomWeighted:
+		return true
+	}
+	return false
+}
+
+// 创建n个上游的Balancer，weights为random-weighted策略下各上游的权重，未指定的上游权重为1
+func NewBalancer(policy string, n int, weights []int) (*Balancer, error) {
+	if policy == "" {
+		policy = Sequential
+	}
+	if !ValidPolicy(policy) {
+		return nil, fmt.Errorf("unknown policy: %s", policy)
+	}
+	if len(weights) > n {
+		return nil, fmt.Errorf("invalid weights: %d weights for %d upstreams", len(weights), n)
+	}
+	b := &Balancer{policy: policy, stats: make([]upstreamStat, n),
+		rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for i := range b.stats {
+		b.stats[i].weight = 1
+		if i < len(weights) {
+			if weights[i] <= 0 {
+				return nil, fmt.Errorf("invalid weight: %d", weights[i])
+			}
+			b.stats[i].weight = weights[i]
+		}
+	}
+	return b, nil
+}
+
+// 返回本次查询依次尝试的上游下标。退避中的上游排在最后，全部处于退避时仍会依次尝试。b为nil时按配置顺序
+func (b *Balancer) Order(n int, now time.Time) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	if b == nil || n != len(b.stats) {
+		return order
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	switch b.policy {
+	case RoundRobin:
+		for i := range order {
+			order[i] = (b.next + i) % n
+		}
+		b.next = (b.next + 1) % n
+	case Fastest: // 尚未测得延迟的上游优先，以便获取其延迟
+		sort.SliceStable(order, func(i, j int) bool {
+			return b.stats[order[i]].latency < b.stats[order[j]].latency
+		})
+	case RandomWeighted: // 按权重不放回地随机抽取
+		total := 0
+		for _, stat := range b.stats {
+			total += stat.weight
+		}
+		for i := range order {
+			pick := b.rand.Intn(total)
+			for j := i; j < n; j++ {
+				if pick -= b.stats[order[j]].weight; pick < 0 {
+					order[i], order[j] = order[j], order[i]
+					break
+				}
+			}
+			total -= b.stats[order[i]].weight
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return !now.Before(b.stats[order[i]].retryAt) && now.Before(b.stats[order[j]].retryAt)
+	})
+	return order
+}
+
+// 记录上游i的查询结果及耗时
+func (b *Balancer) Report(i int, ok bool, latency time.Duration, now time.Time) {
+	if b == nil || i >= len(b.stats) {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	stat := &b.stats[i]
+	if !ok {
+		backoff := maxBackoff
+		if stat.failures < 6 && minBackoff<<uint(stat.failures) < maxBackoff {
+			backoff = minBackoff << uint(stat.failures)
+		}
+		stat.failures++
+		stat.retryAt = now.Add(backoff)
+		return
+	}
+	stat.failures, stat.retryAt = 0, time.Time{}
+	if stat.latency == 0 {
+		stat.latency = latency
+	} else {
+		stat.latency = (stat.latency*7 + latency) / 8
+	}
+}
+
+// 返回上游i的平均延迟（为0时尚未测得）及连续失败次数
+func (b *Balancer) Stat(i int) (latency time.Duration, failures int) {
+	if b == nil || i >= len(b.stats) {
+		return 0, 0
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.stats[i].latency, b.stats[i].failures
+}
@@ -0,0 +1,65 @@
+package failover
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBalancer(t *testing.T) {
+	var nilBalancer *Balancer
+	now := time.Now()
+	assert.Equal(t, nilBalancer.Order(3, now), []int{0, 1, 2})
+	nilBalancer.Report(0, false, 0, now)
+	_, err := NewBalancer("unknown", 2, nil)
+	assert.NotEqual(t, err, nil)
+	_, err = NewBalancer(RandomWeighted, 2, []int{1, 2, 3})
+	assert.NotEqual(t, err, nil)
+	_, err = NewBalancer(RandomWeighted, 2, []int{0})
+	assert.NotEqual(t, err, nil)
+
+	// 顺序策略下失败的上游在退避期间排在最后，退避结束或查询成功后恢复
+	b, err := NewBalancer("", 3, nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, b.Order(3, now), []int{0, 1, 2})
+	b.Report(0, false, time.Second, now)
+	assert.Equal(t, b.Order(3, now), []int{1, 2, 0})
+	assert.Equal(t, b.Order(3, now.Add(minBackoff)), []int{0, 1, 2})
+	b.Report(0, false, time.Second, now) // 连续失败时退避时间翻倍
+	assert.Equal(t, b.Order(3, now.Add(minBackoff)), []int{1, 2, 0})
+	_, failures := b.Stat(0)
+	assert.Equal(t, failures, 2)
+	b.Report(0, true, time.Millisecond, now)
+	assert.Equal(t, b.Order(3, now), []int{0, 1, 2})
+	// 所有上游均在退避时仍依次尝试
+	for i := 0; i < 3; i++ {
+		b.Report(i, false, 0, now)
+	}
+	assert.Equal(t, len(b.Order(3, now)), 3)
+
+	b, _ = NewBalancer(RoundRobin, 3, nil)
+	assert.Equal(t, b.Order(3, now), []int{0, 1, 2})
+	assert.Equal(t, b.Order(3, now), []int{1, 2, 0})
+	assert.Equal(t, b.Order(3, now), []int{2, 0, 1})
+
+	// 尚未测得延迟的上游优先，其余按平均延迟排序
+	b, _ = NewBalancer(Fastest, 3, nil)
+	b.Report(0, true, 30*time.Millisecond, now)
+	b.Report(1, true, 10*time.Millisecond, now)
+	assert.Equal(t, b.Order(3, now), []int{2, 1, 0})
+	b.Report(2, true, 20*time.Millisecond, now)
+	assert.Equal(t, b.Order(3, now), []int{1, 2, 0})
+	latency, _ := b.Stat(1)
+	assert.Equal(t, latency, 10*time.Millisecond)
+
+	// 按权重随机选择首选上游
+	b, _ = NewBalancer(RandomWeighted, 2, []int{9})
+	first := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		order := b.Order(2, now)
+		assert.Equal(t, len(order), 2)
+		first[order[0]]++
+	}
+	assert.True(t, first[0] > first[1]*3)
+	assert.True(t, first[1] > 0)
+}
@@ -0,0 +1,72 @@
+package failover
+
+import (
+	"sync"
+	"time"
+)
+
+// 分组的可用状态：连续threshold次查询均无有效响应时视为不可用，由备用组代为解析；
+// 不可用期间每隔probe放行一次查询作为探测，探测成功后恢复可用
+type State struct {
+	Name      string // 分组名称，用于输出日志
+	threshold int
+	probe     time.Duration
+
+	mux      sync.Mutex
+	failures int       // 连续失败次数
+	down     bool      // 是否不可用
+	probeAt  time.Time // 不可用时下次放行探测查询的时间
+}
+
+// 判断是否向该组发送查询：可用时总是返回true，不可用时每个探测周期仅返回一次true
+func (s *State) Available(now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !s.down {
+		return true
+	}
+	if now.Before(s.probeAt) {
+		return false
+	}
+	s.probeAt = now.Add(s.probe)
+	return true
+}
+
+// 记录一次查询结果，返回可用状态是否因此改变
+func (s *State) Report(ok bool, now time.Time) (changed bool) {
+	if s == nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if ok {
+		changed, s.failures, s.down = s.down, 0, false
+		return changed
+	}
+	if s.failures++; s.failures >= s.threshold && !s.down {
+		s.down, s.probeAt = true, now.Add(s.probe)
+		return true
+	}
+	return false
+}
+
+// 返回该组当前是否不可用
+func (s *State) Down() bool {
+	if s == nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.down
+}
+
+// 创建分组name的可用状态，threshold为判定不可用的连续失败次数，probe为不可用期间的探测间隔
+func New(name string, threshold int, probe time.Duration) *State {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &State{Name: name, threshold: threshold, probe: probe}
+}
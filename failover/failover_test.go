@@ -0,0 +1,35 @@
+package failover
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	var nilState *State
+	assert.True(t, nilState.Available(time.Now()))
+	assert.False(t, nilState.Report(false, time.Now()))
+	assert.False(t, nilState.Down())
+
+	s, now := New("vpn", 2, time.Minute), time.Now()
+	assert.False(t, s.Report(false, now))
+	assert.True(t, s.Available(now))
+	// 连续失败达到阈值时不可用
+	assert.True(t, s.Report(false, now))
+	assert.True(t, s.Down())
+	assert.False(t, s.Available(now))
+	// 到达探测时间时仅放行一次
+	now = now.Add(time.Minute)
+	assert.True(t, s.Available(now))
+	assert.False(t, s.Available(now))
+	// 探测失败时保持不可用
+	assert.False(t, s.Report(false, now))
+	assert.False(t, s.Available(now.Add(time.Second)))
+	// 探测成功后恢复
+	assert.True(t, s.Available(now.Add(time.Minute)))
+	assert.True(t, s.Report(true, now.Add(time.Minute)))
+	assert.False(t, s.Down())
+	assert.True(t, s.Available(now.Add(time.Minute)))
+	assert.False(t, s.Report(true, now))
+}
@@ -0,0 +1,248 @@
+package fakeip
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 虚假ip地址池（同clash的fake-ip模式）：为域名分配保留网段内的地址并记录映射，
+// 透明代理可根据连接的目标地址反查域名后按域名转发，客户端无需等待真实的解析结果
+type Pool struct {
+	mux    sync.Mutex
+	ipNet  *net.IPNet
+	base   uint32 // 首个可分配地址
+	size   uint32 // 可分配地址数量，不含网络地址及广播地址
+	next   uint32 // 下一个从未分配过的地址偏移
+	expire time.Duration
+	byName map[string]*entry
+	byIP   map[uint32]*entry
+	lru    *list.List // 按最近使用时间排列的映射，表头为最久未使用
+	file   string
+	dirty  bool // 映射在上次保存后是否有变化
+	done   chan struct{}
+	closer sync.Once
+}
+
+type entry struct {
+	name string
+	ip   uint32
+	used time.Time // 最近一次分配或反查的时间
+	elem *list.Element
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// 判断地址池是否可沿用于网段为cidr、映射文件为file的配置
+func (p *Pool) Reusable(cidr, file string) bool {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return err == nil && ipNet.String() == p.ipNet.String() && file == p.file
+}
+
+// 修改映射的过期时间
+func (p *Pool) SetExpire(expire time.Duration) {
+	p.mux.Lock()
+	p.expire = expire
+	p.mux.Unlock()
+}
+
+// 判断ip是否属于地址池网段
+func (p *Pool) Contains(ip net.IP) bool {
+	return ip.To4() != nil && p.ipNet.Contains(ip)
+}
+
+// 获取域名对应的虚假ip，未分配时优先使用空闲地址，地址池已满时回收最久未使用（含已过期）的地址
+func (p *Pool) Lookup(name string) net.IP {
+	name = dns.Fqdn(strings.ToLower(name))
+	now := time.Now()
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if e, ok := p.byName[name]; ok {
+		p.touch(e, now)
+		return uintToIP(e.ip)
+	}
+	var ip uint32
+	for ; p.next < p.size; p.next++ {
+		if _, ok := p.byIP[p.base+p.next]; !ok {
+			break
+		}
+	}
+	if p.next < p.size {
+		ip = p.base + p.next
+		p.next++
+	} else {
+		victim := p.lru.Remove(p.lru.Front()).(*entry)
+		delete(p.byName, victim.name)
+		ip = victim.ip
+	}
+	p.add(&entry{name: name, ip: ip, used: now})
+	p.dirty = true
+	return uintToIP(ip)
+}
+
+// 记录映射，调用方需持有锁
+func (p *Pool) add(e *entry) {
+	p.byName[e.name], p.byIP[e.ip] = e, e
+	e.elem = p.lru.PushBack(e)
+}
+
+// 更新映射的最近使用时间，调用方需持有锁
+func (p *Pool) touch(e *entry, now time.Time) {
+	e.used = now
+	p.lru.MoveToBack(e.elem)
+}
+
+// 反查虚假ip对应的域名，映射不存在或已过期时返回false
+func (p *Pool) Domain(ip net.IP) (string, bool) {
+	if !p.Contains(ip) {
+		return "", false
+	}
+	now := time.Now()
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	e, ok := p.byIP[ipToUint(ip)]
+	if !ok || now.Sub(e.used) > p.expire {
+		return "", false
+	}
+	p.touch(e, now)
+	return e.name, true
+}
+
+// 将未过期的映射写入文件，每行格式为"ip 域名 最近使用时间（unix时间戳）"，可供代理程序读取
+func (p *Pool) Save() error {
+	if p.file == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	now := time.Now()
+	p.mux.Lock()
+	for _, e := range p.byIP {
+		if now.Sub(e.used) <= p.expire {
+			_, _ = fmt.Fprintf(&buf, "%s %s %d\n", uintToIP(e.ip), e.name, e.used.Unix())
+		}
+	}
+	p.dirty = false
+	p.mux.Unlock()
+	tmp := p.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.file)
+}
+
+// 从文件恢复映射，跳过格式错误、不属于地址池网段及已过期的行
+func (p *Pool) load() error {
+	raw, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var entries []*entry
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		ip, name := net.ParseIP(fields[0]), fields[1]
+		sec, err := strconv.ParseInt(fields[2], 10, 64)
+		if ip == nil || err != nil || !p.Contains(ip) {
+			continue
+		}
+		n := ipToUint(ip)
+		if n < p.base || n >= p.base+p.size || now.Sub(time.Unix(sec, 0)) > p.expire {
+			continue
+		}
+		entries = append(entries, &entry{name: name, ip: n, used: time.Unix(sec, 0)})
+	}
+	// 按使用时间顺序写入，同一地址或域名以最近使用的为准
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	for _, e := range entries {
+		if old, ok := p.byIP[e.ip]; ok {
+			p.remove(old)
+		}
+		if old, ok := p.byName[e.name]; ok {
+			p.remove(old)
+		}
+		p.add(e)
+	}
+	return scanner.Err()
+}
+
+// 删除映射，调用方需持有锁
+func (p *Pool) remove(e *entry) {
+	delete(p.byName, e.name)
+	delete(p.byIP, e.ip)
+	p.lru.Remove(e.elem)
+}
+
+// 定时保存有变化的映射
+func (p *Pool) saveLoop(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		p.mux.Lock()
+		dirty := p.dirty
+		p.mux.Unlock()
+		if dirty {
+			if err := p.Save(); err != nil {
+				log.Printf("[ERROR] save fake ip mapping error: %v\n", err)
+			}
+		}
+	}
+}
+
+// 停止定时保存，配置重载后不再使用的地址池需调用
+func (p *Pool) Close() {
+	if p != nil {
+		p.closer.Do(func() { close(p.done) })
+	}
+}
+
+// 创建虚假ip地址池。cidr为ipv4保留网段，expire为映射的过期时间（期间未被使用的地址可被回收），
+// file不为空时从中恢复映射并每分钟保存
+func NewPool(cidr string, expire time.Duration, file string) (*Pool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits != 8*net.IPv4len || ones < 8 || ones > 30 {
+		return nil, fmt.Errorf("invalid fake ip range: %s", cidr)
+	}
+	p := &Pool{ipNet: ipNet, base: ipToUint(ipNet.IP) + 1, size: 1<<uint(bits-ones) - 2,
+		expire: expire, byName: map[string]*entry{}, byIP: map[uint32]*entry{}, lru: list.New(),
+		file: file, done: make(chan struct{})}
+	if file != "" {
+		if err = p.load(); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARNING] load fake ip mapping error: %v\n", err)
+		}
+		go p.saveLoop(time.Minute)
+	}
+	return p, nil
+}
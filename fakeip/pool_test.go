@@ -0,0 +1,77 @@
+package fakeip
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	_, err := NewPool("198.18.0.0/31", time.Hour, "")
+	assert.NotEqual(t, err, nil)
+	_, err = NewPool("fc00::/64", time.Hour, "")
+	assert.NotEqual(t, err, nil)
+
+	p, err := NewPool("198.18.0.0/30", time.Hour, "")
+	assert.Equal(t, err, nil)
+	ip1 := p.Lookup("ip.cn")
+	assert.Equal(t, ip1.String(), "198.18.0.1")
+	assert.Equal(t, p.Lookup("IP.CN.").String(), "198.18.0.1") // 同一域名复用地址
+	ip2 := p.Lookup("example.com.")
+	assert.Equal(t, ip2.String(), "198.18.0.2")
+	name, ok := p.Domain(ip1)
+	assert.True(t, ok)
+	assert.Equal(t, name, "ip.cn.")
+	_, ok = p.Domain(net.ParseIP("198.18.0.3"))
+	assert.False(t, ok)
+	assert.False(t, p.Contains(net.ParseIP("198.19.0.1")))
+	// 地址池已满时回收最久未使用的地址
+	time.Sleep(time.Millisecond)
+	_, _ = p.Domain(ip1)
+	assert.Equal(t, p.Lookup("example.org.").String(), "198.18.0.2")
+	_, ok = p.Domain(ip1)
+	assert.True(t, ok)
+	// 过期的映射不再反查，地址按最久未使用的顺序重新分配
+	p.SetExpire(time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	_, ok = p.Domain(ip1)
+	assert.False(t, ok)
+	assert.Equal(t, p.Lookup("example.net.").String(), "198.18.0.2")
+	assert.Equal(t, p.Lookup("example.edu.").String(), "198.18.0.1")
+	p.Close()
+	p.Close()
+	(*Pool)(nil).Close()
+}
+
+func TestPoolPersist(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fakeip")
+	defer func() { _ = os.RemoveAll(dir) }()
+	file := filepath.Join(dir, "fakeip.txt")
+	p, _ := NewPool("198.18.0.0/15", time.Hour, file)
+	ip := p.Lookup("ip.cn.")
+	assert.Equal(t, p.Save(), nil)
+	assert.True(t, p.Reusable("198.18.0.1/15", file))
+	assert.False(t, p.Reusable("198.18.0.0/16", file))
+	// 从文件恢复映射，新域名不占用已恢复的地址
+	p, _ = NewPool("198.18.0.0/15", time.Hour, file)
+	name, ok := p.Domain(ip)
+	assert.True(t, ok)
+	assert.Equal(t, name, "ip.cn.")
+	assert.Equal(t, p.Lookup("ip.cn.").String(), ip.String())
+	assert.NotEqual(t, p.Lookup("example.com.").String(), ip.String())
+	// 已满时回收恢复的映射中最久未使用的地址
+	_ = ioutil.WriteFile(file, []byte("198.18.0.2 b.com. 200\n198.18.0.1 a.com. 100\n"), 0644)
+	p, _ = NewPool("198.18.0.0/30", time.Hour*1e6, file)
+	assert.Equal(t, p.Lookup("c.com.").String(), "198.18.0.1")
+	name, _ = p.Domain(net.ParseIP("198.18.0.2"))
+	assert.Equal(t, name, "b.com.")
+	p.Close()
+	// 网段变化时忽略不属于新网段的映射
+	p, _ = NewPool("10.0.0.0/8", time.Hour, file)
+	_, ok = p.Domain(ip)
+	assert.False(t, ok)
+}
@@ -0,0 +1,305 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+)
+
+// 元数据区之前的标记，位于文件末尾128KiB内
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errInvalid = errors.New("invalid mmdb data")
+
+// MaxMind DB格式（.mmdb，如GeoLite2-Country）的ip地理位置数据库，仅用于查询ip所属的国家/地区代码
+type DB struct {
+	tree       []byte // 搜索树
+	data       decoder
+	nodeCount  uint
+	recordSize uint // 每条记录的比特数，可为24/28/32
+	ipVersion  uint
+	ipv4Start  uint // ipv6数据库中ipv4地址（::/96）对应的节点
+	mux        sync.Mutex
+	codes      map[uint]string // 数据偏移到国家/地区代码的缓存，不同记录的数量很少
+}
+
+// 判断内容是否为mmdb格式
+func IsMMDB(raw []byte) bool {
+	return bytes.Contains(raw, metadataMarker)
+}
+
+// 从内存中的mmdb内容创建数据库
+func New(raw []byte) (*DB, error) {
+	i := bytes.LastIndex(raw, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid mmdb: metadata not found")
+	}
+	value, _, err := decoder(raw[i+len(metadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mmdb metadata: %v", err)
+	}
+	meta, _ := value.(map[string]interface{})
+	db := &DB{codes: map[uint]string{}}
+	for _, field := range []struct {
+		name  string
+		value *uint
+	}{{"node_count", &db.nodeCount}, {"record_size", &db.recordSize}, {"ip_version", &db.ipVersion}} {
+		v, ok := meta[field.name].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("invalid mmdb metadata: %s not found", field.name)
+		}
+		*field.value = uint(v)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported mmdb record size: %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported mmdb ip version: %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) { // 搜索树与数据区之间有16字节的分隔
+		return nil, errors.New("invalid mmdb: search tree out of range")
+	}
+	db.tree, db.data = raw[:treeSize], decoder(raw[treeSize+16:i])
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// 读取mmdb文件
+func Open(filename string) (*DB, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return New(raw)
+}
+
+// 读取节点的左（bit为0）或右记录
+func (db *DB) record(node, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// 在搜索树中查找ip，返回对应记录在数据区中的偏移，未收录时ok为false
+func (db *DB) lookup(ip net.IP) (offset uint, ok bool, err error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if ip = ip.To16(); ip == nil || db.ipVersion == 4 {
+		return 0, false, nil
+	}
+	for i := 0; i < bits && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i>>3]>>(7-uint(i&7)))&1)
+	}
+	switch {
+	case node == db.nodeCount:
+		return 0, false, nil
+	case node > db.nodeCount:
+		if offset = node - db.nodeCount - 16; offset >= uint(len(db.data)) {
+			return 0, false, errInvalid
+		}
+		return offset, true, nil
+	}
+	return 0, false, errInvalid
+}
+
+// 查询ip所属的国家/地区代码（如"CN"），无country字段时使用registered_country，未收录时返回空字符串
+func (db *DB) Country(ip net.IP) (string, error) {
+	offset, ok, err := db.lookup(ip)
+	if !ok {
+		return "", err
+	}
+	db.mux.Lock()
+	code, ok := db.codes[offset]
+	db.mux.Unlock()
+	if ok {
+		return code, nil
+	}
+	value, _, err := db.data.decode(offset, 0)
+	if err != nil {
+		return "", err
+	}
+	record, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok = country["iso_code"].(string); ok {
+				break
+			}
+		}
+	}
+	db.mux.Lock()
+	db.codes[offset] = code
+	db.mux.Unlock()
+	return code, nil
+}
+
+// 国家/地区代码为Country的ip集合
+type Set struct {
+	DB      *DB
+	Country string
+}
+
+// 判断目标ip是否属于该国家/地区
+func (s *Set) Contain(target net.IP) bool {
+	code, err := s.DB.Country(target)
+	return err == nil && code != "" && strings.EqualFold(code, s.Country)
+}
+
+// mmdb数据区（及元数据区）的解码器
+type decoder []byte
+
+// 数据类型
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// 最大嵌套深度，避免格式错误的数据导致无限递归
+const maxDepth = 32
+
+// 读取n字节的大端无符号整数
+func (d decoder) uint(offset, n uint) (uint64, uint, error) {
+	if n > 8 || offset+n > uint(len(d)) {
+		return 0, 0, errInvalid
+	}
+	var v uint64
+	for _, b := range d[offset : offset+n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, offset + n, nil
+}
+
+// 解码offset处的值，返回值及下一个值的偏移。map解码为map[string]interface{}，整数解码为uint64/int64
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth || offset >= uint(len(d)) {
+		return nil, 0, errInvalid
+	}
+	ctrl := d[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == typePointer { // 指针：大小字段的2位决定偏移的字节数，其余3位为偏移的高位
+		n := uint(ctrl>>3&3) + 1
+		v, next, err := d.uint(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch n {
+		case 1, 2, 3:
+			v |= uint64(ctrl&7) << (8 * n)
+			v += []uint64{0, 0, 2048, 526336}[n]
+		}
+		value, _, err := d.decode(uint(v), depth+1)
+		return value, next, err
+	}
+	if typ == typeExtended {
+		if offset >= uint(len(d)) {
+			return nil, 0, errInvalid
+		}
+		typ = 7 + uint(d[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		v, next, err := d.uint(offset, size-28)
+		if err != nil {
+			return nil, 0, err
+		}
+		size, offset = []uint{29, 285, 65821}[size-29]+uint(v), next
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalid
+			}
+			if m[name], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			var err error
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d)) {
+		return nil, 0, errInvalid
+	}
+	raw, next := d[offset:offset+size], offset+size
+	switch typ {
+	case typeString:
+		return string(raw), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte{}, raw...), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		v, _, err := d.uint(offset, size)
+		return v, next, err
+	case typeInt32:
+		v, _, err := d.uint(offset, size)
+		return int64(int32(v)), next, err
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported mmdb data type: %d", typ)
+}
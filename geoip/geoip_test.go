@@ -0,0 +1,138 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// 编码mmdb数据区的值，仅支持测试用到的类型
+func encodeString(s string) []byte {
+	return append([]byte{typeString<<5 | byte(len(s))}, s...)
+}
+
+func encodeUint(v uint32) []byte {
+	return []byte{typeUint32<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func encodeMap(pairs ...[]byte) []byte {
+	raw := []byte{typeMap<<5 | byte(len(pairs)/2)}
+	for _, pair := range pairs {
+		raw = append(raw, pair...)
+	}
+	return raw
+}
+
+// 生成mmdb文件内容，networks为网段到国家/地区代码的映射
+func buildMMDB(networks map[string]string, ipVersion int, recordSize uint) []byte {
+	// 数据区：第二条及之后的记录中"country"键使用指针引用第一条记录中的键
+	var data []byte
+	offsets := map[string]uint{}
+	for _, code := range networks {
+		if _, ok := offsets[code]; ok {
+			continue
+		}
+		offsets[code] = uint(len(data))
+		key := encodeString("country")
+		if len(data) > 0 {
+			key = []byte{typePointer << 5, 1}
+		}
+		data = append(data, encodeMap(key, encodeMap(encodeString("iso_code"), encodeString(code)))...)
+	}
+	// 搜索树，记录为-1时代表未收录，小于-1时代表数据偏移
+	nodes := [][2]int{{-1, -1}}
+	for cidr, code := range networks {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		ip, ones := ipNet.IP.To16(), 0
+		if ipVersion == 4 {
+			ip = ipNet.IP.To4()
+			ones, _ = ipNet.Mask.Size()
+		} else if ones, _ = ipNet.Mask.Size(); ipNet.IP.To4() != nil { // ipv4地址位于::/96
+			ip, ones = append(make(net.IP, 12), ipNet.IP.To4()...), ones+96
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i>>3]>>(7-uint(i&7))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - int(offsets[code])
+			} else {
+				if nodes[node][bit] < 0 {
+					nodes = append(nodes, [2]int{-1, -1})
+					nodes[node][bit] = len(nodes) - 1
+				}
+				node = nodes[node][bit]
+			}
+		}
+	}
+	count := uint(len(nodes))
+	var raw []byte
+	for _, node := range nodes {
+		var records [2]uint
+		for i, record := range node {
+			switch {
+			case record == -1:
+				records[i] = count
+			case record < -1:
+				records[i] = count + 16 + uint(-2-record)
+			default:
+				records[i] = uint(record)
+			}
+		}
+		switch recordSize {
+		case 24:
+			raw = append(raw, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 28:
+			raw = append(raw, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>20&0xf0|records[1]>>24&0x0f), byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		default:
+			raw = binary.BigEndian.AppendUint32(raw, uint32(records[0]))
+			raw = binary.BigEndian.AppendUint32(raw, uint32(records[1]))
+		}
+	}
+	raw = append(append(raw, make([]byte, 16)...), data...)
+	meta := encodeMap(encodeString("node_count"), encodeUint(uint32(count)),
+		encodeString("record_size"), encodeUint(uint32(recordSize)),
+		encodeString("ip_version"), encodeUint(uint32(ipVersion)))
+	return append(append(raw, metadataMarker...), meta...)
+}
+
+func TestDB(t *testing.T) {
+	_, err := New([]byte("not a mmdb"))
+	assert.NotEqual(t, err, nil)
+	assert.False(t, IsMMDB([]byte("1.0.1.0/24")))
+	networks := map[string]string{"1.0.1.0/24": "CN", "8.8.8.0/24": "US", "2400:3200::/32": "CN"}
+	for _, recordSize := range []uint{24, 28, 32} {
+		raw := buildMMDB(networks, 6, recordSize)
+		assert.True(t, IsMMDB(raw))
+		db, err := New(raw)
+		if !assert.Equal(t, err, nil) {
+			continue
+		}
+		for ip, expected := range map[string]string{"1.0.1.1": "CN", "8.8.8.8": "US", "2400:3200::1": "CN",
+			"1.0.2.1": "", "2400:3300::1": ""} {
+			code, err := db.Country(net.ParseIP(ip))
+			assert.Equal(t, err, nil)
+			assert.Equal(t, code, expected)
+		}
+		set := &Set{DB: db, Country: "cn"}
+		assert.True(t, set.Contain(net.ParseIP("1.0.1.1")))
+		assert.False(t, set.Contain(net.ParseIP("8.8.8.8")))
+		assert.False(t, set.Contain(nil))
+	}
+	// ipv4数据库不收录ipv6地址
+	db, err := New(buildMMDB(map[string]string{"1.0.1.0/24": "CN"}, 4, 24))
+	assert.Equal(t, err, nil)
+	code, _ := db.Country(net.ParseIP("1.0.1.1"))
+	assert.Equal(t, code, "CN")
+	code, _ = db.Country(net.ParseIP("2400:3200::1"))
+	assert.Equal(t, code, "")
+	// 格式错误的数据
+	raw := buildMMDB(map[string]string{"1.0.1.0/24": "CN"}, 4, 24)
+	raw[len(raw)-1] = 99
+	_, err = New(raw)
+	assert.NotEqual(t, err, nil)
+	_, _, err = decoder([]byte{typePointer << 5, 0}).decode(0, 0) // 指向自身
+	assert.NotEqual(t, err, nil)
+}
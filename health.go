@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// 健康检查使用的dns.ResponseWriter，模拟经TCP连接的本机客户端，避免受响应限速影响
+type probeWriter struct {
+	done chan *dns.Msg
+}
+
+func (w *probeWriter) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *probeWriter) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *probeWriter) WriteMsg(msg *dns.Msg) error {
+	select {
+	case w.done <- msg:
+	default:
+	}
+	return nil
+}
+func (w *probeWriter) Write(data []byte) (int, error) { return len(data), nil }
+func (w *probeWriter) Close() error                   { return nil }
+func (w *probeWriter) TsigStatus() error              { return nil }
+func (w *probeWriter) TsigTimersOnly(bool)            {}
+func (w *probeWriter) Hijack()                        {}
+
+// 经handler查询localhost.（本地应答，不依赖上游），timeout内未得到响应时视为服务异常，如处理流程阻塞
+func healthCheck(timeout time.Duration) error {
+	request := new(dns.Msg)
+	request.SetQuestion("localhost.", dns.TypeA)
+	writer := &probeWriter{done: make(chan *dns.Msg, 1)}
+	go (&handler{}).ServeDNS(writer, request)
+	select {
+	case <-writer.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no response in %v", timeout)
+	}
+}
@@ -2,10 +2,11 @@ package hosts
 
 import (
 	"fmt"
+	"github.com/miekg/dns"
 	"io/ioutil"
 	"net"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,21 +17,58 @@ const (
 type Reader interface {
 	IP(hostname string, ipv6 bool) string
 	Record(hostname string, ipv6 bool) string
+	Hostname(ip string) string
+	CNAME(hostname string) string
+	TXT(hostname string) []string
 }
 
 type TextReader struct {
-	v4Map map[string]string
-	v6Map map[string]string
+	v4Map    map[string]string
+	v6Map    map[string]string
+	ptrMap   map[string]string
+	cnameMap map[string]string
+	txtMap   map[string][]string
+}
+
+// 在映射中查找hostname，不存在时依次查找"*.上级域名"形式的通配符记录（不匹配上级域名自身）
+func lookup(hostname string, exists func(key string) bool) string {
+	if exists(hostname) {
+		return hostname
+	}
+	for suffix := hostname; strings.Contains(suffix, "."); {
+		suffix = suffix[strings.Index(suffix, ".")+1:]
+		if key := "*." + suffix; exists(key) {
+			return key
+		}
+	}
+	return ""
 }
 
 // 获取hostname对应的ip地址，如不存在则返回空串
-func (r *TextReader) IP(hostname string, ipv6 bool) (val string) {
+func (r *TextReader) IP(hostname string, ipv6 bool) string {
+	m := r.v4Map
 	if ipv6 {
-		val, _ = r.v6Map[hostname]
-	} else {
-		val, _ = r.v4Map[hostname]
+		m = r.v6Map
 	}
-	return
+	key := lookup(hostname, func(key string) bool { _, ok := m[key]; return ok })
+	return m[key]
+}
+
+// 获取ip对应的首个hostname，如不存在则返回空串
+func (r *TextReader) Hostname(ip string) string {
+	return r.ptrMap[ip]
+}
+
+// 获取hostname的别名目标，如不存在则返回空串
+func (r *TextReader) CNAME(hostname string) string {
+	key := lookup(hostname, func(key string) bool { _, ok := r.cnameMap[key]; return ok })
+	return r.cnameMap[key]
+}
+
+// 获取hostname的TXT记录内容，如不存在则返回nil
+func (r *TextReader) TXT(hostname string) []string {
+	key := lookup(hostname, func(key string) bool { _, ok := r.txtMap[key]; return ok })
+	return r.txtMap[key]
 }
 
 // 生成hostname对应的dns记录，格式为"hostname ttl IN A ip"，如不存在则返回空串
@@ -45,60 +83,110 @@ func (r *TextReader) Record(hostname string, ipv6 bool) (record string) {
 	return fmt.Sprintf("%s 0 IN %s %s", hostname, t, ip)
 }
 
-// 解析文本内容中的Hosts
+// 解析文本内容中的Hosts。除"ip hostname"外支持"CNAME hostname target"、"TXT hostname text"（text可加双引号）、
+// "PTR ip hostname"（指定ip反向查询返回的hostname，优先于"ip hostname"行），hostname可为"*.internal.lan"形式的通配符
 func NewTextReader(text string) (r *TextReader) {
-	r = &TextReader{v4Map: map[string]string{}, v6Map: map[string]string{}}
+	r = &TextReader{v4Map: map[string]string{}, v6Map: map[string]string{}, ptrMap: map[string]string{},
+		cnameMap: map[string]string{}, txtMap: map[string][]string{}}
 	for _, line := range strings.Split(text, "\n") {
 		line = strings.Trim(line, " \t\r")
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		splitter := func(r rune) bool { return r == ' ' || r == '\t' }
-		if arr := strings.FieldsFunc(line, splitter); len(arr) >= 2 {
-			ip, hostname := net.ParseIP(arr[0]), arr[1]
-			if ip.To4() != nil {
-				r.v4Map[hostname] = ip.To4().String()
-			} else if ip.To16() != nil {
-				r.v6Map[hostname] = ip.To16().String()
+		arr := strings.FieldsFunc(line, splitter)
+		if len(arr) < 2 {
+			continue
+		}
+		switch strings.ToUpper(arr[0]) {
+		case "CNAME":
+			if len(arr) >= 3 {
+				r.cnameMap[arr[1]] = dns.Fqdn(arr[2])
+			}
+			continue
+		case "TXT":
+			if len(arr) >= 3 {
+				txt := strings.TrimSpace(line[len(arr[0]):])
+				txt = strings.Trim(strings.TrimSpace(txt[len(arr[1]):]), `"`)
+				r.txtMap[arr[1]] = append(r.txtMap[arr[1]], txt)
+			}
+			continue
+		case "PTR":
+			if ip := net.ParseIP(arr[1]); ip != nil && len(arr) >= 3 {
+				r.ptrMap[ip.String()] = arr[2]
 			}
+			continue
+		}
+		ip, hostname := net.ParseIP(arr[0]), arr[1]
+		if ip.To4() != nil {
+			r.v4Map[hostname] = ip.To4().String()
+		} else if ip.To16() != nil {
+			r.v6Map[hostname] = ip.To16().String()
+		}
+		// 通配符hostname不作为反向查询的结果
+		if _, ok := r.ptrMap[ip.String()]; ip != nil && !ok && !strings.Contains(hostname, "*") {
+			r.ptrMap[ip.String()] = hostname
 		}
 	}
 	return
 }
 
 type FileReader struct {
-	mux        *sync.Mutex
 	filename   string
-	timestamp  time.Time
 	reloadTick time.Duration
-	reader     *TextReader
+	nextReload int64        // 下次检查重载的时间（UnixNano），原子访问
+	reader     atomic.Value // *TextReader，重载时整体替换，查询时无需加锁
 }
 
 func (r *FileReader) reload() {
-	r.mux.Lock()
-	defer r.mux.Unlock()
-	if r.reloadTick <= 0 || time.Now().Before(r.timestamp.Add(r.reloadTick)) {
+	if r.reloadTick <= 0 {
+		return
+	}
+	now, next := time.Now().UnixNano(), atomic.LoadInt64(&r.nextReload)
+	// 仅由抢到本次重载的请求读取文件，其它请求继续使用已有记录
+	if now < next || !atomic.CompareAndSwapInt64(&r.nextReload, next, now+int64(r.reloadTick)) {
 		return
 	}
 	// read host file again
 	nr, err := NewFileReader(r.filename, r.reloadTick)
 	// 当hosts文件读取失败时不更新内存中已有hosts记录
 	if err == nil {
-		r.reader = nr.reader
+		r.reader.Store(nr.textReader())
 	}
-	r.timestamp = time.Now()
+}
+
+func (r *FileReader) textReader() *TextReader {
+	return r.reader.Load().(*TextReader)
 }
 
 // 获取hostname对应的ip地址，如不存在则返回空串
 func (r *FileReader) IP(hostname string, ipv6 bool) string {
 	r.reload()
-	return r.reader.IP(hostname, ipv6)
+	return r.textReader().IP(hostname, ipv6)
 }
 
 // 生成hostname对应的dns记录，格式为"hostname ttl IN A ip"，如不存在则返回空串
 func (r *FileReader) Record(hostname string, ipv6 bool) string {
 	r.reload()
-	return r.reader.Record(hostname, ipv6)
+	return r.textReader().Record(hostname, ipv6)
+}
+
+// 获取ip对应的首个hostname，如不存在则返回空串
+func (r *FileReader) Hostname(ip string) string {
+	r.reload()
+	return r.textReader().Hostname(ip)
+}
+
+// 获取hostname的别名目标，如不存在则返回空串
+func (r *FileReader) CNAME(hostname string) string {
+	r.reload()
+	return r.textReader().CNAME(hostname)
+}
+
+// 获取hostname的TXT记录内容，如不存在则返回nil
+func (r *FileReader) TXT(hostname string) []string {
+	r.reload()
+	return r.textReader().TXT(hostname)
 }
 
 // 解析目标文件内容中的Hosts
@@ -110,8 +198,8 @@ func NewFileReader(filename string, reloadTick time.Duration) (r *FileReader, er
 	if raw, err = ioutil.ReadFile(filename); err != nil {
 		return
 	}
-	r = &FileReader{mux: new(sync.Mutex), filename: filename, reloadTick: reloadTick}
-	r.reader = NewTextReader(string(raw))
-	r.timestamp = time.Now()
+	r = &FileReader{filename: filename, reloadTick: reloadTick}
+	r.reader.Store(NewTextReader(string(raw)))
+	r.nextReload = time.Now().Add(reloadTick).UnixNano()
 	return
 }
@@ -1,6 +1,7 @@
 package hosts
 
 import (
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
@@ -50,3 +51,70 @@ func TestNewFileReader(t *testing.T) {
 
 	_ = os.Remove(filename)
 }
+
+func TestHostname(t *testing.T) {
+	reader := NewTextReader("192.168.1.1 router\n192.168.1.1 gateway\nfd00::1 nas")
+	assert.Equal(t, reader.Hostname("192.168.1.1"), "router")
+	assert.Equal(t, reader.Hostname("fd00::1"), "nas")
+	assert.Equal(t, reader.Hostname("192.168.1.2"), "")
+}
+
+func TestReverse(t *testing.T) {
+	assert.Equal(t, PrivateZone("1.1.168.192.in-addr.arpa."), "168.192.in-addr.arpa.")
+	assert.Equal(t, PrivateZone("1.0.20.172.in-addr.arpa."), "20.172.in-addr.arpa.")
+	assert.Equal(t, PrivateZone("1.0.32.172.in-addr.arpa."), "")
+	assert.Equal(t, PrivateZone("8.8.8.8.in-addr.arpa."), "")
+	assert.Equal(t, ReverseIP("1.1.168.192.in-addr.arpa.").String(), "192.168.1.1")
+	assert.True(t, ReverseIP("1.168.192.in-addr.arpa.") == nil)
+	name, _ := dns.ReverseAddr("fd00::1")
+	assert.Equal(t, PrivateZone(name), "d.f.ip6.arpa.")
+	assert.Equal(t, ReverseIP(name).String(), "fd00::1")
+	zones, _ := ReverseZones("192.168.0.0/16")
+	assert.Equal(t, zones, []string{"168.192.in-addr.arpa."})
+	zones, _ = ReverseZones("10.1.2.0/24")
+	assert.Equal(t, zones, []string{"2.1.10.in-addr.arpa."})
+	zones, _ = ReverseZones("fd00::/8")
+	assert.Equal(t, zones, []string{"d.f.ip6.arpa."})
+	// 前缀长度未按标签对齐时展开为覆盖的各个区域
+	zones, _ = ReverseZones("172.16.0.0/12")
+	assert.Equal(t, len(zones), 16)
+	assert.Equal(t, zones[0], "16.172.in-addr.arpa.")
+	assert.Equal(t, zones[15], "31.172.in-addr.arpa.")
+	zones, _ = ReverseZones("100.64.0.0/10")
+	assert.Equal(t, len(zones), 64)
+	assert.Equal(t, zones[63], "127.100.in-addr.arpa.")
+	zones, _ = ReverseZones("fc00::/7")
+	assert.Equal(t, zones, []string{"c.f.ip6.arpa.", "d.f.ip6.arpa."})
+	zones, _ = ReverseZones("2001:db8::/34")
+	assert.Equal(t, zones, []string{"0.8.b.d.0.1.0.0.2.ip6.arpa.", "1.8.b.d.0.1.0.0.2.ip6.arpa.",
+		"2.8.b.d.0.1.0.0.2.ip6.arpa.", "3.8.b.d.0.1.0.0.2.ip6.arpa."})
+	_, err := ReverseZones("172.16.0.0")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestSpecialZone(t *testing.T) {
+	assert.Equal(t, SpecialZone("localhost."), "localhost.")
+	assert.Equal(t, SpecialZone("a.LOCALHOST."), "localhost.")
+	assert.Equal(t, SpecialZone("example.onion."), "onion.")
+	assert.Equal(t, SpecialZone("router.home.arpa."), "home.arpa.")
+	assert.Equal(t, SpecialZone("test.com."), "")
+}
+
+func TestRecordTypes(t *testing.T) {
+	reader := NewTextReader("10.0.0.5 *.internal.lan\n10.0.0.6 api.internal.lan\n" +
+		"CNAME www.lan nas.lan\ncname *.cdn.lan edge.example.com.\n" +
+		"TXT nas.lan \"v=spf1 -all\"\nTXT nas.lan hello world\nPTR 10.0.0.5 gateway.lan\nTXT invalid")
+	assert.Equal(t, reader.IP("a.internal.lan", false), "10.0.0.5")
+	assert.Equal(t, reader.IP("a.b.internal.lan", false), "10.0.0.5")
+	assert.Equal(t, reader.IP("api.internal.lan", false), "10.0.0.6")
+	assert.Equal(t, reader.IP("internal.lan", false), "")
+	assert.Equal(t, reader.Record("x.internal.lan", false), "x.internal.lan 0 IN A 10.0.0.5")
+	assert.Equal(t, reader.CNAME("www.lan"), "nas.lan.")
+	assert.Equal(t, reader.CNAME("img.cdn.lan"), "edge.example.com.")
+	assert.Equal(t, reader.CNAME("nas.lan"), "")
+	assert.Equal(t, reader.TXT("nas.lan"), []string{"v=spf1 -all", "hello world"})
+	assert.Equal(t, len(reader.TXT("invalid")), 0)
+	// 通配符不作为反向查询结果，PTR行指定的名称优先
+	assert.Equal(t, reader.Hostname("10.0.0.5"), "gateway.lan")
+	assert.Equal(t, reader.Hostname("10.0.0.6"), "api.internal.lan")
+}
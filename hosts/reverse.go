@@ -0,0 +1,96 @@
+package hosts
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// RFC 6303规定应在本地解析的私有地址反向区域
+var privateZones = func() (zones []string) {
+	zones = []string{"10.in-addr.arpa.", "168.192.in-addr.arpa.", "254.169.in-addr.arpa.",
+		"127.in-addr.arpa.", "0.in-addr.arpa.", "c.f.ip6.arpa.", "d.f.ip6.arpa.",
+		"8.e.f.ip6.arpa.", "9.e.f.ip6.arpa.", "a.e.f.ip6.arpa.", "b.e.f.ip6.arpa.",
+		"1" + strings.Repeat(".0", 31) + ".ip6.arpa.", // ::1
+		"0" + strings.Repeat(".0", 31) + ".ip6.arpa."} // ::
+	for i := 16; i <= 31; i++ {
+		zones = append(zones, fmt.Sprintf("%d.172.in-addr.arpa.", i))
+	}
+	return
+}()
+
+// 判断name是否属于私有地址反向区域，是则返回对应区域，否则返回空串
+func PrivateZone(name string) string {
+	for _, zone := range privateZones {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
+
+// 解析反向域名（如"1.0.0.127.in-addr.arpa."）对应的ip地址，格式错误时返回nil
+func ReverseIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		var buf strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			if len(nibbles[i]) != 1 {
+				return nil
+			}
+			buf.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				buf.WriteByte(':')
+			}
+		}
+		return net.ParseIP(buf.String())
+	}
+	return nil
+}
+
+// 获取网段对应的反向区域名称（如"192.168.0.0/16"对应"168.192.in-addr.arpa."）。前缀长度不是8（ipv4）或4（ipv6）
+// 的倍数时展开为覆盖该网段的各个区域，如"172.16.0.0/12"对应"16.172.in-addr.arpa."至"31.172.in-addr.arpa."
+func ReverseZones(cidr string) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	step, labels := 8, 4 // 每个标签对应的位数及地址的标签数
+	if bits == 8*net.IPv6len {
+		step, labels = 4, 32
+	}
+	aligned := (ones + step - 1) / step * step
+	ip := ipNet.IP
+	zones := make([]string, 0, 1<<uint(aligned-ones))
+	for i := 0; i < 1<<uint(aligned-ones); i++ {
+		sub := make(net.IP, len(ip))
+		copy(sub, ip)
+		// 依次设置ones至aligned之间的地址位
+		for bit := 0; bit < aligned-ones; bit++ {
+			if i&(1<<uint(bit)) != 0 {
+				pos := aligned - 1 - bit
+				sub[pos/8] |= 0x80 >> uint(pos%8)
+			}
+		}
+		name, _ := dns.ReverseAddr(sub.String())
+		parts := strings.SplitN(name, ".", labels-aligned/step+1)
+		zones = append(zones, parts[len(parts)-1])
+	}
+	return zones, nil
+}
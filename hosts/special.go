@@ -0,0 +1,18 @@
+package hosts
+
+import (
+	"github.com/miekg/dns"
+)
+
+// 应在本地解析的特殊用途域名（RFC 6761/7686/8375）
+var specialZones = []string{"localhost.", "invalid.", "test.", "onion.", "home.arpa."}
+
+// 判断name是否属于特殊用途域名，是则返回对应区域，否则返回空串
+func SpecialZone(name string) string {
+	for _, zone := range specialZones {
+		if dns.IsSubDomain(zone, name) {
+			return zone
+		}
+	}
+	return ""
+}
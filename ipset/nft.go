@@ -0,0 +1,62 @@
+package ipset
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// 执行nft命令，测试时替换
+var runNFT = func(args ...string) ([]byte, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, fmt.Errorf("nft utility not found")
+	}
+	return exec.Command(path, args...).CombinedOutput()
+}
+
+// nftables中的命名集合，通过nft命令添加元素，适用于没有ipset的系统（如OpenWrt 22+的fw4）
+type NFTSet struct {
+	Family string // 表所属的协议族，如inet、ip、ip6
+	Table  string
+	Name   string
+}
+
+// 解析"family table set"格式的集合，如"inet fw4 gfwlist"，省略family时为inet
+func NewNFTSet(spec string) (*NFTSet, error) {
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 2:
+		return &NFTSet{Family: "inet", Table: fields[0], Name: fields[1]}, nil
+	case 3:
+		switch fields[0] {
+		case "ip", "ip6", "inet", "arp", "bridge", "netdev":
+			return &NFTSet{Family: fields[0], Table: fields[1], Name: fields[2]}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid nftset: %s", spec)
+}
+
+func (s *NFTSet) String() string {
+	return s.Family + " " + s.Table + " " + s.Name
+}
+
+// 通过一次nft命令向集合添加多个地址，timeout为元素的超时秒数（集合须带timeout标志），为0时不设置。s为nil时忽略
+func (s *NFTSet) Add(ips []string, timeout int) error {
+	if s == nil || len(ips) == 0 {
+		return nil
+	}
+	elements := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if timeout > 0 {
+			ip += " timeout " + strconv.Itoa(timeout) + "s"
+		}
+		elements = append(elements, ip)
+	}
+	out, err := runNFT("add", "element", s.Family, s.Table, s.Name, "{ "+strings.Join(elements, ", ")+" }")
+	if err != nil {
+		return fmt.Errorf("error adding to nftset %s: %v (%s)", s, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
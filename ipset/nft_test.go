@@ -0,0 +1,37 @@
+package ipset
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNFTSet(t *testing.T) {
+	for _, spec := range []string{"", "gfwlist", "foo fw4 gfwlist", "inet fw4 gfwlist extra"} {
+		_, err := NewNFTSet(spec)
+		assert.NotEqual(t, err, nil)
+	}
+	s, err := NewNFTSet("fw4 gfwlist")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s.String(), "inet fw4 gfwlist")
+
+	var commands [][]string
+	runNFT = func(args ...string) ([]byte, error) {
+		commands = append(commands, args)
+		return nil, nil
+	}
+	s, _ = NewNFTSet("ip fw4 gfwlist")
+	assert.Equal(t, s.Add(nil, 60), nil)
+	assert.Equal(t, len(commands), 0) // 无地址时不执行命令
+	assert.Equal(t, s.Add([]string{"1.1.1.1", "8.8.8.8"}, 60), nil)
+	assert.Equal(t, s.Add([]string{"1.1.1.1"}, 0), nil)
+	assert.Equal(t, commands, [][]string{
+		{"add", "element", "ip", "fw4", "gfwlist", "{ 1.1.1.1 timeout 60s, 8.8.8.8 timeout 60s }"},
+		{"add", "element", "ip", "fw4", "gfwlist", "{ 1.1.1.1 }"}})
+	runNFT = func(args ...string) ([]byte, error) {
+		return []byte("Error: No such file or directory\n"), errors.New("exit status 1")
+	}
+	err = s.Add([]string{"1.1.1.1"}, 0)
+	assert.NotEqual(t, err, nil)
+	assert.Contains(t, err.Error(), "No such file or directory")
+}
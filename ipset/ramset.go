@@ -1,12 +1,19 @@
 package ipset
 
 import (
+	"encoding/binary"
 	"io/ioutil"
+	"math/bits"
 	"net"
-	"regexp"
+	"strconv"
 	"strings"
 )
 
+// ip集合，如RamSet、定时刷新的RemoteSet
+type Matcher interface {
+	Contain(target net.IP) bool
+}
+
 // 在go内存中的ipset
 type RamSet struct {
 	subnet []*net.IPNet
@@ -26,20 +33,25 @@ func (s *RamSet) Contain(target net.IP) bool {
 	return false
 }
 
-// 用文本内容初始化一个RamSet，每行一个ip/网段
+// 返回ip及网段的数量
+func (s *RamSet) Len() int {
+	return len(s.ipMap) + len(s.subnet)
+}
+
+// 用文本内容初始化一个RamSet，每行一个ip/网段，支持ipv4及ipv6
 func NewRamSetByText(text string) (s *RamSet) {
 	s = &RamSet{subnet: []*net.IPNet{}, ipMap: map[string]bool{}}
-	v4reg := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}$`)
-	cidr4reg := regexp.MustCompile(`^(\d{1,3}\.){3}\d{1,3}/\d{1,2}$`)
 	for _, line := range strings.Split(text, "\n") {
 		line = strings.Trim(line, " \t\n\r")
-		if v4reg.MatchString(line) {
-			s.ipMap[net.ParseIP(line).String()] = true
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
 		}
-		if cidr4reg.MatchString(line) {
+		if strings.Contains(line, "/") {
 			if _, subnet, err := net.ParseCIDR(line); err == nil {
 				s.subnet = append(s.subnet, subnet)
 			}
+		} else if ip := net.ParseIP(line); ip != nil {
+			s.ipMap[ip.String()] = true
 		}
 	}
 	return s
@@ -53,3 +65,48 @@ func NewRamSetByFn(filename string) (matcher *RamSet, err error) {
 		return NewRamSetByText(string(raw)), nil
 	}
 }
+
+// 判断文本是否为RIR统计文件格式（如APNIC的delegated-apnic-latest），每行格式为registry|cc|type|start|value|date|status
+func IsDelegated(text string) bool {
+	return strings.Contains(text, "|ipv4|") || strings.Contains(text, "|ipv6|")
+}
+
+// 用RIR统计文件初始化一个RamSet，仅读取指定国家/地区代码（如CN）的ipv4、ipv6记录。
+// ipv4记录的value为地址数量，按对齐的网段拆分；ipv6记录的value为前缀长度
+func NewRamSetByDelegated(text, country string) (s *RamSet) {
+	s = &RamSet{subnet: []*net.IPNet{}, ipMap: map[string]bool{}}
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) < 5 || !strings.EqualFold(fields[1], country) {
+			continue
+		}
+		ip := net.ParseIP(fields[3])
+		value, err := strconv.ParseUint(fields[4], 10, 32)
+		if ip == nil || err != nil {
+			continue
+		}
+		switch fields[2] {
+		case "ipv4":
+			if ip = ip.To4(); ip == nil || value == 0 {
+				continue
+			}
+			start := uint64(binary.BigEndian.Uint32(ip))
+			for end := start + value; start < end; {
+				size := 63 - bits.LeadingZeros64(end-start) // 不超过剩余地址数量且按起始地址对齐的最大网段
+				if align := bits.TrailingZeros64(start); align < size {
+					size = align
+				}
+				subnet := &net.IPNet{IP: make(net.IP, 4), Mask: net.CIDRMask(32-size, 32)}
+				binary.BigEndian.PutUint32(subnet.IP, uint32(start))
+				s.subnet = append(s.subnet, subnet)
+				start += 1 << size
+			}
+		case "ipv6":
+			if value <= 128 {
+				s.subnet = append(s.subnet, &net.IPNet{IP: ip.Mask(net.CIDRMask(int(value), 128)),
+					Mask: net.CIDRMask(int(value), 128)})
+			}
+		}
+	}
+	return s
+}
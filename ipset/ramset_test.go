@@ -25,6 +25,11 @@ func TestRamSet(t *testing.T) {
 		assert.True(t, matcher.Contain(net.ParseIP("8.8.8.8")))
 		assert.True(t, matcher.Contain(net.ParseIP("1.254.254.254")))
 		assert.False(t, matcher.Contain(net.ParseIP("192.168.1.1")))
+		assert.True(t, matcher.Contain(net.ParseIP("::2")))
 	}
+	// ipv6网段
+	matcher = NewRamSetByText("fd00::/8\n# comment")
+	assert.True(t, matcher.Contain(net.ParseIP("fd00::1")))
+	assert.False(t, matcher.Contain(net.ParseIP("fe80::1")))
 	_ = os.Remove(filename)
 }
@@ -0,0 +1,86 @@
+package ipset
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 最短刷新间隔
+const MinRefresh = time.Minute
+
+// 定时刷新的ip集合（如从远程地址下载的中国ip网段列表），刷新时整体替换，刷新失败时保留原有网段
+type RemoteSet struct {
+	Name    string
+	load    func() ([]byte, error) // 内容未变更时返回nil
+	parse   func(raw []byte) *RamSet
+	refresh time.Duration
+	mux     sync.Mutex
+	set     *RamSet
+	loaded  time.Time
+	loading bool
+}
+
+// 判断目标ip是否在范围内，集合过期时在后台刷新
+func (s *RemoteSet) Contain(target net.IP) bool {
+	s.mux.Lock()
+	if s.refresh > 0 && !s.loading && time.Since(s.loaded) >= s.refresh {
+		s.loading = true
+		go s.reload()
+	}
+	set := s.set
+	s.mux.Unlock()
+	return set.Contain(target)
+}
+
+// 返回ip及网段的数量
+func (s *RemoteSet) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.set.Len()
+}
+
+// 解析内容，无有效网段时视为错误，避免将错误页面等内容解析为空集合
+func (s *RemoteSet) build(raw []byte) (*RamSet, error) {
+	if set := s.parse(raw); set.Len() > 0 {
+		return set, nil
+	}
+	return nil, errors.New("no valid ip in " + s.Name)
+}
+
+func (s *RemoteSet) reload() {
+	raw, err := s.load()
+	var set *RamSet
+	if err == nil && raw != nil {
+		set, err = s.build(raw)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.loading, s.loaded = false, time.Now()
+	if err != nil {
+		log.Printf("[ERROR] refresh %s error: %v\n", s.Name, err)
+		return
+	}
+	if set != nil {
+		s.set = set
+	}
+}
+
+// 创建定时刷新的ip集合，load用于读取内容，parse将内容解析为RamSet，refresh为0时不刷新
+func NewRemoteSet(name string, load func() ([]byte, error), parse func(raw []byte) *RamSet,
+	refresh time.Duration) (*RemoteSet, error) {
+	if refresh > 0 && refresh < MinRefresh {
+		refresh = MinRefresh
+	}
+	s := &RemoteSet{Name: name, load: load, parse: parse, refresh: refresh, loaded: time.Now()}
+	raw, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if s.set, err = s.build(raw); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,61 @@
+package ipset
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDelegated(t *testing.T) {
+	text := "2|apnic|20240101|3|19830613|20240101|+1000\napnic|*|ipv4|*|2|summary\n" +
+		"apnic|CN|ipv4|1.0.1.0|256|20110414|allocated\n" +
+		"apnic|CN|ipv4|1.0.2.0|768|20110414|allocated\n" + // 非2的幂，拆分为/23及/24
+		"apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated\n" +
+		"apnic|CN|ipv6|2400:3200::|32|20090807|allocated\n"
+	assert.True(t, IsDelegated(text))
+	assert.False(t, IsDelegated("1.0.1.0/24\n"))
+	s := NewRamSetByDelegated(text, "cn")
+	assert.Equal(t, s.Len(), 4)
+	for _, ip := range []string{"1.0.1.1", "1.0.2.1", "1.0.4.255", "2400:3200::1"} {
+		assert.True(t, s.Contain(net.ParseIP(ip)))
+	}
+	for _, ip := range []string{"1.0.5.0", "1.0.16.1", "2400:3300::1"} {
+		assert.False(t, s.Contain(net.ParseIP(ip)))
+	}
+}
+
+func TestRemoteSet(t *testing.T) {
+	_, err := NewRemoteSet("cnip", func() ([]byte, error) { return nil, errors.New("fail") }, nil, 0)
+	assert.NotEqual(t, err, nil)
+	parse := func(raw []byte) *RamSet { return NewRamSetByText(string(raw)) }
+	_, err = NewRemoteSet("cnip", func() ([]byte, error) { return []byte("<html>"), nil }, parse, 0)
+	assert.NotEqual(t, err, nil)
+	responses := [][]byte{[]byte("1.0.1.0/24"), nil, []byte("invalid"), []byte("1.0.2.0/24")}
+	load := func() ([]byte, error) {
+		raw := responses[0]
+		responses = responses[1:]
+		return raw, nil
+	}
+	s, err := NewRemoteSet("cnip", load, parse, time.Second)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, s.refresh, MinRefresh)
+	assert.True(t, s.Contain(net.ParseIP("1.0.1.1")))
+	// 内容未变更、内容无效时保留原有网段，之后替换为新网段
+	refresh := func() {
+		s.refresh = time.Millisecond
+		time.Sleep(2 * time.Millisecond)
+		s.Contain(nil)
+		time.Sleep(10 * time.Millisecond)
+		s.refresh = 0
+	}
+	for i := 0; i < 2; i++ {
+		refresh()
+		assert.True(t, s.Contain(net.ParseIP("1.0.1.1")))
+	}
+	refresh()
+	assert.True(t, s.Contain(net.ParseIP("1.0.2.1")))
+	assert.False(t, s.Contain(net.ParseIP("1.0.1.1")))
+	assert.Equal(t, s.Len(), 1)
+}
@@ -0,0 +1,128 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志级别，与日志内容中的"[LEVEL]"标记对应
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelCritical
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// 解析日志级别名称，空串视为INFO
+func ParseLevel(name string) (level int, err error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %s", name)
+}
+
+// 提取日志内容中的级别标记，无标记时视为INFO
+func extractLevel(line []byte) (level int, msg []byte) {
+	if len(line) > 0 && line[0] == '[' {
+		if i := bytes.IndexByte(line, ']'); i > 0 {
+			for j, levelName := range levelNames {
+				if string(line[1:i]) == levelName {
+					return j, bytes.TrimLeft(line[i+1:], " ")
+				}
+			}
+		}
+	}
+	return LevelInfo, line
+}
+
+// 按级别过滤日志并格式化输出的Writer，配合log.SetFlags(0)使用
+type Writer struct {
+	Level  int
+	JSON   bool
+	NoTime bool // 为true时不输出时间戳
+	mux    *sync.Mutex
+	out    io.Writer
+	closer io.Closer
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	level, msg := extractLevel(p)
+	if level < w.Level {
+		return len(p), nil
+	}
+	now := time.Now()
+	var line []byte
+	if w.JSON {
+		obj := map[string]string{"level": levelNames[level], "msg": string(bytes.TrimRight(msg, "\n"))}
+		if !w.NoTime {
+			obj["time"] = now.Format(time.RFC3339)
+		}
+		line, _ = json.Marshal(obj)
+		line = append(line, '\n')
+	} else if w.NoTime {
+		line = p
+	} else {
+		line = append([]byte(now.Format("2006/01/02 15:04:05 ")), p...)
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if _, err = w.out.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 关闭日志文件，输出到stderr时不做任何操作
+func (w *Writer) Close() error {
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+// 创建日志Writer。filename为空时输出到stderr，format可选text/json
+func New(level, filename, format string) (w *Writer, err error) {
+	w = &Writer{mux: new(sync.Mutex), out: os.Stderr}
+	if w.Level, err = ParseLevel(level); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		w.JSON = true
+	default:
+		return nil, fmt.Errorf("unknown log format: %s", format)
+	}
+	if filename != "" {
+		var file *os.File
+		flag := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if file, err = os.OpenFile(filename, flag, 0644); err != nil {
+			return nil, err
+		}
+		w.out, w.closer = file, file
+	}
+	return w, nil
+}
+
+// 创建前台模式的日志Writer：输出到stdout且不输出时间戳，时间戳由init系统、容器等负责记录
+func NewForeground(level, format string) (w *Writer, err error) {
+	if w, err = New(level, "", format); err != nil {
+		return nil, err
+	}
+	w.out, w.NoTime = os.Stdout, true
+	return w, nil
+}
@@ -0,0 +1,65 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, level, LevelInfo)
+	level, err = ParseLevel("warning")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, level, LevelWarning)
+	_, err = ParseLevel("unknown")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestWriter(t *testing.T) {
+	// 无效参数
+	_, err := New("unknown", "", "")
+	assert.NotEqual(t, err, nil)
+	_, err = New("", "", "xml")
+	assert.NotEqual(t, err, nil)
+	_, err = New("", "/not-exists/log.txt", "")
+	assert.NotEqual(t, err, nil)
+	// 按级别过滤
+	buf := new(bytes.Buffer)
+	w, err := New("warning", "", "text")
+	assert.Equal(t, err, nil)
+	w.out = buf
+	_, _ = w.Write([]byte("[INFO] ignored\n"))
+	assert.Equal(t, buf.Len(), 0)
+	_, _ = w.Write([]byte("[ERROR] printed\n"))
+	assert.True(t, strings.HasSuffix(buf.String(), " [ERROR] printed\n"))
+	// json格式
+	buf.Reset()
+	w.JSON = true
+	_, _ = w.Write([]byte("[WARNING] test json\n"))
+	var obj map[string]string
+	assert.Equal(t, json.Unmarshal(buf.Bytes(), &obj), nil)
+	assert.Equal(t, obj["level"], "WARNING")
+	assert.Equal(t, obj["msg"], "test json")
+	// 前台模式不输出时间戳
+	w, err = NewForeground("", "")
+	assert.Equal(t, err, nil)
+	buf.Reset()
+	w.out = buf
+	_, _ = w.Write([]byte("[INFO] foreground\n"))
+	assert.Equal(t, buf.String(), "[INFO] foreground\n")
+	// 输出到文件
+	filename := "go_test_log_file"
+	w, err = New("", filename, "")
+	assert.Equal(t, err, nil)
+	_, _ = w.Write([]byte("no level\n"))
+	assert.Equal(t, w.Close(), nil)
+	raw, _ := ioutil.ReadFile(filename)
+	assert.True(t, strings.HasSuffix(string(raw), " no level\n"))
+	_ = os.Remove(filename)
+}
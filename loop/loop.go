@@ -0,0 +1,93 @@
+package loop
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/edns"
+	"net"
+)
+
+// 转发请求时携带的EDNS0 option（位于本地/实验用途范围），内容为8字节的实例标识及1字节的转发跳数
+const OptionCode uint16 = 65053
+
+// 默认的最大转发跳数
+const DefaultMaxHops = 8
+
+// 本进程的实例标识，重载配置时保持不变
+var instanceID = func() []byte {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return id
+}()
+
+var (
+	ErrSelf = errors.New("query forwarded back to itself")
+	ErrHops = errors.New("too many forwarding hops")
+)
+
+// 检查请求中的环路标记并将其移除，返回请求已经过的转发跳数。请求由本实例转发而来时返回ErrSelf，
+// 跳数达到maxHops（为0时使用默认值）时返回ErrHops。格式错误的标记视为不存在
+func Check(request *dns.Msg, maxHops int) (hops int, err error) {
+	option, ok := edns.FindOption(request, OptionCode).(*dns.EDNS0_LOCAL)
+	edns.RemoveOption(request, OptionCode)
+	if !ok || len(option.Data) != len(instanceID)+1 {
+		return 0, nil
+	}
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	hops = int(option.Data[len(instanceID)])
+	if string(option.Data[:len(instanceID)]) == string(instanceID) {
+		return hops, ErrSelf
+	}
+	if hops >= maxHops {
+		return hops, ErrHops
+	}
+	return hops, nil
+}
+
+// 在转发至上游的请求中设置环路标记，请求中无OPT记录时自动添加
+func Mark(request *dns.Msg, hops int) {
+	if hops > 0xff {
+		hops = 0xff
+	}
+	data := append(append([]byte{}, instanceID...), byte(hops))
+	edns.SetOption(request, &dns.EDNS0_LOCAL{Code: OptionCode, Data: data})
+}
+
+// 判断上游地址是否为本机或内网地址，仅向此类上游发送环路标记
+func Private(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// 判断上游地址是否指向本服务器的监听地址：端口相同，且监听所有地址时上游为本机地址，否则与监听地址相同
+func SelfUpstream(upstream, listen string) bool {
+	host, port, err := net.SplitHostPort(upstream)
+	listenHost, listenPort, err2 := net.SplitHostPort(listen)
+	if err != nil || err2 != nil || port != listenPort {
+		return false
+	}
+	ip, listenIP := net.ParseIP(host), net.ParseIP(listenHost)
+	if ip == nil {
+		return false
+	}
+	if listenIP != nil && !listenIP.IsUnspecified() {
+		return ip.Equal(listenIP) || ip.IsUnspecified()
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
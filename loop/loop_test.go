@@ -0,0 +1,60 @@
+package loop
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/edns"
+	"testing"
+)
+
+func TestLoop(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+	hops, err := Check(request, 0)
+	assert.Equal(t, hops, 0)
+	assert.Equal(t, err, nil)
+	// 本实例转发的请求
+	Mark(request, 1)
+	hops, err = Check(request, 0)
+	assert.Equal(t, hops, 1)
+	assert.Equal(t, err, ErrSelf)
+	assert.Equal(t, edns.FindOption(request, OptionCode), nil)
+	// 其它实例转发的请求按跳数限制
+	other := func(hops byte) *dns.Msg {
+		msg := request.Copy()
+		edns.SetOption(msg, &dns.EDNS0_LOCAL{Code: OptionCode, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8, hops}})
+		return msg
+	}
+	hops, err = Check(other(3), 4)
+	assert.Equal(t, hops, 3)
+	assert.Equal(t, err, nil)
+	_, err = Check(other(4), 4)
+	assert.Equal(t, err, ErrHops)
+	_, err = Check(other(DefaultMaxHops), 0)
+	assert.Equal(t, err, ErrHops)
+	// 格式错误的标记视为不存在
+	msg := request.Copy()
+	edns.SetOption(msg, &dns.EDNS0_LOCAL{Code: OptionCode, Data: []byte{1}})
+	hops, err = Check(msg, 0)
+	assert.Equal(t, hops, 0)
+	assert.Equal(t, err, nil)
+}
+
+func TestSelfUpstream(t *testing.T) {
+	assert.True(t, SelfUpstream("127.0.0.1:53", ":53"))
+	assert.True(t, SelfUpstream("[::1]:53", "[::]:53"))
+	assert.True(t, SelfUpstream("127.0.0.1:5353", "127.0.0.1:5353"))
+	assert.False(t, SelfUpstream("127.0.0.1:5353", ":53"))
+	assert.False(t, SelfUpstream("127.0.0.2:53", "127.0.0.1:53"))
+	assert.False(t, SelfUpstream("8.8.8.8:53", ":53"))
+	assert.False(t, SelfUpstream("dns.google:53", ":53"))
+}
+
+func TestPrivate(t *testing.T) {
+	assert.True(t, Private("127.0.0.1:53"))
+	assert.True(t, Private("192.168.1.1:5353"))
+	assert.True(t, Private("[fd00::1]:53"))
+	assert.False(t, Private("8.8.8.8:53"))
+	assert.False(t, Private("[2001:4860:4860::8888]:53"))
+	assert.False(t, Private("dns.google:53"))
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"io/ioutil"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -49,6 +50,49 @@ func (matcher *ABPlus) Match(domain string) (matched bool, ok bool) {
 	return false, false
 }
 
+// 返回规则数量
+func (matcher *ABPlus) Len() int {
+	return len(matcher.isBlocked) + len(matcher.blockedRegs) + len(matcher.unblockedRegs)
+}
+
+// 返回排序后的所有规则：白名单规则以"@@"开头，通配符规则保留"*"，以"."开头的规则仅匹配子域名
+func (matcher *ABPlus) Rules() (rules []string) {
+	for domain, blocked := range matcher.isBlocked {
+		if !blocked {
+			domain = "@@" + domain
+		}
+		rules = append(rules, domain)
+	}
+	// 正则表达式还原为通配符表达式
+	wildcard := func(regex *regexp.Regexp) string {
+		expr := strings.TrimSuffix(strings.TrimPrefix(regex.String(), "^"), "$")
+		return strings.Replace(strings.Replace(expr, ".*", "*", -1), "\\.", ".", -1)
+	}
+	for _, regex := range matcher.blockedRegs {
+		rules = append(rules, wildcard(regex))
+	}
+	for _, regex := range matcher.unblockedRegs {
+		rules = append(rules, "@@"+wildcard(regex))
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+var (
+	tldReg = regexp.MustCompile(`^[a-zA-Z]{2,}$`)
+	idnReg = regexp.MustCompile(`^xn--[a-zA-Z0-9]{3,}$`)
+)
+
+// 通过顶级域名判断域名是否有效
+func validDomain(domain string) bool {
+	i := strings.LastIndex(domain, ".")
+	if i == -1 {
+		return false // 无顶级域名
+	}
+	tld := domain[i+1:]
+	return tldReg.MatchString(tld) || idnReg.MatchString(tld)
+}
+
 // 从文本内容读取AdBlock Plus规则
 func NewABPByText(text string) (matcher *ABPlus) {
 	extractDomain := func(rule string) string {
@@ -88,16 +132,7 @@ func NewABPByText(text string) (matcher *ABPlus) {
 			}
 			continue
 		}
-		// 通过顶级域名判断域名是否有效
-		var tld string
-		if i := strings.LastIndex(domain, "."); i == -1 {
-			continue // 无顶级域名
-		} else {
-			tld = domain[i+1:]
-		}
-		tldReg := regexp.MustCompile(`^[a-zA-Z]{2,}$`)
-		idnReg := regexp.MustCompile(`^xn--[a-zA-Z0-9]{3,}$`)
-		if !tldReg.MatchString(tld) && !idnReg.MatchString(tld) {
+		if !validDomain(domain) {
 			continue // 无效域名
 		}
 		matcher.isBlocked[domain] = line[:2] != "@@"
@@ -105,19 +140,26 @@ func NewABPByText(text string) (matcher *ABPlus) {
 	return matcher
 }
 
+// 解码规则文件内容，b64decode为true时先进行base64解码
+func decodeText(raw []byte, b64decode bool) (string, error) {
+	if !b64decode {
+		return string(raw), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
 // 从文件内容读取AdBlock Plus规则
 func NewABPByFile(filename string, b64decode bool) (checker *ABPlus, err error) {
 	var raw []byte
-	var text string
-	if raw, err = ioutil.ReadFile(filename); err == nil {
-		text = string(raw)
-		if b64decode {
-			if raw, err = base64.StdEncoding.DecodeString(text); err == nil {
-				text = string(raw)
-			}
-		}
+	if raw, err = ioutil.ReadFile(filename); err != nil {
+		return nil, err
 	}
-	if err != nil {
+	var text string
+	if text, err = decodeText(raw, b64decode); err != nil {
 		return nil, err
 	}
 	return NewABPByText(text), nil
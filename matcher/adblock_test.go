@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -61,3 +62,18 @@ func TestNewChecker(t *testing.T) {
 	assert.Equal(t, ok, true)
 	assert.Equal(t, matched, true)
 }
+
+func TestRules(t *testing.T) {
+	matcher := NewABPByText(text)
+	assert.Equal(t, matcher.Rules(), []string{"*.youtube.com", ".google.com", "@@*.cn", "@@cip.cc"})
+	// 导出的规则可重新读取
+	var lines []string
+	for _, rule := range matcher.Rules() {
+		if strings.HasPrefix(rule, "@@") {
+			lines = append(lines, "@@||"+rule[2:])
+		} else {
+			lines = append(lines, "||"+rule)
+		}
+	}
+	assert.Equal(t, NewABPByText(strings.Join(lines, "\n")).Rules(), matcher.Rules())
+}
@@ -0,0 +1,129 @@
+package matcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+)
+
+// 缓存文件格式版本，解析逻辑或格式变更时递增，使旧缓存失效
+const cacheVersion = 1
+
+// 序列化后的ABPlus解析结果
+type abpCache struct {
+	Version       int
+	Source        [sha256.Size]byte // 源文件内容的sha256
+	Blocked       map[string]bool
+	BlockedRegs   []string
+	UnblockedRegs []string
+}
+
+// 读取缓存文件，版本或源文件内容不一致时返回nil
+func loadCache(cacheFile string, source [sha256.Size]byte) *ABPlus {
+	raw, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil
+	}
+	var cache abpCache
+	if err = gob.NewDecoder(bytes.NewReader(raw)).Decode(&cache); err != nil {
+		return nil
+	}
+	if cache.Version != cacheVersion || cache.Source != source {
+		return nil
+	}
+	matcher := &ABPlus{isBlocked: cache.Blocked}
+	if matcher.isBlocked == nil {
+		matcher.isBlocked = map[string]bool{}
+	}
+	for _, expr := range cache.BlockedRegs {
+		if regex, err := regexp.Compile(expr); err == nil {
+			matcher.blockedRegs = append(matcher.blockedRegs, regex)
+		}
+	}
+	for _, expr := range cache.UnblockedRegs {
+		if regex, err := regexp.Compile(expr); err == nil {
+			matcher.unblockedRegs = append(matcher.unblockedRegs, regex)
+		}
+	}
+	return matcher
+}
+
+// 将解析结果写入缓存文件，先写临时文件再重命名，避免中断时留下不完整的缓存
+func saveCache(cacheFile string, source [sha256.Size]byte, matcher *ABPlus) error {
+	cache := abpCache{Version: cacheVersion, Source: source, Blocked: matcher.isBlocked}
+	for _, regex := range matcher.blockedRegs {
+		cache.BlockedRegs = append(cache.BlockedRegs, regex.String())
+	}
+	for _, regex := range matcher.unblockedRegs {
+		cache.UnblockedRegs = append(cache.UnblockedRegs, regex.String())
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cache); err != nil {
+		return err
+	}
+	tmp := cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cacheFile)
+}
+
+// 规则列表解析结果的缓存目录，为空时不缓存
+var cacheDir atomic.Value
+
+// SetCacheDir 设置定时刷新的规则列表（如v2ray geosite导出的域名列表）解析结果的缓存目录，
+// 各列表按名称使用单独的缓存文件，dir为空时不缓存
+func SetCacheDir(dir string) {
+	cacheDir.Store(dir)
+}
+
+// 返回规则列表name的缓存文件路径，未设置缓存目录时返回空字符串
+func cacheFileOf(name string) string {
+	dir, _ := cacheDir.Load().(string)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("%x.cache", sha256.Sum256([]byte(name))))
+}
+
+// 源文件内容未变化时读取缓存，否则调用parse解析并写入缓存，cacheFile为空时直接解析
+func parseCached(cacheFile string, raw []byte, parse func() (*ABPlus, error)) (*ABPlus, error) {
+	if cacheFile == "" {
+		return parse()
+	}
+	source := sha256.Sum256(raw)
+	if matcher := loadCache(cacheFile, source); matcher != nil {
+		return matcher, nil
+	}
+	matcher, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	_ = saveCache(cacheFile, source, matcher)
+	return matcher, nil
+}
+
+// 同NewABPByFile，但将解析结果缓存至cacheFile，源文件内容未变化时直接读取缓存，跳过规则解析。
+// cacheFile为空时不使用缓存，缓存写入失败不影响返回结果
+func NewABPByFileCached(filename string, b64decode bool, cacheFile string) (matcher *ABPlus, err error) {
+	if cacheFile == "" {
+		return NewABPByFile(filename, b64decode)
+	}
+	var raw []byte
+	if raw, err = ioutil.ReadFile(filename); err != nil {
+		return nil, err
+	}
+	return parseCached(cacheFile, raw, func() (*ABPlus, error) {
+		text, err := decodeText(raw, b64decode)
+		if err != nil {
+			return nil, err
+		}
+		return NewABPByText(text), nil
+	})
+}
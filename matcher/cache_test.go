@@ -0,0 +1,70 @@
+package matcher
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNewABPByFileCached(t *testing.T) {
+	filename, cacheFile := "go_test_cached.txt", "go_test_cached.cache"
+	defer func() { _ = os.Remove(filename); _ = os.Remove(cacheFile) }()
+	content := base64.StdEncoding.EncodeToString([]byte(text))
+	_ = ioutil.WriteFile(filename, []byte(content), 0644)
+	// 首次读取时生成缓存
+	matcher, err := NewABPByFileCached(filename, true, cacheFile)
+	assert.Equal(t, err, nil)
+	_, err = os.Stat(cacheFile)
+	assert.Equal(t, err, nil)
+	// 从缓存读取的结果与解析结果一致
+	cached, err := NewABPByFileCached(filename, true, cacheFile)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cached.isBlocked, matcher.isBlocked)
+	for _, domain := range []string{"test.google.com", "cip.cc", "ip.cn", "www.youtube.com", "google.com"} {
+		m1, ok1 := matcher.Match(domain)
+		m2, ok2 := cached.Match(domain)
+		assert.Equal(t, [2]bool{m1, ok1}, [2]bool{m2, ok2})
+	}
+	// 源文件变更后缓存失效
+	content = base64.StdEncoding.EncodeToString([]byte("||twitter.com\n"))
+	_ = ioutil.WriteFile(filename, []byte(content), 0644)
+	cached, err = NewABPByFileCached(filename, true, cacheFile)
+	assert.Equal(t, err, nil)
+	matched, ok := cached.Match("twitter.com")
+	assert.True(t, matched && ok)
+	_, ok = cached.Match("test.google.com")
+	assert.False(t, ok)
+	// 缓存文件损坏时重新解析
+	_ = ioutil.WriteFile(cacheFile, []byte("???"), 0644)
+	cached, err = NewABPByFileCached(filename, true, cacheFile)
+	assert.Equal(t, err, nil)
+	matched, ok = cached.Match("twitter.com")
+	assert.True(t, matched && ok)
+}
+
+func TestRemoteABPCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rules_cache")
+	defer func() { _ = os.RemoveAll(dir) }()
+	SetCacheDir(dir)
+	defer SetCacheDir("")
+	load := func() ([]byte, error) { return []byte("domain:google.com\nfull:www.youtube.com\n"), nil }
+	remote, err := NewRemoteABP("domains:geosite.txt", load, FormatDomains, false, 0)
+	assert.Equal(t, err, nil)
+	_, err = os.Stat(cacheFileOf("domains:geosite.txt"))
+	assert.Equal(t, err, nil)
+	// 内容未变化时读取缓存，结果与解析结果一致
+	cached, err := NewRemoteABP("domains:geosite.txt", load, FormatDomains, false, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cached.Len(), remote.Len())
+	for _, domain := range []string{"test.google.com", "www.youtube.com", "m.youtube.com"} {
+		m1, ok1 := remote.Match(domain)
+		m2, ok2 := cached.Match(domain)
+		assert.Equal(t, [2]bool{m1, ok1}, [2]bool{m2, ok2})
+	}
+	// 各列表使用单独的缓存文件
+	assert.NotEqual(t, cacheFileOf("dnsmasq:geosite.txt"), cacheFileOf("domains:geosite.txt"))
+	SetCacheDir("")
+	assert.Equal(t, cacheFileOf("domains:geosite.txt"), "")
+}
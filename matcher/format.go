@@ -0,0 +1,106 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 规则文件格式
+const (
+	FormatABP     = "abp"     // AdBlock Plus规则，如gfwlist
+	FormatDnsmasq = "dnsmasq" // dnsmasq配置，如felixonmars/dnsmasq-china-list
+	FormatDomains = "domains" // 每行一个域名，如v2ray geosite导出的列表
+)
+
+// 判断规则文件格式是否受支持
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatABP, FormatDnsmasq, FormatDomains:
+		return true
+	}
+	return false
+}
+
+// 按格式读取规则，format为空时视为AdBlock Plus规则
+func NewABPByFormat(text, format string) (*ABPlus, error) {
+	switch format {
+	case "", FormatABP:
+		return NewABPByText(text), nil
+	case FormatDnsmasq:
+		return NewABPByDnsmasq(text), nil
+	case FormatDomains:
+		return NewABPByDomains(text), nil
+	}
+	return nil, fmt.Errorf("unknown rules format: %s", format)
+}
+
+// 添加匹配域名及其子域名的规则，以"*."开头的域名仅匹配子域名
+func (matcher *ABPlus) addDomain(domain string) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	subOnly := strings.HasPrefix(domain, "*.")
+	domain = strings.TrimLeft(domain, "*.")
+	if !validDomain(domain) {
+		return
+	}
+	if subOnly {
+		domain = "." + domain
+	}
+	matcher.isBlocked[domain] = true
+}
+
+// 从dnsmasq配置中读取server、local、address、ipset、nftset等配置项中的域名，匹配域名及其子域名
+func NewABPByDnsmasq(text string) *ABPlus {
+	matcher := &ABPlus{isBlocked: map[string]bool{}}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		i := strings.Index(line, "=/")
+		if i == -1 || line[0] == '#' {
+			continue // 忽略注释行及不含域名的配置项
+		}
+		switch line[:i] {
+		case "server", "local", "address", "ipset", "nftset":
+		default:
+			continue
+		}
+		// 格式为key=/domain1/domain2/value
+		parts := strings.Split(line[i+2:], "/")
+		for _, domain := range parts[:len(parts)-1] {
+			matcher.addDomain(domain)
+		}
+	}
+	return matcher
+}
+
+// 从每行一个域名的列表读取规则，域名匹配其自身及子域名。兼容v2ray geosite导出的格式：
+// "domain:"前缀同普通域名，"full:"前缀仅匹配该域名，忽略keyword、regexp等规则及"@"开头的属性
+func NewABPByDomains(text string) *ABPlus {
+	matcher := &ABPlus{isBlocked: map[string]bool{}}
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i] // 移除注释
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := fields[0]
+		if i := strings.Index(rule, ":@"); i != -1 {
+			rule = rule[:i] // 移除属性
+		}
+		typ := "domain"
+		if i := strings.Index(rule, ":"); i != -1 {
+			typ, rule = rule[:i], rule[i+1:]
+		}
+		switch typ {
+		case "domain":
+			matcher.addDomain(rule)
+		case "full":
+			if rule = strings.TrimSuffix(strings.ToLower(rule), "."); validDomain(rule) {
+				regex := regexp.MustCompile("^" + regexp.QuoteMeta(rule) + "$")
+				matcher.blockedRegs = append(matcher.blockedRegs, regex)
+			}
+		}
+	}
+	return matcher
+}
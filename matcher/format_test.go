@@ -0,0 +1,38 @@
+package matcher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	_, err := NewABPByFormat("", "unknown")
+	assert.NotEqual(t, err, nil)
+	assert.False(t, ValidFormat("https"))
+	// dnsmasq配置
+	conf := "# comment\nserver=/baidu.com/114.114.114.114\nipset=/qq.com/Taobao.COM/cn\n" +
+		"address=/*.ads.cn/0.0.0.0\nserver=/#/1.1.1.1\nserver=8.8.8.8\ncache-size=1000\n"
+	m, err := NewABPByFormat(conf, FormatDnsmasq)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, m.Rules(), []string{".ads.cn", "baidu.com", "qq.com", "taobao.com"})
+	for _, domain := range []string{"baidu.com.", "www.baidu.com.", "taobao.com", "x.ads.cn."} {
+		matched, _ := m.Match(domain)
+		assert.True(t, matched)
+	}
+	_, ok := m.Match("ads.cn.")
+	assert.False(t, ok)
+	// 域名列表及geosite导出格式
+	list := "google.com\n# comment\ndomain:youtube.com:@ads\nfull:www.example.com @cn\n" +
+		"keyword:google\nregexp:^ad\\.\ninvalid\n"
+	m, err = NewABPByFormat(list, FormatDomains)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, m.Rules(), []string{"google.com", "www.example.com", "youtube.com"})
+	for _, domain := range []string{"mail.google.com.", "youtube.com", "www.example.com."} {
+		matched, _ := m.Match(domain)
+		assert.True(t, matched)
+	}
+	for _, domain := range []string{"example.com.", "a.www.example.com.", "ad.test.com."} {
+		_, ok = m.Match(domain)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,121 @@
+package matcher
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// 最短刷新间隔
+const MinRefresh = time.Minute
+
+// 首次加载失败后的重试间隔
+const RetryInterval = time.Minute
+
+// 定时刷新的规则列表（如从远程地址下载的gfwlist），刷新时整体替换匹配器，刷新失败时保留原有规则
+type RemoteABP struct {
+	Name      string
+	load      func() ([]byte, error) // 内容未变更时返回nil
+	format    string
+	b64decode bool
+	refresh   time.Duration
+	mux       sync.Mutex
+	matcher   *ABPlus
+	loaded    time.Time
+	loading   bool
+	pending   bool // 尚未成功加载，按RetryInterval重试
+}
+
+// 解析规则内容，无有效规则时视为错误，避免将错误页面等内容解析为空列表。设置了缓存目录时，内容未变化则读取缓存
+func (r *RemoteABP) parse(raw []byte) (*ABPlus, error) {
+	matcher, err := parseCached(cacheFileOf(r.Name), raw, func() (*ABPlus, error) {
+		text, err := decodeText(raw, r.b64decode)
+		if err != nil {
+			return nil, err
+		}
+		return NewABPByFormat(text, r.format)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if matcher.Len() == 0 {
+		return nil, fmt.Errorf("no valid rules in %s", r.Name)
+	}
+	return matcher, nil
+}
+
+// 判断域名是否匹配规则，列表过期时在后台刷新
+func (r *RemoteABP) Match(domain string) (matched bool, ok bool) {
+	r.mux.Lock()
+	interval := r.refresh
+	if r.pending {
+		interval = RetryInterval
+	}
+	if interval > 0 && !r.loading && time.Since(r.loaded) >= interval {
+		r.loading = true
+		go r.reload()
+	}
+	matcher := r.matcher
+	r.mux.Unlock()
+	return matcher.Match(domain)
+}
+
+// 返回规则数量
+func (r *RemoteABP) Len() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.matcher.Len()
+}
+
+func (r *RemoteABP) reload() {
+	raw, err := r.load()
+	var matcher *ABPlus
+	if err == nil && raw != nil {
+		matcher, err = r.parse(raw)
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.loading, r.loaded = false, time.Now()
+	if err != nil {
+		log.Printf("[ERROR] refresh %s error: %v\n", r.Name, err)
+		return
+	}
+	if matcher != nil {
+		r.matcher, r.pending = matcher, false
+	}
+}
+
+// 创建定时刷新的规则列表，load用于读取规则内容，format为规则格式（见NewABPByFormat），
+// b64decode为true时先进行base64解码，refresh为0时不刷新
+func NewRemoteABP(name string, load func() ([]byte, error), format string, b64decode bool,
+	refresh time.Duration) (*RemoteABP, error) {
+	if refresh > 0 && refresh < MinRefresh {
+		refresh = MinRefresh
+	}
+	r := &RemoteABP{Name: name, load: load, format: format, b64decode: b64decode, refresh: refresh, loaded: time.Now()}
+	raw, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if r.matcher, err = r.parse(raw); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 同NewRemoteABP，但首次加载失败时以空列表启动，并在查询时于后台每隔RetryInterval重试直至成功，
+// 避免远程地址暂时不可用时无法启动
+func NewRemoteABPRetry(name string, load func() ([]byte, error), format string, b64decode bool,
+	refresh time.Duration) *RemoteABP {
+	r, err := NewRemoteABP(name, load, format, b64decode, refresh)
+	if err == nil {
+		return r
+	}
+	log.Printf("[WARNING] load %s error, start with empty list and retry later: %v\n", name, err)
+	if refresh > 0 && refresh < MinRefresh {
+		refresh = MinRefresh
+	}
+	return &RemoteABP{Name: name, load: load, format: format, b64decode: b64decode, refresh: refresh,
+		matcher: NewABPByText(""), loaded: time.Now(), pending: true}
+}
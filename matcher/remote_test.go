@@ -0,0 +1,71 @@
+package matcher
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRemoteABP(t *testing.T) {
+	_, err := NewRemoteABP("gfwlist", func() ([]byte, error) { return nil, errors.New("fail") }, FormatABP, true, 0)
+	assert.NotEqual(t, err, nil)
+	_, err = NewRemoteABP("gfwlist", func() ([]byte, error) { return []byte("<html>"), nil }, FormatABP, true, 0)
+	assert.NotEqual(t, err, nil)
+	responses := [][]byte{[]byte(base64.StdEncoding.EncodeToString([]byte("||google.com"))), nil,
+		[]byte("invalid"), []byte(base64.StdEncoding.EncodeToString([]byte("||twitter.com")))}
+	load := func() ([]byte, error) {
+		raw := responses[0]
+		responses = responses[1:]
+		return raw, nil
+	}
+	r, err := NewRemoteABP("gfwlist", load, FormatABP, true, time.Hour)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.refresh, time.Hour)
+	matched, _ := r.Match("www.google.com.")
+	assert.True(t, matched)
+	// 内容未变更、内容无效时保留原有规则，之后替换为新规则
+	refresh := func() {
+		r.refresh = time.Millisecond
+		time.Sleep(2 * time.Millisecond)
+		r.Match("")
+		time.Sleep(10 * time.Millisecond)
+		r.refresh = 0
+	}
+	for i := 0; i < 2; i++ {
+		refresh()
+		matched, _ = r.Match("www.google.com.")
+		assert.True(t, matched)
+	}
+	refresh()
+	matched, _ = r.Match("twitter.com.")
+	assert.True(t, matched)
+	_, ok := r.Match("www.google.com.")
+	assert.False(t, ok)
+	assert.Equal(t, r.Len(), 1)
+}
+
+func TestRemoteABPRetry(t *testing.T) {
+	fail := true
+	load := func() ([]byte, error) {
+		if fail {
+			return nil, errors.New("fail")
+		}
+		return []byte("example.com"), nil
+	}
+	// 首次加载失败时以空列表启动
+	r := NewRemoteABPRetry("rules", load, FormatDomains, false, 0)
+	_, ok := r.Match("example.com.")
+	assert.False(t, ok)
+	// 到达重试间隔后在后台重新加载，成功后不再重试
+	fail = false
+	r.loaded = time.Now().Add(-RetryInterval)
+	r.Match("")
+	time.Sleep(10 * time.Millisecond)
+	matched, _ := r.Match("www.example.com.")
+	assert.True(t, matched)
+	r.mux.Lock()
+	assert.False(t, r.pending)
+	r.mux.Unlock()
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"github.com/miekg/dns"
+	"sync"
+)
+
+// 合并键相同的并发查询（singleflight）：首个查询经处理链解析，其余查询等待并共享其响应及组
+type Flight struct {
+	mux   sync.Mutex
+	calls map[string]*flightCall
+}
+
+// 正在处理的查询
+type flightCall struct {
+	done     chan struct{}
+	response *dns.Msg
+	group    string
+}
+
+// 执行next或等待键相同的查询完成，返回true时ctx.Response为共享响应的副本。f为nil时直接执行next
+func (f *Flight) Do(key string, ctx *Context, next Handler) (shared bool) {
+	if f == nil {
+		next(ctx)
+		return false
+	}
+	f.mux.Lock()
+	if call, ok := f.calls[key]; ok {
+		f.mux.Unlock()
+		<-call.done
+		if call.response != nil {
+			ctx.Response = call.response.Copy()
+			ctx.Response.Id = ctx.Request.Id
+		}
+		if ctx.Group == "" {
+			ctx.Group = call.group
+		}
+		return true
+	}
+	if f.calls == nil {
+		f.calls = map[string]*flightCall{}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	f.calls[key] = call
+	f.mux.Unlock()
+
+	defer func() { // next出现panic时也需唤醒等待者
+		if ctx.Response != nil {
+			call.response = ctx.Response.Copy()
+		}
+		call.group = ctx.Group
+		f.mux.Lock()
+		delete(f.calls, key)
+		f.mux.Unlock()
+		close(call.done)
+	}()
+	next(ctx)
+	return false
+}
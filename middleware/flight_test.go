@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlight(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	next := func(ctx *Context) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		ctx.Response = new(dns.Msg).SetReply(ctx.Request)
+		ctx.Group = "clean"
+	}
+	f := &Flight{}
+	var wg sync.WaitGroup
+	var shared int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			request := new(dns.Msg)
+			request.SetQuestion("ip.cn.", dns.TypeA)
+			request.Id = id
+			ctx := &Context{Request: request}
+			if f.Do("ip.cn.1", ctx, next) {
+				atomic.AddInt32(&shared, 1)
+			}
+			if assert.True(t, ctx.Response != nil) {
+				assert.Equal(t, ctx.Response.Id, id) // 共享的响应使用各自的请求ID
+			}
+			assert.Equal(t, ctx.Group, "clean")
+		}(uint16(i + 1))
+	}
+	time.Sleep(50 * time.Millisecond) // 等待所有查询开始
+	close(release)
+	wg.Wait()
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	assert.Equal(t, atomic.LoadInt32(&shared), int32(4))
+	// 查询完成后不再共享
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.False(t, f.Do("ip.cn.1", &Context{Request: request}, next))
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(2))
+	// 为nil时直接执行
+	var nilFlight *Flight
+	assert.False(t, nilFlight.Do("ip.cn.1", &Context{Request: request}, next))
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"sync"
+)
+
+// 单次查询在处理链中传递的上下文
+type Context struct {
+	Request   *dns.Msg
+	Response  *dns.Msg // 处理链返回后写入客户端的响应，为nil时不响应
+	ClientIP  net.IP
+	Group     string // 处理该查询的组名称，响应中的ipv4地址按该组的配置写入ipset
+	LogPrefix string // 查询日志的前缀，未开启查询日志时为空
+	Trace     *Trace // 处理过程记录，为nil时不记录
+	values    map[string]interface{}
+}
+
+// 保存供后续阶段读取的数据
+func (ctx *Context) Set(key string, value interface{}) {
+	if ctx.values == nil {
+		ctx.values = map[string]interface{}{}
+	}
+	ctx.values[key] = value
+}
+
+// 读取先前阶段保存的数据
+func (ctx *Context) Get(key string) (value interface{}, ok bool) {
+	value, ok = ctx.values[key]
+	return
+}
+
+// 处理查询，结果写入ctx.Response
+type Handler func(ctx *Context)
+
+// 处理链中的一个阶段。调用next将查询交由后续阶段处理，next返回后可检查或修改ctx.Response；
+// 不调用next时终止处理，由该阶段生成的ctx.Response作为最终响应
+type Middleware interface {
+	Handle(ctx *Context, next Handler)
+}
+
+// 将函数适配为Middleware
+type Func func(ctx *Context, next Handler)
+
+func (f Func) Handle(ctx *Context, next Handler) {
+	f(ctx, next)
+}
+
+// 将中间件依次串联为处理链，最后一个中间件调用next时执行final
+func Chain(final Handler, mws ...Middleware) Handler {
+	h := final
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, next := mws[i], h
+		h = func(ctx *Context) { mw.Handle(ctx, next) }
+	}
+	return h
+}
+
+// 插件的构造函数，params为配置文件中该插件的参数
+type Factory func(params map[string]interface{}) (Middleware, error)
+
+var (
+	mux       sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// 注册插件，通常在插件包的init函数中调用，编译时在main包中匿名导入插件包即可启用。名称重复时panic
+func Register(name string, factory Factory) {
+	mux.Lock()
+	defer mux.Unlock()
+	if _, ok := factories[name]; ok {
+		panic("middleware: duplicate plugin " + name)
+	}
+	factories[name] = factory
+}
+
+// 已注册的插件名称
+func Plugins() (names []string) {
+	mux.RLock()
+	defer mux.RUnlock()
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// 按名称创建已注册的插件
+func New(name string, params map[string]interface{}) (Middleware, error) {
+	mux.RLock()
+	factory, ok := factories[name]
+	mux.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown plugin: %s", name)
+	}
+	return factory(params)
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var trace []string
+	stage := func(name string) Middleware {
+		return Func(func(ctx *Context, next Handler) {
+			trace = append(trace, name)
+			if name == "stop" {
+				return
+			}
+			next(ctx)
+			trace = append(trace, name+" done")
+		})
+	}
+	h := Chain(func(ctx *Context) { trace = append(trace, "final") }, stage("a"), stage("b"))
+	h(&Context{})
+	assert.Equal(t, trace, []string{"a", "b", "final", "b done", "a done"})
+	trace = nil
+	Chain(func(ctx *Context) { trace = append(trace, "final") }, stage("a"), stage("stop"))(&Context{})
+	assert.Equal(t, trace, []string{"a", "stop", "a done"})
+
+	ctx := &Context{}
+	_, ok := ctx.Get("key")
+	assert.False(t, ok)
+	ctx.Set("key", 1)
+	value, _ := ctx.Get("key")
+	assert.Equal(t, value, 1)
+}
+
+// 直接执行下一阶段的插件，在init中注册以免重复运行测试时因名称重复而panic
+func init() {
+	Register("test", func(params map[string]interface{}) (Middleware, error) {
+		return Func(func(ctx *Context, next Handler) { next(ctx) }), nil
+	})
+}
+
+func TestRegister(t *testing.T) {
+	assert.Equal(t, Plugins(), []string{"test"})
+	assert.Panics(t, func() { Register("test", nil) })
+	_, err := New("test", nil)
+	assert.Equal(t, err, nil)
+	_, err = New("unknown", nil)
+	assert.NotEqual(t, err, nil)
+}
+
+func TestTrace(t *testing.T) {
+	var nilTrace *Trace
+	nilTrace.Add("cache", "miss")
+	nilTrace.Addf("route", "match group '%s'", "dirty")
+	assert.Equal(t, len(nilTrace.Steps()), 0)
+	trace := NewTrace()
+	trace.Add("cache", "miss")
+	trace.Addf("route", "match group '%s'", "dirty")
+	steps := trace.Steps()
+	assert.Equal(t, len(steps), 2)
+	assert.Equal(t, steps[1].Stage, "route")
+	assert.Equal(t, steps[1].Detail, "match group 'dirty'")
+	assert.True(t, steps[1].Elapsed >= steps[0].Elapsed)
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 处理过程中的一个步骤
+type TraceStep struct {
+	Elapsed float64 `json:"elapsed"` // 距开始处理的毫秒数
+	Stage   string  `json:"stage"`   // 所在阶段，如cache、route、upstream
+	Detail  string  `json:"detail"`
+}
+
+// 单次查询的处理过程，由各处理阶段及上游查询记录，供调试接口及query子命令输出
+type Trace struct {
+	start    time.Time
+	mux      sync.Mutex
+	steps    []TraceStep
+	upstream string
+}
+
+// 记录一个步骤，t为nil时忽略。可并发调用（如同时查询多个上游时）
+func (t *Trace) Add(stage, detail string) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(t.start).Seconds() * 1000
+	t.mux.Lock()
+	t.steps = append(t.steps, TraceStep{Elapsed: elapsed, Stage: stage, Detail: detail})
+	t.mux.Unlock()
+}
+
+// 同Add，t为nil时不格式化detail
+func (t *Trace) Addf(stage, format string, args ...interface{}) {
+	if t != nil {
+		t.Add(stage, fmt.Sprintf(format, args...))
+	}
+}
+
+// 记录产生响应的上游服务器，t为nil时不格式化upstream
+func (t *Trace) SetUpstream(upstream interface{}) {
+	if t != nil {
+		name := fmt.Sprint(upstream)
+		t.mux.Lock()
+		t.upstream = name
+		t.mux.Unlock()
+	}
+}
+
+// 返回最后记录的上游服务器
+func (t *Trace) Upstream() string {
+	if t == nil {
+		return ""
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.upstream
+}
+
+// 返回已记录的步骤
+func (t *Trace) Steps() []TraceStep {
+	if t == nil {
+		return nil
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return append([]TraceStep(nil), t.steps...)
+}
+
+func NewTrace() *Trace {
+	return &Trace{start: time.Now()}
+}
@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// 告警事件类型
+const (
+	UpstreamDown = "upstream_down" // 上游服务器连续查询失败
+	ReloadFailed = "reload_failed" // 重载配置失败
+	IPSetErrors  = "ipset_errors"  // 写入ipset出错次数超出阈值
+)
+
+// 发送给webhook的事件内容
+type Event struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Host    string    `json:"host"`
+	Time    time.Time `json:"time"`
+}
+
+// 告警通知：事件发生时向webhook发送POST请求（json格式的Event）或通过Telegram机器人发送消息。
+// 同一事件在cooldown内只通知一次，避免故障期间重复告警
+type Notifier struct {
+	Webhooks      []string
+	TelegramToken string
+	TelegramChat  string
+	Events        map[string]bool // 需要通知的事件，为nil时通知所有事件
+	Cooldown      time.Duration
+	// 上游服务器连续失败多少次时告警，为0时不告警
+	UpstreamFailures int
+	// 每分钟写入ipset出错多少次时告警，为0时不告警
+	IPSetFailures int
+
+	mux       sync.Mutex
+	last      map[string]time.Time // 事件（类型+来源）上次通知的时间
+	failures  map[string]int       // 上游服务器的连续失败次数
+	ipsetErrs int
+	ipsetFrom time.Time // ipset出错次数的统计起始时间
+	apiURL    string    // Telegram API地址，测试时替换
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// 发送事件通知，在后台发送，不阻塞调用方。subject为事件的来源（如上游服务器），用于区分冷却时间
+func (n *Notifier) Notify(event, subject, message string) {
+	if n == nil || n.Events != nil && !n.Events[event] {
+		return
+	}
+	now := time.Now()
+	key := event + "/" + subject
+	n.mux.Lock()
+	if last, ok := n.last[key]; ok && now.Sub(last) < n.Cooldown {
+		n.mux.Unlock()
+		return
+	}
+	if n.last == nil {
+		n.last = map[string]time.Time{}
+	}
+	for k, last := range n.last { // 清理过期的记录
+		if now.Sub(last) >= n.Cooldown {
+			delete(n.last, k)
+		}
+	}
+	n.last[key] = now
+	n.mux.Unlock()
+	host, _ := os.Hostname()
+	go n.send(Event{Event: event, Message: message, Host: host, Time: now})
+}
+
+// 向所有webhook及Telegram发送事件
+func (n *Notifier) send(event Event) {
+	body, _ := json.Marshal(&event)
+	for _, hook := range n.Webhooks {
+		n.post(hook, "application/json", body)
+	}
+	if n.TelegramToken != "" && n.TelegramChat != "" {
+		apiURL := n.apiURL
+		if apiURL == "" {
+			apiURL = "https://api.telegram.org"
+		}
+		text := fmt.Sprintf("[ts-dns@%s] %s: %s", event.Host, event.Event, event.Message)
+		form := url.Values{"chat_id": {n.TelegramChat}, "text": {text}}
+		n.post(apiURL+"/bot"+n.TelegramToken+"/sendMessage", "application/x-www-form-urlencoded",
+			[]byte(form.Encode()))
+	}
+}
+
+func (n *Notifier) post(addr, contentType string, body []byte) {
+	resp, err := client.Post(addr, contentType, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[ERROR] send notification error: %v\n", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[ERROR] send notification error: status %d\n", resp.StatusCode)
+	}
+}
+
+// 记录上游服务器的查询结果，连续失败次数达到UpstreamFailures时告警，成功时重新计数
+func (n *Notifier) UpstreamResult(upstream string, err error) {
+	if n == nil || n.UpstreamFailures <= 0 {
+		return
+	}
+	n.mux.Lock()
+	if err == nil {
+		delete(n.failures, upstream)
+		n.mux.Unlock()
+		return
+	}
+	if n.failures == nil {
+		n.failures = map[string]int{}
+	}
+	n.failures[upstream]++
+	count := n.failures[upstream]
+	n.mux.Unlock()
+	if count == n.UpstreamFailures {
+		n.Notify(UpstreamDown, upstream, fmt.Sprintf("%s failed %d times in a row: %v", upstream, count, err))
+	}
+}
+
+// 记录一次写入ipset出错，一分钟内的出错次数达到IPSetFailures时告警
+func (n *Notifier) IPSetError(err error) {
+	if n == nil || n.IPSetFailures <= 0 {
+		return
+	}
+	now := time.Now()
+	n.mux.Lock()
+	if now.Sub(n.ipsetFrom) >= time.Minute {
+		n.ipsetFrom, n.ipsetErrs = now, 0
+	}
+	n.ipsetErrs++
+	count := n.ipsetErrs
+	n.mux.Unlock()
+	if count == n.IPSetFailures {
+		n.Notify(IPSetErrors, "", fmt.Sprintf("%d ipset errors within a minute, last: %v", count, err))
+	}
+}
+
+// 沿用重载前的告警通知的冷却时间、上游连续失败次数及ipset出错次数，避免重载后重复告警或重新计数
+func (n *Notifier) Inherit(old *Notifier) {
+	if n == nil || old == nil || n == old {
+		return
+	}
+	old.mux.Lock()
+	defer old.mux.Unlock()
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.last, n.failures = map[string]time.Time{}, map[string]int{}
+	for k, v := range old.last {
+		n.last[k] = v
+	}
+	for k, v := range old.failures {
+		n.failures[k] = v
+	}
+	n.ipsetErrs, n.ipsetFrom = old.ipsetErrs, old.ipsetFrom
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/bottoken/sendMessage" {
+			form, _ := url.ParseQuery(string(body))
+			received <- "telegram " + form.Get("chat_id")
+			return
+		}
+		var event Event
+		_ = json.Unmarshal(body, &event)
+		received <- event.Event
+	}))
+	defer server.Close()
+	wait := func() string {
+		select {
+		case s := <-received:
+			return s
+		case <-time.After(time.Second):
+			return ""
+		}
+	}
+
+	n := &Notifier{Webhooks: []string{server.URL}, Cooldown: time.Hour, UpstreamFailures: 2, IPSetFailures: 2}
+	n.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	n.UpstreamResult("udp://1.1.1.1:53", nil) // 成功后重新计数
+	n.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	n.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	assert.Equal(t, wait(), UpstreamDown)
+	// 冷却时间内不重复通知，不同来源单独计算
+	n.Notify(UpstreamDown, "udp://1.1.1.1:53", "again")
+	n.Notify(UpstreamDown, "udp://8.8.8.8:53", "down")
+	assert.Equal(t, wait(), UpstreamDown)
+	assert.Equal(t, wait(), "")
+	n.IPSetError(fmt.Errorf("no such set"))
+	n.IPSetError(fmt.Errorf("no such set"))
+	assert.Equal(t, wait(), IPSetErrors)
+
+	// 仅通知指定事件，通过Telegram发送
+	n = &Notifier{TelegramToken: "token", TelegramChat: "42", apiURL: server.URL,
+		Events: map[string]bool{ReloadFailed: true}}
+	n.Notify(IPSetErrors, "", "ignored")
+	n.Notify(ReloadFailed, "", "bad config")
+	assert.Equal(t, wait(), "telegram 42")
+	assert.Equal(t, wait(), "")
+	// 重载后沿用冷却时间及连续失败次数
+	old := &Notifier{Webhooks: []string{server.URL}, Cooldown: time.Hour, UpstreamFailures: 3}
+	old.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	old.Notify(ReloadFailed, "", "bad config")
+	assert.Equal(t, wait(), ReloadFailed)
+	n = &Notifier{Webhooks: []string{server.URL}, Cooldown: time.Hour, UpstreamFailures: 3}
+	n.Inherit(old)
+	n.Notify(ReloadFailed, "", "bad config")
+	n.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	assert.Equal(t, wait(), "")
+	n.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+	assert.Equal(t, wait(), UpstreamDown)
+	var nilNotifier *Notifier
+	nilNotifier.Inherit(old)
+	nilNotifier.Notify(ReloadFailed, "", "nothing")
+	nilNotifier.UpstreamResult("udp://1.1.1.1:53", fmt.Errorf("timeout"))
+}
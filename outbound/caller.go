@@ -2,43 +2,94 @@ package outbound
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/edns"
 	"golang.org/x/net/proxy"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
-var udpClient = dns.Client{Net: "udp"}
-var tcpClient = dns.Client{Net: "tcp"}
-var httpClient = http.Client{}
-
 type Caller interface {
 	Call(request *dns.Msg) (r *dns.Msg, err error)
 }
 
-func call(client dns.Client, request *dns.Msg, address string, dialer proxy.Dialer) (r *dns.Msg, err error) {
-	if request == nil || len(request.Question) <= 0 || address == "" {
-		return nil, fmt.Errorf("request or server address cannot be empty")
+// 可被取消的Caller，ctx被取消时立即结束查询并释放连接、子进程等资源
+type ContextCaller interface {
+	CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error)
+}
+
+// CallContext 发送查询请求，ctx被取消时返回ctx.Err()。caller未实现ContextCaller时，
+// 未完成的查询在后台继续至超时，但不阻塞调用方
+func CallContext(ctx context.Context, caller Caller, request *dns.Msg) (r *dns.Msg, err error) {
+	if cc, ok := caller.(ContextCaller); ok {
+		return cc.CallContext(ctx, request)
 	}
-	var proxyConn net.Conn
-	// 返回前关闭代理连接
-	defer func() {
-		if proxyConn != nil {
-			_ = proxyConn.Close()
-		}
+	type result struct {
+		r   *dns.Msg
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		r, err := caller.Call(request)
+		ch <- result{r: r, err: err}
 	}()
+	select {
+	case res := <-ch:
+		return res.r, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 持有连接、定时器等资源的Caller，所属配置被替换后关闭。关闭后仍可处理旧配置上未完成的查询，
+// 但不再预热或保持空闲连接
+type Closer interface {
+	Close()
+}
+
+func checkRequest(request *dns.Msg, address string) error {
+	if request == nil || len(request.Question) <= 0 || address == "" {
+		return fmt.Errorf("request or server address cannot be empty")
+	}
+	return nil
+}
+
+func call(client *dns.Client, request *dns.Msg, address string, dialer proxy.Dialer) (r *dns.Msg, err error) {
+	if err = checkRequest(request, address); err != nil {
+		return nil, err
+	}
 	if dialer == nil {
 		// 不使用代理
+		if client.Net == "udp" {
+			r, _, err = exchangeUDP(request, address, client.Timeout, 0, nil)
+			return r, err
+		}
 		r, _, err = client.Exchange(request, address)
-		return r, err
+	} else {
+		r, err = proxyCall(client, request, address, dialer)
+	}
+	if err == nil && !matchResponse(request, r) {
+		return nil, errMismatch
 	}
-	// 使用代理连接DNS服务器
+	return r, err
+}
+
+// 使用代理连接DNS服务器
+func proxyCall(client *dns.Client, request *dns.Msg, address string, dialer proxy.Dialer) (r *dns.Msg, err error) {
+	var proxyConn net.Conn
 	if proxyConn, err = dialer.Dial("tcp", address); err != nil {
 		return nil, err
 	}
+	defer func() { _ = proxyConn.Close() }() // 返回前关闭代理连接
+	if client.Timeout > 0 {
+		_ = proxyConn.SetDeadline(time.Now().Add(client.Timeout))
+	}
 	var conn *dns.Conn
 	if client.Net == "tcp" || client.Net == "udp" {
 		conn = &dns.Conn{Conn: proxyConn}
@@ -49,64 +100,447 @@ func call(client dns.Client, request *dns.Msg, address string, dialer proxy.Dial
 		return nil, err
 	}
 	return conn.ReadMsg()
-
 }
 
 type UDPCaller struct {
-	Address string
-	Dialer  proxy.Dialer
+	Address   string
+	Dialer    proxy.Dialer
+	Timeout   time.Duration // 为0时使用默认超时时间
+	Use0x20   bool          // 随机化请求域名的大小写并校验响应，仅在不使用代理时生效
+	UseCookie bool          // 向上游发送DNS Cookie并校验响应，仅在不使用代理时生效
+	// 收到首个响应后继续等待的时间，仅在不使用代理时生效。伪造响应通常抢先到达，
+	// 因此优先使用后到达的响应；等待期间收到内容不一致的响应时改用TCP查询确认
+	Wait time.Duration
+	// 复用的UDP socket数量，仅在不使用代理时生效。为0时每次请求使用新的socket及随机源端口，
+	// 大于0时减少创建socket的开销，但源端口随机性降低
+	PoolSize int
+	Socket   *SocketOptions // 出站socket选项，为nil时使用默认选项，仅在不使用代理时生效
+	cookies  cookieJar
+	poolOnce sync.Once
+	pool     *socketPool
+}
+
+// 获取该服务器的socket池，未启用复用且未指定socket选项时返回nil
+func (caller *UDPCaller) sockets() *socketPool {
+	if caller.PoolSize <= 0 && caller.Socket == nil {
+		return nil
+	}
+	caller.poolOnce.Do(func() { caller.pool = newSocketPool(caller.PoolSize, caller.Socket) })
+	return caller.pool
+}
+
+// 关闭socket池中的socket
+func (caller *UDPCaller) Close() {
+	caller.poolOnce.Do(func() { caller.pool = &socketPool{opts: caller.Socket} }) // 未使用过时无需预先打开socket
+	caller.pool.close()
 }
 
 func (caller *UDPCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
-	return call(udpClient, request, caller.Address, caller.Dialer)
+	if (caller.Use0x20 || caller.UseCookie || caller.Wait > 0 || caller.PoolSize > 0 || caller.Socket != nil) &&
+		caller.Dialer == nil {
+		if err = checkRequest(request, caller.Address); err != nil {
+			return nil, err
+		}
+		if r, err = caller.exchange(request, true); err == nil && r.Truncated {
+			return caller.retryTCP(request)
+		}
+		return r, err
+	}
+	client := &dns.Client{Net: "udp", Timeout: caller.Timeout}
+	if r, err = call(client, request, caller.Address, caller.Dialer); err == nil && r.Truncated {
+		return caller.retryTCP(request)
+	}
+	return r, err
+}
+
+// 响应被截断时改用TCP重新查询
+func (caller *UDPCaller) retryTCP(request *dns.Msg) (*dns.Msg, error) {
+	tcp := &TCPCaller{Address: caller.Address, Dialer: caller.Dialer, Timeout: caller.Timeout}
+	if tcp.Dialer == nil {
+		tcp.Dialer = caller.Socket.proxyDialer()
+	}
+	return tcp.Call(request)
+}
+
+// 使用0x20、DNS Cookie等机制发送UDP请求。上游返回BADCOOKIE时使用新的服务端Cookie重试一次
+func (caller *UDPCaller) exchange(request *dns.Msg, retry bool) (r *dns.Msg, err error) {
+	sent := request.Copy()
+	if caller.Use0x20 {
+		sent.Question[0].Name = randomizeCase(sent.Question[0].Name)
+	}
+	hasOPT := sent.IsEdns0() != nil
+	if caller.UseCookie {
+		caller.cookies.prepare(sent)
+	}
+	accept := func(r *dns.Msg) bool {
+		if caller.Use0x20 && r.Question[0].Name != sent.Question[0].Name {
+			return false // 大小写不一致
+		}
+		return !caller.UseCookie || caller.cookies.accept(r)
+	}
+	var conflict bool
+	if r, conflict, err = caller.sockets().exchange(sent, caller.Address, caller.Timeout, caller.Wait, accept); err != nil {
+		return nil, err
+	}
+	if conflict { // 疑似遭到抢答污染，通过TCP确认
+		tcp := &TCPCaller{Address: caller.Address, Dialer: caller.Socket.proxyDialer(), Timeout: caller.Timeout}
+		if verified, err := tcp.Call(request); err == nil {
+			return verified, nil
+		}
+	}
+	if caller.UseCookie && r.Rcode == dns.RcodeBadCookie && retry {
+		return caller.exchange(request, false)
+	}
+	// 还原请求域名，并移除上游的Cookie
+	r.Question[0].Name = request.Question[0].Name
+	if caller.UseCookie {
+		if hasOPT {
+			edns.RemoveOption(r, dns.EDNS0COOKIE)
+		} else {
+			edns.RemoveOPT(r)
+		}
+	}
+	return r, nil
+}
+
+// 连接DNS服务器，dialer为nil时直接连接
+func dialTCP(address string, dialer proxy.Dialer, timeout time.Duration) (net.Conn, error) {
+	if dialer != nil {
+		return dialer.Dial("tcp", address)
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return net.DialTimeout("tcp", address, timeout)
 }
 
 type TCPCaller struct {
-	Address string
-	Dialer  proxy.Dialer
+	Address  string
+	Dialer   proxy.Dialer
+	Timeout  time.Duration // 为0时使用默认超时时间
+	Pipeline bool          // 复用连接并同时发送多个请求
+	Idle     time.Duration // 复用连接的空闲超时时间，服务器未声明时使用，为0时使用默认值
+	once     sync.Once
+	pipe     *pipeline
 }
 
 func (caller *TCPCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
-	return call(tcpClient, request, caller.Address, caller.Dialer)
+	if caller.Pipeline {
+		if err = checkRequest(request, caller.Address); err != nil {
+			return nil, err
+		}
+		return caller.conns().exchange(request, caller.Timeout)
+	}
+	client := &dns.Client{Net: "tcp", Timeout: caller.Timeout}
+	return call(client, request, caller.Address, caller.Dialer)
+}
+
+// 获取复用的连接
+func (caller *TCPCaller) conns() *pipeline {
+	caller.once.Do(func() {
+		caller.pipe = &pipeline{dial: func() (net.Conn, error) {
+			return dialTCP(caller.Address, caller.Dialer, caller.Timeout)
+		}, maxIdle: caller.Idle}
+	})
+	return caller.pipe
+}
+
+// 关闭复用的空闲连接
+func (caller *TCPCaller) Close() {
+	if caller.Pipeline {
+		caller.conns().close()
+	}
+}
+
+// 填充请求以隐藏加密传输中的报文长度，返回填充后的请求副本
+func padRequest(request *dns.Msg) (*dns.Msg, error) {
+	padded := request.Copy()
+	if err := edns.Pad(padded, edns.QueryPaddingBlock); err != nil {
+		return nil, err
+	}
+	return padded, nil
+}
+
+// 移除响应中的填充，请求原本无OPT记录时一并移除OPT记录
+func unpadResponse(request, r *dns.Msg) {
+	if request.IsEdns0() != nil {
+		edns.RemoveOption(r, dns.EDNS0PADDING)
+	} else {
+		edns.RemoveOPT(r)
+	}
 }
 
 type TLSCaller struct {
-	address string
-	dialer  proxy.Dialer
-	client  dns.Client
+	Timeout   time.Duration // 为0时使用默认超时时间
+	Padding   bool          // 是否使用EDNS0 Padding填充请求
+	Pipeline  bool          // 复用连接并同时发送多个请求
+	Idle      time.Duration // 复用连接的空闲超时时间，服务器未声明时使用，为0时使用默认值
+	once      sync.Once
+	pipe      *pipeline
+	address   string
+	dialer    proxy.Dialer
+	tlsConfig *tls.Config
 }
 
 func (caller *TLSCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
-	return call(caller.client, request, caller.address, caller.dialer)
+	if !caller.Padding || request == nil {
+		return caller.exchange(request)
+	}
+	var padded *dns.Msg
+	if padded, err = padRequest(request); err != nil {
+		return nil, err
+	}
+	if r, err = caller.exchange(padded); r != nil {
+		unpadResponse(request, r)
+	}
+	return r, err
+}
+
+func (caller *TLSCaller) exchange(request *dns.Msg) (r *dns.Msg, err error) {
+	if caller.Pipeline {
+		if err = checkRequest(request, caller.address); err != nil {
+			return nil, err
+		}
+		return caller.conns().exchange(request, caller.Timeout)
+	}
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: caller.tlsConfig, Timeout: caller.Timeout}
+	return call(client, request, caller.address, caller.dialer)
+}
+
+// 获取复用的连接
+func (caller *TLSCaller) conns() *pipeline {
+	caller.once.Do(func() {
+		caller.pipe = &pipeline{dial: caller.dialTLS, maxIdle: caller.Idle}
+	})
+	return caller.pipe
+}
+
+// 关闭复用的空闲连接
+func (caller *TLSCaller) Close() {
+	if caller.Pipeline {
+		caller.conns().close()
+	}
+}
+
+// 建立TLS连接并完成握手
+func (caller *TLSCaller) dialTLS() (net.Conn, error) {
+	raw, err := dialTCP(caller.address, caller.dialer, caller.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	timeout := caller.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	_ = raw.SetDeadline(time.Now().Add(timeout))
+	conn := tls.Client(raw, caller.tlsConfig)
+	if err = conn.Handshake(); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return conn, nil
 }
 
 func NewTLSCaller(address string, dialer proxy.Dialer,
 	serverName string, skipVerify bool) *TLSCaller {
-	client := dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{
-		ServerName: serverName, InsecureSkipVerify: skipVerify,
-	}}
-	caller := &TLSCaller{address: address, dialer: dialer, client: client}
+	// 重连时恢复TLS会话，减少握手的往返次数
+	tlsConfig := &tls.Config{ServerName: serverName, InsecureSkipVerify: skipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	caller := &TLSCaller{address: address, dialer: dialer, tlsConfig: tlsConfig}
 	return caller
 }
 
+// 要求服务器证书链中任一证书TBS部分的SHA256与hashes之一匹配（证书固定）
+func (caller *TLSCaller) PinCertificates(hashes [][]byte) {
+	if len(hashes) > 0 {
+		caller.tlsConfig.VerifyPeerCertificate = verifyHashes(hashes)
+	}
+}
+
+// DoH连接的空闲超时时间
+const dohIdleTimeout = 90 * time.Second
+
 type DoHCaller struct {
-	Url    string
-	Dialer proxy.Dialer
+	Url     string
+	Dialer  proxy.Dialer
+	Timeout time.Duration // 为0时使用默认超时时间
+	Padding bool          // 是否使用EDNS0 Padding填充请求
+	// 服务器域名对应的ip，为空时通过Resolver或系统解析。TLS证书仍按Url中的域名校验
+	Bootstrap []string
+	Resolver  Caller   // 解析服务器域名的上游，避免经可能被污染的系统DNS解析
+	Hashes    [][]byte // 证书链中任一证书TBS部分的SHA256，为空时不校验
+	once      sync.Once
+	client    *http.Client
+	mux       sync.Mutex
+	timer     *time.Timer // 为nil时未启用预热
+	used      bool        // 上次预热后是否有请求
+	closed    bool        // 关闭后不再预热
+}
+
+// 获取共享的http客户端，并发请求通过HTTP/2在同一连接上复用
+func (caller *DoHCaller) httpClient() *http.Client {
+	caller.once.Do(func() {
+		transport := &http.Transport{ForceAttemptHTTP2: true, IdleConnTimeout: dohIdleTimeout,
+			MaxIdleConnsPerHost: 4, TLSHandshakeTimeout: defaultTimeout}
+		if caller.Dialer != nil { // 使用代理
+			transport.Dial = caller.Dialer.Dial
+		}
+		if len(caller.Bootstrap) > 0 || caller.Resolver != nil {
+			transport.Dial = caller.bootstrapDial(transport.Dial)
+		}
+		if len(caller.Hashes) > 0 {
+			transport.TLSClientConfig = &tls.Config{VerifyPeerCertificate: verifyHashes(caller.Hashes)}
+		}
+		timeout := caller.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+		caller.client = &http.Client{Transport: transport, Timeout: timeout}
+	})
+	return caller.client
+}
+
+// 将连接的目标地址替换为Bootstrap中或经Resolver解析得到的ip，依次尝试直至连接成功
+func (caller *DoHCaller) bootstrapDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: defaultTimeout}).Dial
+	}
+	return func(network, addr string) (conn net.Conn, err error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips := caller.Bootstrap
+		if len(ips) == 0 {
+			if ips, err = caller.resolve(host); err != nil {
+				return nil, err
+			}
+		}
+		for _, ip := range ips {
+			if conn, err = dial(network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// 经Resolver查询服务器域名的A及AAAA记录
+func (caller *DoHCaller) resolve(host string) (ips []string, err error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		request := new(dns.Msg)
+		request.SetQuestion(dns.Fqdn(host), qtype)
+		var r *dns.Msg
+		if r, err = caller.Resolver.Call(request); err != nil {
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if err == nil {
+			err = fmt.Errorf("bootstrap resolve %s: no address", host)
+		}
+		return nil, err
+	}
+	return ips, nil
+}
+
+// Warmup 预先建立到DoH服务器的连接，避免首个请求等待TLS握手。
+// 连接因空闲超时关闭后，若期间有过请求则重新建立连接
+func (caller *DoHCaller) Warmup() {
+	caller.mux.Lock()
+	closed := caller.closed
+	caller.mux.Unlock()
+	if closed {
+		return
+	}
+	req, err := http.NewRequest(http.MethodHead, caller.Url, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = caller.httpClient().Do(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	if caller.closed {
+		return
+	} else if caller.timer == nil {
+		caller.timer = time.AfterFunc(dohIdleTimeout+time.Second, caller.rewarm)
+	} else {
+		caller.timer.Reset(dohIdleTimeout + time.Second)
+	}
+	caller.used = false
+}
+
+// 空闲超时后重新预热，期间无请求时停止预热
+func (caller *DoHCaller) rewarm() {
+	caller.mux.Lock()
+	used := caller.used
+	caller.mux.Unlock()
+	if used {
+		caller.Warmup()
+	}
+}
+
+// 记录请求，并推迟下次预热的时间
+func (caller *DoHCaller) touch() {
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	if caller.timer != nil && !caller.closed {
+		caller.used = true
+		caller.timer.Reset(dohIdleTimeout + time.Second)
+	}
+}
+
+// 停止预热并关闭空闲连接
+func (caller *DoHCaller) Close() {
+	caller.mux.Lock()
+	caller.closed = true
+	if caller.timer != nil {
+		caller.timer.Stop()
+	}
+	caller.mux.Unlock()
+	caller.httpClient().CloseIdleConnections()
 }
 
 func (caller *DoHCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+func (caller *DoHCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
 	// 打包请求
+	sent := request
+	if caller.Padding {
+		if sent, err = padRequest(request); err != nil {
+			return nil, err
+		}
+	}
 	var buf []byte
-	if buf, err = request.Pack(); err != nil {
+	if buf, err = sent.Pack(); err != nil {
 		return nil, err
 	}
-	if caller.Dialer != nil { // 使用代理
-		httpClient.Transport = &http.Transport{Dial: caller.Dialer.Dial}
-	}
+	defer caller.touch()
 	// 发送请求
 	var resp *http.Response
 	contentType, payload := "application/dns-message", bytes.NewBuffer(buf)
-	if resp, err = httpClient.Post(caller.Url, contentType, payload); err != nil {
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, caller.Url, payload); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if resp, err = caller.httpClient().Do(req); err != nil {
 		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -120,5 +554,11 @@ func (caller *DoHCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
 	if err = msg.Unpack(body); err != nil {
 		return nil, err
 	}
+	if !matchResponse(request, msg) {
+		return nil, errMismatch
+	}
+	if caller.Padding {
+		unpadResponse(request, msg)
+	}
 	return msg, nil
 }
@@ -5,7 +5,10 @@ import (
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/proxy"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type DialerMock struct {
@@ -61,6 +64,37 @@ func TestUDPCaller(t *testing.T) {
 	assertSuccess(t, r, err)
 }
 
+func TestUDPTruncated(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	// UDP响应设置TC标志，TCP响应包含完整记录
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		r := new(dns.Msg).SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			r.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(req.Question[0].Name + " 0 IN A 1.2.3.4")
+			r.Answer = append(r.Answer, rr)
+		}
+		_ = w.WriteMsg(r)
+	})
+	udpServer := &dns.Server{PacketConn: conn, Handler: handler}
+	tcpServer := &dns.Server{Listener: listener, Handler: handler}
+	go func() { _ = udpServer.ActivateAndServe() }()
+	go func() { _ = tcpServer.ActivateAndServe() }()
+	defer func() { _ = udpServer.Shutdown(); _ = tcpServer.Shutdown() }()
+	time.Sleep(50 * time.Millisecond)
+
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	caller := UDPCaller{Address: listener.Addr().String(), Timeout: time.Second}
+	r, err := caller.Call(req)
+	assertSuccess(t, r, err)
+	assert.False(t, r.Truncated)
+}
+
 func TestTCPCaller(t *testing.T) {
 	address := "1.1.1.1:53"
 	// 正常请求
@@ -110,4 +144,30 @@ func TestDoHCaller(t *testing.T) {
 	caller = DoHCaller{Url: url, Dialer: fakeDialer}
 	r, err = caller.Call(request)
 	assertFail(t, r, err)
+	// 通过指定的ip连接服务器
+	caller = DoHCaller{Url: url, Bootstrap: []string{"127.0.0.1"}}
+	r, err = caller.Call(request)
+	assertFail(t, r, err)
+	caller = DoHCaller{Url: url, Bootstrap: []string{"127.0.0.1", "1.1.1.1"}}
+	r, err = caller.Call(request)
+	assertSuccess(t, r, err)
+}
+
+func TestDoHTimeout(t *testing.T) {
+	done := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+	// 未指定超时时间时使用默认超时时间，不因服务器无响应而阻塞
+	request.SetQuestion(question.Name, question.Qtype)
+	caller := DoHCaller{Url: server.URL}
+	start := time.Now()
+	r, err := caller.Call(request)
+	assertFail(t, r, err)
+	assert.True(t, time.Since(start) < defaultTimeout+time.Second)
 }
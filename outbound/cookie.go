@@ -0,0 +1,41 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/edns"
+	"sync"
+)
+
+// 与上游服务器间的DNS Cookie状态（RFC 7873）
+type cookieJar struct {
+	mux    sync.Mutex
+	client string // 本地生成的客户端Cookie
+	server string // 上游返回的服务端Cookie
+}
+
+// 将请求中的Cookie替换为本地Cookie，避免转发客户端的Cookie
+func (j *cookieJar) prepare(request *dns.Msg) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	if j.client == "" {
+		j.client = edns.NewClientCookie()
+	}
+	edns.SetCookie(request, j.client, j.server)
+}
+
+// 校验响应中的Cookie并记录服务端Cookie。响应中的客户端Cookie与本地不一致时视为伪造响应
+func (j *cookieJar) accept(r *dns.Msg) bool {
+	client, server, ok := edns.GetCookie(r)
+	j.mux.Lock()
+	defer j.mux.Unlock()
+	if !ok {
+		return j.server == "" // 上游曾返回过Cookie时，缺少Cookie的响应视为伪造
+	}
+	if client != j.client {
+		return false
+	}
+	if server != "" {
+		j.server = server
+	}
+	return true
+}
@@ -0,0 +1,358 @@
+package outbound
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/proxy"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DNSCrypt v2证书及响应的magic
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+)
+
+// DNSCrypt证书声明的加密方式
+const (
+	dnscryptXSalsa20  = 0x0001 // X25519-XSalsa20Poly1305
+	dnscryptXChacha20 = 0x0002 // X25519-XChacha20Poly1305
+)
+
+const (
+	dnscryptMinUDPQuery = 256              // UDP查询填充后的最小长度
+	dnscryptCertTTL     = 30 * time.Minute // 重新获取证书的间隔，以便及时使用轮换后的证书
+)
+
+var errDNSCryptResponse = errors.New("invalid dnscrypt response")
+
+// 服务器证书及由此计算的共享密钥
+type dnscryptCert struct {
+	esVersion   uint16
+	clientMagic []byte
+	serial      uint32
+	notAfter    time.Time
+	sharedKey   [32]byte
+	fetchedAt   time.Time
+}
+
+// DNSCrypt v2服务器，地址、服务名及公钥通常来自DNS stamp。使用socks5代理时经TCP查询；
+// 指定Relay时经匿名化中继（Anonymized DNSCrypt）以UDP查询，服务器地址须为ip:port
+type DNSCryptCaller struct {
+	Timeout      time.Duration // 为0时使用默认超时时间
+	Dialer       proxy.Dialer
+	Relay        string
+	Socket       *SocketOptions // 出站socket选项，为nil时使用默认选项，仅在不使用代理时生效
+	address      string
+	providerName string
+	publicKey    ed25519.PublicKey
+	clientPK     [32]byte
+	clientSK     [32]byte
+	mux          sync.Mutex
+	cert         *dnscryptCert
+}
+
+func NewDNSCryptCaller(address, providerName string, publicKey []byte) (*DNSCryptCaller, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid dnscrypt public key length: %d", len(publicKey))
+	}
+	caller := &DNSCryptCaller{address: address, providerName: dns.Fqdn(providerName), publicKey: publicKey}
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caller.clientPK, caller.clientSK = *pk, *sk
+	return caller, nil
+}
+
+// 匿名化中继请求的头部：8字节0xff、2字节0及服务器的ipv6（ipv4映射）地址和端口
+func relayHeader(address string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip, portNum := net.ParseIP(host), 0
+	if portNum, err = strconv.Atoi(port); ip == nil || err != nil {
+		return nil, fmt.Errorf("relay requires an ip:port server address: %s", address)
+	}
+	header := append(bytes.Repeat([]byte{0xff}, 8), 0, 0)
+	header = append(header, ip.To16()...)
+	return append(header, byte(portNum>>8), byte(portNum)), nil
+}
+
+// 发送报文并读取响应，经TCP时使用2字节长度前缀
+func (caller *DNSCryptCaller) roundTrip(packet []byte, tcp bool) ([]byte, error) {
+	timeout := caller.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if tcp || caller.Dialer != nil {
+		dialer := caller.Dialer
+		if dialer == nil {
+			dialer = caller.Socket.proxyDialer()
+		}
+		conn, err := dialTCP(caller.address, dialer, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 2, 2+len(packet))
+		binary.BigEndian.PutUint16(buf, uint16(len(packet)))
+		if _, err = conn.Write(append(buf, packet...)); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint16(buf))
+		_, err = io.ReadFull(conn, data)
+		return data, err
+	}
+	address := caller.address
+	if caller.Relay != "" {
+		header, err := relayHeader(caller.address)
+		if err != nil {
+			return nil, err
+		}
+		address, packet = caller.Relay, append(header, packet...)
+	}
+	conn, err := caller.Socket.dialUDP(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(buf)
+	return buf[:n], err
+}
+
+// 还原TXT记录中经miekg/dns转义的二进制内容
+func unescapeTXT(text string) []byte {
+	var buf []byte
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 >= len(text) {
+			buf = append(buf, text[i])
+			continue
+		}
+		if i+3 < len(text) && isDigit(text[i+1]) && isDigit(text[i+2]) && isDigit(text[i+3]) {
+			n, _ := strconv.Atoi(text[i+1 : i+4])
+			buf, i = append(buf, byte(n)), i+3
+		} else {
+			buf, i = append(buf, text[i+1]), i+1
+		}
+	}
+	return buf
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// 解析并校验证书，证书无效或不在有效期内时返回nil
+func (caller *DNSCryptCaller) parseCert(data []byte, now time.Time) *dnscryptCert {
+	if len(data) < 124 || !bytes.Equal(data[:4], dnscryptCertMagic) {
+		return nil
+	}
+	signature, signed := data[8:72], data[72:]
+	if !ed25519.Verify(caller.publicKey, signed, signature) {
+		return nil
+	}
+	cert := &dnscryptCert{esVersion: binary.BigEndian.Uint16(data[4:6]), clientMagic: signed[32:40],
+		serial: binary.BigEndian.Uint32(signed[40:44])}
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0)
+	if now.Before(notBefore) || !now.Before(cert.notAfter) {
+		return nil
+	}
+	var resolverPK [32]byte
+	copy(resolverPK[:], signed[:32])
+	switch cert.esVersion {
+	case dnscryptXSalsa20:
+		box.Precompute(&cert.sharedKey, &resolverPK, &caller.clientSK)
+	case dnscryptXChacha20:
+		shared, err := curve25519.X25519(caller.clientSK[:], resolverPK[:])
+		if err != nil {
+			return nil
+		}
+		key, _ := chacha20.HChaCha20(shared, make([]byte, 16))
+		copy(cert.sharedKey[:], key)
+	default:
+		return nil
+	}
+	return cert
+}
+
+// 获取服务器证书，有多个有效证书时使用序列号最大的，序列号相同时优先使用XChacha20
+func (caller *DNSCryptCaller) certificate() (*dnscryptCert, error) {
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	now := time.Now()
+	if cert := caller.cert; cert != nil && now.Before(cert.notAfter) && now.Sub(cert.fetchedAt) < dnscryptCertTTL {
+		return cert, nil
+	}
+	request := new(dns.Msg)
+	request.SetQuestion(caller.providerName, dns.TypeTXT)
+	raw, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = caller.roundTrip(raw, false); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err = r.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if r.Truncated && caller.Relay == "" {
+		if raw, err = request.Pack(); err == nil {
+			raw, err = caller.roundTrip(raw, true)
+		}
+		if err != nil || r.Unpack(raw) != nil {
+			return nil, fmt.Errorf("fetch dnscrypt certificate error: %v", err)
+		}
+	}
+	if !matchResponse(request, r) {
+		return nil, errMismatch
+	}
+	var best *dnscryptCert
+	for _, answer := range r.Answer {
+		txt, ok := answer.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		var data []byte
+		for _, text := range txt.Txt {
+			data = append(data, unescapeTXT(text)...)
+		}
+		cert := caller.parseCert(data, now)
+		if cert != nil && (best == nil || cert.serial > best.serial ||
+			cert.serial == best.serial && cert.esVersion > best.esVersion) {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no valid dnscrypt certificate for %s", caller.providerName)
+	}
+	best.fetchedAt, caller.cert = now, best
+	return best, nil
+}
+
+// 按ISO/IEC 7816-4填充至64字节的整数倍且不小于minLen
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := (len(msg) + 1 + 63) &^ 63
+	if n < minLen {
+		n = minLen
+	}
+	padded := make([]byte, n)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(msg []byte) ([]byte, error) {
+	i := len(msg) - 1
+	for i >= 0 && msg[i] == 0 {
+		i--
+	}
+	if i < 0 || msg[i] != 0x80 {
+		return nil, errDNSCryptResponse
+	}
+	return msg[:i], nil
+}
+
+// 使用证书中的密钥加密、解密报文
+func (cert *dnscryptCert) seal(nonce *[24]byte, plain []byte) []byte {
+	if cert.esVersion == dnscryptXSalsa20 {
+		return box.SealAfterPrecomputation(nil, plain, nonce, &cert.sharedKey)
+	}
+	aead, _ := chacha20poly1305.NewX(cert.sharedKey[:])
+	return aead.Seal(nil, nonce[:], plain, nil)
+}
+
+func (cert *dnscryptCert) open(nonce *[24]byte, sealed []byte) ([]byte, error) {
+	if cert.esVersion == dnscryptXSalsa20 {
+		if plain, ok := box.OpenAfterPrecomputation(nil, sealed, nonce, &cert.sharedKey); ok {
+			return plain, nil
+		}
+		return nil, errDNSCryptResponse
+	}
+	aead, _ := chacha20poly1305.NewX(cert.sharedKey[:])
+	return aead.Open(nil, nonce[:], sealed, nil)
+}
+
+// 加密发送请求并解密响应
+func (caller *DNSCryptCaller) exchange(cert *dnscryptCert, query []byte, tcp bool) (*dns.Msg, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+	minLen := dnscryptMinUDPQuery
+	if tcp {
+		minLen = 0
+	}
+	packet := append(append(append([]byte{}, cert.clientMagic...), caller.clientPK[:]...), nonce[:12]...)
+	packet = append(packet, cert.seal(&nonce, dnscryptPad(query, minLen))...)
+	raw, err := caller.roundTrip(packet, tcp)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 8+24+16 || !bytes.Equal(raw[:8], dnscryptResolverMagic) || !bytes.Equal(raw[8:20], nonce[:12]) {
+		return nil, errDNSCryptResponse
+	}
+	copy(nonce[:], raw[8:32])
+	plain, err := cert.open(&nonce, raw[32:])
+	if err != nil {
+		return nil, err
+	}
+	if plain, err = dnscryptUnpad(plain); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err = r.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (caller *DNSCryptCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	if err = checkRequest(request, caller.address); err != nil {
+		return nil, err
+	}
+	cert, err := caller.certificate()
+	if err != nil {
+		return nil, err
+	}
+	query, err := request.Pack()
+	if err != nil {
+		return nil, err
+	}
+	tcp := caller.Dialer != nil
+	if r, err = caller.exchange(cert, query, tcp); err == nil && r.Truncated && !tcp && caller.Relay == "" {
+		r, err = caller.exchange(cert, query, true) // 响应被截断时改用TCP重新查询
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !matchResponse(request, r) {
+		return nil, errMismatch
+	}
+	return r, nil
+}
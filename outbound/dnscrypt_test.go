@@ -0,0 +1,154 @@
+package outbound
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 本地DNSCrypt服务器，应答所有A查询为1.1.1.1，返回服务器地址及提供者公钥
+func startDNSCryptServer(t *testing.T, esVersion uint16) (addr string, providerPK []byte, stop func()) {
+	providerPK, providerSK, _ := ed25519.GenerateKey(rand.Reader)
+	resolverPK, resolverSK, _ := box.GenerateKey(rand.Reader)
+	clientMagic := resolverPK[:8]
+	// 生成证书：magic、加密方式、次版本号、签名及签名内容
+	signed := append(append([]byte{}, resolverPK[:]...), clientMagic...)
+	now := uint32(time.Now().Unix())
+	for _, value := range []uint32{1, now - 60, now + 3600} { // 序列号及有效期
+		signed = binary.BigEndian.AppendUint32(signed, value)
+	}
+	cert := append(append([]byte("DNSC"), byte(esVersion>>8), byte(esVersion), 0, 0),
+		ed25519.Sign(providerSK, signed)...)
+	cert = append(cert, signed...)
+	var escaped strings.Builder
+	for _, b := range cert {
+		fmt.Fprintf(&escaped, "\\%03d", b)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packet := buf[:n]
+			if !bytes.HasPrefix(packet, clientMagic) { // 查询证书
+				request := new(dns.Msg)
+				_ = request.Unpack(packet)
+				r := new(dns.Msg).SetReply(request)
+				r.Answer = append(r.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: request.Question[0].Name,
+					Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{escaped.String()}})
+				raw, _ := r.Pack()
+				_, _ = conn.WriteTo(raw, client)
+				continue
+			}
+			var clientPK [32]byte
+			copy(clientPK[:], packet[8:40])
+			key := &dnscryptCert{esVersion: esVersion}
+			if esVersion == dnscryptXSalsa20 {
+				box.Precompute(&key.sharedKey, &clientPK, resolverSK)
+			} else {
+				shared, _ := curve25519.X25519(resolverSK[:], clientPK[:])
+				hkey, _ := chacha20.HChaCha20(shared, make([]byte, 16))
+				copy(key.sharedKey[:], hkey)
+			}
+			var nonce [24]byte
+			copy(nonce[:], packet[40:52])
+			plain, err := key.open(&nonce, packet[52:])
+			if !assert.Equal(t, err, nil) {
+				continue
+			}
+			assert.True(t, len(plain) >= dnscryptMinUDPQuery && len(plain)%64 == 0)
+			plain, _ = dnscryptUnpad(plain)
+			request := new(dns.Msg)
+			_ = request.Unpack(plain)
+			r := new(dns.Msg).SetReply(request)
+			rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 1.1.1.1")
+			r.Answer = append(r.Answer, rr)
+			raw, _ := r.Pack()
+			_, _ = rand.Read(nonce[12:])
+			resp := append(append(append([]byte{}, dnscryptResolverMagic...), nonce[:]...),
+				key.seal(&nonce, dnscryptPad(raw, 0))...)
+			_, _ = conn.WriteTo(resp, client)
+		}
+	}()
+	return conn.LocalAddr().String(), providerPK, func() { _ = conn.Close() }
+}
+
+// 匿名化中继：移除请求头部后转发至头部指定的服务器
+func startRelay(t *testing.T) (addr string, stop func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 28 || !bytes.Equal(buf[:10], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0}) {
+				continue
+			}
+			server := &net.UDPAddr{IP: net.IP(buf[10:26]), Port: int(binary.BigEndian.Uint16(buf[26:28]))}
+			upstream, _ := net.DialUDP("udp", nil, server)
+			_, _ = upstream.Write(buf[28:n])
+			resp := make([]byte, dns.MaxMsgSize)
+			_ = upstream.SetDeadline(time.Now().Add(time.Second))
+			if m, err := upstream.Read(resp); err == nil {
+				_, _ = conn.WriteTo(resp[:m], client)
+			}
+			_ = upstream.Close()
+		}
+	}()
+	return conn.LocalAddr().String(), func() { _ = conn.Close() }
+}
+
+func TestDNSCryptCaller(t *testing.T) {
+	_, err := NewDNSCryptCaller("127.0.0.1:443", "2.dnscrypt-cert.example.com", []byte("short"))
+	assert.NotEqual(t, err, nil)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	for _, esVersion := range []uint16{dnscryptXSalsa20, dnscryptXChacha20} {
+		addr, providerPK, stop := startDNSCryptServer(t, esVersion)
+		caller, err := NewDNSCryptCaller(addr, "2.dnscrypt-cert.example.com", providerPK)
+		assert.Equal(t, err, nil)
+		for i := 0; i < 2; i++ { // 证书获取后复用
+			r, err := caller.Call(request)
+			assertSuccess(t, r, err)
+		}
+		assert.Equal(t, caller.cert.esVersion, esVersion)
+		assert.Equal(t, caller.String(), "dnscrypt://"+addr+"@2.dnscrypt-cert.example.com")
+		// 经匿名化中继查询
+		relay, stopRelay := startRelay(t)
+		caller, _ = NewDNSCryptCaller(addr, "2.dnscrypt-cert.example.com", providerPK)
+		caller.Relay = relay
+		r, err := caller.Call(request)
+		assertSuccess(t, r, err)
+		stopRelay()
+		// 公钥不匹配时证书无效
+		otherPK, _, _ := ed25519.GenerateKey(rand.Reader)
+		caller, _ = NewDNSCryptCaller(addr, "2.dnscrypt-cert.example.com", otherPK)
+		r, err = caller.Call(request)
+		assertFail(t, r, err)
+		stop()
+	}
+	_, err = relayHeader("example.com:443")
+	assert.NotEqual(t, err, nil)
+	header, _ := relayHeader("1.2.3.4:443")
+	assert.Equal(t, header[10:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4, 1, 187})
+	assert.Equal(t, unescapeTXT(`a\\\"\000\255`), []byte{'a', '\\', '"', 0, 255})
+}
@@ -0,0 +1,174 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DoQ连接的空闲超时时间，超时后由quic-go关闭连接
+const doqIdleTimeout = 90 * time.Second
+
+// DNS over QUIC（RFC 9250）服务器，所有查询复用同一QUIC连接，每个查询使用单独的流。
+// QUIC基于UDP，不支持通过socks5代理连接
+type DoQCaller struct {
+	Timeout   time.Duration  // 为0时使用默认超时时间
+	Padding   bool           // 是否使用EDNS0 Padding填充请求
+	Socket    *SocketOptions // 出站socket选项，为nil时使用默认选项
+	address   string
+	tlsConfig *tls.Config
+	mux       sync.Mutex
+	conn      quic.Connection // 为nil时在下次查询时建立连接
+}
+
+func NewDoQCaller(address, serverName string) *DoQCaller {
+	tlsConfig := &tls.Config{ServerName: serverName, NextProtos: []string{"doq"}, MinVersion: tls.VersionTLS13}
+	return &DoQCaller{address: address, tlsConfig: tlsConfig}
+}
+
+// 要求服务器证书链中任一证书TBS部分的SHA256与hashes之一匹配（证书固定）
+func (caller *DoQCaller) PinCertificates(hashes [][]byte) {
+	if len(hashes) > 0 {
+		caller.tlsConfig.VerifyPeerCertificate = verifyHashes(hashes)
+	}
+}
+
+// 获取可用的QUIC连接，reused表示该连接是否已被先前的查询使用过
+func (caller *DoQCaller) connection(ctx context.Context) (conn quic.Connection, reused bool, err error) {
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	if caller.conn != nil && caller.conn.Context().Err() == nil {
+		return caller.conn, true, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", caller.address)
+	if err != nil {
+		return nil, false, err
+	}
+	udp, err := caller.Socket.listenUDP()
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err = quic.Dial(ctx, udp, addr, caller.tlsConfig, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+	if err != nil {
+		_ = udp.Close()
+		return nil, false, err
+	}
+	go func() { // quic-go不关闭传入的socket，连接关闭后自行关闭
+		<-conn.Context().Done()
+		_ = udp.Close()
+	}()
+	caller.conn = conn
+	return conn, false, nil
+}
+
+// 在未完成的查询超时后关闭连接
+func (caller *DoQCaller) Close() {
+	caller.mux.Lock()
+	conn := caller.conn
+	caller.conn = nil
+	caller.mux.Unlock()
+	if conn != nil {
+		timeout := caller.Timeout
+		if timeout <= 0 {
+			timeout = defaultTimeout
+		}
+		time.AfterFunc(timeout, func() { _ = conn.CloseWithError(0, "") })
+	}
+}
+
+// 丢弃出错的连接，下次查询时重新建立
+func (caller *DoQCaller) reset(conn quic.Connection) {
+	caller.mux.Lock()
+	if caller.conn == conn {
+		caller.conn = nil
+	}
+	caller.mux.Unlock()
+	_ = conn.CloseWithError(0, "")
+}
+
+func (caller *DoQCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+func (caller *DoQCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
+	if err = checkRequest(request, caller.address); err != nil {
+		return nil, err
+	}
+	query := request
+	if caller.Padding {
+		if query, err = padRequest(request); err != nil {
+			return nil, err
+		}
+	} else {
+		query = request.Copy()
+	}
+	query.Id = 0 // RFC 9250要求DNS消息的ID为0
+	var raw []byte
+	if raw, err = query.Pack(); err != nil {
+		return nil, err
+	}
+	timeout := caller.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		conn, reused, err := caller.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if r, err = caller.exchange(ctx, conn, raw); err == nil {
+			break
+		}
+		caller.reset(conn)
+		if !reused || ctx.Err() != nil { // 复用的连接可能已被服务器关闭，使用新连接重试一次
+			return nil, err
+		}
+	}
+	r.Id = request.Id
+	if caller.Padding {
+		unpadResponse(request, r)
+	}
+	if !matchResponse(request, r) {
+		return nil, errMismatch
+	}
+	return r, nil
+}
+
+// 在新的流中发送带有2字节长度前缀的请求，并读取响应
+func (caller *DoQCaller) exchange(ctx context.Context, conn quic.Connection, raw []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CancelRead(0)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	buf := make([]byte, 2+len(raw))
+	binary.BigEndian.PutUint16(buf, uint16(len(raw)))
+	copy(buf[2:], raw)
+	if _, err = stream.Write(buf); err != nil {
+		return nil, err
+	}
+	_ = stream.Close() // 关闭发送方向，表示请求已发送完毕
+	if _, err = io.ReadFull(stream, buf[:2]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err = io.ReadFull(stream, data); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err = r.Unpack(data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
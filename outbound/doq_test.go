@@ -0,0 +1,101 @@
+package outbound
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 本地DoQ服务器，应答所有A查询为1.1.1.1，返回服务器地址及证书
+func startDoQServer(t *testing.T) (addr string, cert *x509.Certificate, stop func()) {
+	server := httptest.NewTLSServer(http.NotFoundHandler()) // 仅用于生成证书
+	server.Close()
+	tlsConfig := &tls.Config{Certificates: server.TLS.Certificates, NextProtos: []string{"doq"}}
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, nil)
+	assert.Equal(t, err, nil)
+	serve := func(stream quic.Stream) {
+		defer stream.Close()
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(stream, data); err != nil {
+			return
+		}
+		request := new(dns.Msg)
+		_ = request.Unpack(data)
+		assert.Equal(t, request.Id, uint16(0))
+		r := new(dns.Msg).SetReply(request)
+		rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 1.1.1.1")
+		r.Answer = append(r.Answer, rr)
+		raw, _ := r.Pack()
+		binary.BigEndian.PutUint16(buf, uint16(len(raw)))
+		_, _ = stream.Write(append(buf, raw...))
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					go serve(stream)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), server.Certificate(), func() { _ = listener.Close() }
+}
+
+func TestDoQCaller(t *testing.T) {
+	addr, cert, stop := startDoQServer(t)
+	defer stop()
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 证书不受信任
+	caller := NewDoQCaller(addr, "example.com")
+	r, err := caller.Call(request)
+	assertFail(t, r, err)
+	// 复用连接发送多个请求，响应的ID与请求一致
+	caller = NewDoQCaller(addr, "example.com")
+	caller.tlsConfig.RootCAs = x509.NewCertPool()
+	caller.tlsConfig.RootCAs.AddCert(cert)
+	caller.Padding = true
+	for i := 0; i < 3; i++ {
+		request.Id = uint16(100 + i)
+		r, err = caller.Call(request)
+		assertSuccess(t, r, err)
+		assert.Equal(t, r.Id, request.Id)
+		assert.True(t, r.IsEdns0() == nil)
+	}
+	// 连接被关闭时重新建立
+	caller.reset(caller.conn)
+	r, err = caller.Call(request)
+	assertSuccess(t, r, err)
+	assert.Equal(t, caller.String(), "quic://"+addr+"@example.com")
+	// 证书固定
+	caller = NewDoQCaller(addr, "example.com")
+	caller.tlsConfig.InsecureSkipVerify = true
+	caller.PinCertificates([][]byte{[]byte("other")})
+	r, err = caller.Call(request)
+	assertFail(t, r, err)
+	sum := sha256.Sum256(cert.RawTBSCertificate)
+	caller.PinCertificates([][]byte{sum[:]})
+	r, err = caller.Call(request)
+	assertSuccess(t, r, err)
+}
@@ -0,0 +1,132 @@
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// 外部程序的输入输出格式
+const (
+	ExecWire = "wire" // stdin/stdout均为DNS报文
+	ExecJSON = "json" // stdin为execQuery，stdout为execAnswer
+)
+
+// json格式的查询
+type execQuery struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+	DO    bool   `json:"do"` // 是否请求DNSSEC记录
+}
+
+// json格式的响应，记录为区域文件格式的字符串，如"example.com. 60 IN A 1.2.3.4"
+type execAnswer struct {
+	Rcode  string   `json:"rcode"` // 为空时视为NOERROR
+	Answer []string `json:"answer"`
+	Ns     []string `json:"ns"`
+	Extra  []string `json:"extra"`
+}
+
+// 通过外部程序解析的Caller：每次查询启动一次程序，经stdin传入查询，从stdout读取响应，
+// 用于接入企业内部API、DNS over Tor等非标准的解析后端
+type ExecCaller struct {
+	Command []string      // 程序路径及参数
+	Format  string        // 输入输出格式，为空时使用ExecWire
+	Timeout time.Duration // 程序的最长运行时间，为0时使用默认超时时间
+}
+
+// 生成传给外部程序的输入
+func (caller *ExecCaller) input(request *dns.Msg) ([]byte, error) {
+	if caller.Format != ExecJSON {
+		return request.Pack()
+	}
+	question := request.Question[0]
+	query := execQuery{Name: question.Name, Type: dns.TypeToString[question.Qtype],
+		Class: dns.ClassToString[question.Qclass]}
+	if opt := request.IsEdns0(); opt != nil {
+		query.DO = opt.Do()
+	}
+	return json.Marshal(&query)
+}
+
+// 解析外部程序的输出
+func (caller *ExecCaller) output(request *dns.Msg, out []byte) (r *dns.Msg, err error) {
+	r = new(dns.Msg)
+	if caller.Format != ExecJSON {
+		if err = r.Unpack(out); err != nil {
+			return nil, err
+		}
+		r.Id = request.Id
+		return r, nil
+	}
+	var answer execAnswer
+	if err = json.Unmarshal(out, &answer); err != nil {
+		return nil, err
+	}
+	r.SetReply(request)
+	if answer.Rcode != "" {
+		var ok bool
+		if r.Rcode, ok = dns.StringToRcode[strings.ToUpper(answer.Rcode)]; !ok {
+			return nil, fmt.Errorf("unknown rcode: %s", answer.Rcode)
+		}
+	}
+	for _, section := range []struct {
+		records []string
+		rrs     *[]dns.RR
+	}{{answer.Answer, &r.Answer}, {answer.Ns, &r.Ns}, {answer.Extra, &r.Extra}} {
+		for _, record := range section.records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+			if rr != nil {
+				*section.rrs = append(*section.rrs, rr)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (caller *ExecCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+func (caller *ExecCaller) CallContext(ctx context.Context, request *dns.Msg) (r *dns.Msg, err error) {
+	if request == nil || len(request.Question) <= 0 || len(caller.Command) <= 0 {
+		return nil, fmt.Errorf("request or command cannot be empty")
+	}
+	in, err := caller.input(request)
+	if err != nil {
+		return nil, err
+	}
+	timeout := caller.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, caller.Command[0], caller.Command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(in), &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, &net.OpError{Op: "exec", Net: caller.Command[0], Err: ctx.Err()}
+		}
+		return nil, fmt.Errorf("exec %s error: %v %s", caller.Command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if r, err = caller.output(request, out); err != nil {
+		return nil, fmt.Errorf("invalid output of %s: %v", caller.Command[0], err)
+	}
+	if !matchResponse(request, r) {
+		return nil, fmt.Errorf("mismatched response from %s", caller.Command[0])
+	}
+	return r, nil
+}
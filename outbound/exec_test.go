@@ -0,0 +1,47 @@
+package outbound
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestExecCaller(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// wire格式：原样返回请求
+	caller := &ExecCaller{Command: []string{"cat"}}
+	r, err := caller.Call(request)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Question[0].Name, "ip.cn.")
+	// json格式
+	caller = &ExecCaller{Format: ExecJSON, Command: []string{"sh", "-c",
+		`grep -q '"name":"ip.cn."' && echo '{"answer":["ip.cn. 60 IN A 1.2.3.4"]}'`}}
+	r, err = caller.Call(request)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Id, request.Id)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.2.3.4")
+	caller.Command[2] = `echo '{"rcode":"BOGUS"}'`
+	_, err = caller.Call(request)
+	assert.NotEqual(t, err, nil)
+	// 程序运行失败、超时
+	_, err = (&ExecCaller{Command: []string{"sh", "-c", "exit 1"}}).Call(request)
+	assert.NotEqual(t, err, nil)
+	_, err = (&ExecCaller{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}).Call(request)
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout())
+	// 取消时立即结束子进程
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = CallContext(ctx, &ExecCaller{Command: []string{"sleep", "5"}}, request)
+	assert.NotEqual(t, err, nil)
+	assert.True(t, time.Since(start) < time.Second)
+}
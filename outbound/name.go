@@ -0,0 +1,44 @@
+package outbound
+
+import (
+	"net/url"
+	"strings"
+)
+
+// 以下String方法用于在日志及告警中标识上游服务器
+
+func (caller *UDPCaller) String() string {
+	return "udp://" + caller.Address
+}
+
+func (caller *TCPCaller) String() string {
+	return "tcp://" + caller.Address
+}
+
+func (caller *TLSCaller) String() string {
+	return "tls://" + caller.address + "@" + caller.tlsConfig.ServerName
+}
+
+// DoH地址中可能包含认证信息，仅保留主机名及路径
+func (caller *DoHCaller) String() string {
+	if u, err := url.Parse(caller.Url); err == nil {
+		return "https://" + u.Host + u.Path
+	}
+	return "https://"
+}
+
+func (caller *ExecCaller) String() string {
+	return "exec://" + strings.Join(caller.Command, " ")
+}
+
+func (caller *RecursiveCaller) String() string {
+	return "recursive://."
+}
+
+func (caller *DoQCaller) String() string {
+	return "quic://" + caller.address + "@" + caller.tlsConfig.ServerName
+}
+
+func (caller *DNSCryptCaller) String() string {
+	return "dnscrypt://" + caller.address + "@" + strings.TrimSuffix(caller.providerName, ".")
+}
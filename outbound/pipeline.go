@@ -0,0 +1,191 @@
+package outbound
+
+import (
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/edns"
+	"net"
+	"sync"
+	"time"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// 服务器未声明空闲超时时间时，客户端关闭空闲连接的默认时间
+const pipelineIdle = 30 * time.Second
+
+// 复用单个TCP/DoT连接同时发送多个请求，按消息ID分发乱序到达的响应（RFC 7766 6.2.1.1）。
+// 请求携带edns-tcp-keepalive（RFC 7828），按服务器声明的空闲超时时间决定是否复用空闲连接
+type pipeline struct {
+	dial      func() (net.Conn, error)
+	mux       sync.Mutex
+	conn      *dns.Conn
+	pending   map[uint16]chan *dns.Msg
+	keepalive bool          // 服务器是否声明了空闲超时时间
+	idle      time.Duration // 服务器声明的空闲超时时间
+	lastUsed  time.Time     // 连接上次收发报文的时间
+	maxIdle   time.Duration // 服务器未声明空闲超时时间时使用，为0时使用pipelineIdle
+	timer     *time.Timer   // 空闲时关闭连接的定时器
+}
+
+// 连接的空闲超时时间，优先使用服务器声明的值
+func (p *pipeline) idleTimeout() time.Duration {
+	if p.keepalive {
+		return p.idle
+	}
+	if p.maxIdle > 0 {
+		return p.maxIdle
+	}
+	return pipelineIdle
+}
+
+// 连接上无等待中的请求时，在空闲超时后关闭连接，调用方需持有锁
+func (p *pipeline) scheduleIdle(conn *dns.Conn) {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if p.conn != conn || len(p.pending) > 0 {
+		return
+	}
+	p.timer = time.AfterFunc(p.idleTimeout(), func() {
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		if p.conn == conn && len(p.pending) == 0 && time.Since(p.lastUsed) >= p.idleTimeout() {
+			p.closeConn(conn)
+		}
+	})
+}
+
+// 建立连接并启动读取协程，调用方需持有锁
+func (p *pipeline) connect() error {
+	raw, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.conn, p.pending, p.keepalive = &dns.Conn{Conn: raw}, map[uint16]chan *dns.Msg{}, false
+	go p.readLoop(p.conn)
+	return nil
+}
+
+// 关闭连接并通知所有等待中的请求，调用方需持有锁
+func (p *pipeline) closeConn(conn *dns.Conn) {
+	if p.conn != conn {
+		return
+	}
+	for _, ch := range p.pending {
+		close(ch)
+	}
+	_ = conn.Close()
+	p.conn, p.pending = nil, nil
+}
+
+// 关闭空闲的连接，有等待中的请求时在其完成后按空闲超时关闭
+func (p *pipeline) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if p.conn != nil && len(p.pending) == 0 {
+		p.closeConn(p.conn)
+	}
+}
+
+// 持续读取响应并分发给对应的请求，连接出错时关闭连接
+func (p *pipeline) readLoop(conn *dns.Conn) {
+	for {
+		r, err := conn.ReadMsg()
+		p.mux.Lock()
+		if err != nil {
+			p.closeConn(conn)
+			p.mux.Unlock()
+			return
+		}
+		ch, ok := p.pending[r.Id]
+		delete(p.pending, r.Id)
+		p.lastUsed = time.Now()
+		if timeout, found, _ := edns.GetKeepalive(r); found && timeout >= 0 {
+			p.keepalive, p.idle = true, timeout
+			if timeout == 0 && len(p.pending) == 0 { // 服务器要求尽快关闭连接
+				p.closeConn(conn)
+			}
+		}
+		p.scheduleIdle(conn)
+		p.mux.Unlock()
+		if ok {
+			ch <- r
+		}
+	}
+}
+
+// 发送请求，ID与其它未完成的请求冲突时使用新的ID
+func (p *pipeline) send(request *dns.Msg, timeout time.Duration) (ch chan *dns.Msg, id uint16, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	// 空闲时间超过超时时间时连接可能已被服务器关闭，直接建立新连接
+	if p.conn != nil && len(p.pending) == 0 && time.Since(p.lastUsed) >= p.idleTimeout() {
+		p.closeConn(p.conn)
+	}
+	for retry := 0; retry < 2; retry++ { // 空闲连接可能已被服务器关闭，写入失败时重连一次
+		if p.conn == nil {
+			if err = p.connect(); err != nil {
+				return nil, 0, err
+			}
+		}
+		sent := request.Copy()
+		edns.SetKeepalive(sent, -1)
+		for {
+			if _, used := p.pending[sent.Id]; !used {
+				break
+			}
+			sent.Id = dns.Id()
+		}
+		conn := p.conn
+		_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+		if err = conn.WriteMsg(sent); err != nil {
+			p.closeConn(conn)
+			continue
+		}
+		ch = make(chan *dns.Msg, 1)
+		p.pending[sent.Id], p.lastUsed = ch, time.Now()
+		return ch, sent.Id, nil
+	}
+	return nil, 0, err
+}
+
+// 通过共享连接发送请求并等待对应的响应
+func (p *pipeline) exchange(request *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ch, id, err := p.send(request, timeout)
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, errConnClosed
+		}
+		r.Id = request.Id // 还原请求ID
+		if request.IsEdns0() != nil {
+			edns.RemoveOption(r, dns.EDNS0TCPKEEPALIVE)
+		} else { // 请求原本无OPT记录
+			edns.RemoveOPT(r)
+		}
+		if !matchResponse(request, r) {
+			return nil, errMismatch
+		}
+		return r, nil
+	case <-timer.C:
+		p.mux.Lock()
+		if p.pending != nil {
+			delete(p.pending, id)
+			p.scheduleIdle(p.conn)
+		}
+		p.mux.Unlock()
+		return nil, errors.New("pipeline query timeout")
+	}
+}
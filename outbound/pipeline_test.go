@@ -0,0 +1,263 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/edns"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan bool, 2)
+	// 模拟在同一连接上读取两个请求后乱序返回响应的服务器
+	go func() {
+		for {
+			raw, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			conn := &dns.Conn{Conn: raw}
+			var requests []*dns.Msg
+			for len(requests) < 2 {
+				req, err := conn.ReadMsg()
+				if err != nil {
+					return
+				}
+				requests = append(requests, req)
+			}
+			for i := len(requests) - 1; i >= 0; i-- {
+				r := new(dns.Msg)
+				r.SetReply(requests[i])
+				rr, _ := dns.NewRR(requests[i].Question[0].Name + " 0 IN A 1.2.3.4")
+				r.Answer = append(r.Answer, rr)
+				_ = conn.WriteMsg(r)
+			}
+		}
+	}()
+	caller := &TCPCaller{Address: listener.Addr().String(), Timeout: time.Second, Pipeline: true}
+	var wg sync.WaitGroup
+	for _, name := range []string{"a.ip.cn.", "b.ip.cn."} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			req.Id = 1 // 相同的ID
+			r, err := caller.Call(req)
+			assert.Equal(t, err, nil)
+			if assert.True(t, r != nil) {
+				assert.Equal(t, r.Id, uint16(1))
+				assert.Equal(t, r.Question[0].Name, name)
+			}
+		}(name)
+	}
+	wg.Wait()
+	assert.Equal(t, len(accepted), 1) // 两个请求共用一个连接
+}
+
+func TestPipelineKeepalive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = listener.Close() }()
+	accepted := make(chan bool, 3)
+	// 模拟声明200毫秒空闲超时时间的服务器
+	go func() {
+		for {
+			raw, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			go func(conn *dns.Conn) {
+				for {
+					req, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					timeout, ok, _ := edns.GetKeepalive(req)
+					assert.True(t, ok)
+					assert.True(t, timeout < 0) // 请求中不携带超时时间
+					r := new(dns.Msg)
+					r.SetReply(req)
+					r.SetEdns0(4096, false)
+					edns.SetKeepalive(r, 200*time.Millisecond)
+					_ = conn.WriteMsg(r)
+				}
+			}(&dns.Conn{Conn: raw})
+		}
+	}()
+	caller := &TCPCaller{Address: listener.Addr().String(), Timeout: time.Second, Pipeline: true}
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("ip.cn.", dns.TypeA)
+		r, err := caller.Call(req)
+		assert.Equal(t, err, nil)
+		assert.True(t, r.IsEdns0() == nil) // 请求无OPT记录时移除响应的OPT记录
+	}
+	query()
+	query()
+	assert.Equal(t, len(accepted), 1)
+	// 空闲超过服务器声明的超时时间后使用新连接
+	time.Sleep(300 * time.Millisecond)
+	query()
+	assert.Equal(t, len(accepted), 2)
+}
+
+func TestPipelineIdle(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = listener.Close() }()
+	accepted, closed := make(chan bool, 2), make(chan bool, 2)
+	// 模拟未声明空闲超时时间的服务器，连接被客户端关闭时通知
+	go func() {
+		for {
+			raw, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- true
+			go func(conn *dns.Conn) {
+				for {
+					req, err := conn.ReadMsg()
+					if err != nil {
+						closed <- true
+						return
+					}
+					r := new(dns.Msg)
+					r.SetReply(req)
+					_ = conn.WriteMsg(r)
+				}
+			}(&dns.Conn{Conn: raw})
+		}
+	}()
+	caller := &TCPCaller{Address: listener.Addr().String(), Timeout: time.Second, Pipeline: true,
+		Idle: 100 * time.Millisecond}
+	query := func() {
+		req := new(dns.Msg)
+		req.SetQuestion("ip.cn.", dns.TypeA)
+		_, err := caller.Call(req)
+		assert.Equal(t, err, nil)
+	}
+	query()
+	query()
+	assert.Equal(t, len(accepted), 1)
+	// 空闲超时后客户端主动关闭连接，再次请求时重连
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	query()
+	assert.Equal(t, len(accepted), 2)
+	// 关闭后立即断开空闲连接
+	caller.Close()
+	select {
+	case <-closed:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestDoHWarmup(t *testing.T) {
+	var mux sync.Mutex
+	conns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		msg := new(dns.Msg)
+		_ = msg.Unpack(body)
+		r := new(dns.Msg)
+		r.SetReply(msg)
+		buf, _ := r.Pack()
+		_, _ = w.Write(buf)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mux.Lock()
+			conns++
+			mux.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+	caller := &DoHCaller{Url: server.URL + "/dns-query", Timeout: time.Second}
+	caller.Warmup()
+	mux.Lock()
+	assert.Equal(t, conns, 1) // 预热时建立连接
+	mux.Unlock()
+	// 后续请求复用预热的连接
+	for i := 0; i < 3; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("ip.cn.", dns.TypeA)
+		r, err := caller.Call(req)
+		assert.Equal(t, err, nil)
+		assert.True(t, r != nil)
+	}
+	mux.Lock()
+	assert.Equal(t, conns, 1)
+	mux.Unlock()
+	// 关闭后不再预热
+	caller.Close()
+	caller.Warmup()
+	caller.rewarm()
+	mux.Lock()
+	assert.Equal(t, conns, 1)
+	mux.Unlock()
+}
+
+// 按域名返回固定A记录的上游
+type resolverMock map[string]string
+
+func (mock resolverMock) Call(request *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(request)
+	if ip, ok := mock[request.Question[0].Name]; ok && request.Question[0].Qtype == dns.TypeA {
+		r.Answer = append(r.Answer, &dns.A{A: net.ParseIP(ip),
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}})
+	}
+	return r, nil
+}
+
+func TestDoHResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		msg := new(dns.Msg)
+		_ = msg.Unpack(body)
+		r := new(dns.Msg)
+		r.SetReply(msg)
+		buf, _ := r.Pack()
+		_, _ = w.Write(buf)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	// 服务器域名经Resolver解析
+	caller := &DoHCaller{Url: "http://doh.invalid:" + port + "/dns-query", Timeout: time.Second,
+		Resolver: resolverMock{"doh.invalid.": "127.0.0.1"}}
+	r, err := caller.Call(req)
+	assert.Equal(t, err, nil)
+	assert.True(t, r != nil)
+	// 无法解析
+	caller = &DoHCaller{Url: "http://other.invalid:" + port + "/dns-query", Timeout: time.Second,
+		Resolver: resolverMock{"doh.invalid.": "127.0.0.1"}}
+	_, err = caller.Call(req)
+	assert.NotEqual(t, err, nil)
+	// Bootstrap优先于Resolver
+	caller = &DoHCaller{Url: "http://other.invalid:" + port + "/dns-query", Timeout: time.Second,
+		Bootstrap: []string{"127.0.0.1"}, Resolver: resolverMock{}}
+	_, err = caller.Call(req)
+	assert.Equal(t, err, nil)
+}
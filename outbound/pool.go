@@ -0,0 +1,69 @@
+package outbound
+
+import (
+	"net"
+	"sync"
+)
+
+// 预先打开的UDP socket池。复用socket可减少高并发时创建、关闭socket的开销，
+// 但同一socket的源端口固定，伪造响应的难度随之降低
+type socketPool struct {
+	mux    sync.Mutex
+	size   int
+	conns  []*net.UDPConn
+	closed bool           // 关闭后归还的socket直接关闭
+	opts   *SocketOptions // 新建socket时应用的选项
+}
+
+// 从池中获取socket，池为空时新建socket
+func (p *socketPool) get() (*net.UDPConn, error) {
+	if p != nil {
+		p.mux.Lock()
+		if n := len(p.conns); n > 0 {
+			conn := p.conns[n-1]
+			p.conns = p.conns[:n-1]
+			p.mux.Unlock()
+			return conn, nil
+		}
+		p.mux.Unlock()
+		return p.opts.listenUDP()
+	}
+	return net.ListenUDP("udp", nil)
+}
+
+// 将socket放回池中。出现超时以外的错误或池已满时关闭socket
+func (p *socketPool) put(conn *net.UDPConn, err error) {
+	if p != nil {
+		if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+			p.mux.Lock()
+			if len(p.conns) < p.size && !p.closed {
+				p.conns = append(p.conns, conn)
+				p.mux.Unlock()
+				return
+			}
+			p.mux.Unlock()
+		}
+	}
+	_ = conn.Close()
+}
+
+// 关闭池中的socket
+func (p *socketPool) close() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns, p.closed = nil, true
+}
+
+// 创建socket池并预先打开size个socket，size为0时每次请求新建socket
+func newSocketPool(size int, opts *SocketOptions) *socketPool {
+	p := &socketPool{size: size, opts: opts}
+	for i := 0; i < size; i++ {
+		if conn, err := opts.listenUDP(); err == nil {
+			p.conns = append(p.conns, conn)
+		}
+	}
+	return p
+}
@@ -0,0 +1,107 @@
+package outbound
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 与代理服务器握手的超时时间
+const proxyTimeout = 10 * time.Second
+
+// 经HTTP(S)代理的CONNECT方法建立TCP连接，代理地址中的用户名及密码用于Basic认证
+type HTTPProxyDialer struct {
+	URL     *url.URL
+	Forward proxy.Dialer // 连接代理服务器使用的Dialer
+}
+
+// 连接经CONNECT方法请求后保留在缓冲区中的数据
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// 经代理连接addr，仅支持tcp
+func (d *HTTPProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("unsupported network for http proxy: %s", network)
+	}
+	host := d.URL.Host
+	if d.URL.Port() == "" {
+		host = net.JoinHostPort(d.URL.Hostname(), map[string]string{"http": "80", "https": "443"}[d.URL.Scheme])
+	}
+	conn, err := d.Forward.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	return d.connect(conn, addr)
+}
+
+// 在到代理服务器的连接上请求CONNECT，失败时关闭连接
+func (d *HTTPProxyDialer) connect(conn net.Conn, addr string) (net.Conn, error) {
+	_ = conn.SetDeadline(time.Now().Add(proxyTimeout))
+	if d.URL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: d.URL.Hostname()})
+	}
+	request := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr,
+		Header: http.Header{}}
+	if user := d.URL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	reader := bufio.NewReader(conn)
+	err := request.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(reader, request)
+	}
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("http proxy connect %s error: %s", addr, resp.Status)
+		}
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// 根据代理地址创建Dialer，支持socks5://、http://、https://，地址中可包含"用户名:密码@"。forward为nil时直接连接代理
+func NewProxyDialer(rawURL string, forward proxy.Dialer) (proxy.Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy: %s", rawURL)
+	}
+	if forward == nil {
+		forward = proxy.Direct
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		return proxy.SOCKS5("tcp", u.Host, auth, forward)
+	case "http", "https":
+		return &HTTPProxyDialer{URL: u, Forward: forward}, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+}
@@ -0,0 +1,279 @@
+package outbound
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 根服务器（a至m.root-servers.net）的ipv4地址，未指定root hints时使用
+var RootHints = []string{"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129",
+	"199.7.83.42", "202.12.27.33"}
+
+const (
+	maxReferrals     = 32   // 单次解析中跟随referral的最大次数
+	maxResolveDepth  = 8    // 解析NS地址、CNAME目标时的最大嵌套深度
+	maxReferralCache = 4096 // 缓存的区域数上限，超出时清空
+	minReferralTTL   = 60   // 区域授权信息的最短缓存时间，单位为秒
+)
+
+// 缓存的区域授权信息
+type referral struct {
+	servers []string // 权威服务器地址，格式为ip:port
+	expire  time.Time
+}
+
+// 递归解析的Caller：从根服务器开始迭代查询各级权威服务器，不依赖任何上游转发服务器。
+// 缓存各区域的权威服务器地址（referral），减少对根及顶级域服务器的重复查询。仅使用ipv4地址访问权威服务器
+type RecursiveCaller struct {
+	Roots     []string       // 根服务器ip，为空时使用RootHints
+	Timeout   time.Duration  // 查询单台权威服务器的超时时间，为0时使用默认超时时间
+	Socket    *SocketOptions // 出站socket选项，为nil时使用默认选项
+	mux       sync.Mutex
+	referrals map[string]referral // 区域名称（小写FQDN）到授权信息的映射
+	poolOnce  sync.Once
+	pool      *socketPool
+	exchange  func(request *dns.Msg, address string) (*dns.Msg, error) // 测试时替换
+}
+
+// 获取socket池，未指定socket选项时返回nil
+func (caller *RecursiveCaller) sockets() *socketPool {
+	if caller.Socket == nil {
+		return nil
+	}
+	caller.poolOnce.Do(func() { caller.pool = newSocketPool(0, caller.Socket) })
+	return caller.pool
+}
+
+// 向单台权威服务器发送请求，响应被截断时改用TCP重新查询
+func (caller *RecursiveCaller) exchangeOne(request *dns.Msg, address string) (r *dns.Msg, err error) {
+	if caller.exchange != nil {
+		return caller.exchange(request, address)
+	}
+	if r, _, err = caller.sockets().exchange(request, address, caller.Timeout, 0, nil); err != nil || !r.Truncated {
+		return r, err
+	}
+	client := &dns.Client{Net: "tcp", Timeout: caller.Timeout}
+	if caller.Socket != nil {
+		client.Dialer = caller.Socket.Dialer()
+	}
+	if r, _, err = client.Exchange(request, address); err == nil && !matchResponse(request, r) {
+		return nil, errMismatch
+	}
+	return r, err
+}
+
+// 依次查询区域的权威服务器（从随机位置开始），直至获得NOERROR或NXDOMAIN响应
+func (caller *RecursiveCaller) query(servers []string, name string, qtype uint16, do bool) (*dns.Msg, error) {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	request.RecursionDesired = false
+	request.SetEdns0(1232, do)
+	err := fmt.Errorf("no server available for %s", name)
+	offset := rand.Intn(len(servers))
+	for i := range servers {
+		server := servers[(offset+i)%len(servers)]
+		request.Id = dns.Id()
+		r, e := caller.exchangeOne(request, server)
+		switch {
+		case e != nil:
+			err = e
+		case r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError:
+			err = fmt.Errorf("%s returned %s for %s", server, dns.RcodeToString[r.Rcode], name)
+		default:
+			return r, nil
+		}
+	}
+	return nil, err
+}
+
+// 获取已缓存的、最接近name的区域及其权威服务器，无缓存时返回根区域
+func (caller *RecursiveCaller) closest(name string) (zone string, servers []string) {
+	name = strings.ToLower(name)
+	now := time.Now()
+	caller.mux.Lock()
+	defer caller.mux.Unlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if ref, ok := caller.referrals[name[off:]]; ok && now.Before(ref.expire) {
+			return name[off:], ref.servers
+		}
+	}
+	roots := caller.Roots
+	if len(roots) == 0 {
+		roots = RootHints
+	}
+	for _, ip := range roots {
+		servers = append(servers, net.JoinHostPort(ip, "53"))
+	}
+	return ".", servers
+}
+
+// 缓存区域的权威服务器地址
+func (caller *RecursiveCaller) store(zone string, servers []string, ttl uint32) {
+	if ttl < minReferralTTL {
+		ttl = minReferralTTL
+	}
+	caller.mux.Lock()
+	if caller.referrals == nil || len(caller.referrals) >= maxReferralCache {
+		caller.referrals = map[string]referral{}
+	}
+	caller.referrals[zone] = referral{servers: servers, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+	caller.mux.Unlock()
+}
+
+// 从响应的authority部分获取比zone更接近name的子区域授权，不是referral时返回空串
+func delegation(r *dns.Msg, zone, name string) (child string, nsNames map[string]bool, ttl uint32) {
+	for _, rr := range r.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if !dns.IsSubDomain(owner, name) || !dns.IsSubDomain(zone, owner) ||
+			dns.CountLabel(owner) <= dns.CountLabel(zone) || child != "" && owner != child {
+			continue
+		}
+		if child == "" {
+			child, nsNames, ttl = owner, map[string]bool{}, ns.Hdr.Ttl
+		}
+		nsNames[strings.ToLower(ns.Ns)] = true
+		if ns.Hdr.Ttl < ttl {
+			ttl = ns.Hdr.Ttl
+		}
+	}
+	return
+}
+
+// 获取子区域权威服务器的地址：优先使用响应中位于zone内的glue记录，无glue时递归解析NS的地址
+func (caller *RecursiveCaller) nsAddrs(r *dns.Msg, zone string, nsNames map[string]bool, depth int) ([]string, error) {
+	var servers []string
+	for _, rr := range r.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if a, ok := rr.(*dns.A); ok && nsNames[owner] && dns.IsSubDomain(zone, owner) { // 忽略区域外的glue，避免缓存投毒
+			servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	if len(servers) > 0 {
+		return servers, nil
+	}
+	err := fmt.Errorf("no address for name servers")
+	for ns := range nsNames {
+		answer, e := caller.resolve(ns, dns.TypeA, false, depth+1)
+		if e != nil {
+			err = e
+			continue
+		}
+		for _, rr := range answer.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+	return nil, err
+}
+
+// 响应仅包含CNAME链时继续解析CNAME目标，并将结果追加至应答
+func (caller *RecursiveCaller) chase(r *dns.Msg, name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	if r.Rcode != dns.RcodeSuccess || qtype == dns.TypeCNAME {
+		return r, nil
+	}
+	target := name
+	for i := 0; i <= len(r.Answer); i++ { // 限制循环次数，避免CNAME环路
+		next := ""
+		for _, rr := range r.Answer {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return r, nil
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	if target == name {
+		return r, nil
+	}
+	sub, err := caller.resolve(target, qtype, do, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	r = r.Copy()
+	r.Answer = append(r.Answer, sub.Answer...)
+	r.Ns, r.Rcode = sub.Ns, sub.Rcode
+	return r, nil
+}
+
+// 从最接近的已知区域开始迭代查询name，跟随referral直至获得应答、NXDOMAIN或NODATA
+func (caller *RecursiveCaller) resolve(name string, qtype uint16, do bool, depth int) (*dns.Msg, error) {
+	if depth > maxResolveDepth {
+		return nil, fmt.Errorf("max recursion depth exceeded for %s", name)
+	}
+	zone, servers := caller.closest(name)
+	for i := 0; i < maxReferrals; i++ {
+		r, err := caller.query(servers, name, qtype, do)
+		if err != nil {
+			return nil, err
+		}
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+			return caller.chase(r, name, qtype, do, depth)
+		}
+		child, nsNames, ttl := delegation(r, zone, name)
+		if child == "" { // NODATA
+			return r, nil
+		}
+		if servers, err = caller.nsAddrs(r, zone, nsNames, depth); err != nil {
+			return nil, fmt.Errorf("resolve name servers of %s error: %v", child, err)
+		}
+		caller.store(child, servers, ttl)
+		zone = child
+	}
+	return nil, fmt.Errorf("too many referrals for %s", name)
+}
+
+func (caller *RecursiveCaller) Call(request *dns.Msg) (r *dns.Msg, err error) {
+	if request == nil || len(request.Question) <= 0 {
+		return nil, fmt.Errorf("request cannot be empty")
+	}
+	question, opt := request.Question[0], request.IsEdns0()
+	answer, err := caller.resolve(question.Name, question.Qtype, opt != nil && opt.Do(), 0)
+	if err != nil {
+		return nil, err
+	}
+	r = new(dns.Msg).SetReply(request)
+	r.Rcode, r.Answer, r.Ns, r.RecursionAvailable = answer.Rcode, answer.Answer, answer.Ns, true
+	if opt != nil {
+		r.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return r, nil
+}
+
+// 解析named.root格式的root hints文件内容，返回其中的ipv4地址
+func ParseRootHints(text string) (roots []string, err error) {
+	parser := dns.NewZoneParser(strings.NewReader(text), ".", "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if a, isA := rr.(*dns.A); isA {
+			roots = append(roots, a.A.String())
+		}
+	}
+	if err = parser.Err(); err != nil {
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no ipv4 address in root hints")
+	}
+	return roots, nil
+}
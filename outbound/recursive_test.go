@@ -0,0 +1,81 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// 模拟的权威服务器：根、com.、example.com.
+func mockAuthority(queries map[string]int) func(request *dns.Msg, address string) (*dns.Msg, error) {
+	records := map[string][]string{
+		"1.0.0.1:53": {"com. 172800 IN NS a.gtld.net.", "a.gtld.net. 172800 IN A 2.0.0.1"},
+		"2.0.0.1:53": {"example.com. 3600 IN NS ns1.example.com.", "ns1.example.com. 3600 IN A 3.0.0.1",
+			"noglue.com. 3600 IN NS ns1.example.com."},
+		"3.0.0.1:53": {"www.example.com. 300 IN A 5.6.7.8", "alias.example.com. 300 IN CNAME www.example.com.",
+			"ns1.example.com. 300 IN A 3.0.0.1", "www.noglue.com. 300 IN A 7.7.7.7"},
+	}
+	return func(request *dns.Msg, address string) (*dns.Msg, error) {
+		queries[address]++
+		question := request.Question[0]
+		r := new(dns.Msg).SetReply(request)
+		for _, text := range records[address] {
+			rr, _ := dns.NewRR(text)
+			header := rr.Header()
+			switch {
+			case header.Rrtype == dns.TypeNS && dns.IsSubDomain(header.Name, question.Name):
+				r.Ns = append(r.Ns, rr)
+			case header.Rrtype == dns.TypeA && len(r.Ns) > 0:
+				r.Extra = append(r.Extra, rr)
+			case strings.EqualFold(header.Name, question.Name):
+				if header.Rrtype == question.Qtype || header.Rrtype == dns.TypeCNAME {
+					r.Answer = append(r.Answer, rr)
+				}
+			}
+		}
+		if len(r.Answer) == 0 && len(r.Ns) == 0 && address == "3.0.0.1:53" {
+			r.Rcode = dns.RcodeNameError
+		}
+		return r, nil
+	}
+}
+
+func TestRecursiveCaller(t *testing.T) {
+	queries := map[string]int{}
+	caller := &RecursiveCaller{Roots: []string{"1.0.0.1"}, exchange: mockAuthority(queries)}
+	request := new(dns.Msg)
+	request.SetQuestion("www.example.com.", dns.TypeA)
+	r, err := caller.Call(request)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "5.6.7.8")
+	assert.True(t, r.RecursionAvailable)
+	// 已缓存的referral不再查询根服务器
+	request.SetQuestion("alias.example.com.", dns.TypeA)
+	r, err = caller.Call(request)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(r.Answer), 2)
+	assert.Equal(t, r.Answer[1].(*dns.A).A.String(), "5.6.7.8")
+	assert.Equal(t, queries["1.0.0.1:53"], 1)
+	request.SetQuestion("none.example.com.", dns.TypeA)
+	r, _ = caller.Call(request)
+	assert.Equal(t, r.Rcode, dns.RcodeNameError)
+	// 无glue时解析NS的地址
+	request.SetQuestion("www.noglue.com.", dns.TypeA)
+	r, err = caller.Call(request)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "7.7.7.7")
+	// 忽略区域外的glue
+	glue, _ := dns.NewRR("ns.other.net. 300 IN A 6.6.6.6")
+	servers, err := caller.nsAddrs(&dns.Msg{Extra: []dns.RR{glue}}, "example.com.",
+		map[string]bool{"ns.other.net.": true}, maxResolveDepth)
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, len(servers), 0)
+
+	roots, err := ParseRootHints(".  3600000  NS  A.ROOT-SERVERS.NET.\n" +
+		"A.ROOT-SERVERS.NET.  3600000  A  198.41.0.4\nA.ROOT-SERVERS.NET.  3600000  AAAA  2001:503:ba3e::2:30")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, roots, []string{"198.41.0.4"})
+	_, err = ParseRootHints("")
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,77 @@
+package outbound
+
+import (
+	"context"
+	"golang.org/x/net/proxy"
+	"net"
+	"syscall"
+	"time"
+)
+
+// 出站socket选项，用于指定查询上游时使用的源地址、网卡及fwmark
+type SocketOptions struct {
+	LocalIP   net.IP // 源地址，为nil时由系统选择
+	Interface string // 绑定的网卡（SO_BINDTODEVICE），为空时不绑定
+	Mark      int    // 设置的fwmark（SO_MARK），用于linux策略路由，为0时不设置
+}
+
+// 在socket创建后、连接前设置socket选项
+func (o *SocketOptions) control(network, address string, raw syscall.RawConn) error {
+	var sockErr error
+	err := raw.Control(func(fd uintptr) {
+		sockErr = setSocketOptions(fd, o)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Dialer 生成应用该选项的TCP Dialer，可作为TCP/DoT/DoH请求或socks5代理连接的Dialer。o为nil时返回nil
+func (o *SocketOptions) Dialer() *net.Dialer {
+	if o == nil {
+		return nil
+	}
+	dialer := &net.Dialer{Timeout: defaultTimeout, Control: o.control}
+	if o.LocalIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: o.LocalIP}
+	}
+	return dialer
+}
+
+// 打开应用该选项的UDP socket，o为nil时打开普通的UDP socket
+func (o *SocketOptions) listenUDP() (*net.UDPConn, error) {
+	if o == nil {
+		return net.ListenUDP("udp", nil)
+	}
+	address := ":0"
+	if o.LocalIP != nil {
+		address = net.JoinHostPort(o.LocalIP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: o.control}
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// 建立应用该选项的UDP连接，o为nil时使用普通的UDP socket
+func (o *SocketOptions) dialUDP(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if o != nil {
+		dialer.Control = o.control
+		if o.LocalIP != nil {
+			dialer.LocalAddr = &net.UDPAddr{IP: o.LocalIP}
+		}
+	}
+	return dialer.Dial("udp", address)
+}
+
+// 同Dialer，但o为nil时返回nil接口值，用于proxy.Dialer类型的字段
+func (o *SocketOptions) proxyDialer() proxy.Dialer {
+	if o == nil {
+		return nil
+	}
+	return o.Dialer()
+}
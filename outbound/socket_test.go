@@ -0,0 +1,68 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSocketOptions(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	sources := make(chan *net.UDPAddr, 2)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sources <- addr.(*net.UDPAddr)
+			req := new(dns.Msg)
+			_ = req.Unpack(buf[:n])
+			raw, _ := new(dns.Msg).SetReply(req).Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+	opts := &SocketOptions{LocalIP: net.ParseIP("127.0.0.1")}
+	if runtime.GOOS == "linux" && os.Geteuid() == 0 { // 设置网卡、fwmark需要相应权限
+		opts.Interface, opts.Mark = "lo", 1
+	}
+	// UDP请求使用指定的源地址，未启用复用时每次请求使用新的socket
+	caller := &UDPCaller{Address: conn.LocalAddr().String(), Timeout: time.Second, Socket: opts}
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, err = caller.Call(req)
+		assert.Equal(t, err, nil)
+	}
+	first, second := <-sources, <-sources
+	assert.Equal(t, first.IP.String(), "127.0.0.1")
+	assert.NotEqual(t, first.Port, second.Port)
+	// TCP连接使用指定的源地址
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = listener.Close() }()
+	tcpConn, err := opts.Dialer().Dial("tcp", listener.Addr().String())
+	assert.Equal(t, err, nil)
+	if tcpConn != nil {
+		assert.Equal(t, tcpConn.LocalAddr().(*net.TCPAddr).IP.String(), "127.0.0.1")
+		_ = tcpConn.Close()
+	}
+	// DNSCrypt等UDP连接使用指定的源地址
+	udpConn, err := opts.dialUDP(conn.LocalAddr().String(), time.Second)
+	assert.Equal(t, err, nil)
+	if udpConn != nil {
+		assert.Equal(t, udpConn.LocalAddr().(*net.UDPAddr).IP.String(), "127.0.0.1")
+		_ = udpConn.Close()
+	}
+	// 未指定选项时返回nil
+	var none *SocketOptions
+	assert.True(t, none.Dialer() == nil)
+	assert.True(t, none.proxyDialer() == nil)
+}
@@ -0,0 +1,18 @@
+package outbound
+
+import "golang.org/x/sys/unix"
+
+// 设置socket选项
+func setSocketOptions(fd uintptr, o *SocketOptions) error {
+	if o.Interface != "" {
+		if err := unix.BindToDevice(int(fd), o.Interface); err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, o.Mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package outbound
+
+import "errors"
+
+// 设置socket选项，绑定网卡及fwmark仅支持linux
+func setSocketOptions(fd uintptr, o *SocketOptions) error {
+	if o.Interface != "" {
+		return errors.New("binding to interface is only supported on linux")
+	}
+	if o.Mark != 0 {
+		return errors.New("fwmark is only supported on linux")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package outbound
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DNS stamp的协议类型
+const (
+	StampPlain    = 0x00
+	StampDNSCrypt = 0x01
+	StampDoH      = 0x02
+	StampDoT      = 0x03
+	StampDoQ      = 0x04
+	StampRelay    = 0x81 // Anonymized DNSCrypt中继
+)
+
+// DNS stamp的服务器属性
+const (
+	StampDNSSEC   = 1 << 0 // 支持DNSSEC
+	StampNoLog    = 1 << 1 // 不记录日志
+	StampNoFilter = 1 << 2 // 不过滤结果
+)
+
+// 解码后的DNS stamp（sdns://），格式见https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	Proto        uint8
+	Props        uint64
+	Addr         string   // 服务器ip，可包含端口，DoH/DoT可为空
+	Hashes       [][]byte // 证书链中任一证书TBS部分的SHA256
+	Hostname     string   // DoH/DoT服务器的域名，可包含端口
+	Path         string   // DoH的路径
+	ProviderName string   // DNSCrypt的服务名
+	PublicKey    []byte   // DNSCrypt的公钥
+	Bootstrap    []string // 解析Hostname使用的dns服务器
+}
+
+var errStampTruncated = errors.New("truncated stamp")
+
+// stamp的读取器，字段为长度前缀（LP）或变长列表（VLP）格式
+type stampReader struct {
+	data []byte
+}
+
+func (r *stampReader) lp() ([]byte, error) {
+	if len(r.data) < 1 || len(r.data) < 1+int(r.data[0]) {
+		return nil, errStampTruncated
+	}
+	n := int(r.data[0])
+	value := r.data[1 : 1+n]
+	r.data = r.data[1+n:]
+	return value, nil
+}
+
+func (r *stampReader) vlp() (values [][]byte, err error) {
+	for more := true; more; {
+		if len(r.data) < 1 {
+			return nil, errStampTruncated
+		}
+		more = r.data[0]&0x80 != 0
+		n := int(r.data[0] & 0x7f)
+		if len(r.data) < 1+n {
+			return nil, errStampTruncated
+		}
+		if n > 0 {
+			values = append(values, r.data[1:1+n])
+		}
+		r.data = r.data[1+n:]
+	}
+	return values, nil
+}
+
+// 解码sdns://格式的DNS stamp
+func ParseStamp(text string) (stamp *Stamp, err error) {
+	if !strings.HasPrefix(text, "sdns://") {
+		return nil, fmt.Errorf("invalid stamp: %s", text)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(text[7:], "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp: %v", err)
+	}
+	if len(raw) < 9 {
+		return nil, errStampTruncated
+	}
+	stamp = &Stamp{Proto: raw[0], Props: binary.LittleEndian.Uint64(raw[1:9])}
+	r := &stampReader{data: raw[9:]}
+	var addr, value []byte
+	if addr, err = r.lp(); err != nil {
+		return nil, err
+	}
+	stamp.Addr = string(addr)
+	switch stamp.Proto {
+	case StampPlain, StampRelay:
+	case StampDNSCrypt:
+		if stamp.PublicKey, err = r.lp(); err != nil {
+			return nil, err
+		}
+		if value, err = r.lp(); err != nil {
+			return nil, err
+		}
+		stamp.ProviderName = string(value)
+	case StampDoH, StampDoT, StampDoQ:
+		if stamp.Hashes, err = r.vlp(); err != nil {
+			return nil, err
+		}
+		if value, err = r.lp(); err != nil {
+			return nil, err
+		}
+		stamp.Hostname = string(value)
+		if stamp.Proto == StampDoH {
+			if value, err = r.lp(); err != nil {
+				return nil, err
+			}
+			stamp.Path = string(value)
+		}
+		if len(r.data) > 0 { // 可选的bootstrap服务器列表
+			var servers [][]byte
+			if servers, err = r.vlp(); err != nil {
+				return nil, err
+			}
+			for _, server := range servers {
+				stamp.Bootstrap = append(stamp.Bootstrap, string(server))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol: 0x%02x", stamp.Proto)
+	}
+	return stamp, nil
+}
+
+// 生成校验证书哈希的函数，用于tls.Config.VerifyPeerCertificate，在证书链校验通过后额外要求任一证书匹配哈希
+func verifyHashes(hashes [][]byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(sum[:], hash) {
+					return nil
+				}
+			}
+		}
+		return errors.New("certificate hash mismatch")
+	}
+}
@@ -0,0 +1,74 @@
+package outbound
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// 按stamp格式编码各字段，字段为string时按LP编码，为[]string时按VLP编码
+func makeStamp(proto byte, props byte, fields ...interface{}) string {
+	raw := []byte{proto, props, 0, 0, 0, 0, 0, 0, 0}
+	for _, field := range fields {
+		switch field := field.(type) {
+		case string:
+			raw = append(append(raw, byte(len(field))), field...)
+		case []string:
+			if len(field) == 0 {
+				raw = append(raw, 0)
+			}
+			for i, value := range field {
+				n := byte(len(value))
+				if i < len(field)-1 {
+					n |= 0x80
+				}
+				raw = append(append(raw, n), value...)
+			}
+		}
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func TestParseStamp(t *testing.T) {
+	stamp, err := ParseStamp(makeStamp(StampPlain, StampDNSSEC, "8.8.8.8"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, stamp.Proto, uint8(StampPlain))
+	assert.Equal(t, stamp.Props, uint64(StampDNSSEC))
+	assert.Equal(t, stamp.Addr, "8.8.8.8")
+
+	stamp, err = ParseStamp(makeStamp(StampDoH, StampNoLog, "1.1.1.1", []string{"0123", "4567"},
+		"cloudflare-dns.com", "/dns-query", []string{"1.0.0.1"}))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, stamp.Hashes, [][]byte{[]byte("0123"), []byte("4567")})
+	assert.Equal(t, stamp.Hostname, "cloudflare-dns.com")
+	assert.Equal(t, stamp.Path, "/dns-query")
+	assert.Equal(t, stamp.Bootstrap, []string{"1.0.0.1"})
+
+	stamp, err = ParseStamp(makeStamp(StampDoT, 0, "", []string{}, "dns.google"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(stamp.Hashes), 0)
+	assert.Equal(t, stamp.Hostname, "dns.google")
+
+	stamp, err = ParseStamp(makeStamp(StampRelay, 0, "1.2.3.4:443"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, stamp.Addr, "1.2.3.4:443")
+
+	// 无效stamp
+	for _, text := range []string{"https://dns.google", "sdns://!!", makeStamp(StampDoH, 0, "1.1.1.1"),
+		makeStamp(0x05, 0, "1.1.1.1")} {
+		_, err = ParseStamp(text)
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+func TestVerifyHashes(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	cert := server.Certificate()
+	sum := sha256.Sum256(cert.RawTBSCertificate)
+	assert.Equal(t, verifyHashes([][]byte{[]byte("other"), sum[:]})([][]byte{cert.Raw}, nil), nil)
+	assert.NotEqual(t, verifyHashes([][]byte{[]byte("other")})([][]byte{cert.Raw}, nil), nil)
+}
@@ -0,0 +1,163 @@
+package outbound
+
+import (
+	"crypto/rand"
+	"errors"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultTimeout = 2 * time.Second
+
+var errMismatch = errors.New("response does not match request")
+
+// UDP接收缓冲区大小，原子访问
+var packetSize int32 = dns.MaxMsgSize
+
+// UDP接收缓冲区池，避免每次请求分配64KB的缓冲区
+var packetPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, atomic.LoadInt32(&packetSize))
+	return &buf
+}}
+
+// 请求打包缓冲区池，请求超过缓冲区大小时由PackBuffer另行分配
+var packPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, dns.MinMsgSize)
+	return &buf
+}}
+
+// SetPacketSize 设置UDP接收缓冲区大小。发往上游的请求声明的UDP缓冲区大小不超过4096，
+// 内存较小的设备上可降低为dns.DefaultMsgSize
+func SetPacketSize(size int) {
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	} else if size > dns.MaxMsgSize {
+		size = dns.MaxMsgSize
+	}
+	atomic.StoreInt32(&packetSize, int32(size))
+}
+
+// 判断响应的ID及问题部分是否与请求一致
+func matchResponse(request, r *dns.Msg) bool {
+	if r == nil || r.Id != request.Id || len(r.Question) != len(request.Question) {
+		return false
+	}
+	for i, question := range request.Question {
+		reply := r.Question[i]
+		if reply.Qtype != question.Qtype || reply.Qclass != question.Qclass ||
+			!strings.EqualFold(reply.Name, question.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// 随机化域名中字母的大小写（DNS 0x20），增加伪造响应的难度
+func randomizeCase(name string) string {
+	random := make([]byte, len(name))
+	_, _ = rand.Read(random)
+	buf := []byte(name)
+	for i, c := range buf {
+		if random[i]&1 == 0 {
+			continue
+		}
+		if 'a' <= c && c <= 'z' {
+			buf[i] = c - 'a' + 'A'
+		} else if 'A' <= c && c <= 'Z' {
+			buf[i] = c - 'A' + 'a'
+		}
+	}
+	return string(buf)
+}
+
+// 判断两个响应的应答部分是否一致（忽略TTL）
+func sameAnswer(a, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode || len(a.Answer) != len(b.Answer) {
+		return false
+	}
+	for i := range a.Answer {
+		if !dns.IsDuplicate(a.Answer[i], b.Answer[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 通过UDP发送请求，丢弃来源地址、ID或问题不匹配的响应（伪造响应），直至收到有效响应或超时。
+// 每次请求使用新建的socket及随机的源端口，增加伪造响应的难度。
+// accept不为nil时用于对响应进行额外校验。wait大于0时，收到首个有效响应后继续等待wait，
+// 返回最后收到的有效响应；期间收到内容不一致的响应时conflict为true
+func exchangeUDP(request *dns.Msg, address string, timeout, wait time.Duration,
+	accept func(r *dns.Msg) bool) (r *dns.Msg, conflict bool, err error) {
+	var pool *socketPool
+	return pool.exchange(request, address, timeout, wait, accept)
+}
+
+// 同exchangeUDP，但从socket池中获取socket，p为nil时使用新建的socket
+func (p *socketPool) exchange(request *dns.Msg, address string, timeout, wait time.Duration,
+	accept func(r *dns.Msg) bool) (r *dns.Msg, conflict bool, err error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	packed := packPool.Get().(*[]byte)
+	defer packPool.Put(packed)
+	var buf []byte
+	if buf, err = request.PackBuffer(*packed); err != nil {
+		return nil, false, err
+	}
+	var raddr *net.UDPAddr
+	if raddr, err = net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, false, err
+	}
+	var conn *net.UDPConn
+	if conn, err = p.get(); err != nil {
+		return nil, false, err
+	}
+	defer func() { p.put(conn, err) }()
+	deadline := time.Now().Add(timeout)
+	_ = conn.SetDeadline(deadline)
+	if _, err = conn.WriteToUDP(buf, raddr); err != nil {
+		return nil, false, err
+	}
+	pooled := packetPool.Get().(*[]byte)
+	defer packetPool.Put(pooled)
+	packet := *pooled
+	if size := int(atomic.LoadInt32(&packetSize)); len(packet) != size { // 缓冲区大小已调整
+		packet = make([]byte, size)
+		*pooled = packet
+	}
+	for {
+		n, from, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			if r != nil { // 等待期间超时，使用已收到的响应
+				return r, conflict, nil
+			}
+			return nil, false, err
+		}
+		if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+			continue // 来源地址不匹配
+		}
+		msg := new(dns.Msg)
+		if err = msg.Unpack(packet[:n]); err != nil || !matchResponse(request, msg) {
+			continue // 无效响应
+		}
+		if accept != nil && !accept(msg) {
+			continue
+		}
+		if wait <= 0 {
+			return msg, false, nil
+		}
+		if r == nil { // 收到首个有效响应，缩短等待时间
+			if end := time.Now().Add(wait); end.Before(deadline) {
+				_ = conn.SetDeadline(end)
+			}
+		} else if !sameAnswer(r, msg) {
+			conflict = true
+		}
+		r = msg
+	}
+}
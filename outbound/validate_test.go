@@ -0,0 +1,255 @@
+package outbound
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/edns"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMatchResponse(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	assert.False(t, matchResponse(req, nil))
+	r := new(dns.Msg)
+	r.SetReply(req)
+	assert.True(t, matchResponse(req, r))
+	// 问题部分大小写不同视为匹配
+	r.Question[0].Name = "IP.cn."
+	assert.True(t, matchResponse(req, r))
+	// ID不匹配
+	r.Id++
+	assert.False(t, matchResponse(req, r))
+	// 问题不匹配
+	r.SetReply(req)
+	r.Question[0].Qtype = dns.TypeAAAA
+	assert.False(t, matchResponse(req, r))
+}
+
+func TestExchangeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	// 模拟先返回伪造响应、后返回真实响应的服务器
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		_ = req.Unpack(buf[:n])
+		fake := new(dns.Msg)
+		fake.SetReply(req)
+		fake.Id++
+		rr, _ := dns.NewRR(req.Question[0].Name + " 0 IN A 1.2.3.4")
+		fake.Answer = append(fake.Answer, rr)
+		raw, _ := fake.Pack()
+		_, _ = conn.WriteTo(raw, addr)
+		real := new(dns.Msg)
+		real.SetReply(req)
+		rr, _ = dns.NewRR(req.Question[0].Name + " 0 IN A 5.6.7.8")
+		real.Answer = append(real.Answer, rr)
+		raw, _ = real.Pack()
+		_, _ = conn.WriteTo(raw, addr)
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	caller := UDPCaller{Address: conn.LocalAddr().String(), Timeout: time.Second}
+	r, err := caller.Call(req)
+	assert.Equal(t, err, nil)
+	if assert.True(t, r != nil && len(r.Answer) == 1) {
+		assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "5.6.7.8")
+	}
+	// 无响应时超时
+	r, err = caller.Call(req)
+	assert.NotEqual(t, err, nil)
+	assert.True(t, r == nil)
+}
+
+func TestExchangeUDPSourcePort(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	ports := make(chan int, 2)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ports <- addr.(*net.UDPAddr).Port
+			req := new(dns.Msg)
+			_ = req.Unpack(buf[:n])
+			raw, _ := new(dns.Msg).SetReply(req).Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		_, _, err = exchangeUDP(req, conn.LocalAddr().String(), time.Second, 0, nil)
+		assert.Equal(t, err, nil)
+	}
+	// 每次请求使用不同的源端口
+	assert.NotEqual(t, <-ports, <-ports)
+	// 复用socket时使用相同的源端口
+	caller := &UDPCaller{Address: conn.LocalAddr().String(), Timeout: time.Second, PoolSize: 1}
+	for i := 0; i < 2; i++ {
+		_, err = caller.Call(req)
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, <-ports, <-ports)
+}
+
+func TestExchangeUDPWait(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	// 模拟抢答：先返回ID正确的伪造响应，稍后返回真实响应
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		_ = req.Unpack(buf[:n])
+		for i, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+			if i > 0 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			r := new(dns.Msg)
+			r.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 0 IN A " + ip)
+			r.Answer = append(r.Answer, rr)
+			raw, _ := r.Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	r, conflict, err := exchangeUDP(req, conn.LocalAddr().String(), time.Second, 200*time.Millisecond, nil)
+	assert.Equal(t, err, nil)
+	assert.True(t, conflict)
+	if assert.True(t, r != nil && len(r.Answer) == 1) {
+		assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "5.6.7.8")
+	}
+}
+
+func TestRandomizeCase(t *testing.T) {
+	name := "www.example-domain.com."
+	for i := 0; i < 10; i++ {
+		assert.True(t, strings.EqualFold(randomizeCase(name), name))
+	}
+	assert.Equal(t, randomizeCase("123.-."), "123.-.")
+}
+
+func TestUDPCookie(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	serverCookie := "0102030405060708"
+	received := make(chan string, 2)
+	// 模拟支持Cookie的服务器，每次先返回一个Cookie错误的伪造响应
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			_ = req.Unpack(buf[:n])
+			client, server, _ := edns.GetCookie(req)
+			received <- server
+			for _, c := range []string{edns.NewClientCookie(), client} {
+				r := new(dns.Msg)
+				r.SetReply(req)
+				r.SetEdns0(4096, false)
+				edns.SetCookie(r, c, serverCookie)
+				raw, _ := r.Pack()
+				_, _ = conn.WriteTo(raw, addr)
+			}
+		}
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	caller := &UDPCaller{Address: conn.LocalAddr().String(), Timeout: time.Second, UseCookie: true}
+	r, err := caller.Call(req)
+	assert.Equal(t, err, nil)
+	assert.True(t, r != nil && r.IsEdns0() == nil) // 客户端请求无OPT记录，响应中也不应包含
+	assert.Equal(t, <-received, "")
+	// 第二次请求携带服务端Cookie
+	_, err = caller.Call(req)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, <-received, serverCookie)
+}
+
+func BenchmarkExchangeUDP(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			_ = req.Unpack(buf[:n])
+			raw, _ := new(dns.Msg).SetReply(req).Pack()
+			_, _ = conn.WriteTo(raw, addr)
+		}
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeA)
+	caller := &UDPCaller{Address: conn.LocalAddr().String(), Timeout: time.Second, PoolSize: 4}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := caller.Call(req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetPacketSize(t *testing.T) {
+	defer SetPacketSize(dns.MaxMsgSize)
+	SetPacketSize(100)
+	assert.Equal(t, atomic.LoadInt32(&packetSize), int32(dns.MinMsgSize))
+	SetPacketSize(1 << 20)
+	assert.Equal(t, atomic.LoadInt32(&packetSize), int32(dns.MaxMsgSize))
+	// 调整后的缓冲区仍可接收不超过该大小的响应
+	SetPacketSize(dns.DefaultMsgSize)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close() }()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		_ = req.Unpack(buf[:n])
+		r := new(dns.Msg).SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 0 IN TXT \"" + strings.Repeat("a", 200) + "\"")
+		r.Answer = append(r.Answer, rr)
+		raw, _ := r.Pack()
+		_, _ = conn.WriteTo(raw, addr)
+	}()
+	req := new(dns.Msg)
+	req.SetQuestion("ip.cn.", dns.TypeTXT)
+	r, _, err := exchangeUDP(req, conn.LocalAddr().String(), time.Second, 0, nil)
+	assert.Equal(t, err, nil)
+	assert.True(t, r != nil && len(r.Answer) == 1)
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/control"
+	"github.com/wolf-joe/ts-dns/device"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"github.com/wolf-joe/ts-dns/rewrite"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// 内置处理阶段的名称，按执行顺序排列。插件可插入到任一阶段之前
+var stageNames = []string{"log", "ipset", "search", "local", "rewrite", "post", "block", "cache", "hosts", "route"}
+
+// 请求上下文中保存客户端设备配置及命中的屏蔽列表名称的键
+const (
+	deviceKey  = "device"
+	blockedKey = "blocked"
+	reasonKey  = "reason"   // 结构化查询日志中的原因
+	clientKey  = "client"   // 客户端发起的查询（非预取、跟踪等内部查询）
+	noIPSetKey = "no-ipset" // 结果不写入ipset
+)
+
+// 获取请求对应的设备配置，未识别设备时返回nil
+func deviceProfile(ctx *middleware.Context) *device.Profile {
+	profile, _ := ctx.Get(deviceKey)
+	p, _ := profile.(*device.Profile)
+	return p
+}
+
+// 按客户端识别设备配置，并确定请求使用的组：已指定的组（如DoH请求路径）优先，其次为设备配置、client_rules
+func assignClient(c *config.Config, ctx *middleware.Context) {
+	if profile := c.Devices.Match(ctx.ClientIP); profile != nil { // 按MAC地址或主机名识别的设备配置
+		ctx.Set(deviceKey, profile)
+		if ctx.Group == "" {
+			ctx.Group = profile.Group
+		}
+	}
+	for _, rule := range c.ClientRules { // 首个匹配的规则生效
+		if ctx.Group == "" && rule.Clients.Contains(ctx.ClientIP) {
+			ctx.Group = rule.Group
+		}
+	}
+}
+
+// 创建内置处理阶段
+func newStage(c *config.Config, name string) middleware.Middleware {
+	switch name {
+	case "log":
+		return logStage(c)
+	case "ipset":
+		return ipsetStage(c)
+	case "search":
+		return searchStage(c)
+	case "local":
+		return localStage(c)
+	case "rewrite":
+		return rewriteStage(c)
+	case "post":
+		return postStage(c)
+	case "block":
+		return blockStage(c)
+	case "cache":
+		return cacheStage(c)
+	case "hosts":
+		return hostsStage(c)
+	case "route":
+		return routeStage(c)
+	}
+	return nil
+}
+
+// 按配置创建处理链，插件按配置顺序插入到指定阶段之前，未指定阶段时插入到route之前
+func buildPipeline(c *config.Config, plugins []pluginStruct) (middleware.Handler, error) {
+	before := map[string][]middleware.Middleware{}
+	for _, plugin := range plugins {
+		stage := plugin.Before
+		if stage == "" {
+			stage = "route"
+		}
+		if newStage(c, stage) == nil {
+			return nil, fmt.Errorf("unknown stage for plugin %s: %s", plugin.Name, stage)
+		}
+		mw, err := middleware.New(plugin.Name, plugin.Params)
+		if err != nil {
+			return nil, err
+		}
+		before[stage] = append(before[stage], mw)
+	}
+	var chain []middleware.Middleware
+	for _, name := range stageNames {
+		chain = append(chain, before[name]...)
+		chain = append(chain, newStage(c, name))
+	}
+	return middleware.Chain(func(*middleware.Context) {}, chain...), nil
+}
+
+// 记录客户端查询：处理链返回后写入结构化查询日志，并向控制接口推送查询事件及处理过程
+func logStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		if _, ok := ctx.Get(clientKey); !ok {
+			next(ctx)
+			return
+		}
+		question := ctx.Request.Question[0]
+		// 控制接口的跟踪者关注该查询时记录处理过程；输出结构化查询日志时用于记录使用的上游
+		tracing := c.Control.Tracing(question.Name, ctx.ClientIP)
+		if ctx.Trace == nil && (tracing || c.QueryLogger != nil) {
+			ctx.Trace = middleware.NewTrace()
+		}
+		start := time.Now()
+		next(ctx)
+		if c.QueryLogger != nil {
+			writeQueryLog(c, ctx, ctx.Response, time.Since(start))
+		}
+		if watching := c.Control.Watching(); watching || tracing {
+			event := control.NewEvent(ctx.ClientIP, question, ctx.Group, ctx.Response, time.Since(start))
+			if list, ok := ctx.Get(blockedKey); ok {
+				event.Blocked = list.(string)
+			}
+			if watching { // 向控制接口的订阅者推送查询事件
+				c.Control.Publish(event)
+			}
+			if tracing {
+				c.Control.PublishTrace(control.NewTraceEvent(event, ctx.Trace))
+			}
+		}
+	}
+}
+
+// 处理链返回后将响应中的地址写入所属组的ipset/nftset，在响应写入客户端前完成，便于客户端随即按集合路由
+func ipsetStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		next(ctx)
+		if _, ok := ctx.Get(noIPSetKey); ok || ctx.Response == nil {
+			return
+		}
+		r := *ctx.Response // 本地生成的响应不含问题部分，按请求的域名沿CNAME链提取地址
+		r.Question = ctx.Request.Question
+		if err := addIPSet(c.GroupMap[ctx.Group], &r); err != nil {
+			log.Printf("[ERROR] add record to ipset error: %v\n", err)
+			c.Notifier.IPSetError(err)
+		}
+	}
+}
+
+// 在应答前加入origin指向target的CNAME记录，返回修改后的副本
+func prependCNAME(r *dns.Msg, origin, target string) *dns.Msg {
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeCNAME, Class: dns.ClassINET,
+		Ttl: r.Answer[0].Header().Ttl}, Target: target}
+	r = r.Copy()
+	r.Answer = append([]dns.RR{cname}, r.Answer...)
+	return r
+}
+
+// 在hosts及本地权威区域中查找name的记录，无记录时返回nil
+func localRecord(c *config.Config, request *dns.Msg, name string) *dns.Msg {
+	qtype := request.Question[0].Qtype
+	if qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		if record := hostsRecord(c, name, qtype == dns.TypeAAAA); record != "" {
+			if rr, err := dns.NewRR(record); err == nil {
+				r := new(dns.Msg).SetReply(request)
+				r.Answer = append(r.Answer, rr)
+				return r
+			}
+		}
+	}
+	if z := findZone(c, name); z != nil {
+		sub := request.Copy()
+		sub.Question[0].Name = name
+		if r := z.Query(sub); r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+// 扩展查询名称：本地无记录的单标签名称先按本地域名在hosts及本地权威区域中查找，不转发至上游；
+// 再按resolv.conf的search及ndots选项扩展：点号少于ndots的名称先依次尝试各搜索域，
+// 其余名称仅在原名称无应答时尝试。扩展后的名称有应答时，在应答前加入原名称指向该名称的CNAME记录
+func searchStage(c *config.Config) middleware.Func {
+	found := func(r *dns.Msg) bool {
+		return r != nil && r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0
+	}
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		origin := ctx.Request.Question[0].Name
+		if dns.CountLabel(origin) == 1 && len(c.LocalDomains) > 0 && localRecord(c, ctx.Request, origin) == nil {
+			for _, domain := range c.LocalDomains {
+				if r := localRecord(c, ctx.Request, origin+domain); r != nil {
+					stageLog(c, ctx, "search", "expand to local "+origin+domain)
+					ctx.Response = prependCNAME(r, origin, origin+domain)
+					return
+				}
+			}
+		}
+		if len(c.Search) == 0 || origin == "." {
+			next(ctx)
+			return
+		}
+		dots := strings.Count(strings.TrimSuffix(origin, "."), ".")
+		var r *dns.Msg
+		group, preset := "", ctx.Group
+		if dots >= c.Ndots {
+			if next(ctx); found(ctx.Response) {
+				return
+			}
+			r, group = ctx.Response, ctx.Group
+		}
+		for _, domain := range c.Search {
+			name := origin + domain
+			ctx.Request.Question[0].Name = name
+			ctx.Response, ctx.Group = nil, preset
+			next(ctx)
+			ctx.Request.Question[0].Name = origin
+			if found(ctx.Response) {
+				stageLog(c, ctx, "search", "expand to "+name)
+				ctx.Response = prependCNAME(ctx.Response, origin, name)
+				return
+			}
+		}
+		if dots >= c.Ndots { // 搜索域均无应答时返回原名称的应答
+			ctx.Response, ctx.Group = r, group
+			return
+		}
+		ctx.Response, ctx.Group = nil, preset
+		next(ctx)
+	}
+}
+
+// 本地应答：ANY查询、被禁止的记录类型、本地权威区域、条件转发及私有地址/虚假ip的反向查询
+func localStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		request := ctx.Request
+		question := request.Question[0]
+		// 按RFC 8482对ANY查询返回HINFO记录，不转发至上游
+		if question.Qtype == dns.TypeANY {
+			r := new(dns.Msg)
+			r.Answer = append(r.Answer, &dns.HINFO{Hdr: dns.RR_Header{Name: question.Name,
+				Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3789}, Cpu: "RFC8482"})
+			stageLog(c, ctx, "local", "refuse ANY")
+			ctx.Response = r
+			return
+		}
+		if c.BlockedQtypes[question.Qtype] {
+			stageLog(c, ctx, "local", "block qtype "+dns.TypeToString[question.Qtype])
+			ctx.Response = denyReply(c, c.BlockAction, request)
+			return
+		}
+		// 本地权威区域内的查询直接应答
+		if z := findZone(c, question.Name); z != nil {
+			stageLog(c, ctx, "local", "match zone "+z.Origin)
+			ctx.Response = z.Query(request)
+			return
+		}
+		// 条件转发的域名直接转发至目标组
+		if forward := findForward(c, question.Name); forward != nil {
+			stageLog(c, ctx, "local", fmt.Sprintf("match group '%s' (forward %s)", forward.Group, forward.Zone))
+			ctx.Group = forward.Group
+			ctx.Response = callDNS(c, c.GroupMap[forward.Group], request, ctx.Trace)
+			return
+		}
+		// 私有地址的反向查询不泄露给公共dns服务器（RFC 6303）
+		if question.Qtype == dns.TypePTR {
+			ip := hosts.ReverseIP(question.Name)
+			// 虚假ip的反向查询返回对应的域名，供透明代理按域名转发
+			if c.FakeIP != nil && ip != nil && c.FakeIP.Contains(ip) {
+				stageLog(c, ctx, "local", "match fake ip ptr")
+				ctx.Response = fakePTR(c, question.Name, ip)
+				return
+			}
+			// hosts（含自定义hosts、Docker容器）中的地址在本地应答，便于netstat、tcpdump等显示域名
+			if hostname := hostsHostname(c, ip); hostname != "" {
+				stageLog(c, ctx, "local", "match hosts ptr")
+				ctx.Response = new(dns.Msg)
+				ctx.Response.Answer = append(ctx.Response.Answer, &dns.PTR{Hdr: dns.RR_Header{
+					Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: c.HostsTTL}, Ptr: hostname})
+				return
+			}
+			if zone := hosts.PrivateZone(question.Name); zone != "" {
+				if c.PrivatePTR != "" {
+					stageLog(c, ctx, "local", fmt.Sprintf("match group '%s' (private ptr)", c.PrivatePTR))
+					ctx.Group = c.PrivatePTR
+					ctx.Response = callDNS(c, c.GroupMap[c.PrivatePTR], request, ctx.Trace)
+				} else {
+					stageLog(c, ctx, "local", "match private ptr")
+					ctx.Response = privatePTR(zone)
+				}
+				return
+			}
+		}
+		next(ctx)
+	}
+}
+
+// 强制安全搜索：改写为对CNAME目标的查询，返回前在应答中加入CNAME记录
+func rewriteStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		origin := ctx.Request.Question[0].Name
+		target := safeSearchTarget(c, ctx.ClientIP, origin)
+		if profile := deviceProfile(ctx); profile != nil && profile.SafeSearch != nil { // 设备配置优先
+			if target = ""; *profile.SafeSearch {
+				target = rewrite.SafeSearch(origin)
+			}
+		}
+		if target == "" {
+			next(ctx)
+			return
+		}
+		cname := &dns.CNAME{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeCNAME,
+			Class: dns.ClassINET, Ttl: 300}, Target: target}
+		ctx.Trace.Add("rewrite", "safe search "+target)
+		ctx.Request.Question[0].Name = target
+		ctx.LogPrefix += "safe search "
+		next(ctx)
+		ctx.Request.Question[0].Name = origin
+		if r := ctx.Response; r != nil {
+			r = r.Copy()
+			r.Answer = append([]dns.RR{cname}, r.Answer...)
+			ctx.Response = r
+		}
+	}
+}
+
+// 后处理：上游仅返回CNAME时通过后续阶段查询CNAME目标
+func postStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		next(ctx)
+		if c.ResolveCNAME {
+			ctx.Response = chaseCNAME(c, ctx.Request, ctx.Response, ctx.ClientIP, ctx.Trace, next, 0)
+		}
+	}
+}
+
+// 判断域名是否被分类屏蔽列表屏蔽
+func blockStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		if name := matchBlocklist(c, ctx); name != "" {
+			stageLog(c, ctx, "block", fmt.Sprintf("match blocklist '%s'", name))
+			ctx.Set(blockedKey, name)
+			ctx.Response = denyReply(c, c.BlockAction, ctx.Request)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// 查找对该客户端生效且匹配请求域名的屏蔽列表，返回列表名称，未匹配时返回空串
+func matchBlocklist(c *config.Config, ctx *middleware.Context) string {
+	profile, now := deviceProfile(ctx), time.Now()
+	for _, list := range c.Blocklists {
+		active := list.Active(ctx.ClientIP, now)
+		if profile != nil && profile.Blocklists != nil { // 设备配置指定了生效的屏蔽列表
+			active = profile.UsesBlocklist(list.Name) && list.Scheduled(now)
+		}
+		if active && list.Match(ctx.Request.Question[0].Name) {
+			return list.Name
+		}
+	}
+	return ""
+}
+
+// 检测dns缓存是否命中。缓存命中时无需查找hosts及分组规则，未命中时合并并发的相同查询。
+// 已指定组的请求使用该组的缓存分区，避免与其它组的结果混淆
+func cacheStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		store, key := c.Cache.Partition(ctx.Group), cache.Key(ctx.Request)
+		if ctx.Group != "" {
+			key = ctx.Group + "/" + key
+		}
+		r, status := store.Lookup(ctx.Request)
+		switch status {
+		case cache.Hit:
+			ctx.Response = r
+			stageLog(c, ctx, "cache", "hit cache")
+			return
+		case cache.Expiring, cache.Stale: // 返回缓存的响应，同时在后台重新查询并更新缓存
+			ctx.Response = r
+			if status == cache.Stale {
+				stageLog(c, ctx, "cache", "hit stale cache")
+			} else {
+				stageLog(c, ctx, "cache", "hit expiring cache")
+			}
+			if store.StartRefresh(ctx.Request) {
+				go refreshCache(c, ctx.Request.Copy(), ctx.ClientIP, ctx.Group, next)
+			}
+			return
+		}
+		ctx.Trace.Add("cache", "miss")
+		// 等待相同的查询完成时共享其响应，避免缓存未命中时重复查询上游
+		if c.Flight.Do(key, ctx, next) {
+			stageLog(c, ctx, "cache", "share in-flight query")
+		}
+	}
+}
+
+// 由缓存阶段之后的处理链重新解析请求，结果经查询路径写入缓存及ipset
+func refreshCache(c *config.Config, request *dns.Msg, ip net.IP, group string, next middleware.Handler) {
+	defer c.Cache.Partition(group).RefreshDone(request)
+	ctx := &middleware.Context{Request: request, ClientIP: ip, Group: group}
+	if c.QueryLog {
+		ctx.LogPrefix = fmt.Sprintf("[INFO] %s refresh ", request.Question[0].Name)
+	}
+	next(ctx)
+	if ctx.Response != nil {
+		if err := addIPSet(c.GroupMap[ctx.Group], ctx.Response); err != nil {
+			log.Printf("[ERROR] add record to ipset error: %v\n", err)
+		}
+	}
+}
+
+// 判断域名是否存在于hosts内。hosts中的别名依次展开，目标不在hosts中时改写为对目标的查询，返回前在应答中加入CNAME记录
+func hostsStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		question := ctx.Request.Question[0]
+		name, cnames := question.Name, []dns.RR(nil)
+		for len(cnames) < maxCNAMEDepth {
+			target := hostsCNAME(c, name)
+			if target == "" {
+				break
+			}
+			cnames = append(cnames, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME,
+				Class: dns.ClassINET}, Target: target})
+			if name = target; question.Qtype == dns.TypeCNAME {
+				break
+			}
+		}
+		answer := hostsAnswer(c, name, question.Qtype)
+		for _, rr := range append(cnames, answer...) {
+			rr.Header().Ttl = c.HostsTTL
+		}
+		if answer != nil || question.Qtype == dns.TypeCNAME && cnames != nil {
+			ctx.Response = new(dns.Msg)
+			ctx.Response.Answer = append(cnames, answer...)
+			stageLog(c, ctx, "hosts", "match hosts")
+			return
+		}
+		if cnames == nil {
+			ctx.Trace.Add("hosts", "no match")
+			next(ctx)
+			return
+		}
+		stageLog(c, ctx, "hosts", "match hosts cname "+name)
+		ctx.Request.Question[0].Name = name
+		next(ctx)
+		ctx.Request.Question[0].Name = question.Name
+		if r := ctx.Response; r != nil {
+			r = r.Copy()
+			r.Answer = append(cnames, r.Answer...)
+			ctx.Response = r
+		}
+	}
+}
+
+// 生成hosts中域名对应的A/AAAA/TXT记录，如不存在则返回nil
+func hostsAnswer(c *config.Config, name string, qtype uint16) (answer []dns.RR) {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		if record := hostsRecord(c, name, qtype == dns.TypeAAAA); record != "" {
+			if ret, err := dns.NewRR(record); err != nil {
+				log.Printf("[ERROR] make DNS.RR error: %v\n", err)
+			} else {
+				answer = append(answer, ret)
+			}
+		}
+	case dns.TypeTXT:
+		for _, reader := range c.HostsReaders {
+			for _, hostname := range hostsNames(c, name) {
+				for _, txt := range reader.TXT(hostname) {
+					answer = append(answer, &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT,
+						Class: dns.ClassINET}, Txt: splitTXT(txt)})
+				}
+				if answer != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// 将TXT记录内容按255字节拆分为多个字符串
+func splitTXT(txt string) (parts []string) {
+	for len(txt) > 255 {
+		parts, txt = append(parts, txt[:255]), txt[255:]
+	}
+	return append(parts, txt)
+}
+
+// 查找hosts中域名的别名目标（FQDN），如不存在则返回空串
+func hostsCNAME(c *config.Config, name string) string {
+	for _, reader := range c.HostsReaders {
+		for _, hostname := range hostsNames(c, name) {
+			if target := reader.CNAME(hostname); target != "" {
+				return target
+			}
+		}
+	}
+	return ""
+}
+
+// 输出查询日志，并记录到该查询的处理过程中
+func stageLog(c *config.Config, ctx *middleware.Context, stage, detail string) {
+	queryLog(c, ctx.LogPrefix+detail)
+	ctx.Trace.Add(stage, detail)
+	if c.QueryLogger != nil {
+		ctx.Set(reasonKey, detail)
+	}
+}
+
+// 返回在hosts中查找域名时依次使用的名称。"主机名.本地域名"同样匹配hosts中的主机名（同dnsmasq的expand-hosts）
+func hostsNames(c *config.Config, name string) []string {
+	candidates := []string{name, name[:len(name)-1]} // 去掉末尾的根域名再找一次
+	for _, domain := range c.LocalDomains {
+		if label := strings.TrimSuffix(name, "."+domain); label != name && !strings.Contains(label, ".") {
+			candidates = append(candidates, label)
+		}
+	}
+	return candidates
+}
+
+// 查找hosts中域名对应的记录，如不存在则返回空串
+func hostsRecord(c *config.Config, name string, ipv6 bool) string {
+	candidates := hostsNames(c, name)
+	for _, reader := range c.HostsReaders {
+		for i, hostname := range candidates {
+			if record := reader.Record(hostname, ipv6); record != "" {
+				if i >= 2 { // 记录名称替换为查询的名称
+					record = name + strings.TrimPrefix(record, hostname)
+				}
+				return record
+			}
+		}
+	}
+	return ""
+}
+
+// 按分组规则、gfwlist等确定域名所属的组并查询。特殊用途域名及控制接口的动态规则优先于请求已指定的组
+func routeStage(c *config.Config) middleware.Func {
+	return func(ctx *middleware.Context, next middleware.Handler) {
+		question := ctx.Request.Question[0]
+		// 特殊用途域名不转发至上游（RFC 6761）
+		if zone := hosts.SpecialZone(question.Name); zone != "" && !c.ForwardSpecial {
+			stageLog(c, ctx, "route", "match special-use domain")
+			ctx.Response, ctx.Group = specialReply(question, zone), ""
+			return
+		}
+		// 控制接口添加的动态规则优先于配置文件中的规则
+		if name, ok := c.Control.Group(question.Name); ok {
+			if group, ok := c.GroupMap[name]; ok {
+				stageLog(c, ctx, "route", fmt.Sprintf("match group '%s' (control)", name))
+				ctx.Response, ctx.Group = callDNS(c, group, ctx.Request, ctx.Trace), name
+				return
+			}
+		}
+		if group, ok := c.GroupMap[ctx.Group]; ctx.Group != "" && ok { // 请求已指定组（如DoH请求路径、设备配置）
+			stageLog(c, ctx, "route", fmt.Sprintf("match group '%s' (assigned)", ctx.Group))
+			nc := *c
+			nc.Cache = c.Cache.Partition(ctx.Group) // 结果写入该组的缓存分区
+			ctx.Response = callDNS(&nc, group, ctx.Request, ctx.Trace)
+			return
+		}
+		ctx.Response, ctx.Group = route(c, ctx)
+	}
+}
+
+// 判断域名是否匹配组的规则：rules中的规则（含白名单）优先，其次为rules_files、rules_urls中的列表
+func groupMatch(group config.Group, name string) bool {
+	if match, ok := group.Matcher.Match(name); ok {
+		return match
+	}
+	for _, list := range group.Lists {
+		if match, ok := list.Match(name); ok {
+			return match
+		}
+	}
+	return false
+}
+
+// 查找规则匹配域名的组，返回组名，未匹配时返回空串
+func ruleGroup(c *config.Config, name string) string {
+	for groupName, group := range c.GroupMap {
+		if groupMatch(group, name) {
+			return groupName
+		}
+	}
+	return ""
+}
+
+// 按分组规则、gfwlist等确定域名所属的组并查询，返回响应及所属组的名称
+func route(c *config.Config, ctx *middleware.Context) (r *dns.Msg, name string) {
+	request, trace := ctx.Request, ctx.Trace
+	question := request.Question[0]
+	// 判断域名是否匹配指定规则
+	if name := ruleGroup(c, question.Name); name != "" {
+		stageLog(c, ctx, "route", fmt.Sprintf("match group '%s' (rules)", name))
+		return callDNS(c, c.GroupMap[name], request, trace), name
+	}
+
+	// 先假设域名属于clean组
+	group := c.GroupMap["clean"]
+	r, bogus := forwardDNS(c, group, request, trace)
+	if bogus {
+		// clean组的响应均包含劫持/污染地址，转由dirty组解析；超时等其它原因无响应时不转发
+		stageLog(c, ctx, "route", "match group 'dirty' (clean poisoned)")
+		return callDNS(c, c.GroupMap["dirty"], request, trace), "dirty"
+	} else if r == nil {
+		stageLog(c, ctx, "route", "match group 'clean' (clean failed)")
+		return nil, "clean"
+	}
+	// 判断响应的ipv4中是否都为中国ip，校验模式下同时判断ipv6
+	ips := extractIPv4(r)
+	if c.VerifyCNIP {
+		ips = append(ips, extractIPv6(r)...)
+	}
+	var allInCN, anyInCN = true, false
+	for _, ip := range ips {
+		if c.CNIPs.Contain(net.ParseIP(ip)) {
+			anyInCN = true
+		} else {
+			allInCN = false
+		}
+	}
+	if allInCN {
+		stageLog(c, ctx, "route", fmt.Sprintf("match group 'clean' (cn ip)"))
+		return r, "clean"
+	}
+	// 出现非中国ip，根据gfwlist再次判断
+	if blocked, ok := c.GFWMatcher.Match(question.Name); ok && blocked {
+		stageLog(c, ctx, "route", fmt.Sprintf("match group 'dirty' (in gfwlist)"))
+		return callDNS(c, c.GroupMap["dirty"], request, trace), "dirty" // 判断域名属于dirty组
+	}
+	// 校验模式（同ChinaDNS）：不在gfwlist中但响应中无中国ip，可能是被污染或新近被封锁的域名，转由dirty组解析，
+	// dirty组无有效响应时仍使用clean组的响应
+	if c.VerifyCNIP && !anyInCN {
+		if dr := callDNS(c, c.GroupMap["dirty"], request, trace); dr != nil {
+			stageLog(c, ctx, "route", "match group 'dirty' (no cn ip)")
+			return dr, "dirty"
+		}
+		stageLog(c, ctx, "route", "match group 'clean' (no cn ip, dirty failed)")
+		return r, "clean"
+	}
+	stageLog(c, ctx, "route", fmt.Sprintf("match group 'clean' (not in gfwlist)"))
+	return r, "clean"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 同时进行的预取查询数
+const prefetchWorkers = 4
+
+// 读取预取域名列表，每行一个域名，域名后可指定记录类型（默认为A），#开头的行为注释
+func readPrefetch(filename string) (questions []dns.Question, err error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		qtypes := []uint16{dns.TypeA}
+		if len(fields) > 1 {
+			qtypes = nil
+		}
+		for _, name := range fields[1:] {
+			qtype, ok := dns.StringToType[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown query type %s at line %d", name, i+1)
+			}
+			qtypes = append(qtypes, qtype)
+		}
+		for _, qtype := range qtypes {
+			questions = append(questions, dns.Question{Name: dns.Fqdn(strings.ToLower(fields[0])), Qtype: qtype,
+				Qclass: dns.ClassINET})
+		}
+	}
+	return questions, nil
+}
+
+// 按正常的分组规则解析各查询，结果写入缓存及ipset，返回无有效响应的查询数
+func prefetch(c *config.Config, questions []dns.Question) (failed int) {
+	var count int32
+	var wg sync.WaitGroup
+	ch := make(chan dns.Question)
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for question := range ch {
+				request := new(dns.Msg)
+				request.SetQuestion(question.Name, question.Qtype)
+				ctx := &middleware.Context{Request: request, ClientIP: net.IPv4(127, 0, 0, 1)}
+				if c.QueryLog {
+					ctx.LogPrefix = fmt.Sprintf("[INFO] %s prefetch ", question.Name)
+				}
+				c.Pipeline(ctx)
+				if ctx.Response == nil || ctx.Response.Rcode == dns.RcodeServerFailure {
+					atomic.AddInt32(&count, 1)
+				}
+			}
+		}()
+	}
+	for _, question := range questions {
+		ch <- question
+	}
+	close(ch)
+	wg.Wait()
+	return int(count)
+}
+
+// 启动时及之后每隔prefetch_interval预取列表中的域名，每次按当前配置读取列表及解析
+func prefetchLoop() {
+	var last time.Time
+	for ; ; time.Sleep(time.Minute) {
+		c := currentConfig()
+		if c.PrefetchFile == "" || !last.IsZero() && (c.PrefetchInterval <= 0 ||
+			time.Since(last) < c.PrefetchInterval) {
+			continue
+		}
+		last = time.Now()
+		questions, err := readPrefetch(c.PrefetchFile)
+		if err != nil {
+			log.Printf("[ERROR] read prefetch_domains error: %v\n", err)
+			continue
+		}
+		failed := prefetch(c, questions)
+		log.Printf("[INFO] prefetched %d queries in %v, %d failed\n", len(questions),
+			time.Since(last).Round(time.Millisecond), failed)
+	}
+}
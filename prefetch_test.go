@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "prefetch")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "prefetch.txt")
+	_ = ioutil.WriteFile(filename, []byte("# comment\nWWW.QQ.com\n\ngoogle.com A aaaa\n"), 0644)
+	questions, err := readPrefetch(filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, questions, []dns.Question{{Name: "www.qq.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "google.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "google.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}})
+	_ = ioutil.WriteFile(filename, []byte("google.com TXT unknown\n"), 0644)
+	_, err = readPrefetch(filename)
+	assert.NotEqual(t, err, nil)
+	_, err = readPrefetch(filepath.Join(dir, "missing.txt"))
+	assert.NotEqual(t, err, nil)
+
+	// 按分组规则解析并写入缓存
+	clean, stopClean := startUpstream(t, "1.1.1.1")
+	defer stopClean()
+	dirty, stopDirty := startUpstream(t, "2.2.2.2")
+	defer stopDirty()
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs: ipset.NewRamSetByText("1.0.0.0/8"),
+		GroupMap: map[string]config.Group{
+			"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: clean}}, Matcher: matcher.NewABPByText("")},
+			"dirty": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: dirty}},
+				Matcher: matcher.NewABPByText("google.com")},
+		}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	assert.Equal(t, prefetch(c, questions[:2]), 0)
+	request := new(dns.Msg)
+	request.SetQuestion("www.qq.com.", dns.TypeA)
+	assert.Equal(t, c.Cache.Get(request).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	request.SetQuestion("google.com.", dns.TypeA)
+	assert.Equal(t, c.Cache.Get(request).Answer[0].(*dns.A).A.String(), "2.2.2.2")
+	// 无有效响应的查询计为失败
+	stopClean()
+	stopDirty()
+	for _, group := range c.GroupMap {
+		group.Callers[0].(*outbound.UDPCaller).Timeout = 100 * time.Millisecond
+	}
+	assert.Equal(t, prefetch(c, []dns.Question{{Name: "www.baidu.com.", Qtype: dns.TypeA}}), 1)
+}
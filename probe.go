@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单个上游服务器的测试结果
+type probeResult struct {
+	group     string
+	upstream  string
+	total     int
+	failed    int
+	blocked   int // 查询被墙域名的成功次数
+	poisoned  int // 被墙域名返回污染地址的次数
+	latencies []time.Duration
+}
+
+// 查询成功率
+func (result *probeResult) rate() float64 {
+	if result.total == 0 {
+		return 0
+	}
+	return float64(result.total-result.failed) / float64(result.total)
+}
+
+// 判断被墙域名的响应是否被污染：包含bogus_ips、国内地址或保留地址
+func isPoisoned(c *config.Config, r *dns.Msg) bool {
+	if findBogusIP(c, r) != nil {
+		return true
+	}
+	for _, answer := range r.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip == nil {
+			continue
+		}
+		if c.CNIPs != nil && c.CNIPs.Contain(ip) || ip.IsLoopback() || ip.IsUnspecified() ||
+			ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// 按各域名依次查询rounds轮，blocked中的域名用于检测污染
+func probeUpstream(c *config.Config, caller outbound.Caller, domains, blocked []string, rounds int) (
+	result probeResult) {
+	result.upstream = fmt.Sprint(caller)
+	isBlocked := map[string]bool{}
+	for _, domain := range blocked {
+		isBlocked[domain] = true
+	}
+	for i := 0; i < rounds; i++ {
+		for _, domain := range append(append([]string{}, domains...), blocked...) {
+			request := new(dns.Msg)
+			request.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+			start := time.Now()
+			r, err := caller.Call(request)
+			result.total++
+			if err != nil || r.Rcode != dns.RcodeSuccess {
+				result.failed++
+				continue
+			}
+			result.latencies = append(result.latencies, time.Since(start))
+			if isBlocked[domain] {
+				result.blocked++
+				if isPoisoned(c, r) {
+					result.poisoned++
+				}
+			}
+		}
+	}
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result
+}
+
+// 排序测试结果：同组内未被污染的优先，其次按成功率降序、延迟中位数升序
+func rankProbes(results []probeResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := &results[i], &results[j]
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		if (a.poisoned > 0) != (b.poisoned > 0) {
+			return a.poisoned == 0
+		}
+		if a.rate() != b.rate() {
+			return a.rate() > b.rate()
+		}
+		if len(a.latencies) == 0 || len(b.latencies) == 0 {
+			return len(a.latencies) > len(b.latencies)
+		}
+		return percentile(a.latencies, 0.5) < percentile(b.latencies, 0.5)
+	})
+}
+
+// 拆分逗号分隔的列表，忽略空项
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// probe子命令：测试配置文件中各上游服务器的延迟、成功率及被墙域名的污染情况，按组输出排序后的结果
+func runProbe(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path")
+	domains := fs.String("domains", "www.baidu.com,www.qq.com,www.taobao.com", "comma-separated test domains")
+	blocked := fs.String("blocked", "www.google.com,www.youtube.com,twitter.com,www.facebook.com",
+		"comma-separated known-blocked domains used to detect poisoning")
+	rounds := fs.Int("n", 3, "rounds of queries for each domain")
+	groups := fs.String("group", "", "comma-separated groups to probe, all groups if empty")
+	_ = fs.Parse(args)
+
+	c, err := newQueryConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config error: %v\n", err)
+		os.Exit(1)
+	}
+	names := splitList(*groups)
+	if len(names) == 0 {
+		for name := range c.GroupMap {
+			names = append(names, name)
+		}
+	}
+	var mux sync.Mutex
+	var results []probeResult
+	var wg sync.WaitGroup
+	for _, name := range names {
+		group, ok := c.GroupMap[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown group: %s\n", name)
+			os.Exit(1)
+		}
+		for _, caller := range group.Callers {
+			wg.Add(1)
+			go func(name string, caller outbound.Caller) { // 各上游并行测试，同一上游的查询依次进行
+				defer wg.Done()
+				result := probeUpstream(c, caller, splitList(*domains), splitList(*blocked), *rounds)
+				result.group = name
+				mux.Lock()
+				results = append(results, result)
+				mux.Unlock()
+			}(name, caller)
+		}
+	}
+	wg.Wait()
+	rankProbes(results)
+
+	fmt.Printf("%-8s %-4s %-48s %8s %10s %10s %9s\n", "GROUP", "RANK", "UPSTREAM", "SUCCESS", "P50", "P90",
+		"POISONED")
+	rank := 0
+	for i, result := range results {
+		if i == 0 || result.group != results[i-1].group {
+			rank = 0
+		}
+		rank++
+		p50, p90 := "-", "-"
+		if len(result.latencies) > 0 {
+			p50 = percentile(result.latencies, 0.5).Round(time.Millisecond / 10).String()
+			p90 = percentile(result.latencies, 0.9).Round(time.Millisecond / 10).String()
+		}
+		fmt.Printf("%-8s %-4d %-48s %7.1f%% %10s %10s %9s\n", result.group, rank, result.upstream,
+			result.rate()*100, p50, p90, fmt.Sprintf("%d/%d", result.poisoned, result.blocked))
+	}
+}
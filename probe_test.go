@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	c := &config.Config{CNIPs: ipset.NewRamSetByText("114.0.0.0/8"), BogusIPs: ipset.NewRamSetByText("2.2.2.2/32")}
+	poisoned := func(ip string) bool {
+		r := new(dns.Msg)
+		rr, _ := dns.NewRR("www.google.com. 60 IN A " + ip)
+		r.Answer = append(r.Answer, rr)
+		return isPoisoned(c, r)
+	}
+	assert.False(t, poisoned("142.250.1.1"))
+	assert.True(t, poisoned("114.114.114.114"))
+	assert.True(t, poisoned("2.2.2.2"))
+	assert.True(t, poisoned("127.0.0.1"))
+	assert.True(t, poisoned("192.168.1.1"))
+
+	addr, stop := startUpstream(t, "114.1.1.1")
+	defer stop()
+	result := probeUpstream(c, &outbound.UDPCaller{Address: addr}, []string{"www.qq.com"}, []string{"www.google.com"}, 2)
+	assert.Equal(t, result.upstream, "udp://"+addr)
+	assert.Equal(t, result.total, 4)
+	assert.Equal(t, result.failed, 0)
+	assert.Equal(t, result.rate(), 1.0)
+	assert.Equal(t, result.blocked, 2)
+	assert.Equal(t, result.poisoned, 2)
+	assert.Equal(t, len(result.latencies), 4)
+	assert.Equal(t, (&probeResult{}).rate(), 0.0)
+
+	// 同组内未被污染的优先，其次按成功率、延迟排序
+	ms := func(n int) []time.Duration { return []time.Duration{time.Duration(n) * time.Millisecond} }
+	results := []probeResult{
+		{group: "dirty", upstream: "poisoned", total: 1, poisoned: 1, latencies: ms(1)},
+		{group: "dirty", upstream: "slow", total: 1, latencies: ms(100)},
+		{group: "dirty", upstream: "fast", total: 1, latencies: ms(10)},
+		{group: "dirty", upstream: "failed", total: 2, failed: 1, latencies: ms(1)},
+		{group: "clean", upstream: "down", total: 1, failed: 1},
+	}
+	rankProbes(results)
+	var order []string
+	for _, result := range results {
+		order = append(order, result.upstream)
+	}
+	assert.Equal(t, order, []string{"down", "fast", "slow", "failed", "poisoned"})
+	assert.Equal(t, splitList(" a, ,b,"), []string{"a", "b"})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/control"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// 解析命令行参数，允许选项出现在域名及记录类型之后
+func parseQueryArgs(fs *flag.FlagSet, args []string) (positional []string) {
+	_ = fs.Parse(args)
+	for rest := fs.Args(); len(rest) > 0; rest = fs.Args() {
+		if len(rest[0]) > 1 && strings.HasPrefix(rest[0], "-") { // 单独的"-"表示stdin
+			_ = fs.Parse(rest)
+			continue
+		}
+		positional = append(positional, rest[0])
+		_ = fs.Parse(rest[1:])
+	}
+	return positional
+}
+
+// 按配置文件在本进程内生成配置，关闭会影响运行中实例的功能（控制接口、ipset、告警等），查询日志输出到stdout
+func newQueryConfig(cfgPath string) (*config.Config, error) {
+	raw, err := ioutil.ReadFile(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	tomlConfig, err := decodeConfig(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	tomlConfig.Control.Listen, tomlConfig.Notify = "", notifyStruct{}
+	tomlConfig.FakeIP.File = ""
+	tomlConfig.Log = logStruct{Level: "warning"} // 处理过程由trace输出
+	for name, group := range tomlConfig.GroupMap {
+		group.IPSetName, group.IPSet6, group.NFTSet, group.NFTSet6 = "", "", "", ""
+		tomlConfig.GroupMap[name] = group
+	}
+	foreground = true
+	return newConfig(tomlConfig)
+}
+
+// query子命令：按配置文件在本地解析域名并输出处理过程（匹配的规则、所属组、上游错误等）及响应；
+// 指定-s时改为向运行中的ts-dns查询，仅输出响应
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path")
+	server := fs.String("s", "", "query a running instance at this address instead of resolving locally")
+	group := fs.String("group", "", "resolve through this group, ignoring rules")
+	client := fs.String("client", "127.0.0.1", "client ip used for device profiles")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ts-dns query [options] <name> [type]")
+		fs.PrintDefaults()
+	}
+	positional := parseQueryArgs(fs, args)
+	if len(positional) == 0 || len(positional) > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	qtype := dns.TypeA
+	if len(positional) > 1 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(positional[1])]; !ok {
+			fmt.Fprintf(os.Stderr, "unknown query type: %s\n", positional[1])
+			os.Exit(1)
+		}
+	}
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(positional[0]), qtype)
+
+	if *server != "" {
+		if _, _, err := net.SplitHostPort(*server); err != nil { // 未指定端口时使用53
+			*server = net.JoinHostPort(*server, "53")
+		}
+		dnsClient := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+		r, rtt, err := dnsClient.Exchange(request, *server)
+		if err == nil && r.Truncated { // 响应被截断时改用TCP重新查询
+			dnsClient.Net = "tcp"
+			r, rtt, err = dnsClient.Exchange(request, *server)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "query %s error: %v\n", *server, err)
+			os.Exit(1)
+		}
+		fmt.Println(r.String())
+		fmt.Printf(";; Query time: %v\n;; SERVER: %s\n", rtt.Round(time.Microsecond), *server)
+		return
+	}
+
+	c, err := newQueryConfig(*cfgPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config error: %v\n", err)
+		os.Exit(1)
+	}
+	swapConfig(c)
+	if _, ok := c.GroupMap[*group]; *group != "" && !ok {
+		fmt.Fprintf(os.Stderr, "unknown group: %s\n", *group)
+		os.Exit(1)
+	}
+	ctx, elapsed := traceQuery(c, request, net.ParseIP(*client), *group)
+	fmt.Println(";; TRACE:")
+	for _, step := range ctx.Trace.Steps() {
+		fmt.Printf(";; %8.1fms %-8s %s\n", step.Elapsed, step.Stage, step.Detail)
+	}
+	fmt.Println()
+	if ctx.Response == nil {
+		fmt.Fprintln(os.Stderr, "no response")
+		os.Exit(1)
+	}
+	fmt.Println(ctx.Response.String())
+	fmt.Printf(";; Query time: %v\n;; GROUP: %s\n", elapsed.Round(time.Microsecond), ctx.Group)
+}
+
+// 在处理链中执行一次查询并记录处理过程，group不为空时经由指定组解析。不写入ipset
+func traceQuery(c *config.Config, request *dns.Msg, client net.IP, group string) (
+	ctx *middleware.Context, elapsed time.Duration) {
+	ctx = &middleware.Context{Request: request, ClientIP: client, Group: group, Trace: middleware.NewTrace()}
+	if c.QueryLog {
+		ctx.LogPrefix = fmt.Sprintf("[INFO] %s from %s (trace) ", request.Question[0].Name, client)
+	}
+	ctx.Set(noIPSetKey, true)
+	assignClient(c, ctx)
+	start := time.Now()
+	c.Pipeline(ctx)
+	elapsed = time.Since(start)
+	if r := ctx.Response; r != nil {
+		rcode := r.Rcode // SetReply会重置rcode
+		r.SetReply(request)
+		r.Rcode = rcode
+	}
+	return ctx, elapsed
+}
+
+// 控制接口的replay命令：按当前配置执行查询并返回处理过程
+func replayQuery(name string, qtype uint16, client net.IP, group string) control.TraceEvent {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	ctx, elapsed := traceQuery(currentConfig(), request, client, group)
+	event := control.NewEvent(client, request.Question[0], ctx.Group, ctx.Response, elapsed)
+	return control.NewTraceEvent(event, ctx.Trace)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseQueryArgs(t *testing.T) {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	group := fs.String("group", "", "")
+	server := fs.String("s", "", "")
+	positional := parseQueryArgs(fs, []string{"-s", "127.0.0.1", "www.google.com", "AAAA", "--group", "dirty"})
+	assert.Equal(t, positional, []string{"www.google.com", "AAAA"})
+	assert.Equal(t, *group, "dirty")
+	assert.Equal(t, *server, "127.0.0.1")
+	assert.Equal(t, len(parseQueryArgs(fs, nil)), 0)
+	assert.Equal(t, parseQueryArgs(fs, []string{"-", "-s", "1.1.1.1"}), []string{"-"})
+}
+
+func TestTraceQuery(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	c := &config.Config{GroupMap: map[string]config.Group{
+		"clean": {}, "dirty": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: addr}}},
+	}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	ctx, _ := traceQuery(c, request, net.ParseIP("127.0.0.1"), "dirty")
+	assert.Equal(t, ctx.Response.Id, request.Id)
+	assert.Equal(t, ctx.Response.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	var stages []string
+	for _, step := range ctx.Trace.Steps() {
+		stages = append(stages, step.Stage)
+	}
+	assert.Equal(t, stages, []string{"cache", "hosts", "route", "upstream"}) // 指定组的查询同样使用缓存
+	assert.True(t, strings.HasPrefix(ctx.Trace.Steps()[3].Detail, "udp://"+addr+" NOERROR"))
+}
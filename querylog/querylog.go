@@ -0,0 +1,146 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 单次查询的日志记录
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Group    string    `json:"group,omitempty"`
+	Reason   string    `json:"reason,omitempty"`   // 确定响应的处理阶段给出的原因，如"match group 'dirty' (in gfwlist)"
+	Upstream string    `json:"upstream,omitempty"` // 产生响应的上游服务器，命中缓存、hosts等时为空
+	Rcode    string    `json:"rcode"`              // 未响应时为"DROP"
+	Answers  int       `json:"answers"`
+	Latency  float64   `json:"latency_ms"`
+}
+
+// 文本格式的一行日志，各字段以空格分隔，含空格的字段加引号
+func (e Entry) text() string {
+	field := func(value string) string {
+		if value == "" {
+			return "-"
+		} else if strings.ContainsAny(value, " \"") {
+			return fmt.Sprintf("%q", value)
+		}
+		return value
+	}
+	return fmt.Sprintf("%s %s %s %s group=%s reason=%s upstream=%s rcode=%s answers=%d latency=%.1fms\n",
+		e.Time.Format("2006/01/02 15:04:05"), e.Client, e.Name, e.Type, field(e.Group), field(e.Reason),
+		field(e.Upstream), e.Rcode, e.Answers, e.Latency)
+}
+
+// 写入文件的查询日志，文件超过MaxSize或打开时间超过MaxAge时轮转，保留MaxBackups个旧文件（filename.1为最新）
+type Logger struct {
+	JSON       bool
+	MaxSize    int64         // 单个文件的最大字节数，为0时不按大小轮转
+	MaxAge     time.Duration // 单个文件的最长使用时间，为0时不按时间轮转
+	MaxBackups int           // 为0时轮转后直接删除旧文件
+	filename   string
+	mux        sync.Mutex
+	file       *os.File
+	size       int64
+	opened     time.Time
+	closed     bool
+}
+
+// 打开查询日志文件，format可选text/json
+func New(filename, format string) (l *Logger, err error) {
+	l = &Logger{filename: filename}
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		l.JSON = true
+	default:
+		return nil, fmt.Errorf("unknown query log format: %s", format)
+	}
+	if err = l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	file, err := os.OpenFile(l.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.size, l.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// 依次重命名旧文件，超出MaxBackups的文件被删除，然后打开新文件
+func (l *Logger) rotate() error {
+	_ = l.file.Close()
+	l.file = nil
+	if l.MaxBackups <= 0 {
+		_ = os.Remove(l.filename)
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", l.filename, l.MaxBackups))
+		for i := l.MaxBackups - 1; i > 0; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", l.filename, i), fmt.Sprintf("%s.%d", l.filename, i+1))
+		}
+		_ = os.Rename(l.filename, l.filename+".1")
+	}
+	return l.open()
+}
+
+// 写入一条记录，l为nil时忽略
+func (l *Logger) Log(e Entry) error {
+	if l == nil {
+		return nil
+	}
+	var line []byte
+	if l.JSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.text())
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed { // 重载配置后仍在处理的查询
+		return nil
+	} else if l.file == nil { // 上次轮转失败
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && (l.MaxSize > 0 && l.size+int64(len(line)) > l.MaxSize ||
+		l.MaxAge > 0 && time.Since(l.opened) >= l.MaxAge) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// 关闭日志文件，l为nil时忽略
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.closed = true; l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package querylog
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "querylog")
+	defer func() { _ = os.RemoveAll(dir) }()
+	filename := filepath.Join(dir, "query.log")
+	_, err := New(filename, "xml")
+	assert.NotEqual(t, err, nil)
+	_, err = New(filepath.Join(dir, "not-exists", "query.log"), "")
+	assert.NotEqual(t, err, nil)
+	var l *Logger
+	assert.Equal(t, l.Log(Entry{}), nil)
+
+	entry := Entry{Time: time.Now(), Client: "192.168.1.2", Name: "google.com.", Type: "A", Group: "dirty",
+		Reason: "match group 'dirty' (in gfwlist)", Upstream: "udp://8.8.8.8:53", Rcode: "NOERROR", Answers: 1,
+		Latency: 12.3}
+	// 文本格式
+	l, err = New(filename, "text")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, l.Log(entry), nil)
+	raw, _ := ioutil.ReadFile(filename)
+	assert.True(t, strings.HasSuffix(string(raw), ` 192.168.1.2 google.com. A group=dirty `+
+		`reason="match group 'dirty' (in gfwlist)" upstream=udp://8.8.8.8:53 rcode=NOERROR answers=1 latency=12.3ms`+
+		"\n"))
+	// json格式，按大小轮转
+	_ = l.Close()
+	assert.Equal(t, l.Log(entry), nil) // 关闭后忽略
+	l, _ = New(filename, "json")
+	l.MaxSize, l.MaxBackups = 10, 2
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, l.Log(entry), nil)
+	}
+	raw, _ = ioutil.ReadFile(filename)
+	var obj map[string]interface{}
+	assert.Equal(t, json.Unmarshal(raw, &obj), nil)
+	assert.Equal(t, obj["reason"], entry.Reason)
+	assert.Equal(t, obj["latency_ms"], 12.3)
+	for _, name := range []string{".1", ".2"} {
+		_, err = os.Stat(filename + name)
+		assert.Equal(t, err, nil)
+	}
+	_, err = os.Stat(filename + ".3")
+	assert.True(t, os.IsNotExist(err))
+	// 按时间轮转，不保留旧文件
+	_ = os.Remove(filename + ".1")
+	l.MaxSize, l.MaxAge, l.MaxBackups = 0, time.Millisecond, 0
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, l.Log(entry), nil)
+	_, err = os.Stat(filename + ".1")
+	assert.True(t, os.IsNotExist(err))
+	raw, _ = ioutil.ReadFile(filename)
+	assert.Equal(t, strings.Count(string(raw), "\n"), 1)
+	_ = l.Close()
+}
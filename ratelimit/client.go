@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// 长时间未查询的客户端计数器的清理间隔
+const clientCleanInterval = time.Minute
+
+// 按客户端网段限制每秒查询数（令牌桶），超出速率的查询在处理前被拒绝，防止被滥用为开放解析器
+type ClientLimiter struct {
+	mux       sync.Mutex
+	rate      float64
+	burst     float64
+	v4Mask    net.IPMask
+	v6Mask    net.IPMask
+	buckets   map[string]*bucket
+	lastClean time.Time
+}
+
+// 判断来自ip的查询是否允许处理
+func (l *ClientLimiter) Allow(ip net.IP, now time.Time) bool {
+	if l == nil || ip == nil {
+		return true
+	}
+	var key string
+	if v4 := ip.To4(); v4 != nil {
+		key = v4.Mask(l.v4Mask).String()
+	} else {
+		key = ip.Mask(l.v6Mask).String()
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if now.Sub(l.lastClean) >= clientCleanInterval {
+		for k, b := range l.buckets { // 令牌已补满的计数器与新建的无异，可直接删除
+			if now.Sub(b.last).Seconds()*l.rate+b.balance >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastClean = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{balance: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if b.balance += now.Sub(b.last).Seconds() * l.rate; b.balance > l.burst {
+		b.balance = l.burst
+	}
+	b.last = now
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// 创建客户端查询限速器。rate为每秒允许的查询数，burst为允许的突发查询数（不小于1），
+// v4Prefix/v6Prefix为合并计算的客户端网段前缀长度
+func NewClientLimiter(rate float64, burst int, v4Prefix, v6Prefix int) *ClientLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &ClientLimiter{rate: rate, burst: float64(burst), v4Mask: net.CIDRMask(v4Prefix, 32),
+		v6Mask: net.CIDRMask(v6Prefix, 128), buckets: map[string]*bucket{}, lastClean: time.Now()}
+}
@@ -0,0 +1,33 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	var nilLimiter *ClientLimiter
+	assert.True(t, nilLimiter.Allow(net.ParseIP("1.2.3.4"), time.Now()))
+	l, now := NewClientLimiter(2, 3, 24, 56), time.Now()
+	ip := net.ParseIP("1.2.3.4")
+	// 允许突发的查询数
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(ip, now))
+	}
+	assert.False(t, l.Allow(ip, now))
+	// 同一网段合并计算，其它客户端不受影响
+	assert.False(t, l.Allow(net.ParseIP("1.2.3.5"), now))
+	assert.True(t, l.Allow(net.ParseIP("1.2.4.4"), now))
+	assert.True(t, l.Allow(net.ParseIP("2001:db8::1"), now))
+	// 按速率补充令牌
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, l.Allow(ip, now))
+	assert.False(t, l.Allow(ip, now))
+	// 清理令牌已补满的计数器
+	now = now.Add(clientCleanInterval)
+	assert.True(t, l.Allow(ip, now))
+	assert.Equal(t, len(l.buckets), 1)
+	assert.True(t, l.Allow(nil, now))
+}
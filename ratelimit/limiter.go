@@ -0,0 +1,39 @@
+package ratelimit
+
+import "time"
+
+// 并发请求数限制，避免突发流量产生大量并发处理导致内存耗尽
+type Limiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// 获取处理名额，已达上限时最多排队等待wait，超时返回false
+func (l *Limiter) Acquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// 释放Acquire获取的名额
+func (l *Limiter) Release() {
+	<-l.slots
+}
+
+// 创建并发限制，max为同时处理的最大请求数，wait为超出上限时的最长排队时间
+func NewLimiter(max int, wait time.Duration) *Limiter {
+	return &Limiter{slots: make(chan struct{}, max), wait: wait}
+}
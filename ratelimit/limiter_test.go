@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(2, 0)
+	assert.True(t, l.Acquire())
+	assert.True(t, l.Acquire())
+	// 超出上限且不排队时直接拒绝
+	assert.False(t, l.Acquire())
+	l.Release()
+	assert.True(t, l.Acquire())
+	// 排队期间有名额释放时获取成功
+	l = NewLimiter(1, time.Second)
+	assert.True(t, l.Acquire())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.Release()
+	}()
+	assert.True(t, l.Acquire())
+	// 排队超时
+	l = NewLimiter(1, 10*time.Millisecond)
+	assert.True(t, l.Acquire())
+	assert.False(t, l.Acquire())
+}
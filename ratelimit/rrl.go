@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 限速后的处理方式
+type Action int
+
+const (
+	Send Action = iota // 正常发送
+	Slip               // 发送设置了TC标志的空响应，迫使真实客户端改用TCP
+	Drop               // 丢弃响应
+)
+
+type bucket struct {
+	balance float64
+	last    time.Time
+	limited int // 被限速的次数，用于计算slip
+}
+
+// 响应速率限制（Response Rate Limiting），防止被用作DNS反射放大攻击的反射源。
+// 同一客户端网段收到的相同响应超过速率时，每slip个响应发送一个截断响应，其余丢弃
+type RRL struct {
+	mux       *sync.Mutex
+	rate      float64
+	slip      int
+	window    time.Duration
+	v4Mask    net.IPMask
+	v6Mask    net.IPMask
+	buckets   map[string]*bucket
+	lastClean time.Time
+}
+
+// 生成限速key：客户端网段 + 响应类型
+func (l *RRL) key(ip net.IP, r *dns.Msg) string {
+	var prefix string
+	if v4 := ip.To4(); v4 != nil {
+		prefix = v4.Mask(l.v4Mask).String()
+	} else {
+		prefix = ip.Mask(l.v6Mask).String()
+	}
+	name, qtype := "", uint16(0)
+	if len(r.Question) > 0 {
+		name, qtype = strings.ToLower(r.Question[0].Name), r.Question[0].Qtype
+	}
+	switch {
+	case r.Rcode == dns.RcodeNameError: // 不存在的域名合并计算，避免随机子域名绕过限制
+		name, qtype = "nxdomain", 0
+	case r.Rcode != dns.RcodeSuccess:
+		name, qtype = "error", 0
+	}
+	return fmt.Sprintf("%s/%s/%d/%d", prefix, name, qtype, r.Rcode)
+}
+
+// 判断向ip发送响应r时应采取的动作
+func (l *RRL) Check(ip net.IP, r *dns.Msg, now time.Time) Action {
+	if ip == nil || r == nil {
+		return Send
+	}
+	key := l.key(ip, r)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.clean(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{balance: l.rate, last: now}
+		l.buckets[key] = b
+	}
+	// 按时间补充余额，余额最多为每秒速率，最少为-window*rate
+	b.balance += now.Sub(b.last).Seconds() * l.rate
+	if b.balance > l.rate {
+		b.balance = l.rate
+	}
+	b.last = now
+	b.balance--
+	if min := -l.window.Seconds() * l.rate; b.balance < min {
+		b.balance = min
+	}
+	if b.balance >= 0 {
+		b.limited = 0
+		return Send
+	}
+	b.limited++
+	if l.slip > 0 && b.limited%l.slip == 0 {
+		return Slip
+	}
+	return Drop
+}
+
+// 清理长时间未使用的计数器
+func (l *RRL) clean(now time.Time) {
+	if now.Sub(l.lastClean) < l.window {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastClean = now
+}
+
+// 创建响应限速器。rate为每秒允许的相同响应数，slip为0时不发送截断响应，
+// v4Prefix/v6Prefix为合并计算的客户端网段前缀长度
+func NewRRL(rate float64, slip int, window time.Duration, v4Prefix, v6Prefix int) *RRL {
+	if window < time.Second {
+		window = time.Second
+	}
+	return &RRL{mux: new(sync.Mutex), rate: rate, slip: slip, window: window,
+		v4Mask: net.CIDRMask(v4Prefix, 32), v6Mask: net.CIDRMask(v6Prefix, 128),
+		buckets: map[string]*bucket{}, lastClean: time.Now()}
+}
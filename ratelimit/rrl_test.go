@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRRL(t *testing.T) {
+	rrl := NewRRL(2, 2, time.Second, 24, 56)
+	r := new(dns.Msg)
+	r.SetQuestion("ip.cn.", dns.TypeA)
+	ip, now := net.ParseIP("10.0.0.1"), time.Now()
+	assert.Equal(t, rrl.Check(nil, r, now), Send)
+	// 速率内正常发送
+	assert.Equal(t, rrl.Check(ip, r, now), Send)
+	assert.Equal(t, rrl.Check(ip, r, now), Send)
+	// 超出速率后交替丢弃、截断
+	assert.Equal(t, rrl.Check(ip, r, now), Drop)
+	assert.Equal(t, rrl.Check(ip, r, now), Slip)
+	// 同一网段共用计数
+	assert.Equal(t, rrl.Check(net.ParseIP("10.0.0.2"), r, now), Drop)
+	// 其它网段、其它响应不受影响
+	assert.Equal(t, rrl.Check(net.ParseIP("10.0.1.1"), r, now), Send)
+	other := new(dns.Msg)
+	other.SetQuestion("ip.cn.", dns.TypeAAAA)
+	assert.Equal(t, rrl.Check(ip, other, now), Send)
+	// 时间流逝后恢复
+	assert.Equal(t, rrl.Check(ip, r, now.Add(3*time.Second)), Send)
+	// NXDOMAIN响应合并计算
+	nx1, nx2 := new(dns.Msg), new(dns.Msg)
+	nx1.SetQuestion("a.ip.cn.", dns.TypeA)
+	nx2.SetQuestion("b.ip.cn.", dns.TypeA)
+	nx1.Rcode, nx2.Rcode = dns.RcodeNameError, dns.RcodeNameError
+	assert.Equal(t, rrl.key(ip, nx1), rrl.key(ip, nx2))
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// 打开设置了SO_REUSEPORT的UDP监听器，多个监听器可绑定同一地址，由内核在其间分配报文
+func listenReusePort(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, raw syscall.RawConn) error {
+		var sockErr error
+		err := raw.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listenReusePort("127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	defer func() { _ = first.Close() }()
+	// 多个监听器可绑定同一地址
+	second, err := listenReusePort(first.LocalAddr().String())
+	assert.Equal(t, err, nil)
+	if second != nil {
+		_ = second.Close()
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// windows不支持SO_REUSEPORT
+func listenReusePort(addr string) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on windows")
+}
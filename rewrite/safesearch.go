@@ -0,0 +1,48 @@
+package rewrite
+
+import (
+	"strings"
+)
+
+// 各搜索引擎强制安全搜索的CNAME目标
+var safeSearchMap = map[string]string{
+	"www.bing.com.":             "strict.bing.com.",
+	"bing.com.":                 "strict.bing.com.",
+	"duckduckgo.com.":           "safe.duckduckgo.com.",
+	"www.duckduckgo.com.":       "safe.duckduckgo.com.",
+	"www.youtube.com.":          "restrict.youtube.com.",
+	"m.youtube.com.":            "restrict.youtube.com.",
+	"youtubei.googleapis.com.":  "restrict.youtube.com.",
+	"youtube.googleapis.com.":   "restrict.youtube.com.",
+	"www.youtube-nocookie.com.": "restrict.youtube.com.",
+	"www.google.com.":           "forcesafesearch.google.com.",
+	"google.com.":               "forcesafesearch.google.com.",
+}
+
+// 判断是否为google各国家/地区的搜索域名，如"google.de."、"www.google.co.jp."
+func isGoogleSearch(name string) bool {
+	name = strings.TrimPrefix(name, "www.")
+	if !strings.HasPrefix(name, "google.") {
+		return false
+	}
+	labels := strings.Split(strings.TrimSuffix(name[len("google."):], "."), ".")
+	switch len(labels) {
+	case 1: // google.de
+		return len(labels[0]) == 2
+	case 2: // google.co.jp、google.com.hk
+		return (labels[0] == "co" || labels[0] == "com") && len(labels[1]) == 2
+	}
+	return false
+}
+
+// 获取域名强制安全搜索时应指向的CNAME目标，无需改写时返回空串
+func SafeSearch(name string) string {
+	name = strings.ToLower(name)
+	if target, ok := safeSearchMap[name]; ok {
+		return target
+	}
+	if isGoogleSearch(name) {
+		return "forcesafesearch.google.com."
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+package rewrite
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSafeSearch(t *testing.T) {
+	assert.Equal(t, SafeSearch("www.Google.com."), "forcesafesearch.google.com.")
+	assert.Equal(t, SafeSearch("www.google.co.jp."), "forcesafesearch.google.com.")
+	assert.Equal(t, SafeSearch("google.de."), "forcesafesearch.google.com.")
+	assert.Equal(t, SafeSearch("mail.google.com."), "")
+	assert.Equal(t, SafeSearch("google.example.com."), "")
+	assert.Equal(t, SafeSearch("forcesafesearch.google.com."), "")
+	assert.Equal(t, SafeSearch("www.bing.com."), "strict.bing.com.")
+	assert.Equal(t, SafeSearch("m.youtube.com."), "restrict.youtube.com.")
+	assert.Equal(t, SafeSearch("duckduckgo.com."), "safe.duckduckgo.com.")
+	assert.Equal(t, SafeSearch("ip.cn."), "")
+}
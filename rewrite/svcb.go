@@ -0,0 +1,90 @@
+package rewrite
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/miekg/dns"
+)
+
+// SVCB/HTTPS记录类型（RFC 9460）。dns库解析为SVCB/HTTPS类型，不支持该类型的旧版本解析为未知类型（RFC 3597）
+const (
+	TypeSVCB  = dns.TypeSVCB
+	TypeHTTPS = dns.TypeHTTPS
+)
+
+// SVCB记录的参数key
+const (
+	KeyIPv4Hint uint16 = 4
+	KeyECH      uint16 = 5
+	KeyIPv6Hint uint16 = 6
+)
+
+// 移除SVCB/HTTPS记录rdata中指定的参数，rdata格式错误时返回false
+func stripParams(rdata []byte, keys map[uint16]bool) ([]byte, bool) {
+	if len(rdata) < 3 {
+		return nil, false
+	}
+	// 跳过priority及未压缩的target name
+	i := 2
+	for i < len(rdata) && rdata[i] != 0 {
+		i += int(rdata[i]) + 1
+	}
+	if i++; i > len(rdata) {
+		return nil, false
+	}
+	stripped := append([]byte{}, rdata[:i]...)
+	for i < len(rdata) {
+		if i+4 > len(rdata) {
+			return nil, false
+		}
+		key, length := binary.BigEndian.Uint16(rdata[i:]), int(binary.BigEndian.Uint16(rdata[i+2:]))
+		end := i + 4 + length
+		if end > len(rdata) {
+			return nil, false
+		}
+		if !keys[key] {
+			stripped = append(stripped, rdata[i:end]...)
+		}
+		i = end
+	}
+	return stripped, true
+}
+
+// 移除响应中SVCB/HTTPS记录的指定参数（如ipv6hint、ech），返回修改后的副本
+func StripSVCParams(r *dns.Msg, keys ...uint16) *dns.Msg {
+	keyMap := map[uint16]bool{}
+	for _, key := range keys {
+		keyMap[key] = true
+	}
+	r = r.Copy()
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			rr.Value = stripValues(rr.Value, keyMap)
+		case *dns.HTTPS:
+			rr.Value = stripValues(rr.Value, keyMap)
+		case *dns.RFC3597:
+			if rr.Hdr.Rrtype != TypeSVCB && rr.Hdr.Rrtype != TypeHTTPS {
+				continue
+			}
+			rdata, err := hex.DecodeString(rr.Rdata)
+			if err != nil {
+				continue
+			}
+			if rdata, ok := stripParams(rdata, keyMap); ok {
+				rr.Rdata = hex.EncodeToString(rdata)
+			}
+		}
+	}
+	return r
+}
+
+// 移除已解析的SVCB/HTTPS记录中指定的参数
+func stripValues(values []dns.SVCBKeyValue, keys map[uint16]bool) (kept []dns.SVCBKeyValue) {
+	for _, value := range values {
+		if !keys[uint16(value.Key())] {
+			kept = append(kept, value)
+		}
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package rewrite
+
+import (
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStripSVCParams(t *testing.T) {
+	// priority=1, target=".", alpn=h2, ipv4hint=1.2.3.4, ipv6hint=::1
+	rdata := "0001" + "00" + "00010003026832" + "0004000401020304" +
+		"00060010" + "00000000000000000000000000000001"
+	rr := &dns.RFC3597{Hdr: dns.RR_Header{Name: "ip.cn.", Rrtype: TypeHTTPS, Class: dns.ClassINET},
+		Rdata: rdata}
+	r := new(dns.Msg)
+	r.Answer = append(r.Answer, rr)
+	stripped := StripSVCParams(r, KeyIPv6Hint, KeyECH)
+	expect := "0001" + "00" + "00010003026832" + "0004000401020304"
+	assert.Equal(t, stripped.Answer[0].(*dns.RFC3597).Rdata, expect)
+	assert.Equal(t, rr.Rdata, rdata) // 不修改原响应
+	// rdata格式错误时保留原记录
+	raw, _ := hex.DecodeString(rdata)
+	_, ok := stripParams(raw[:len(raw)-1], map[uint16]bool{})
+	assert.False(t, ok)
+	// 已解析的HTTPS记录
+	https, err := dns.NewRR("ip.cn. 300 IN HTTPS 1 . alpn=h2 ipv4hint=1.2.3.4 ipv6hint=::1")
+	assert.Equal(t, err, nil)
+	r.Answer = []dns.RR{https}
+	stripped = StripSVCParams(r, KeyIPv4Hint, KeyIPv6Hint)
+	assert.Equal(t, len(stripped.Answer[0].(*dns.HTTPS).Value), 1)
+	assert.Equal(t, stripped.Answer[0].(*dns.HTTPS).Value[0].Key(), dns.SVCB_ALPN)
+	assert.Equal(t, len(https.(*dns.HTTPS).Value), 3)
+	// 经打包后解析为已知类型
+	raw, _ = r.Pack()
+	unpacked := new(dns.Msg)
+	assert.Equal(t, unpacked.Unpack(raw), nil)
+	svcb := StripSVCParams(unpacked, KeyECH, KeyIPv6Hint).Answer[0].(*dns.HTTPS)
+	assert.Equal(t, len(svcb.Value), 2)
+}
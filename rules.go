@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// 解码gfwlist文件内容，内容不是base64编码时视为AdBlock Plus规则原文
+func decodeRules(raw []byte) string {
+	if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw))); err == nil {
+		return string(decoded)
+	}
+	return string(raw)
+}
+
+// 将AdBlock Plus规则转换为域名列表，每行一条，白名单规则以"@@"开头
+func exportRules(text string) string {
+	rules := matcher.NewABPByText(text).Rules()
+	if len(rules) == 0 {
+		return ""
+	}
+	return strings.Join(rules, "\n") + "\n"
+}
+
+// 将域名列表转换为base64编码的AdBlock Plus规则，忽略空行及"#"开头的注释行；raw为true时不进行base64编码
+func importRules(text string, raw bool) string {
+	lines := []string{"[AutoProxy 0.2.9]"}
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "@@") {
+			lines = append(lines, "@@||"+line[2:])
+		} else {
+			lines = append(lines, "||"+line)
+		}
+	}
+	abp := strings.Join(lines, "\n") + "\n"
+	if raw {
+		return abp
+	}
+	// 与官方gfwlist一致，每行64个字符
+	encoded := base64.StdEncoding.EncodeToString([]byte(abp))
+	var b strings.Builder
+	for len(encoded) > 64 {
+		b.WriteString(encoded[:64] + "\n")
+		encoded = encoded[64:]
+	}
+	b.WriteString(encoded + "\n")
+	return b.String()
+}
+
+// 读取文件内容，filename为"-"时读取stdin
+func readInput(filename string) ([]byte, error) {
+	if filename == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// 写入文件，filename为空时输出到stdout
+func writeOutput(filename, content string) error {
+	if filename == "" {
+		_, err := fmt.Print(content)
+		return err
+	}
+	return ioutil.WriteFile(filename, []byte(content), 0644)
+}
+
+// rules子命令：export将gfwlist（base64编码或AdBlock Plus原文）转换为域名列表，便于检查哪些域名会分配到dirty组；
+// import将域名列表转换回gfwlist格式
+func runRules(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: ts-dns rules export [-c config] [-o output] [gfwlist]")
+		fmt.Fprintln(os.Stderr, "       ts-dns rules import [-raw] [-o output] <domain list>")
+	}
+	if len(args) == 0 || args[0] != "export" && args[0] != "import" {
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("rules "+args[0], flag.ExitOnError)
+	output := fs.String("o", "", "output file, stdout if empty")
+	var cfgPath *string
+	var raw *bool
+	if args[0] == "export" {
+		cfgPath = fs.String("c", "ts-dns.toml", "config file path, used to locate gfwlist when no file given")
+	} else {
+		raw = fs.Bool("raw", false, "write plain AdBlock Plus rules instead of base64")
+	}
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	positional := parseQueryArgs(fs, args[1:])
+	if len(positional) > 1 || args[0] == "import" && len(positional) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var content string
+	if args[0] == "export" {
+		filename := ""
+		if len(positional) > 0 {
+			filename = positional[0]
+		} else { // 使用配置文件中的gfwlist
+			text, err := ioutil.ReadFile(*cfgPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "read config error: %v\n", err)
+				os.Exit(1)
+			}
+			tomlConfig, err := decodeConfig(string(text))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "load config error: %v\n", err)
+				os.Exit(1)
+			}
+			if filename = tomlConfig.GFWFile; filename == "" {
+				filename = "gfwlist.txt"
+			}
+		}
+		data, err := readInput(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read gfwlist error: %v\n", err)
+			os.Exit(1)
+		}
+		content = exportRules(decodeRules(data))
+	} else {
+		data, err := readInput(positional[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read domain list error: %v\n", err)
+			os.Exit(1)
+		}
+		content = importRules(string(data), *raw)
+	}
+	if err := writeOutput(*output, content); err != nil {
+		fmt.Fprintf(os.Stderr, "write output error: %v\n", err)
+		os.Exit(1)
+	}
+}
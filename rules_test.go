@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRulesConvert(t *testing.T) {
+	text := "[AutoProxy 0.2.9]\n!comment\n||google.com\n.youtube.com\n|http://*.example.com/path\n@@||ip.cn\n"
+	list := exportRules(text)
+	assert.Equal(t, list, "*.example.com\n.youtube.com\n@@ip.cn\ngoogle.com\n")
+	// 兼容base64编码及原文
+	encoded := base64.StdEncoding.EncodeToString([]byte(text))
+	assert.Equal(t, exportRules(decodeRules([]byte(encoded+"\n"))), list)
+	assert.Equal(t, exportRules(decodeRules([]byte(text))), list)
+	assert.Equal(t, exportRules(""), "")
+	// 转换回gfwlist后规则不变
+	gfwlist := importRules("# comment\n"+list+"\n", false)
+	for _, line := range strings.Split(strings.TrimSpace(gfwlist), "\n") {
+		assert.True(t, len(line) <= 64)
+	}
+	assert.Equal(t, exportRules(decodeRules([]byte(gfwlist))), list)
+	assert.Equal(t, importRules("google.com\n@@ip.cn", true), "[AutoProxy 0.2.9]\n||google.com\n@@||ip.cn\n")
+}
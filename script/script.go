@@ -0,0 +1,208 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/middleware"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lua脚本钩子。脚本可定义以下全局函数，均为可选：
+//
+//	on_request(q)：在转发前调用，q包含name、qtype、client字段。返回响应表时直接应答，返回false时不响应，返回nil时继续处理
+//	on_response(q, r)：在获得响应后调用，q额外包含group字段，r为响应表。返回响应表时替换响应，返回false时不响应，返回nil时保持不变
+//
+// 响应表包含rcode（如"NXDOMAIN"）、answer、ns（记录字符串列表，如{"example.com. 60 IN A 1.2.3.4"}）字段
+type Script struct {
+	proto   *lua.FunctionProto
+	timeout time.Duration // 单次调用的最长执行时间
+	pool    sync.Pool     // *lua.LState，同一LState不能并发使用
+}
+
+// 获取已加载脚本的LState
+func (s *Script) state() (*lua.LState, error) {
+	if L, ok := s.pool.Get().(*lua.LState); ok {
+		return L, nil
+	}
+	L := lua.NewState()
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, lua.MultRet, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return L, nil
+}
+
+// 调用脚本中的全局函数，函数未定义时返回nil
+func (s *Script) call(fn string, args ...func(L *lua.LState) lua.LValue) (lua.LValue, error) {
+	L, err := s.state()
+	if err != nil {
+		return nil, err
+	}
+	f := L.GetGlobal(fn)
+	if f.Type() != lua.LTFunction {
+		s.pool.Put(L)
+		return nil, nil
+	}
+	values := make([]lua.LValue, len(args))
+	for i, arg := range args {
+		values[i] = arg(L)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{Fn: f, NRet: 1, Protect: true}, values...)
+	L.RemoveContext()
+	if err != nil {
+		L.Close() // 执行超时或出错后的状态不再复用
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	s.pool.Put(L)
+	return ret, nil
+}
+
+// 生成传递给脚本的查询表
+func queryTable(ctx *middleware.Context, withGroup bool) func(L *lua.LState) lua.LValue {
+	return func(L *lua.LState) lua.LValue {
+		question := ctx.Request.Question[0]
+		q := L.NewTable()
+		q.RawSetString("name", lua.LString(question.Name))
+		q.RawSetString("qtype", lua.LString(dns.TypeToString[question.Qtype]))
+		q.RawSetString("client", lua.LString(ctx.ClientIP.String()))
+		if withGroup {
+			q.RawSetString("group", lua.LString(ctx.Group))
+		}
+		return q
+	}
+}
+
+// 生成传递给脚本的响应表
+func responseTable(r *dns.Msg) func(L *lua.LState) lua.LValue {
+	return func(L *lua.LState) lua.LValue {
+		t := L.NewTable()
+		t.RawSetString("rcode", lua.LString(dns.RcodeToString[r.Rcode]))
+		for key, rrs := range map[string][]dns.RR{"answer": r.Answer, "ns": r.Ns} {
+			list := L.NewTable()
+			for _, rr := range rrs {
+				list.Append(lua.LString(rr.String()))
+			}
+			t.RawSetString(key, list)
+		}
+		return t
+	}
+}
+
+// 将脚本返回的响应表转换为响应
+func parseResponse(request *dns.Msg, t *lua.LTable) (r *dns.Msg, err error) {
+	r = new(dns.Msg)
+	r.SetReply(request)
+	if rcode := t.RawGetString("rcode"); rcode != lua.LNil {
+		var ok bool
+		if r.Rcode, ok = dns.StringToRcode[strings.ToUpper(rcode.String())]; !ok {
+			return nil, fmt.Errorf("unknown rcode: %s", rcode)
+		}
+	}
+	for key, section := range map[string]*[]dns.RR{"answer": &r.Answer, "ns": &r.Ns} {
+		list, ok := t.RawGetString(key).(*lua.LTable)
+		if !ok {
+			continue
+		}
+		for i := 1; i <= list.Len(); i++ {
+			rr, err := dns.NewRR(list.RawGetInt(i).String())
+			if err != nil {
+				return nil, err
+			}
+			if rr != nil {
+				*section = append(*section, rr)
+			}
+		}
+	}
+	return r, nil
+}
+
+// 按脚本的返回值修改ctx.Response，返回是否已产生最终结果
+func apply(ctx *middleware.Context, fn string, ret lua.LValue) bool {
+	switch ret := ret.(type) {
+	case *lua.LTable:
+		r, err := parseResponse(ctx.Request, ret)
+		if err != nil {
+			log.Printf("[ERROR] invalid response from lua %s: %v\n", fn, err)
+			return false
+		}
+		ctx.Response = r
+		return true
+	case lua.LBool:
+		if !ret {
+			ctx.Response = nil
+			return true
+		}
+	}
+	return false
+}
+
+// 作为处理链中的一个阶段执行脚本钩子，脚本出错时忽略钩子继续处理
+func (s *Script) Handle(ctx *middleware.Context, next middleware.Handler) {
+	ret, err := s.call("on_request", queryTable(ctx, false))
+	if err != nil {
+		log.Printf("[ERROR] lua on_request error: %v\n", err)
+	} else if apply(ctx, "on_request", ret) {
+		return
+	}
+	next(ctx)
+	if ctx.Response == nil {
+		return
+	}
+	ret, err = s.call("on_response", queryTable(ctx, true), responseTable(ctx.Response))
+	if err != nil {
+		log.Printf("[ERROR] lua on_response error: %v\n", err)
+		return
+	}
+	apply(ctx, "on_response", ret)
+}
+
+// 加载Lua脚本文件，timeout为单次调用的最长执行时间
+func New(filename string, timeout time.Duration) (*Script, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	chunk, err := parse.Parse(f, filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{timeout: timeout}
+	if s.proto, err = lua.Compile(chunk, filename); err != nil {
+		return nil, err
+	}
+	L, err := s.state() // 检查脚本能否正常执行
+	if err != nil {
+		return nil, err
+	}
+	s.pool.Put(L)
+	return s, nil
+}
+
+// 注册为名为lua的插件，参数file为脚本路径，timeout为单次调用的最长执行时间（毫秒，默认100）
+func init() {
+	middleware.Register("lua", func(params map[string]interface{}) (middleware.Middleware, error) {
+		filename, _ := params["file"].(string)
+		if filename == "" {
+			return nil, fmt.Errorf("missing file for lua plugin")
+		}
+		timeout := 100 * time.Millisecond
+		if ms, ok := params["timeout"].(int64); ok && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		return New(filename, timeout)
+	})
+}
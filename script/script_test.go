@@ -0,0 +1,70 @@
+package script
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const hook = `
+function on_request(q)
+  if q.name == "blocked.com." then
+    return {rcode = "NXDOMAIN"}
+  end
+  if q.client == "10.0.0.1" then
+    return false
+  end
+end
+
+function on_response(q, r)
+  if q.group == "dirty" and q.qtype == "A" then
+    table.insert(r.answer, q.name .. " 60 IN A 1.2.3.4")
+    return r
+  end
+  if q.name == "loop.com." then
+    while true do end
+  end
+end
+`
+
+func TestScript(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "script")
+	defer func() { _ = os.RemoveAll(dir) }()
+	filename := filepath.Join(dir, "hook.lua")
+	_ = ioutil.WriteFile(filename, []byte("function ("), 0644)
+	_, err := New(filename, time.Second)
+	assert.NotEqual(t, err, nil)
+	_ = ioutil.WriteFile(filename, []byte(hook), 0644)
+	mw, err := middleware.New("lua", map[string]interface{}{"file": filename, "timeout": int64(50)})
+	assert.Equal(t, err, nil)
+
+	group := "clean"
+	h := middleware.Chain(func(ctx *middleware.Context) {
+		ctx.Response, ctx.Group = new(dns.Msg).SetReply(ctx.Request), group
+	}, mw)
+	run := func(name string, client string) *middleware.Context {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		ctx := &middleware.Context{Request: request, ClientIP: net.ParseIP(client)}
+		h(ctx)
+		return ctx
+	}
+	// 请求阶段直接应答或不响应
+	assert.Equal(t, run("blocked.com.", "127.0.0.1").Response.Rcode, dns.RcodeNameError)
+	assert.True(t, run("ip.cn.", "10.0.0.1").Response == nil)
+	// 响应阶段按组修改应答
+	assert.Equal(t, len(run("ip.cn.", "127.0.0.1").Response.Answer), 0)
+	group = "dirty"
+	ctx := run("google.com.", "127.0.0.1")
+	assert.Equal(t, ctx.Response.Answer[0].(*dns.A).A.String(), "1.2.3.4")
+	// 脚本执行超时时保持原响应
+	ctx = run("loop.com.", "127.0.0.1")
+	assert.True(t, ctx.Response != nil)
+	assert.Equal(t, len(run("ip.cn.", "127.0.0.1").Response.Answer), 1)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// 配置向导可选的上游预设及协议
+var (
+	setupCleanPresets = []string{"alidns", "dnspod"}
+	setupDirtyPresets = []string{"cloudflare", "google", "quad9"}
+	setupProtocols    = []string{"udp", "dot", "doh"}
+)
+
+// 配置向导的回答
+type setupAnswers struct {
+	Listen      string
+	CleanPreset string
+	CleanProto  string
+	DirtyPreset string
+	DirtyProto  string
+	Socks5      string
+	IPSet       string
+}
+
+// 读取一行回答，回答为空时返回默认值
+func ask(in *bufio.Reader, out io.Writer, question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(out, "%s: ", question)
+	}
+	line, err := in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// 从选项中选择一项，可输入序号或名称，输入无效时重新询问
+func askChoice(in *bufio.Reader, out io.Writer, question string, choices []string, def string) (string, error) {
+	for {
+		for i, choice := range choices {
+			fmt.Fprintf(out, "  %d) %s\n", i+1, choice)
+		}
+		answer, err := ask(in, out, question, def)
+		if err != nil {
+			return "", err
+		}
+		for i, choice := range choices {
+			if strings.EqualFold(answer, choice) || answer == fmt.Sprint(i+1) {
+				return choice, nil
+			}
+		}
+		fmt.Fprintf(out, "invalid choice: %s\n", answer)
+	}
+}
+
+// 依次询问监听地址、上游服务器、代理及ipset
+func setupWizard(in *bufio.Reader, out io.Writer) (answers setupAnswers, err error) {
+	if answers.Listen, err = ask(in, out, "listen address", ":53"); err != nil {
+		return
+	}
+	fmt.Fprintln(out, "upstream for domestic domains (clean group):")
+	if answers.CleanPreset, err = askChoice(in, out, "preset", setupCleanPresets, setupCleanPresets[0]); err != nil {
+		return
+	}
+	if answers.CleanProto, err = askChoice(in, out, "protocol", setupProtocols, "udp"); err != nil {
+		return
+	}
+	fmt.Fprintln(out, "upstream for blocked domains (dirty group):")
+	if answers.DirtyPreset, err = askChoice(in, out, "preset", setupDirtyPresets, setupDirtyPresets[0]); err != nil {
+		return
+	}
+	// 境外的明文DNS易被污染，默认使用DoT
+	if answers.DirtyProto, err = askChoice(in, out, "protocol", setupProtocols, "dot"); err != nil {
+		return
+	}
+	if answers.Socks5, err = ask(in, out, "socks5 proxy for dirty group, e.g. 127.0.0.1:1080 (empty for none)",
+		""); err != nil {
+		return
+	}
+	answers.IPSet, err = ask(in, out, "ipset name for IPs of blocked domains (empty for none)", "")
+	return
+}
+
+// 生成组内上游服务器的配置
+func setupUpstream(preset, proto string) string {
+	addr := fmt.Sprintf("[%q]", "preset:"+preset)
+	switch proto {
+	case "dot":
+		return "dot = " + addr
+	case "doh":
+		return "doh = " + addr
+	default:
+		return "dns = " + addr
+	}
+}
+
+// 按回答生成配置文件内容
+func renderSetup(answers setupAnswers) string {
+	var b strings.Builder
+	b.WriteString("# Telescope DNS Configure File\n# https://github.com/wolf-joe/ts-dns\n# generated by ts-dns setup\n\n")
+	fmt.Fprintf(&b, "listen = %q\ngfwlist = \"gfwlist.txt\"\ncnip = \"cnip.txt\"\n\n[groups]\n", answers.Listen)
+	fmt.Fprintf(&b, "  [groups.clean]\n  %s\n\n", setupUpstream(answers.CleanPreset, answers.CleanProto))
+	fmt.Fprintf(&b, "  [groups.dirty]\n  %s\n", setupUpstream(answers.DirtyPreset, answers.DirtyProto))
+	if answers.Socks5 != "" {
+		fmt.Fprintf(&b, "  socks5 = %q\n", answers.Socks5)
+	}
+	if answers.IPSet != "" {
+		fmt.Fprintf(&b, "  ipset = %q\n", answers.IPSet)
+	}
+	b.WriteString("  rules = [\"google.com\"]\n")
+	return b.String()
+}
+
+// 按生成的配置向各组的上游服务器发送测试查询，返回是否全部可用
+func probeSetup(text string, out io.Writer) bool {
+	tomlConfig, err := decodeConfig(text)
+	if err != nil {
+		fmt.Fprintf(out, "invalid config: %v\n", err)
+		return false
+	}
+	ok := true
+	for _, name := range []string{"clean", "dirty"} {
+		groupConfig := tomlConfig.GroupMap[name]
+		groupConfig.IPSetName = "" // 测试时不创建ipset
+		group, err := newGroup(groupConfig)
+		if err != nil {
+			fmt.Fprintf(out, "group %s error: %v\n", name, err)
+			ok = false
+			continue
+		}
+		domain := "www.baidu.com."
+		if name == "dirty" {
+			domain = "www.google.com."
+		}
+		for _, caller := range group.Callers {
+			request := new(dns.Msg)
+			request.SetQuestion(domain, dns.TypeA)
+			start := time.Now()
+			r, err := caller.Call(request)
+			if err == nil && r.Rcode != dns.RcodeSuccess {
+				err = fmt.Errorf("rcode %s", dns.RcodeToString[r.Rcode])
+			}
+			if err != nil {
+				fmt.Fprintf(out, "  %-5s %v: %v\n", name, caller, err)
+				ok = false
+			} else {
+				fmt.Fprintf(out, "  %-5s %v: ok in %v\n", name, caller, time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+	return ok
+}
+
+// setup子命令：交互式询问监听地址、上游服务器、代理及ipset，测试上游连通性后写入配置文件
+func runSetup(args []string) {
+	fs := flag.NewFlagSet("setup", flag.ExitOnError)
+	output := fs.String("o", "ts-dns.toml", "config file to write")
+	_ = fs.Parse(args)
+
+	in, out := bufio.NewReader(os.Stdin), os.Stdout
+	answers, err := setupWizard(in, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read answer error: %v\n", err)
+		os.Exit(1)
+	}
+	text := renderSetup(answers)
+	fmt.Fprintln(out, "probing upstreams...")
+	if !probeSetup(text, out) {
+		if answer, _ := ask(in, out, "some upstreams are unavailable, write config anyway? (y/n)", "n"); answer != "y" {
+			os.Exit(1)
+		}
+	}
+	if _, err = os.Stat(*output); err == nil {
+		if answer, _ := ask(in, out, *output+" already exists, overwrite? (y/n)", "n"); answer != "y" {
+			os.Exit(1)
+		}
+	}
+	if err = ioutil.WriteFile(*output, []byte(text), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "write config error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "config written to %s\n", *output)
+}
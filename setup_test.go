@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSetupWizard(t *testing.T) {
+	// 全部使用默认值
+	answers, err := setupWizard(bufio.NewReader(strings.NewReader("\n\n\n\n\n\n\n")), ioutil.Discard)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, answers, setupAnswers{Listen: ":53", CleanPreset: "alidns", CleanProto: "udp",
+		DirtyPreset: "cloudflare", DirtyProto: "dot"})
+	// 按序号或名称选择，无效选项时重新询问
+	input := "127.0.0.1:5353\n2\ndoh\nunknown\nGoogle\n3\n127.0.0.1:1080\ngfw"
+	answers, err = setupWizard(bufio.NewReader(strings.NewReader(input)), ioutil.Discard)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, answers, setupAnswers{Listen: "127.0.0.1:5353", CleanPreset: "dnspod", CleanProto: "doh",
+		DirtyPreset: "google", DirtyProto: "doh", Socks5: "127.0.0.1:1080", IPSet: "gfw"})
+	_, err = setupWizard(bufio.NewReader(strings.NewReader(":53\n")), ioutil.Discard)
+	assert.NotEqual(t, err, nil)
+
+	// 生成的配置可正常解析
+	tomlConfig, err := decodeConfig(renderSetup(answers))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, tomlConfig.Listen, "127.0.0.1:5353")
+	assert.Equal(t, tomlConfig.GroupMap["clean"].DoH, []string{"preset:dnspod"})
+	assert.Equal(t, tomlConfig.GroupMap["dirty"].DoH, []string{"preset:google"})
+	assert.Equal(t, tomlConfig.GroupMap["dirty"].Socks5, "127.0.0.1:1080")
+	assert.Equal(t, tomlConfig.GroupMap["dirty"].IPSetName, "gfw")
+}
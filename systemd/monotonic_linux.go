@@ -0,0 +1,12 @@
+package systemd
+
+import "golang.org/x/sys/unix"
+
+// CLOCK_MONOTONIC的当前时间（微秒）
+func monotonicUsec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package systemd
+
+// 非linux平台无systemd，不提供CLOCK_MONOTONIC时间
+func monotonicUsec() int64 {
+	return 0
+}
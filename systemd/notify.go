@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemd服务状态通知（sd_notify协议）
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// Notify 向systemd发送状态通知，未由systemd以Type=notify启动（未设置NOTIFY_SOCKET）时不做任何处理
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' { // 抽象命名空间的socket
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// WatchdogInterval 获取systemd要求的watchdog通知间隔（WatchdogSec的一半），未启用watchdog时返回0
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0 // watchdog针对的不是当前进程
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// StartWatchdog 启用watchdog时定时执行健康检查，通过时发送WATCHDOG=1通知，未通过时更新服务状态说明；
+// 检查持续未通过时由systemd按WatchdogSec重启服务
+func StartWatchdog(check func() error) {
+	interval := WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := check(); err != nil {
+				_ = Notify("STATUS=health check failed: " + err.Error())
+				continue
+			}
+			_ = Notify(Watchdog)
+		}
+	}()
+}
+
+// NotifyReloading 通知systemd开始重载配置，附带CLOCK_MONOTONIC时间戳（Type=notify-reload要求）
+func NotifyReloading() error {
+	return Notify(Reloading + "\nMONOTONIC_USEC=" + strconv.FormatInt(monotonicUsec(), 10))
+}
+
+// NotifyReady 通知systemd服务已就绪，并设置服务状态说明（如重载失败的原因），status为空时清除说明
+func NotifyReady(status string) error {
+	return Notify(Ready + "\nSTATUS=" + status)
+}
@@ -0,0 +1,70 @@
+package systemd
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	_ = os.Unsetenv("NOTIFY_SOCKET")
+	assert.Equal(t, Notify(Ready), nil) // 未设置NOTIFY_SOCKET时忽略
+	path := filepath.Join(os.TempDir(), "go_test_notify.sock")
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close(); _ = os.Remove(path) }()
+	_ = os.Setenv("NOTIFY_SOCKET", path)
+	defer func() { _ = os.Unsetenv("NOTIFY_SOCKET") }()
+	assert.Equal(t, Notify(Ready), nil)
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(buf[:n]), Ready)
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer func() { _ = os.Unsetenv("WATCHDOG_USEC"); _ = os.Unsetenv("WATCHDOG_PID") }()
+	_ = os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(t, WatchdogInterval(), time.Duration(0))
+	_ = os.Setenv("WATCHDOG_USEC", "10000000")
+	assert.Equal(t, WatchdogInterval(), 5*time.Second)
+	_ = os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(t, WatchdogInterval(), time.Duration(0))
+}
+
+func TestNotifyReload(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "go_test_notify_reload.sock")
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Equal(t, err, nil)
+	defer func() { _ = conn.Close(); _ = os.Remove(path) }()
+	_ = os.Setenv("NOTIFY_SOCKET", path)
+	defer func() { _ = os.Unsetenv("NOTIFY_SOCKET") }()
+	read := func() string {
+		buf := make([]byte, 128)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(buf)
+		return string(buf[:n])
+	}
+	assert.Equal(t, NotifyReloading(), nil)
+	assert.Equal(t, strings.HasPrefix(read(), Reloading+"\nMONOTONIC_USEC="), true)
+	assert.Equal(t, NotifyReady("reload failed: bad config"), nil)
+	assert.Equal(t, read(), Ready+"\nSTATUS=reload failed: bad config")
+	// 健康检查未通过时不发送WATCHDOG=1
+	_ = os.Setenv("WATCHDOG_USEC", "100000")
+	defer func() { _ = os.Unsetenv("WATCHDOG_USEC") }()
+	healthy := make(chan error, 2)
+	healthy <- errors.New("timeout")
+	healthy <- nil
+	StartWatchdog(func() error { return <-healthy })
+	assert.Equal(t, read(), "STATUS=health check failed: timeout")
+	assert.Equal(t, read(), Watchdog)
+}
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
+	"github.com/wolf-joe/ts-dns/cache"
 	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/dns64"
+	"github.com/wolf-joe/ts-dns/dnssec"
+	"github.com/wolf-joe/ts-dns/edns"
+	"github.com/wolf-joe/ts-dns/loop"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
+	"github.com/wolf-joe/ts-dns/ratelimit"
+	"github.com/wolf-joe/ts-dns/rewrite"
+	_ "github.com/wolf-joe/ts-dns/script" // 注册lua插件
+	"github.com/wolf-joe/ts-dns/systemd"
+	"github.com/wolf-joe/ts-dns/zone"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-var c *config.Config
-
 // 列出dns响应中所有的ipv4地址
 func extractIPv4(r *dns.Msg) (ips []string) {
 	ips = []string{}
@@ -25,120 +47,1224 @@ func extractIPv4(r *dns.Msg) (ips []string) {
 	return
 }
 
-// 将dns响应中所有的ipv4地址加入目标group指定的ipset
+// 提取dns响应中的ipv6地址
+func extractIPv6(r *dns.Msg) (ips []string) {
+	if r == nil {
+		return
+	}
+	for _, answer := range r.Answer {
+		if rr, ok := answer.(*dns.AAAA); ok {
+			ips = append(ips, rr.AAAA.String())
+		}
+	}
+	return
+}
+
+// 沿CNAME链提取dns响应中属于查询域名的ipv4或ipv6地址，忽略与查询域名无关的记录
+func chainAddrs(r *dns.Msg, ipv6 bool) (ips []string) {
+	if len(r.Question) == 0 {
+		return
+	}
+	names := map[string]bool{strings.ToLower(r.Question[0].Name): true}
+	for i := 0; i < maxCNAMEDepth; i++ { // CNAME记录可能乱序，重复扫描直至链不再延长
+		grown := false
+		for _, answer := range r.Answer {
+			if cname, ok := answer.(*dns.CNAME); ok && names[strings.ToLower(cname.Hdr.Name)] &&
+				!names[strings.ToLower(cname.Target)] {
+				names[strings.ToLower(cname.Target)], grown = true, true
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+	for _, answer := range r.Answer {
+		if !names[strings.ToLower(answer.Header().Name)] {
+			continue
+		}
+		switch rr := answer.(type) {
+		case *dns.A:
+			if !ipv6 {
+				ips = append(ips, rr.A.String())
+			}
+		case *dns.AAAA:
+			if ipv6 {
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	return
+}
+
+// 将dns响应中查询域名（含CNAME目标）的ipv4地址加入目标group指定的ipset及nftables集合，
+// ipv6地址加入ipset6、nftset6指定的集合
 func addIPSet(group config.Group, r *dns.Msg) (err error) {
-	if group.IPSet == nil || r == nil {
+	if r == nil {
 		return
 	}
-	for _, ip := range extractIPv4(r) {
-		err = group.IPSet.Add(ip, group.IPSetTTL)
+	ipv4, ipv6 := chainAddrs(r, false), chainAddrs(r, true)
+	if group.IPSet != nil {
+		for _, ip := range ipv4 {
+			err = group.IPSet.Add(ip, group.IPSetTTL)
+		}
+	}
+	if group.IPSet6 != nil {
+		for _, ip := range ipv6 {
+			err = group.IPSet6.Add(ip, group.IPSetTTL)
+		}
+	}
+	if e := group.NFTSet.Add(ipv4, group.IPSetTTL); e != nil {
+		err = e
+	}
+	if e := group.NFTSet6.Add(ipv6, group.IPSetTTL); e != nil {
+		err = e
 	}
 	return
 }
 
-// 依次向目标组内的dns服务器转发请求，获得响应则返回
-func callDNS(group config.Group, request *dns.Msg) (r *dns.Msg) {
-	var err error
-	for _, caller := range group.Callers { // 遍历DNS服务器
-		r, err = caller.Call(request) // 发送查询请求
-		c.Cache.Set(request, r)
-		if err != nil {
-			log.Printf("[ERROR] query DNS error: %v\n", err)
+// 查找dns响应中属于bogus_ips的地址，不存在时返回nil
+func findBogusIP(c *config.Config, r *dns.Msg) net.IP {
+	if c.BogusIPs == nil || r == nil {
+		return nil
+	}
+	for _, answer := range r.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip != nil && c.BogusIPs.Contain(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// 生成拒绝查询时的响应，处理方式为drop时返回nil，为zero时返回的记录使用deny_ttl
+func denyReply(c *config.Config, action string, request *dns.Msg) (r *dns.Msg) {
+	r = new(dns.Msg)
+	switch action {
+	case config.DenyDrop:
+		return nil
+	case config.DenyRefused:
+		return r.SetRcode(request, dns.RcodeRefused)
+	case config.DenyNXDomain:
+		return r.SetRcode(request, dns.RcodeNameError)
+	case config.DenyZero:
+		r.SetReply(request)
+		question := request.Question[0]
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: c.DenyTTL}
+		switch question.Qtype {
+		case dns.TypeA:
+			r.Answer = append(r.Answer, &dns.A{Hdr: header, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6zero})
+		}
+		return r
+	}
+	return r.SetReply(request)
+}
+
+// 判断响应的rcode及应答是否符合目标组的接受策略
+func acceptable(group config.Group, r *dns.Msg) bool {
+	if group.AcceptRcodes != nil && !group.AcceptRcodes[r.Rcode] {
+		return false
+	}
+	return !group.RejectEmpty || r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0
+}
+
+// 向单个dns服务器转发请求，响应未通过校验或ctx被取消时返回nil。响应因包含劫持/污染地址被丢弃时bogus为true
+func callOne(ctx context.Context, c *config.Config, group config.Group, caller outbound.Caller, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	question := request.Question[0]
+	if c.Failures != nil && c.Failures.Failed(caller, question) {
+		trace.Addf("upstream", "%v skipped (recent timeout)", caller)
+		return nil, false // 该服务器近期对此查询超时，直接跳过
+	}
+	start := time.Now()
+	r, err := outbound.CallContext(ctx, caller, loopRequest(caller, request)) // 发送查询请求
+	// 已由其它服务器返回有效响应，不再记录结果
+	if ctx.Err() != nil {
+		trace.Addf("upstream", "%v cancelled", caller)
+		return nil, false
+	}
+	if c.Notifier != nil {
+		c.Notifier.UpstreamResult(fmt.Sprint(caller), err)
+	}
+	if err != nil {
+		log.Printf("[ERROR] query DNS error: %v\n", err)
+		trace.Addf("upstream", "%v error in %.1fms: %v", caller, time.Since(start).Seconds()*1000, err)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && c.Failures != nil {
+			c.Failures.Add(caller, question)
+		}
+	} else if r != nil {
+		trace.Addf("upstream", "%v %s in %.1fms, %d answers", caller, dns.RcodeToString[r.Rcode],
+			time.Since(start).Seconds()*1000, len(r.Answer))
+	}
+	if ip := findBogusIP(c, r); ip != nil { // 丢弃包含劫持/污染地址的响应
+		log.Printf("[WARNING] drop bogus answer %s for %s\n", ip, request.Question[0].Name)
+		trace.Addf("upstream", "drop bogus answer %s", ip)
+		return nil, true
+	}
+	if r != nil && !acceptable(group, r) { // 丢弃不符合该组接受策略的响应
+		log.Printf("[WARNING] drop %s response for %s\n", dns.RcodeToString[r.Rcode], request.Question[0].Name)
+		trace.Addf("upstream", "drop %s response", dns.RcodeToString[r.Rcode])
+		return nil, false
+	}
+	return r, false
+}
+
+// 环路标记仅发送至内网及本机地址上的明文上游（可能为其它ts-dns实例），公共上游及加密、递归查询不携带，
+// 避免上游据实例标识关联本服务器的所有查询；需修改时返回副本
+func loopRequest(caller outbound.Caller, request *dns.Msg) *dns.Msg {
+	marked := edns.FindOption(request, loop.OptionCode) != nil
+	var private bool
+	switch caller := caller.(type) {
+	case *outbound.UDPCaller:
+		private = loop.Private(caller.Address)
+	case *outbound.TCPCaller:
+		private = loop.Private(caller.Address)
+	}
+	if marked == private {
+		return request
+	}
+	req := request.Copy()
+	if private { // 未经其它实例转发的请求，跳数为1
+		loop.Mark(req, 1)
+	} else {
+		edns.RemoveOption(req, loop.OptionCode)
+	}
+	return req
+}
+
+// 某个dns服务器的查询结果
+type callResult struct {
+	caller outbound.Caller
+	r      *dns.Msg
+	bogus  bool
+}
+
+// 同时向组内所有dns服务器转发请求，结果按到达顺序写入返回的channel。ctx被取消时未完成的查询立即结束
+func callAll(ctx context.Context, c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) chan callResult {
+	ch := make(chan callResult, len(group.Callers))
+	for _, caller := range group.Callers {
+		go func(caller outbound.Caller) {
+			r, bogus := callOne(ctx, c, group, caller, request.Copy(), trace)
+			ch <- callResult{caller: caller, r: r, bogus: bogus}
+		}(caller)
+	}
+	return ch
+}
+
+// 同时向组内所有dns服务器转发请求，返回首个通过校验的响应。其余查询被取消，
+// 并在其结束后返回，使该组的并发查询数限制覆盖所有未完成的查询
+func callParallel(c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := callAll(ctx, c, group, request, trace)
+	for i := range group.Callers {
+		result := <-ch
+		if result.r == nil {
+			bogus = bogus || result.bogus
+			continue
+		}
+		cancel()
+		for range group.Callers[i+1:] {
+			<-ch
+		}
+		trace.SetUpstream(result.caller)
+		return result.r, false
+	}
+	return nil, bogus
+}
+
+// 同时向组内所有dns服务器转发请求并等待全部响应，返回最多服务器一致的响应，票数相同时取先到达者
+func callCompare(c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	ch := callAll(context.Background(), c, group, request, trace)
+	var keys []string
+	votes, responses := map[string]int{}, map[string]callResult{}
+	for range group.Callers {
+		result := <-ch
+		if bogus = bogus || result.bogus; result.r == nil {
+			continue
+		}
+		key := answerKey(result.r)
+		if votes[key]++; votes[key] == 1 {
+			keys, responses[key] = append(keys, key), result
+		}
+	}
+	if len(keys) == 0 {
+		return nil, bogus
+	}
+	best := keys[0]
+	for _, key := range keys[1:] {
+		if votes[key] > votes[best] {
+			best = key
+		}
+	}
+	if len(keys) > 1 {
+		log.Printf("[WARNING] upstreams disagree on %s, %d different answers\n", request.Question[0].Name, len(keys))
+		trace.Addf("upstream", "compare: %d different answers, use one agreed by %d upstreams", len(keys),
+			votes[best])
+	}
+	trace.SetUpstream(responses[best].caller)
+	return responses[best].r, false
+}
+
+// 响应的rcode及排序后的应答记录（不含TTL），用于比较各服务器的响应是否一致
+func answerKey(r *dns.Msg) string {
+	records := make([]string, 0, len(r.Answer))
+	for _, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		records = append(records, strings.ToLower(rr.String()))
+	}
+	sort.Strings(records)
+	return dns.RcodeToString[r.Rcode] + "\n" + strings.Join(records, "\n")
+}
+
+// 向组内的dns服务器转发请求，使用首个有效响应。无有效响应且有响应因包含劫持/污染地址被丢弃时bogus为true
+func callGroup(c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	if group.Compare {
+		return callCompare(c, group, request, trace)
+	} else if group.Parallel {
+		return callParallel(c, group, request, trace)
+	}
+	for _, i := range group.Balancer.Order(len(group.Callers), time.Now()) { // 按选择策略遍历DNS服务器
+		caller, start := group.Callers[i], time.Now()
+		var dropped bool
+		r, dropped = callOne(context.Background(), c, group, caller, request, trace)
+		group.Balancer.Report(i, r != nil, time.Since(start), time.Now())
+		if r != nil {
+			trace.SetUpstream(caller)
+			return r, false
+		}
+		bogus = bogus || dropped
+	}
+	return nil, bogus
+}
+
+// 向组内的dns服务器转发请求；该组不可用或无有效响应时，依次由备用组解析
+func callFailover(c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	name := request.Question[0].Name
+	if group.State.Available(time.Now()) {
+		r, bogus = callGroup(c, group, request, trace)
+		if group.State.Report(r != nil, time.Now()) {
+			if r == nil {
+				log.Printf("[WARNING] group %s is down, failover to %v\n", group.State.Name, group.Failover)
+			} else {
+				log.Printf("[INFO] group %s recovered\n", group.State.Name)
+			}
 		}
 		if r != nil {
+			return r, false
+		}
+	} else {
+		trace.Addf("upstream", "group %s is down", group.State.Name)
+	}
+	for _, backup := range group.Failover {
+		trace.Addf("upstream", "failover to group '%s'", backup)
+		var dropped bool
+		if r, dropped = callGroup(c, c.GroupMap[backup], request, trace); r != nil {
+			queryLog(c, fmt.Sprintf("[INFO] %s resolved by failover group '%s'", name, backup))
+			return r, false
+		}
+		bogus = bogus || dropped
+	}
+	return nil, bogus
+}
+
+// 按组的ecs配置生成转发的请求，需修改时返回副本：固定子网覆盖请求中的ECS；由客户端地址派生的ECS仅转发至
+// ecs = "auto"的组，转发至其它组时移除
+func subnetRequest(group config.Group, request *dns.Msg) *dns.Msg {
+	derived := edns.FindOption(request, edns.DerivedSubnet) != nil
+	if group.ECS == nil && !derived {
+		return request
+	}
+	req := request.Copy()
+	edns.RemoveOption(req, edns.DerivedSubnet)
+	if group.ECS != nil {
+		edns.SetOption(req, group.ECS)
+	} else if !group.AutoECS {
+		edns.RemoveOption(req, dns.EDNS0SUBNET)
+	}
+	return req
+}
+
+// 依次向目标组内的dns服务器转发请求，获得响应则返回。trace不为nil时记录上游查询及后处理过程
+func callDNS(c *config.Config, group config.Group, request *dns.Msg, trace *middleware.Trace) *dns.Msg {
+	r, _ := forwardDNS(c, group, request, trace)
+	return r
+}
+
+// 同callDNS，无有效响应且有响应因包含劫持/污染地址被丢弃时bogus为true
+func forwardDNS(c *config.Config, group config.Group, request *dns.Msg,
+	trace *middleware.Trace) (r *dns.Msg, bogus bool) {
+	if group.Block != "" {
+		trace.Add("upstream", "block group: "+group.Block)
+		return denyReply(c, group.Block, request), false
+	}
+	if group.NoAAAA && request.Question[0].Qtype == dns.TypeAAAA {
+		trace.Add("upstream", "no_aaaa: empty response")
+		return new(dns.Msg).SetReply(request), false // 屏蔽ipv6解析
+	}
+	if group.BlockedQtypes[request.Question[0].Qtype] {
+		trace.Add("upstream", "block qtype of group")
+		action := group.BlockAction
+		if action == "" {
+			action = c.BlockAction
+		}
+		return denyReply(c, action, request), false
+	}
+	if group.FakeIP && c.FakeIP != nil {
+		switch request.Question[0].Qtype {
+		case dns.TypeA:
+			trace.Add("upstream", "fake ip")
+			r = fakeReply(c, request)
+			c.Cache.Set(request, r) // 覆盖先前查询clean组时写入的缓存
+			return r, false
+		case dns.TypeAAAA: // 虚假ip仅支持ipv4，避免客户端经由ipv6绕过代理
+			trace.Add("upstream", "fake ip: empty AAAA response")
+			return new(dns.Msg).SetReply(request), false
+		case dns.TypeHTTPS, dns.TypeSVCB: // ipv4hint/ipv6hint会泄露真实地址
+			trace.Add("upstream", "fake ip: empty SVCB response")
+			return new(dns.Msg).SetReply(request), false
+		}
+	}
+	// 限制同时向该组发送的查询数，排队超时时视为无有效响应
+	if group.Limiter != nil {
+		if !group.Limiter.Acquire() {
+			log.Printf("[WARNING] too many concurrent queries, drop %s\n", request.Question[0].Name)
+			trace.Add("upstream", "drop: too many concurrent queries")
+			return nil, false
+		}
+		defer group.Limiter.Release()
+	}
+	req := subnetRequest(group, request)
+	if (group.DNSSEC != nil || group.TrustAD) && !request.CheckingDisabled {
+		if req == request {
+			req = request.Copy() // 需要DNSSEC验证时设置DO标志
+		}
+		if opt := req.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			req.SetEdns0(payloadSize(c.UpstreamSize), true)
+		}
+		req.AuthenticatedData = group.TrustAD // 请求上游在响应中设置AD标志（RFC 6840）
+	}
+	if r, bogus = callFailover(c, group, req, trace); r != nil && req != request {
+		if group.DNSSEC != nil {
+			r = validateDNSSEC(group, request, r, trace)
+		} else { // 验证失败时上游返回SERVFAIL，验证通过时设置AD标志
+			trace.Addf("post", "dnssec validated by upstream: %v", r.AuthenticatedData)
+		}
+	}
+	if r != nil && group.DNS64 != nil && request.Question[0].Qtype == dns.TypeAAAA {
+		r = synthesizeAAAA(c, group, request, r, trace)
+	}
+	if r != nil && (group.NoAAAA || group.StripECH) {
+		trace.Add("post", "strip svcb params")
+		r = rewriteSVCB(group, r)
+	}
+	// 缓存上游的原始TTL，仅限制返回给客户端的副本（命中缓存时同样限制）
+	c.Cache.SetClamped(request, r, group.MinTTL, group.MaxTTL)
+	if r != nil && (group.MinTTL > 0 || group.MaxTTL > 0) {
+		trace.Addf("post", "clamp ttl to [%d, %d]", group.MinTTL, group.MaxTTL)
+		r = clampTTL(r, group.MinTTL, group.MaxTTL)
+	}
+	return r, bogus
+}
+
+// DNS64：AAAA查询的NOERROR响应中无AAAA记录时，查询A记录并按NAT64前缀合成AAAA记录
+func synthesizeAAAA(c *config.Config, group config.Group, request, r *dns.Msg, trace *middleware.Trace) *dns.Msg {
+	if r.Rcode != dns.RcodeSuccess {
+		return r
+	}
+	for _, answer := range r.Answer {
+		if answer.Header().Rrtype == dns.TypeAAAA {
+			return r
+		}
+	}
+	prefix := group.DNS64.Prefix(func(request *dns.Msg) *dns.Msg {
+		r, _ := callGroup(c, group, request, nil)
+		return r
+	})
+	if prefix == nil {
+		trace.Add("post", "dns64: no NAT64 prefix")
+		return r
+	}
+	query := request.Copy()
+	query.Question[0].Qtype = dns.TypeA
+	if a, _ := callFailover(c, group, query, trace); a != nil && a.Rcode == dns.RcodeSuccess && len(extractIPv4(a)) > 0 {
+		trace.Addf("post", "dns64: synthesize AAAA with %s", prefix)
+		return dns64.Synthesize(prefix, request, a)
+	}
+	return r
+}
+
+// 将响应中记录的TTL限制在[min, max]范围内，max为0时不限制上限。返回修改后的副本
+func clampTTL(r *dns.Msg, min, max uint32) *dns.Msg {
+	r = r.Copy()
+	cache.ClampTTL(r, min, max)
+	return r
+}
+
+// 移除HTTPS/SVCB记录中与该组策略冲突的参数，避免客户端通过ipv6hint、ech绕过
+func rewriteSVCB(group config.Group, r *dns.Msg) *dns.Msg {
+	var keys []uint16
+	if group.NoAAAA {
+		keys = append(keys, rewrite.KeyIPv6Hint)
+	}
+	if group.StripECH {
+		keys = append(keys, rewrite.KeyECH)
+	}
+	return rewrite.StripSVCParams(r, keys...)
+}
+
+// 验证响应的DNSSEC签名，签名无效时返回SERVFAIL
+func validateDNSSEC(group config.Group, request, r *dns.Msg, trace *middleware.Trace) *dns.Msg {
+	result, err := group.DNSSEC.Validate(r)
+	trace.Addf("post", "dnssec %v", result)
+	if result == dnssec.Bogus {
+		log.Printf("[WARNING] DNSSEC validation failed for %s: %v\n", request.Question[0].Name, err)
+		r = new(dns.Msg)
+		return r.SetRcode(request, dns.RcodeServerFailure)
+	}
+	r.AuthenticatedData = result == dnssec.Secure
+	return r
+}
+
+// 查找hosts中ip对应的域名（FQDN），无对应记录时返回空串。未指定地址多用于屏蔽域名，不作反向解析
+func hostsHostname(c *config.Config, ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	for _, reader := range c.HostsReaders {
+		if hostname := reader.Hostname(ip.String()); hostname != "" {
+			return dns.Fqdn(hostname)
+		}
+	}
+	return ""
+}
+
+// 应答hosts中无对应记录的私有地址反向查询，返回NXDOMAIN
+func privatePTR(zone string) (r *dns.Msg) {
+	r = new(dns.Msg)
+	r.Rcode = dns.RcodeNameError
+	r.Ns = append(r.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA,
+		Class: dns.ClassINET, Ttl: 10800}, Ns: zone, Mbox: "nobody.invalid.",
+		Serial: 1, Refresh: 604800, Retry: 86400, Expire: 2419200, Minttl: 10800})
+	return r
+}
+
+// 查找域名所属的本地权威区域，不属于任何区域时返回nil
+func findZone(c *config.Config, name string) *zone.Zone {
+	for _, z := range c.Zones {
+		if z.Contains(name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// 分多条消息发送区域传送的记录，每条消息使用请求的TSIG密钥签名，其后的消息仅签名时间（RFC 8945 5.3.1）
+func transferZone(resp dns.ResponseWriter, request *dns.Msg, tsig *dns.TSIG, rrs []dns.RR) {
+	const batch = 100
+	for i := 0; i < len(rrs); i += batch {
+		end := i + batch
+		if end > len(rrs) {
+			end = len(rrs)
+		}
+		r := new(dns.Msg)
+		r.SetReply(request)
+		r.Authoritative = true
+		r.Answer = rrs[i:end]
+		r.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+		if err := resp.WriteMsg(r); err != nil {
+			log.Printf("[ERROR] transfer zone error: %v\n", err)
 			return
 		}
+		resp.TsigTimersOnly(true)
+	}
+}
+
+// 查找域名匹配的条件转发配置，未匹配时返回nil
+func findForward(c *config.Config, name string) *config.Forward {
+	for i := range c.Forwards {
+		if dns.IsSubDomain(c.Forwards[i].Zone, name) {
+			return &c.Forwards[i]
+		}
 	}
 	return nil
 }
 
+// 处理本地权威区域的动态更新请求（RFC 2136），key为请求签名有效的TSIG密钥名称，未签名时为空
+func updateReply(c *config.Config, request *dns.Msg, key string) (r *dns.Msg) {
+	r = new(dns.Msg)
+	zoneSection := request.Question[0]
+	if zoneSection.Qtype != dns.TypeSOA {
+		r.Rcode = dns.RcodeFormatError
+		return r
+	}
+	var z *zone.Zone
+	for _, item := range c.Zones {
+		if strings.EqualFold(item.Origin, zoneSection.Name) {
+			z = item
+		}
+	}
+	keys, bound := c.UpdateKeys[strings.ToLower(zoneSection.Name)]
+	switch {
+	case z == nil:
+		r.Rcode = dns.RcodeNotAuth
+	case c.UpdatePolicy == config.UpdateNone, c.UpdatePolicy == config.UpdateTSIG && key == "",
+		bound && !keys[strings.ToLower(key)]:
+		r.Rcode = dns.RcodeRefused
+	default:
+		r.Rcode = z.Update(request)
+	}
+	return r
+}
+
+// 使用虚假ip应答A查询
+func fakeReply(c *config.Config, request *dns.Msg) (r *dns.Msg) {
+	question := request.Question[0]
+	r = new(dns.Msg).SetReply(request)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA,
+		Class: dns.ClassINET, Ttl: c.FakeIPTTL}, A: c.FakeIP.Lookup(question.Name)})
+	return r
+}
+
+// 应答虚假ip的反向查询，映射不存在或已过期时返回NXDOMAIN
+func fakePTR(c *config.Config, name string, ip net.IP) (r *dns.Msg) {
+	r = new(dns.Msg)
+	if domain, ok := c.FakeIP.Domain(ip); ok {
+		r.Answer = append(r.Answer, &dns.PTR{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR,
+			Class: dns.ClassINET, Ttl: c.FakeIPTTL}, Ptr: domain})
+	} else {
+		r.Rcode = dns.RcodeNameError
+	}
+	return r
+}
+
+// 应答特殊用途域名：localhost解析为回环地址，其余返回NXDOMAIN
+func specialReply(question dns.Question, zone string) (r *dns.Msg) {
+	r = new(dns.Msg)
+	if zone != "localhost." {
+		r.Rcode = dns.RcodeNameError
+		return r
+	}
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET}
+	switch question.Qtype {
+	case dns.TypeA:
+		r.Answer = append(r.Answer, &dns.A{Hdr: header, A: net.IPv4(127, 0, 0, 1)})
+	case dns.TypeAAAA:
+		r.Answer = append(r.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6loopback})
+	}
+	return r
+}
+
+// 获取需要强制安全搜索的域名对应的CNAME目标，无需改写时返回空串
+func safeSearchTarget(c *config.Config, ip net.IP, name string) string {
+	if !c.SafeSearch || (c.SafeClients != nil && !c.SafeClients.Contain(ip)) {
+		return ""
+	}
+	return rewrite.SafeSearch(name)
+}
+
+// 获取客户端ip地址
+func remoteIP(resp dns.ResponseWriter) net.IP {
+	switch addr := resp.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// 判断客户端是否允许访问：在denied_clients中则拒绝，设置了allowed_clients时仅允许其中的客户端
+func clientAllowed(c *config.Config, ip net.IP) bool {
+	if c.DeniedClients != nil && c.DeniedClients.Contain(ip) {
+		return false
+	}
+	return c.AllowedClients == nil || c.AllowedClients.Contain(ip)
+}
+
+// 向客户端写入响应，通过UDP查询且被限速时丢弃响应或返回截断响应
+func writeResponse(c *config.Config, resp dns.ResponseWriter, request, r *dns.Msg, cookieValid bool) {
+	if _, ok := resp.RemoteAddr().(*net.UDPAddr); ok && c.RRL != nil && !cookieValid {
+		switch c.RRL.Check(remoteIP(resp), r, time.Now()) {
+		case ratelimit.Drop:
+			return
+		case ratelimit.Slip:
+			r = new(dns.Msg)
+			r.SetReply(request)
+			r.Truncated = true
+		}
+	}
+	_ = resp.WriteMsg(r)
+}
+
+// EDNS0 UDP缓冲区大小，未配置时为4096
+func payloadSize(size uint16) uint16 {
+	if size == 0 {
+		return dns.DefaultMsgSize
+	}
+	return size
+}
+
+// 客户端TCP连接的空闲超时时间，未配置时为10秒
+func tcpIdleTimeout(c *config.Config) time.Duration {
+	if c.TCPIdle == 0 {
+		return 10 * time.Second
+	}
+	return c.TCPIdle
+}
+
+// 输出查询日志，可通过配置关闭
+func queryLog(c *config.Config, msg string) {
+	if c.QueryLog {
+		log.Println(msg)
+	}
+}
+
+// 写入结构化查询日志
+func writeQueryLog(c *config.Config, ctx *middleware.Context, r *dns.Msg, latency time.Duration) {
+	question := ctx.Request.Question[0]
+	entry := querylog.Entry{Time: time.Now(), Client: ctx.ClientIP.String(), Name: question.Name,
+		Type: dns.TypeToString[question.Qtype], Group: ctx.Group, Upstream: ctx.Trace.Upstream(), Rcode: "DROP",
+		Latency: latency.Seconds() * 1000}
+	if entry.Type == "" {
+		entry.Type = strconv.Itoa(int(question.Qtype))
+	}
+	if reason, ok := ctx.Get(reasonKey); ok {
+		entry.Reason = reason.(string)
+	}
+	if r != nil {
+		entry.Rcode, entry.Answers = dns.RcodeToString[r.Rcode], len(r.Answer)
+	}
+	if err := c.QueryLogger.Log(entry); err != nil {
+		log.Printf("[ERROR] write query log error: %v\n", err)
+	}
+}
+
+// 检查请求格式：问题部分须有且仅有一条；除动态更新外answer、authority部分至多一条记录（NOTIFY的SOA、IXFR的SOA），
+// additional部分至多两条记录（OPT及TSIG）；OPT记录至多一条且名称须为根域名（RFC 6891）
+func wellFormed(request *dns.Msg) bool {
+	if len(request.Question) != 1 {
+		return false
+	}
+	if request.Opcode != dns.OpcodeUpdate && (len(request.Answer) > 1 || len(request.Ns) > 1 || len(request.Extra) > 2) {
+		return false
+	}
+	opts := 0
+	for i, section := range [][]dns.RR{request.Answer, request.Ns, request.Extra} {
+		for _, rr := range section {
+			if rr == nil {
+				return false
+			}
+			if header := rr.Header(); header.Rrtype == dns.TypeOPT { // OPT记录只能位于additional部分
+				if opts++; i < 2 || opts > 1 || header.Name != "." {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
 type handler struct{}
 
 func (_ *handler) ServeDNS(resp dns.ResponseWriter, request *dns.Msg) {
 	var r *dns.Msg
-	var group config.Group
+	c := currentConfig()
+	// 拒绝格式错误的请求，优先于其它任何处理；响应报文直接忽略，避免被用于反射
+	if request.Response {
+		_ = resp.Close()
+		return
+	}
+	if !wellFormed(request) {
+		_ = resp.WriteMsg(new(dns.Msg).SetRcodeFormatError(request))
+		_ = resp.Close()
+		return
+	}
+	// 检查客户端是否有权访问，优先于其它任何处理。通过DoH认证的客户端仅受denied_clients限制
+	allowed := clientAllowed(c, remoteIP(resp))
+	if w, ok := resp.(*dohWriter); ok && w.client != nil && !allowed {
+		allowed = c.DeniedClients == nil || !c.DeniedClients.Contain(remoteIP(resp))
+	}
+	if !allowed {
+		if r = denyReply(c, c.ACLAction, request); r != nil {
+			_ = resp.WriteMsg(r)
+		}
+		_ = resp.Close()
+		return
+	}
+	// 按客户端限制查询速率，超出速率的查询不做任何处理
+	if !c.ClientLimit.Allow(remoteIP(resp), time.Now()) {
+		if r = denyReply(c, c.LimitAction, request); r != nil {
+			_ = resp.WriteMsg(r)
+		}
+		_ = resp.Close()
+		return
+	}
+	// 限制并发处理的请求数，超出上限且排队超时时返回SERVFAIL
+	if c.Limiter != nil {
+		if !c.Limiter.Acquire() {
+			_ = resp.WriteMsg(new(dns.Msg).SetRcode(request, dns.RcodeServerFailure))
+			_ = resp.Close()
+			return
+		}
+		defer c.Limiter.Release()
+	}
+	// 校验客户端的TSIG签名，并在转发前移除TSIG记录
+	tsig := request.IsTsig()
+	if tsig != nil {
+		if err := resp.TsigStatus(); err != nil || c.TsigSecrets[strings.ToLower(tsig.Hdr.Name)] == "" {
+			log.Printf("[WARNING] TSIG verification failed for %s: %v\n", resp.RemoteAddr(), err)
+			_ = resp.WriteMsg(new(dns.Msg).SetRcode(request, dns.RcodeNotAuth))
+			_ = resp.Close()
+			return
+		}
+		request.Extra = request.Extra[:len(request.Extra)-1]
+	}
+	// 处理客户端的DNS Cookie，并在转发前移除，避免泄露给上游
+	var clientCookie string
+	var cookieValid bool // 客户端携带了有效的服务端Cookie，不受响应限速影响
+	if c.CookieSecret != nil {
+		var serverCookie string
+		var ok bool
+		if clientCookie, serverCookie, ok = edns.GetCookie(request); !ok && edns.FindOption(request, dns.EDNS0COOKIE) != nil {
+			_ = resp.WriteMsg(new(dns.Msg).SetRcodeFormatError(request)) // Cookie长度错误（RFC 7873 5.2.2）
+			_ = resp.Close()
+			return
+		}
+		cookieValid = serverCookie != "" &&
+			c.CookieSecret.Valid(clientCookie, serverCookie, remoteIP(resp), time.Now())
+		// 经UDP携带了无效（如过期）的服务端Cookie时返回BADCOOKIE及新的服务端Cookie，由客户端重试（RFC 7873 5.4）
+		if _, isUDP := resp.RemoteAddr().(*net.UDPAddr); isUDP && serverCookie != "" && !cookieValid {
+			r := new(dns.Msg)
+			r.SetRcode(request, dns.RcodeBadCookie)
+			r.SetEdns0(payloadSize(c.EDNSSize), false)
+			edns.SetCookie(r, clientCookie, c.CookieSecret.ServerCookie(clientCookie, remoteIP(resp), time.Now()))
+			writeResponse(c, resp, request, r, false)
+			_ = resp.Close()
+			return
+		}
+		edns.RemoveOption(request, dns.EDNS0COOKIE)
+	}
+	// 处理客户端经TCP请求的edns-tcp-keepalive（RFC 7828），请求中不能携带超时时间；经UDP、DoH请求时忽略。
+	// 该option仅作用于客户端与本服务器间的连接，不转发至上游
+	var keepalive bool
+	if _, ok := resp.RemoteAddr().(*net.TCPAddr); ok {
+		if _, isDoH := resp.(*dohWriter); !isDoH {
+			timeout, found, err := edns.GetKeepalive(request)
+			if found && (err != nil || timeout >= 0) {
+				_ = resp.WriteMsg(new(dns.Msg).SetRcodeFormatError(request))
+				_ = resp.Close()
+				return
+			}
+			keepalive = found
+		}
+	}
+	edns.RemoveOption(request, dns.EDNS0TCPKEEPALIVE)
+	// 客户端可接收的UDP响应大小：无OPT记录时为512，否则为其声明的大小（不超过edns_udp_size）
+	reqOpt, clientSize := request.IsEdns0(), dns.MinMsgSize
+	if reqOpt != nil {
+		if size := int(reqOpt.UDPSize()); size > clientSize {
+			clientSize = size
+		}
+		if size := int(payloadSize(c.EDNSSize)); clientSize > size {
+			clientSize = size
+		}
+	}
+	// 拒绝由本服务器转发回来或转发跳数过多的请求，避免上游配置成环时查询无限循环
+	hops, err := loop.Check(request, c.MaxHops)
+	if err != nil {
+		log.Printf("[WARNING] refuse %s from %s: %v\n", request.Question[0].Name, resp.RemoteAddr(), err)
+		_ = resp.WriteMsg(new(dns.Msg).SetRcode(request, dns.RcodeRefused))
+		_ = resp.Close()
+		return
+	}
+	// 客户端请求含填充时填充响应（RFC 8467），填充仅作用于客户端与本服务器间的连接
+	padded := edns.FindOption(request, dns.EDNS0PADDING) != nil
+	// 移除未允许的客户端EDNS0 option，避免向上游泄露
+	edns.Sanitize(request, c.EDNSAllowed, payloadSize(c.UpstreamSize))
+	// 已经过其它实例转发的请求携带增加后的跳数，由callOne决定是否发送至上游
+	if hops > 0 {
+		loop.Mark(request, hops+1)
+	}
+	// 存在ecs = "auto"的组且客户端未携带ECS时，由客户端地址派生ECS，缓存按派生的子网区分
+	var derived bool
+	if c.AutoECS && edns.GetSubnet(request) == nil {
+		if subnet := edns.ClientSubnet(remoteIP(resp)); subnet != nil {
+			edns.SetOption(request, subnet)
+			edns.SetOption(request, &dns.EDNS0_LOCAL{Code: edns.DerivedSubnet})
+			derived = true
+		}
+	}
 	defer func() {
+		if derived { // 还原请求，移除派生的ECS，避免回显给客户端
+			edns.RemoveOption(request, dns.EDNS0SUBNET)
+			edns.RemoveOption(request, edns.DerivedSubnet)
+		}
+		if edns.RemoveOption(request, loop.OptionCode); reqOpt == nil { // 还原请求，移除环路标记及添加的OPT记录
+			edns.RemoveOPT(request)
+		}
 		if r != nil { // 写入响应
+			rcode := r.Rcode // SetReply会重置rcode
 			r.SetReply(request)
-			_ = resp.WriteMsg(r)
-			if err := addIPSet(group, r); err != nil { // 写入ipset
-				log.Printf("[ERROR] add record to ipset error: %v\n", err)
+			r.Rcode = rcode
+			if r.IsEdns0() != nil || edns.GetSubnet(request) != nil { // 按请求回显ECS
+				edns.EchoSubnet(request, r)
+			}
+			if opt := request.IsEdns0(); opt == nil || !opt.Do() {
+				r = dnssec.Strip(r, request.Question[0].Qtype)
+			}
+			if clientCookie != "" { // 返回服务端Cookie
+				server := c.CookieSecret.ServerCookie(clientCookie, remoteIP(resp), time.Now())
+				edns.SetCookie(r, clientCookie, server)
+			}
+			if reqOpt == nil { // 请求不含OPT记录时响应也不能包含
+				edns.RemoveOPT(r)
+			} else if opt := r.IsEdns0(); opt != nil {
+				opt.SetUDPSize(payloadSize(c.EDNSSize))
+			} else {
+				r.SetEdns0(payloadSize(c.EDNSSize), reqOpt.Do())
+			}
+			if keepalive { // 声明空闲超时时间
+				edns.SetKeepalive(r, tcpIdleTimeout(c))
+			}
+			if _, ok := resp.RemoteAddr().(*net.UDPAddr); ok { // 超出客户端缓冲区时截断并设置TC标志
+				r.Truncate(clientSize)
+			} else if padded { // 经TCP、DoT、DoH查询时填充响应，隐藏响应长度
+				_ = edns.Pad(r, edns.ResponsePaddingBlock)
 			}
+			if tsig != nil { // 使用请求的TSIG密钥签名响应
+				r.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+			}
+			writeResponse(c, resp, request, r, cookieValid)
+		}
+		if !keepalive || r == nil { // 结束连接，协商了keepalive时保持TCP连接，空闲超时后由服务器关闭
+			_ = resp.Close()
 		}
-		_ = resp.Close() // 结束连接
 	}()
 
 	question := request.Question[0]
-	msg := fmt.Sprintf("[INFO] %s from %s ", question.Name, resp.RemoteAddr())
-	// 判断域名是否存在于hosts内
-	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
-		ipv6 := question.Qtype == dns.TypeAAAA
-		for _, reader := range c.HostsReaders {
-			record, hostname := "", question.Name
-			if record = reader.Record(hostname, ipv6); record == "" {
-				// 去掉末尾的根域名再找一次
-				record = reader.Record(hostname[:len(hostname)-1], ipv6)
-			}
-			if record != "" {
-				if ret, err := dns.NewRR(record); err != nil {
-					log.Printf("[ERROR] make DNS.RR error: %v\n", err)
-				} else {
-					r = new(dns.Msg)
-					r.Answer = append(r.Answer, ret)
-				}
-				log.Println(msg + "match hosts")
-				return
-			}
+	var msg string
+	if c.QueryLog { // 仅在输出查询日志时格式化，减少缓存命中时的开销
+		msg = fmt.Sprintf("[INFO] %s from %s ", question.Name, resp.RemoteAddr())
+	}
+	// 动态更新请求仅由本地权威区域处理
+	if request.Opcode == dns.OpcodeUpdate {
+		var key string
+		if tsig != nil {
+			key = tsig.Hdr.Name
 		}
+		r = updateReply(c, request, key)
+		queryLog(c, msg+"update zone: "+dns.RcodeToString[r.Rcode])
+		return
 	}
-
-	// 检测dns缓存是否命中
-	if r = c.Cache.Get(request); r != nil {
-		log.Println(msg + "hit cache")
+	// 其它操作码（NOTIFY、STATUS等）及区域传送请求不转发至上游
+	if request.Opcode != dns.OpcodeQuery {
+		r = new(dns.Msg).SetRcode(request, dns.RcodeNotImplemented)
+		queryLog(c, msg+"unsupported opcode "+dns.OpcodeToString[request.Opcode])
 		return
 	}
-
-	// 判断域名是否匹配指定规则
-	var name string
-	for name, group = range c.GroupMap {
-		if match, ok := group.Matcher.Match(question.Name); ok && match {
-			log.Println(msg + fmt.Sprintf("match group '%s' (rules)", name))
-			r = callDNS(group, request)
+	if question.Qtype == dns.TypeAXFR || question.Qtype == dns.TypeIXFR {
+		// 经TCP且使用TSIG签名的请求可传送本地权威区域，IXFR同样返回完整区域（RFC 1995 4）
+		_, isTCP := resp.RemoteAddr().(*net.TCPAddr)
+		if z := findZone(c, question.Name); z != nil && tsig != nil && isTCP && strings.EqualFold(z.Origin, question.Name) {
+			queryLog(c, msg+"transfer zone "+z.Origin)
+			transferZone(resp, request, tsig, z.Transfer())
 			return
 		}
+		r = new(dns.Msg).SetRcode(request, dns.RcodeRefused)
+		queryLog(c, msg+"refuse zone transfer")
+		return
+	}
+	// 依次经过各处理阶段（含插件）生成响应
+	ctx := &middleware.Context{Request: request, ClientIP: remoteIP(resp), LogPrefix: msg}
+	if w, ok := resp.(*dohWriter); ok { // DoH请求路径指定的组
+		ctx.Group = w.group
 	}
+	ctx.Set(clientKey, true)
+	assignClient(c, ctx)
+	c.Pipeline(ctx)
+	r = ctx.Response
+}
 
-	// 先假设域名属于clean组
-	group = c.GroupMap["clean"]
-	r = callDNS(group, request)
-	// 判断响应的ipv4中是否都为中国ip
-	var allInCN = true
-	for _, ip := range extractIPv4(r) {
-		if !c.CNIPs.Contain(net.ParseIP(ip)) {
-			allInCN = false
-			break
+// CNAME链的最大解析深度
+const maxCNAMEDepth = 8
+
+// 沿应答中的CNAME链查找最终目标，应答中无CNAME或已包含目标的qtype记录时返回空串
+func cnameTarget(r *dns.Msg, name string, qtype uint16) string {
+	target := ""
+	for i := 0; i <= len(r.Answer); i++ { // 限制循环次数，避免CNAME环路
+		next := ""
+		for _, rr := range r.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return ""
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
 		}
-	}
-	if allInCN {
-		log.Println(msg + fmt.Sprintf("match group 'clean' (cn ip)"))
-	} else {
-		// 出现非中国ip，根据gfwlist再次判断
-		if blocked, ok := c.GFWMatcher.Match(question.Name); ok && blocked {
-			log.Println(msg + fmt.Sprintf("match group 'dirty' (in gfwlist)"))
-			group = c.GroupMap["dirty"] // 判断域名属于dirty组
-			r = callDNS(group, request)
-		} else {
-			log.Println(msg + fmt.Sprintf("match group 'clean' (not in gfwlist)"))
+		if next == "" {
+			return target
 		}
+		name, target = next, next
+	}
+	return ""
+}
+
+// 上游仅返回CNAME而无最终记录时，通过resolve逐级查询CNAME目标并合并为完整的应答。
+// 查询目标的结果写入对应组的ipset，完整的应答写入缓存
+func chaseCNAME(c *config.Config, request, r *dns.Msg, ip net.IP, trace *middleware.Trace, resolve middleware.Handler,
+	depth int) *dns.Msg {
+	question := request.Question[0]
+	if r == nil || r.Rcode != dns.RcodeSuccess || question.Qtype == dns.TypeCNAME || depth >= maxCNAMEDepth {
+		return r
+	}
+	target := cnameTarget(r, question.Name, question.Qtype)
+	if target == "" {
+		return r
+	}
+	sub := request.Copy()
+	sub.Question[0].Name = target
+	var msg string
+	if c.QueryLog {
+		msg = fmt.Sprintf("[INFO] %s (cname of %s) ", target, question.Name)
+	}
+	trace.Add("post", "resolve cname target "+target)
+	ctx := &middleware.Context{Request: sub, ClientIP: ip, LogPrefix: msg, Trace: trace}
+	resolve(ctx)
+	final := ctx.Response
+	if final == nil {
+		return r
 	}
+	if err := addIPSet(c.GroupMap[ctx.Group], final); err != nil {
+		log.Printf("[ERROR] add record to ipset error: %v\n", err)
+		c.Notifier.IPSetError(err)
+	}
+	final = chaseCNAME(c, sub, final, ip, trace, resolve, depth+1)
+	full := r.Copy()
+	full.Answer = append(full.Answer, final.Answer...)
+	full.Rcode = final.Rcode
+	if final.Rcode != dns.RcodeSuccess || len(final.Answer) == 0 {
+		full.Ns = final.Ns // 目标不存在或无记录时返回目标的SOA
+	}
+	full.AuthenticatedData = r.AuthenticatedData && final.AuthenticatedData
+	c.Cache.Set(request, full)
+	return full
 }
 
 func main() {
-	c = initConfig()
-	srv := &dns.Server{Addr: c.Listen, Net: "udp"}
-	srv.Handler = &handler{}
+	if len(os.Args) > 1 && os.Args[1] == "bench" { // 压测子命令
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "update" { // 自动更新子命令
+		runUpdate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" { // 诊断查询子命令
+		runQuery(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" { // 配置校验子命令
+		runCheck(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "match" { // 规则匹配子命令
+		runMatch(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rules" { // 规则转换子命令
+		runRules(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "setup" { // 配置向导子命令
+		runSetup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" { // 上游测试子命令
+		runProbe(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" { // 缓存快照子命令
+		runCache(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" { // 实时查看查询子命令
+		runWatch(os.Args[2:])
+		return
+	}
+	c, watch := initConfig()
+	warmup = true
+	swapConfig(c)
+	// 初始配置生效后再开始检查配置变更，避免重载时当前配置为空
+	watch()
+	loadCacheFile(c) // 导入上次退出时保存的缓存，避免重启后大量查询同时转发至上游
+	if pidFile != "" {
+		if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Fatalf("[CRITICAL] write pid file error: %v\n", err)
+		}
+	}
+	// DoH、DoT共用证书及ACME验证服务
+	tlsConfig, acme, err := listenerTLSConfig(c)
+	if err != nil {
+		log.Fatalf("[CRITICAL] load certificate error: %v\n", err)
+	}
+	acmeServer = acme
+	go waitSignal()
+	go prefetchLoop() // 预取常用域名，避免重启后首次查询较慢
+	go cacheSaveLoop()
+	// tcp、udp及DoH、DoT均开始监听后通知systemd服务已就绪
+	var listening sync.WaitGroup
+	listening.Add(2)
+	if c.DoHListen != "" {
+		listening.Add(1)
+	}
+	if c.DoTListen != "" {
+		listening.Add(1)
+	}
+	go func() {
+		listening.Wait()
+		_ = systemd.Notify(systemd.Ready)
+		systemd.StartWatchdog(func() error { return healthCheck(systemd.WatchdogInterval() / 2) })
+	}()
+	if c.DoHListen != "" {
+		go func() {
+			if err := serveDoH(c, tlsConfig, listening.Done); err != nil {
+				log.Fatalf("[CRITICAL] listen doh error: %v\n", err)
+			}
+		}()
+	}
+	if c.DoTListen != "" {
+		go func() {
+			srv := &dns.Server{Addr: c.DoTListen, Net: "tcp-tls", TLSConfig: dotTLSConfig(tlsConfig),
+				Handler: &handler{}, TsigProvider: tsigProvider{}, NotifyStartedFunc: listening.Done,
+				MsgAcceptFunc: acceptMsg, IdleTimeout: func() time.Duration { return tcpIdleTimeout(currentConfig()) }}
+			log.Printf("[WARNING] Listen on %s/dot\n", c.DoTListen)
+			if err := srv.ListenAndServe(); err != nil {
+				log.Fatalf("[CRITICAL] listen dot error: %v\n", err)
+			}
+		}()
+	}
+	// 同时监听tcp，供被截断的udp查询重试
+	go func() {
+		srv := &dns.Server{Addr: c.Listen, Net: "tcp", Handler: &handler{}, TsigProvider: tsigProvider{},
+			NotifyStartedFunc: listening.Done, MsgAcceptFunc: acceptMsg,
+			IdleTimeout: func() time.Duration { return tcpIdleTimeout(currentConfig()) }}
+		log.Printf("[WARNING] Listen on %s/tcp\n", c.Listen)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Fatalf("[CRITICAL] listen tcp error: %v\n", err)
+		}
+	}()
 	log.Printf("[WARNING] Listen on %s/udp\n", c.Listen)
+	if c.UDPWorkers > 0 {
+		if err := serveReusePort(c, listening.Done); err != nil {
+			log.Fatalf("[CRITICAL] listen udp error: %v\n", err)
+		}
+		return
+	}
+	if c.UDPBatch {
+		if err := listenBatchUDP(c.Listen, &handler{}, listening.Done); err != nil {
+			log.Fatalf("[CRITICAL] listen udp error: %v\n", err)
+		}
+		return
+	}
+	srv := &dns.Server{Addr: c.Listen, Net: "udp", TsigProvider: tsigProvider{}, NotifyStartedFunc: listening.Done,
+		MsgAcceptFunc: acceptMsg}
+	srv.Handler = &handler{}
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatalf("[CRITICAL] liten udp error: %v\n", err)
 	}
 }
+
+// 使用SO_REUSEPORT打开多个UDP监听器，由内核在各监听器间分配报文，全部监听后调用started
+func serveReusePort(c *config.Config, started func()) error {
+	conns := make([]*net.UDPConn, c.UDPWorkers)
+	for i := range conns {
+		conn, err := listenReusePort(c.Listen)
+		if err != nil {
+			return err
+		}
+		conns[i] = conn
+	}
+	started()
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			if c.UDPBatch {
+				errs <- newBatchServer(conn, &handler{}).serveUDP()
+				return
+			}
+			srv := &dns.Server{PacketConn: conn, Handler: &handler{}, TsigProvider: tsigProvider{},
+				MsgAcceptFunc: acceptMsg}
+			errs <- srv.ActivateAndServe()
+		}(conn)
+	}
+	return <-errs
+}
+
+// 在dns.DefaultMsgAcceptFunc的基础上接受动态更新请求，其各部分可包含多条记录
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if opcode := int(dh.Bits>>11) & 0xF; opcode == dns.OpcodeUpdate && dh.Bits&(1<<15) == 0 {
+		if dh.Qdcount != 1 {
+			return dns.MsgReject
+		}
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// ACME HTTP-01验证服务，为nil时未启用
+var acmeServer *http.Server
+
+// 收到SIGHUP时重载配置；收到SIGINT/SIGTERM时通知systemd服务正在停止，移除pid文件、保存虚假ip映射及缓存、关闭日志文件后退出
+func waitSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-ch
+	for ; sig == syscall.SIGHUP; sig = <-ch {
+		log.Printf("[WARNING] receive signal %v, reloading config\n", sig)
+		_ = reloadOnSignal()
+	}
+	log.Printf("[WARNING] receive signal %v, exiting\n", sig)
+	_ = systemd.Notify(systemd.Stopping)
+	if acmeServer != nil {
+		_ = acmeServer.Close()
+	}
+	if pidFile != "" {
+		_ = os.Remove(pidFile)
+	}
+	if c := currentConfig(); c != nil && c.FakeIP != nil {
+		if err := c.FakeIP.Save(); err != nil {
+			log.Printf("[ERROR] save fake ip mapping error: %v\n", err)
+		}
+	}
+	if c := currentConfig(); c != nil {
+		if err := saveCacheFile(c); err != nil {
+			log.Printf("[ERROR] save cache file error: %v\n", err)
+		}
+	}
+	if c := currentConfig(); c != nil {
+		_ = c.QueryLogger.Close()
+	}
+	if c := currentConfig(); c != nil && c.LogWriter != nil {
+		_ = c.LogWriter.Close()
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,1451 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/blocklist"
+	"github.com/wolf-joe/ts-dns/cache"
+	"github.com/wolf-joe/ts-dns/config"
+	"github.com/wolf-joe/ts-dns/device"
+	"github.com/wolf-joe/ts-dns/dns64"
+	"github.com/wolf-joe/ts-dns/edns"
+	"github.com/wolf-joe/ts-dns/failover"
+	"github.com/wolf-joe/ts-dns/fakeip"
+	"github.com/wolf-joe/ts-dns/hosts"
+	"github.com/wolf-joe/ts-dns/ipset"
+	"github.com/wolf-joe/ts-dns/loop"
+	"github.com/wolf-joe/ts-dns/matcher"
+	"github.com/wolf-joe/ts-dns/middleware"
+	"github.com/wolf-joe/ts-dns/outbound"
+	"github.com/wolf-joe/ts-dns/querylog"
+	"github.com/wolf-joe/ts-dns/ratelimit"
+	"github.com/wolf-joe/ts-dns/zone"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 仅记录响应的ResponseWriter
+type mockWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *mockWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *mockWriter) WriteMsg(msg *dns.Msg) error { w.msg = msg; return nil }
+func (w *mockWriter) Close() error                { return nil }
+
+// 直接返回空应答的插件，用于替代上游查询
+func init() {
+	middleware.Register("test-empty", func(map[string]interface{}) (middleware.Middleware, error) {
+		return middleware.Func(func(ctx *middleware.Context, next middleware.Handler) {
+			ctx.Response = new(dns.Msg).SetReply(ctx.Request)
+		}), nil
+	})
+}
+
+func BenchmarkCacheHit(b *testing.B) {
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(request)
+	rr, _ := dns.NewRR("ip.cn. 600 IN A 1.2.3.4")
+	resp.Answer = append(resp.Answer, rr)
+	c.Cache.Set(request, resp)
+	writer, h := &mockWriter{}, &handler{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		request.Id = uint16(i)
+		h.ServeDNS(writer, request)
+		if writer.msg == nil || writer.msg.Id != request.Id || len(writer.msg.Answer) != 1 {
+			b.Fatal("unexpected response")
+		}
+	}
+}
+
+// 创建以groups分别作为clean、dirty组的配置，生成处理链后设为当前配置，仅指定一个组时两组相同。
+// 未设置规则的组不匹配任何域名，GFWList及CNIP均为空
+func newTestConfig(groups ...config.Group) *config.Config {
+	for i := range groups {
+		if groups[i].Matcher == nil {
+			groups[i].Matcher = matcher.NewABPByText("")
+		}
+	}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs:    ipset.NewRamSetByText(""),
+		GroupMap: map[string]config.Group{"clean": groups[0], "dirty": groups[len(groups)-1]}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	return c
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer func() { _ = os.RemoveAll(dir) }()
+	gfwlist, cnip := filepath.Join(dir, "gfwlist.txt"), filepath.Join(dir, "cnip.txt")
+	_ = ioutil.WriteFile(gfwlist, []byte(base64.StdEncoding.EncodeToString([]byte("||google.com\n"))), 0644)
+	_ = ioutil.WriteFile(cnip, []byte("1.0.1.0/24\n"), 0644)
+	text := fmt.Sprintf("gfwlist = %q\ncnip = %q\n", gfwlist, cnip) +
+		"[groups.clean]\ndns = [\"127.0.0.1:53\"]\n[groups.dirty]\ndns = [\"127.0.0.1:53\"]\nipset_tll = 60\n[cache]\nsize = 100\nmax_tl = 60\n"
+	defer func() { strictConfig = false }()
+	// 默认仅输出警告
+	strictConfig = false
+	_, err := newConfigByText(text)
+	assert.Equal(t, err, nil)
+	// 严格模式下视为配置无效，并指出配置项所在行
+	strictConfig = true
+	_, err = newConfigByText(text)
+	assert.NotEqual(t, err, nil)
+	assert.True(t, strings.Contains(err.Error(), "'groups.dirty.ipset_tll' (line 7)"))
+	assert.True(t, strings.Contains(err.Error(), "'cache.max_tl' (line 10)"))
+	// 类型错误
+	_, err = newConfigByText("[cache]\nsize = \"100\"\n")
+	assert.NotEqual(t, err, nil)
+	assert.True(t, strings.HasPrefix(err.Error(), "read config error"))
+}
+
+func TestDNSCookie(t *testing.T) {
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}},
+		Cache: cache.NewDNSCache(16, time.Minute, time.Hour), CookieSecret: edns.NewCookieSecret(),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader("1.2.3.4 ip.cn")}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	writer, request := &mockWriter{}, new(dns.Msg)
+	query := func(client, server string) *dns.Msg {
+		request.Extra = nil
+		request.SetQuestion("ip.cn.", dns.TypeA).SetEdns0(1232, false)
+		edns.SetCookie(request, client, server)
+		(&handler{}).ServeDNS(writer, request)
+		return writer.msg
+	}
+	// 仅携带客户端Cookie时正常响应并返回服务端Cookie
+	client := edns.NewClientCookie()
+	r := query(client, "")
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	_, server, ok := edns.GetCookie(r)
+	assert.True(t, ok)
+	assert.True(t, server != "")
+	assert.Equal(t, query(client, server).Rcode, dns.RcodeSuccess)
+	// 服务端Cookie无效时返回BADCOOKIE及新的服务端Cookie
+	expired := c.CookieSecret.ServerCookie(client, net.ParseIP("127.0.0.1"), time.Now().Add(-2*edns.CookieLifetime))
+	r = query(client, expired)
+	assert.Equal(t, r.Rcode, dns.RcodeBadCookie)
+	_, server, _ = edns.GetCookie(r)
+	assert.True(t, c.CookieSecret.Valid(client, server, net.ParseIP("127.0.0.1"), time.Now()))
+	_, err := r.Pack()
+	assert.Equal(t, err, nil)
+	// Cookie长度错误时返回FORMERR
+	assert.Equal(t, query(client[:4], "").Rcode, dns.RcodeFormatError)
+}
+
+// 返回固定rcode及记录的上游，delay用于控制并行查询时响应的先后
+type staticCaller struct {
+	rcode  int
+	answer string // 记录的文本格式，为空时返回无应答记录的响应
+	delay  time.Duration
+	calls  int32
+}
+
+func (caller *staticCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&caller.calls, 1)
+	time.Sleep(caller.delay)
+	r := new(dns.Msg).SetRcode(request, caller.rcode)
+	if caller.answer != "" {
+		rr, _ := dns.NewRR(caller.answer)
+		r.Answer = append(r.Answer, rr)
+	}
+	return r, nil
+}
+
+func TestBogusFallback(t *testing.T) {
+	cleanCaller := &staticCaller{answer: "ip.cn. 60 IN A 243.185.187.39"}
+	dirtyCaller := &staticCaller{answer: "ip.cn. 60 IN A 2.2.2.2"}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs: ipset.NewRamSetByText("243.0.0.0/8"), BogusIPs: ipset.NewRamSetByText("243.185.187.39"),
+		GroupMap: map[string]config.Group{
+			"clean": {Callers: []outbound.Caller{cleanCaller}, Matcher: matcher.NewABPByText("")},
+			"dirty": {Callers: []outbound.Caller{dirtyCaller}, Matcher: matcher.NewABPByText("")},
+		}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	writer, request := &mockWriter{}, new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// clean组的响应包含劫持地址时转由dirty组解析
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.A).A.String(), "2.2.2.2")
+	assert.Equal(t, atomic.LoadInt32(&dirtyCaller.calls), int32(1))
+	// clean组因故障无响应时不转由dirty组解析（地址为空的上游直接返回错误）
+	c.Cache = cache.NewDNSCache(16, time.Minute, time.Hour)
+	c.GroupMap["clean"] = config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{}},
+		Matcher: matcher.NewABPByText("")}
+	writer.msg = nil
+	(&handler{}).ServeDNS(writer, request)
+	assert.True(t, writer.msg == nil)
+	assert.Equal(t, atomic.LoadInt32(&dirtyCaller.calls), int32(1))
+	// 并行查询时同样区分劫持与故障
+	c.GroupMap["clean"] = config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{}, cleanCaller},
+		Matcher: matcher.NewABPByText(""), Parallel: true}
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.A).A.String(), "2.2.2.2")
+	assert.Equal(t, atomic.LoadInt32(&dirtyCaller.calls), int32(2))
+}
+
+func TestNoAAAA(t *testing.T) {
+	caller := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	group := config.Group{Callers: []outbound.Caller{caller}, NoAAAA: true}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeAAAA)
+	// AAAA查询直接返回空的NOERROR响应，不转发至上游
+	r := callDNS(c, group, request, nil)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, r.Id, request.Id)
+	assert.Equal(t, len(r.Answer), 0)
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(0))
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 移除HTTPS记录中的ipv6hint
+	https := &staticCaller{answer: "ip.cn. 60 IN HTTPS 1 . alpn=h2 ipv4hint=1.1.1.1 ipv6hint=2001:db8::1"}
+	group.Callers = []outbound.Caller{https}
+	request.SetQuestion("ip.cn.", dns.TypeHTTPS)
+	text := callDNS(c, group, request, nil).Answer[0].String()
+	assert.True(t, strings.Contains(text, `ipv4hint="1.1.1.1"`))
+	assert.False(t, strings.Contains(text, "ipv6hint"))
+	// 未开启时正常转发AAAA查询
+	group.NoAAAA = false
+	group.Callers = []outbound.Caller{caller}
+	request.SetQuestion("ip.cn.", dns.TypeAAAA)
+	callDNS(c, group, request, nil)
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(2))
+}
+
+func TestRefuseANY(t *testing.T) {
+	caller := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}
+	newTestConfig(config.Group{Callers: []outbound.Caller{caller}})
+	writer, request := &mockWriter{}, new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeANY)
+	(&handler{}).ServeDNS(writer, request)
+	// 按RFC 8482返回HINFO记录，不转发至上游
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, writer.msg.Id, request.Id)
+	assert.Equal(t, len(writer.msg.Answer), 1)
+	hinfo, ok := writer.msg.Answer[0].(*dns.HINFO)
+	assert.True(t, ok)
+	assert.Equal(t, hinfo.Cpu, "RFC8482")
+	assert.Equal(t, hinfo.Hdr.Name, "ip.cn.")
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(0))
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(1))
+}
+
+// 模拟TCP连接的ResponseWriter，记录连接是否被关闭
+type tcpWriter struct {
+	mockWriter
+	closed bool
+}
+
+func (w *tcpWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *tcpWriter) Close() error { w.closed = true; return nil }
+
+func TestResponsePadding(t *testing.T) {
+	newTestConfig(config.Group{Callers: []outbound.Caller{&staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}}})
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	request.SetEdns0(4096, false)
+	// 请求不含填充时不填充响应
+	writer := &tcpWriter{}
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, edns.FindOption(writer.msg, dns.EDNS0PADDING), nil)
+	// 经TCP（含DoT、DoH）请求且含填充时按468字节填充响应
+	_ = edns.Pad(request, edns.QueryPaddingBlock)
+	writer = &tcpWriter{}
+	(&handler{}).ServeDNS(writer, request)
+	assert.NotEqual(t, edns.FindOption(writer.msg, dns.EDNS0PADDING), nil)
+	assert.Equal(t, writer.msg.Len()%edns.ResponsePaddingBlock, 0)
+	// 经UDP请求时不填充
+	udpWriter := &mockWriter{}
+	(&handler{}).ServeDNS(udpWriter, request)
+	assert.Equal(t, edns.FindOption(udpWriter.msg, dns.EDNS0PADDING), nil)
+}
+
+func TestGroupClampTTL(t *testing.T) {
+	caller := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}
+	c := &config.Config{Cache: cache.NewDNSCache(16, 0, time.Hour)}
+	group := config.Group{Callers: []outbound.Caller{caller}, MinTTL: 600}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].Header().Ttl, uint32(600))
+	// 命中缓存时同样返回限制后的TTL
+	assert.Equal(t, c.Cache.Get(request).Answer[0].Header().Ttl, uint32(600))
+	group.MinTTL, group.MaxTTL = 0, 30
+	request.SetQuestion("www.ip.cn.", dns.TypeA)
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].Header().Ttl, uint32(30))
+}
+
+func TestGlobalBlockQtypes(t *testing.T) {
+	qtypes, err := parseQtypes([]string{"TYPE65", "null"})
+	assert.Equal(t, err, nil)
+	assert.True(t, qtypes[dns.TypeHTTPS] && qtypes[dns.TypeNULL])
+	_, err = parseQtypes([]string{"TYPE70000"})
+	assert.NotEqual(t, err, nil)
+	_, err = parseQtypes([]string{"FOO"})
+	assert.NotEqual(t, err, nil)
+	caller := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}
+	c := newTestConfig(config.Group{Callers: []outbound.Caller{caller}})
+	c.BlockedQtypes, c.BlockAction = qtypes, "refused"
+	// 被禁止的记录类型在本地应答，不转发至任何组
+	writer, request := &mockWriter{}, new(dns.Msg)
+	for _, qtype := range []uint16{dns.TypeHTTPS, dns.TypeNULL} {
+		request.SetQuestion("ip.cn.", qtype)
+		(&handler{}).ServeDNS(writer, request)
+		assert.Equal(t, writer.msg.Rcode, dns.RcodeRefused)
+	}
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(0))
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 组内禁止的记录类型，默认返回空响应
+	c.BlockedQtypes, c.BlockAction = nil, ""
+	group := config.Group{Callers: []outbound.Caller{caller}, BlockedQtypes: map[uint16]bool{dns.TypeTXT: true}}
+	request.SetQuestion("ip.cn.", dns.TypeTXT)
+	r := callDNS(c, group, request, nil)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	assert.Equal(t, len(r.Answer), 0)
+	assert.Equal(t, atomic.LoadInt32(&caller.calls), int32(1))
+}
+
+func TestDenyReply(t *testing.T) {
+	c := &config.Config{DenyTTL: 60}
+	request := new(dns.Msg)
+	request.SetQuestion("ads.example.com.", dns.TypeA)
+	r := denyReply(c, config.DenyZero, request)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "0.0.0.0")
+	assert.Equal(t, r.Answer[0].Header().Ttl, uint32(60))
+	request.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	r = denyReply(c, config.DenyZero, request)
+	assert.Equal(t, r.Answer[0].(*dns.AAAA).AAAA.String(), "::")
+	assert.Equal(t, r.Answer[0].Header().Ttl, uint32(60))
+	request.SetQuestion("ads.example.com.", dns.TypeTXT)
+	assert.Equal(t, len(denyReply(c, config.DenyZero, request).Answer), 0)
+	assert.Equal(t, denyReply(c, config.DenyNXDomain, request).Rcode, dns.RcodeNameError)
+	assert.Equal(t, denyReply(c, config.DenyRefused, request).Rcode, dns.RcodeRefused)
+	assert.True(t, denyReply(c, config.DenyDrop, request) == nil)
+}
+
+func TestTSIG(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tsig")
+	defer func() { _ = os.RemoveAll(dir) }()
+	filename := filepath.Join(dir, "home.lan.zone")
+	_ = ioutil.WriteFile(filename, []byte("@ 3600 IN SOA ns.home.lan. admin.home.lan. 1 7200 3600 1209600 300\n"+
+		"@ 3600 IN NS ns\nns 3600 IN A 192.168.1.1\n"), 0644)
+	z, _ := zone.NewZone("home.lan", filename)
+	c := &config.Config{Zones: []*zone.Zone{z}, GroupMap: map[string]config.Group{"clean": {}, "dirty": {}},
+		TsigSecrets: map[string]string{"home-key.": "c2VjcmV0"}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	conn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	srv := &dns.Server{Listener: conn, Handler: &handler{}, TsigProvider: tsigProvider{}}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+	addr := conn.Addr().String()
+	// 密钥名称不区分大小写
+	client := &dns.Client{Net: "tcp", TsigSecret: map[string]string{"Home-Key.": "c2VjcmV0"}}
+	request := new(dns.Msg)
+	request.SetQuestion("ns.home.lan.", dns.TypeA)
+	request.SetTsig("Home-Key.", dns.HmacSHA256, 300, time.Now().Unix())
+	r, _, err := client.Exchange(request, addr)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	assert.True(t, r.IsTsig() != nil)
+	// 使用TSIG签名的区域传送
+	transfer := &dns.Transfer{TsigSecret: client.TsigSecret}
+	request = new(dns.Msg)
+	request.SetAxfr("home.lan.")
+	request.SetTsig("Home-Key.", dns.HmacSHA256, 300, time.Now().Unix())
+	envelopes, err := transfer.In(request, addr)
+	assert.Equal(t, err, nil)
+	var records []dns.RR
+	for envelope := range envelopes {
+		assert.Equal(t, envelope.Error, nil)
+		records = append(records, envelope.RR...)
+	}
+	assert.Equal(t, len(records), 4)
+	// 未签名的区域传送被拒绝
+	request = new(dns.Msg)
+	request.SetAxfr("home.lan.")
+	r, _, _ = (&dns.Client{Net: "tcp"}).Exchange(request, addr)
+	assert.Equal(t, r.Rcode, dns.RcodeRefused)
+	// 重载配置后使用新的密钥
+	nc := *c
+	nc.TsigSecrets = map[string]string{"office-key.": "b3RoZXI="}
+	snapshot.Store(&nc)
+	client.TsigSecret = map[string]string{"office-key.": "b3RoZXI="}
+	request = new(dns.Msg)
+	request.SetQuestion("ns.home.lan.", dns.TypeA)
+	request.SetTsig("office-key.", dns.HmacSHA256, 300, time.Now().Unix())
+	r, _, err = client.Exchange(request, addr)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+}
+
+func TestAcceptPolicy(t *testing.T) {
+	group, err := newGroup(groupStruct{Rcodes: []string{"noerror", "NXDOMAIN"}, NoEmpty: true})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, group.AcceptRcodes, map[int]bool{dns.RcodeSuccess: true, dns.RcodeNameError: true})
+	assert.True(t, group.RejectEmpty)
+	group, err = newGroup(groupStruct{})
+	assert.Equal(t, err, nil)
+	assert.True(t, group.AcceptRcodes == nil)
+	_, err = newGroup(groupStruct{Rcodes: []string{"lying"}})
+	assert.NotEqual(t, err, nil)
+
+	lying := &staticCaller{rcode: dns.RcodeNameError}
+	empty := &staticCaller{}
+	good := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1"}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 未指定接受策略时使用首个响应
+	group = config.Group{Callers: []outbound.Caller{lying, good}}
+	assert.Equal(t, callDNS(c, group, request, nil).Rcode, dns.RcodeNameError)
+	// 不接受的rcode视为失败，尝试下一个服务器
+	group.AcceptRcodes = map[int]bool{dns.RcodeSuccess: true}
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 丢弃无应答记录的NOERROR响应
+	group = config.Group{Callers: []outbound.Caller{empty, good}, RejectEmpty: true}
+	assert.Equal(t, len(callDNS(c, group, request, nil).Answer), 1)
+	// NXDOMAIN不受reject_empty影响
+	group.Callers = []outbound.Caller{lying, good}
+	assert.Equal(t, callDNS(c, group, request, nil).Rcode, dns.RcodeNameError)
+	// 均不符合策略时无响应
+	group = config.Group{Callers: []outbound.Caller{lying, empty}, AcceptRcodes: map[int]bool{dns.RcodeSuccess: true},
+		RejectEmpty: true}
+	assert.True(t, callDNS(c, group, request, nil) == nil)
+}
+
+func TestParallel(t *testing.T) {
+	bogus := &staticCaller{answer: "ip.cn. 60 IN A 243.185.187.39"}
+	lying := &staticCaller{rcode: dns.RcodeNameError}
+	good := &staticCaller{answer: "ip.cn. 60 IN A 1.1.1.1", delay: 20 * time.Millisecond}
+	late := &staticCaller{answer: "ip.cn. 60 IN A 2.2.2.2", delay: 200 * time.Millisecond}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour),
+		BogusIPs: ipset.NewRamSetByText("243.185.187.39")}
+	group := config.Group{Callers: []outbound.Caller{bogus, lying, good, late}, Parallel: true,
+		AcceptRcodes: map[int]bool{dns.RcodeSuccess: true}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 先到达的劫持地址及不接受的rcode被丢弃，返回首个通过校验的响应
+	start := time.Now()
+	r := callDNS(c, group, request, nil)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	// 均未通过校验时无响应
+	group.Callers = []outbound.Caller{bogus, lying}
+	assert.True(t, callDNS(c, group, request, nil) == nil)
+}
+
+func TestLowMemory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "memory")
+	defer func() { _ = os.RemoveAll(dir) }()
+	gfwlist, cnip := filepath.Join(dir, "gfwlist.txt"), filepath.Join(dir, "cnip.txt")
+	_ = ioutil.WriteFile(gfwlist, []byte(base64.StdEncoding.EncodeToString([]byte("||google.com\n"))), 0644)
+	_ = ioutil.WriteFile(cnip, []byte("1.0.1.0/24\n"), 0644)
+	text := fmt.Sprintf("gfwlist = %q\ncnip = %q\n", gfwlist, cnip) +
+		"[groups.clean]\ndns = [\"127.0.0.1:53\"]\n[groups.dirty]\ndns = [\"127.0.0.1:53\"]\n"
+	// 缓存中最多保留的记录数
+	cached := func(c *config.Config) (n int) {
+		request, r := new(dns.Msg), new(dns.Msg)
+		for i := 0; i < 1000; i++ {
+			request.SetQuestion(fmt.Sprintf("host%d.ip.cn.", i), dns.TypeA)
+			rr, _ := dns.NewRR(request.Question[0].Name + " 600 IN A 1.1.1.1")
+			r.SetReply(request)
+			r.Answer = []dns.RR{rr}
+			c.Cache.Set(request, r)
+		}
+		for i := 0; i < 1000; i++ {
+			if request.SetQuestion(fmt.Sprintf("host%d.ip.cn.", i), dns.TypeA); c.Cache.Get(request) != nil {
+				n++
+			}
+		}
+		return n
+	}
+	c, err := newConfigByText(text)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cached(c), 1000)
+	assert.Equal(t, c.GCPercent, 0)
+	// 低内存模式下减小默认缓存大小，默认gogc为50
+	c, err = newConfigByText("low_memory = true\nmemory_limit = 64\n" + text)
+	assert.Equal(t, err, nil)
+	assert.True(t, cached(c) <= 512)
+	assert.Equal(t, c.GCPercent, 50)
+	assert.Equal(t, c.MemoryLimit, int64(64<<20))
+	applyMemoryConfig(c)
+	assert.Equal(t, debug.SetGCPercent(100), 50)
+	assert.Equal(t, debug.SetMemoryLimit(math.MaxInt64), int64(64<<20))
+	// 显式指定的缓存大小及gogc优先
+	c, err = newConfigByText("low_memory = true\ngogc = 80\n" + text + "[cache]\nsize = 2000\n")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, cached(c), 1000)
+	assert.Equal(t, c.GCPercent, 80)
+	applyMemoryConfig(&config.Config{})
+	assert.Equal(t, debug.SetGCPercent(100), 100)
+}
+
+func TestChainAddrs(t *testing.T) {
+	r := new(dns.Msg)
+	assert.Equal(t, len(chainAddrs(r, false)), 0)
+	r.SetQuestion("WWW.ip.cn.", dns.TypeA)
+	for _, text := range []string{"cdn.ip.cn. 60 IN A 1.2.3.4", "cdn.ip.cn. 60 IN AAAA ::1",
+		"www.ip.cn. 60 IN CNAME edge.ip.cn.", "edge.ip.cn. 60 IN CNAME cdn.ip.cn.", "other.cn. 60 IN A 5.6.7.8"} {
+		rr, _ := dns.NewRR(text)
+		r.Answer = append(r.Answer, rr)
+	}
+	// CNAME记录乱序时同样沿链查找，忽略与查询域名无关的记录
+	assert.Equal(t, chainAddrs(r, false), []string{"1.2.3.4"})
+	assert.Equal(t, chainAddrs(r, true), []string{"::1"})
+	assert.Equal(t, addIPSet(config.Group{}, r), nil)
+}
+
+func TestChaseCNAME(t *testing.T) {
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader("1.2.3.4 cdn.ip.cn")}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(request)
+	rr, _ := dns.NewRR("ip.cn. 600 IN CNAME cdn.ip.cn.")
+	r.Answer = append(r.Answer, rr)
+	assert.Equal(t, cnameTarget(r, "ip.cn.", dns.TypeA), "cdn.ip.cn.")
+	// 通过hosts解析CNAME目标并合并应答
+	resolve := middleware.Chain(func(*middleware.Context) {}, hostsStage(c))
+	full := chaseCNAME(c, request, r, nil, nil, resolve, 0)
+	assert.Equal(t, len(full.Answer), 2)
+	assert.Equal(t, full.Answer[1].(*dns.A).A.String(), "1.2.3.4")
+	assert.Equal(t, len(r.Answer), 1) // 不修改原响应
+	// 完整的应答写入缓存
+	cached := c.Cache.Get(request)
+	assert.True(t, cached != nil && len(cached.Answer) == 2)
+	// 已包含最终记录、CNAME环路时不再查询
+	assert.Equal(t, cnameTarget(full, "ip.cn.", dns.TypeA), "")
+	loop, _ := dns.NewRR("cdn.ip.cn. 600 IN CNAME ip.cn.")
+	r.Answer = append(r.Answer, loop)
+	assert.Equal(t, cnameTarget(r, "ip.cn.", dns.TypeA), "")
+}
+
+func TestHealthCheck(t *testing.T) {
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	assert.Equal(t, healthCheck(time.Second), nil)
+}
+
+func TestBlockQtypes(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	c := &config.Config{BlockAction: config.DenyNXDomain}
+	qtypes, _ := parseQtypes([]string{"aaaa", "TXT"})
+	group := config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{Address: addr}}, BlockedQtypes: qtypes}
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeAAAA)
+	assert.Equal(t, callDNS(c, group, request, nil).Rcode, dns.RcodeNameError) // 使用全局的block_action
+	// 该组单独指定处理方式
+	group.BlockAction = config.DenyEmpty
+	for _, qtype := range []uint16{dns.TypeAAAA, dns.TypeTXT} {
+		request.SetQuestion("example.com.", qtype)
+		r := callDNS(c, group, request, nil)
+		assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+		assert.Equal(t, len(r.Answer), 0)
+	}
+	request.SetQuestion("example.com.", dns.TypeA)
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+}
+
+func TestFakeIP(t *testing.T) {
+	pool, _ := fakeip.NewPool("198.18.0.0/15", time.Hour, "")
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), FakeIP: pool, FakeIPTTL: 1}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	group := config.Group{FakeIP: true}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	r := callDNS(c, group, request, nil)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "198.18.0.1")
+	assert.True(t, c.Cache.Get(request) != nil)
+	request.SetQuestion("ip.cn.", dns.TypeAAAA)
+	assert.Equal(t, len(callDNS(c, group, request, nil).Answer), 0)
+	request.SetQuestion("ip.cn.", dns.TypeHTTPS)
+	assert.Equal(t, len(callDNS(c, group, request, nil).Answer), 0)
+	// 虚假ip的反向查询返回对应域名
+	writer := &mockWriter{}
+	request.SetQuestion("1.0.18.198.in-addr.arpa.", dns.TypePTR)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.PTR).Ptr, "ip.cn.")
+	request.SetQuestion("2.0.18.198.in-addr.arpa.", dns.TypePTR)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeNameError)
+	// hosts中的地址（含公网地址）在本地应答反向查询
+	c.HostsReaders = []hosts.Reader{hosts.NewTextReader("1.2.3.4 example.com\n0.0.0.0 ads.com")}
+	request.SetQuestion("4.3.2.1.in-addr.arpa.", dns.TypePTR)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].(*dns.PTR).Ptr, "example.com.")
+	request.SetQuestion("1.0.168.192.in-addr.arpa.", dns.TypePTR)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeNameError)
+	assert.Equal(t, hostsHostname(c, net.IPv4zero), "")
+}
+
+func TestUpdateKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "update")
+	defer func() { _ = os.RemoveAll(dir) }()
+	filename := filepath.Join(dir, "home.lan.zone")
+	_ = ioutil.WriteFile(filename, []byte("@ 3600 IN SOA ns.home.lan. admin.home.lan. 1 7200 3600 1209600 300\n"+
+		"@ 3600 IN NS ns\nns 3600 IN A 192.168.1.1\n"), 0644)
+	z, err := zone.NewZone("home.lan", filename)
+	assert.Equal(t, err, nil)
+	c := &config.Config{Zones: []*zone.Zone{z}, UpdatePolicy: config.UpdateTSIG,
+		UpdateKeys: map[string]map[string]bool{"home.lan.": {"home-key.": true}}}
+	request := new(dns.Msg)
+	request.SetUpdate("home.lan.")
+	rr, _ := dns.NewRR("pc.home.lan. 300 IN A 192.168.1.10")
+	request.Insert([]dns.RR{rr})
+	// 区域绑定了密钥时仅接受这些密钥签名的更新
+	assert.Equal(t, updateReply(c, request, "").Rcode, dns.RcodeRefused)
+	assert.Equal(t, updateReply(c, request, "office-key.").Rcode, dns.RcodeRefused)
+	assert.Equal(t, updateReply(c, request, "Home-Key.").Rcode, dns.RcodeSuccess)
+	// 未绑定密钥的区域接受任一有效密钥
+	c.UpdateKeys = nil
+	assert.Equal(t, updateReply(c, request, "office-key.").Rcode, dns.RcodeSuccess)
+}
+
+// 拦截指定域名的插件，返回REFUSED
+func init() {
+	middleware.Register("test-block", func(params map[string]interface{}) (middleware.Middleware, error) {
+		name, _ := params["name"].(string)
+		return middleware.Func(func(ctx *middleware.Context, next middleware.Handler) {
+			if ctx.Request.Question[0].Name == name {
+				ctx.Response = new(dns.Msg).SetRcode(ctx.Request, dns.RcodeRefused)
+				return
+			}
+			next(ctx)
+		}), nil
+	})
+}
+
+func TestPipelinePlugin(t *testing.T) {
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	_, err := buildPipeline(c, []pluginStruct{{Name: "test-block", Before: "unknown"}})
+	assert.NotEqual(t, err, nil)
+	_, err = buildPipeline(c, []pluginStruct{{Name: "unknown"}})
+	assert.NotEqual(t, err, nil)
+	// 插件插入到cache之前，缓存命中的域名同样被拦截
+	params := map[string]interface{}{"name": "ip.cn."}
+	pipeline, err := buildPipeline(c, []pluginStruct{{Name: "test-block", Before: "cache", Params: params}})
+	assert.Equal(t, err, nil)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	c.Cache.Set(request, new(dns.Msg).SetReply(request))
+	ctx := &middleware.Context{Request: request}
+	pipeline(ctx)
+	assert.Equal(t, ctx.Response.Rcode, dns.RcodeRefused)
+}
+
+// 对所有查询返回NXDOMAIN的插件，用于替代上游查询
+func init() {
+	middleware.Register("test-nxdomain", func(map[string]interface{}) (middleware.Middleware, error) {
+		return middleware.Func(func(ctx *middleware.Context, next middleware.Handler) {
+			ctx.Response = new(dns.Msg).SetRcode(ctx.Request, dns.RcodeNameError)
+		}), nil
+	})
+}
+
+// 将域名改写为对CNAME目标的查询，返回前在应答中加入CNAME记录
+func init() {
+	middleware.Register("test-redirect", func(params map[string]interface{}) (middleware.Middleware, error) {
+		from, _ := params["from"].(string)
+		to, _ := params["to"].(string)
+		return middleware.Func(func(ctx *middleware.Context, next middleware.Handler) {
+			if ctx.Request.Question[0].Name != from {
+				next(ctx)
+				return
+			}
+			ctx.Request.Question[0].Name = to
+			next(ctx)
+			ctx.Request.Question[0].Name = from
+			if r := ctx.Response; r != nil {
+				cname := &dns.CNAME{Hdr: dns.RR_Header{Name: from, Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+					Target: to}
+				r.Answer = append([]dns.RR{cname}, r.Answer...)
+			}
+		}), nil
+	})
+}
+
+func TestRedirectPlugin(t *testing.T) {
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader("10.0.0.1 b.com")}}
+	params := map[string]interface{}{"from": "a.com.", "to": "b.com."}
+	pipeline, err := buildPipeline(c, []pluginStruct{{Name: "test-redirect", Before: "cache", Params: params}})
+	assert.Equal(t, err, nil)
+	request := new(dns.Msg)
+	request.SetQuestion("a.com.", dns.TypeA)
+	ctx := &middleware.Context{Request: request}
+	pipeline(ctx)
+	assert.Equal(t, request.Question[0].Name, "a.com.")
+	assert.Equal(t, len(ctx.Response.Answer), 2)
+	assert.Equal(t, ctx.Response.Answer[0].(*dns.CNAME).Target, "b.com.")
+	assert.Equal(t, ctx.Response.Answer[1].(*dns.A).A.String(), "10.0.0.1")
+}
+
+func TestSearchStage(t *testing.T) {
+	text := "10.0.0.5 web.default.svc.cluster.local\n10.0.0.6 db.lan\n10.0.0.7 a.b.c"
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader(text)},
+		Search:       []string{"default.svc.cluster.local.", "lan."}, Ndots: 2}
+	pipeline, _ := buildPipeline(c, []pluginStruct{{Name: "test-nxdomain"}})
+	query := func(name string) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		ctx := &middleware.Context{Request: request}
+		pipeline(ctx)
+		assert.Equal(t, request.Question[0].Name, name)
+		return ctx.Response
+	}
+	// 短名称按搜索域扩展
+	r := query("web.")
+	assert.Equal(t, len(r.Answer), 2)
+	assert.Equal(t, r.Answer[0].(*dns.CNAME).Target, "web.default.svc.cluster.local.")
+	assert.Equal(t, r.Answer[1].(*dns.A).A.String(), "10.0.0.5")
+	assert.Equal(t, query("db.").Answer[1].(*dns.A).A.String(), "10.0.0.6")
+	// 点号不少于ndots的名称直接查询
+	r = query("a.b.c.")
+	assert.Equal(t, len(r.Answer), 1)
+	assert.Equal(t, query("x.y.z.").Rcode, dns.RcodeNameError)
+	assert.Equal(t, query("unknown.").Rcode, dns.RcodeNameError)
+}
+
+func TestAssignedGroup(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	caller := &switchCaller{Caller: &outbound.UDPCaller{Address: addr}}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour),
+		GroupMap: map[string]config.Group{"clean": {}, "dirty": {Callers: []outbound.Caller{caller}}}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	query := func(name string) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		ctx := &middleware.Context{Request: request, Group: "dirty"}
+		c.Pipeline(ctx)
+		return ctx.Response
+	}
+	// 指定组的查询写入该组的缓存分区
+	assert.Equal(t, query("ip.cn.").Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.Equal(t, query("ip.cn.").Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.Equal(t, caller.count(), 1)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.True(t, c.Cache.Get(request) == nil)
+	// 特殊用途域名不转发至指定的组
+	assert.Equal(t, query("secret.onion.").Rcode, dns.RcodeNameError)
+	assert.Equal(t, caller.count(), 1)
+}
+
+func TestDeviceProfile(t *testing.T) {
+	adult, _ := blocklist.New("adult", func() ([]byte, error) { return []byte("||adult.com^"), nil }, 0)
+	ads, _ := blocklist.New("ads", func() ([]byte, error) { return []byte("ads.com"), nil }, 0)
+	safe := true
+	c := &config.Config{Blocklists: []*blocklist.Blocklist{adult, ads}, BlockAction: "nxdomain"}
+	pipeline, _ := buildPipeline(c, []pluginStruct{{Name: "test-empty"}})
+	var ctx *middleware.Context
+	query := func(name string, profile *device.Profile) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		ctx = &middleware.Context{Request: request, ClientIP: net.ParseIP("192.168.1.10")}
+		if profile != nil {
+			ctx.Set(deviceKey, profile)
+		}
+		pipeline(ctx)
+		return ctx.Response
+	}
+	// 未指定blocklists时所有列表生效
+	assert.Equal(t, query("adult.com.", &device.Profile{}).Rcode, dns.RcodeNameError)
+	assert.Equal(t, query("ads.com.", nil).Rcode, dns.RcodeNameError)
+	list, _ := ctx.Get(blockedKey) // 记录命中的屏蔽列表，用于查询事件
+	assert.Equal(t, list, "ads")
+	// 仅设备指定的列表生效
+	kid := &device.Profile{Blocklists: []string{"adult"}, SafeSearch: &safe}
+	assert.Equal(t, query("adult.com.", kid).Rcode, dns.RcodeNameError)
+	assert.Equal(t, query("ads.com.", kid).Rcode, dns.RcodeSuccess)
+	// 设备配置强制安全搜索
+	r := query("www.google.com.", kid)
+	assert.Equal(t, r.Answer[0].(*dns.CNAME).Target, "forcesafesearch.google.com.")
+	assert.Equal(t, len(query("www.google.com.", nil).Answer), 0)
+}
+
+func TestWellFormed(t *testing.T) {
+	request := new(dns.Msg)
+	assert.False(t, wellFormed(request))
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.True(t, wellFormed(request))
+	request.SetEdns0(4096, false)
+	assert.True(t, wellFormed(request))
+	// 多条OPT记录
+	request.Extra = append(request.Extra, request.Extra[0])
+	assert.False(t, wellFormed(request))
+	request.Extra = request.Extra[:1]
+	request.Extra[0].Header().Name = "ip.cn."
+	assert.False(t, wellFormed(request))
+	// OPT记录位于answer部分
+	request.Extra, request.Answer = nil, []dns.RR{&dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}}
+	assert.False(t, wellFormed(request))
+	request.Answer = nil
+	request.Question = append(request.Question, request.Question[0])
+	assert.False(t, wellFormed(request))
+
+	// 格式错误的请求返回FORMERR，响应报文不处理
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	writer := &mockWriter{}
+	(&handler{}).ServeDNS(writer, &dns.Msg{MsgHdr: dns.MsgHdr{Id: 1}})
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeFormatError)
+	assert.Equal(t, writer.msg.Id, uint16(1))
+	writer.msg = nil
+	(&handler{}).ServeDNS(writer, &dns.Msg{MsgHdr: dns.MsgHdr{Response: true}})
+	assert.True(t, writer.msg == nil)
+}
+
+func FuzzServeDNS(f *testing.F) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR, dns.TypeANY, dns.TypeSOA} {
+		request := new(dns.Msg)
+		request.SetQuestion("ip.cn.", qtype)
+		request.SetEdns0(4096, true)
+		raw, _ := request.Pack()
+		f.Add(raw)
+	}
+	request := new(dns.Msg)
+	request.SetQuestion("1.0.168.192.in-addr.arpa.", dns.TypePTR)
+	raw, _ := request.Pack()
+	f.Add(raw)
+	// 上游不可用的配置，覆盖上游查询失败时的处理路径
+	empty := config.Group{Matcher: matcher.NewABPByText("")}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), ResolveCNAME: true,
+		GroupMap: map[string]config.Group{"clean": empty, "dirty": empty}, GFWMatcher: matcher.NewABPByText(""),
+		CNIPs:        ipset.NewRamSetByText(""),
+		HostsReaders: []hosts.Reader{hosts.NewTextReader("10.0.0.5 nas.lan")}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		request := new(dns.Msg)
+		if request.Unpack(data) != nil {
+			return
+		}
+		(&handler{}).ServeDNS(&mockWriter{}, request)
+	})
+}
+
+func TestUnsupportedOpcode(t *testing.T) {
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	writer, request := &mockWriter{}, new(dns.Msg)
+	// 区域传送请求返回REFUSED
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		request.SetQuestion("ip.cn.", qtype)
+		(&handler{}).ServeDNS(writer, request)
+		assert.Equal(t, writer.msg.Rcode, dns.RcodeRefused)
+	}
+	// NOTIFY、STATUS返回NOTIMP
+	for _, opcode := range []int{dns.OpcodeNotify, dns.OpcodeStatus} {
+		request.SetQuestion("ip.cn.", dns.TypeSOA)
+		request.Opcode = opcode
+		(&handler{}).ServeDNS(writer, request)
+		assert.Equal(t, writer.msg.Rcode, dns.RcodeNotImplemented)
+		assert.Equal(t, writer.msg.Opcode, opcode)
+	}
+	// 未配置本地区域时动态更新返回NOTAUTH
+	request.SetUpdate("ip.cn.")
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeNotAuth)
+}
+
+func TestLocalDomains(t *testing.T) {
+	c := &config.Config{HostsReaders: []hosts.Reader{hosts.NewTextReader("192.168.1.2 nas\n192.168.1.3 tv.home.lan")},
+		LocalDomains: []string{"home.lan."}}
+	pipeline, _ := buildPipeline(c, []pluginStruct{{Name: "test-empty"}})
+	query := func(name string) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		ctx := &middleware.Context{Request: request}
+		pipeline(ctx)
+		return ctx.Response
+	}
+	// 单标签名称按本地域名扩展
+	r := query("tv.")
+	assert.Equal(t, r.Answer[0].(*dns.CNAME).Target, "tv.home.lan.")
+	assert.Equal(t, r.Answer[1].(*dns.A).A.String(), "192.168.1.3")
+	// "主机名.本地域名"匹配hosts中的主机名
+	r = query("nas.home.lan.")
+	assert.Equal(t, r.Answer[0].Header().Name, "nas.home.lan.")
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "192.168.1.2")
+	assert.Equal(t, len(query("nas.").Answer), 1)
+	assert.Equal(t, len(query("printer.").Answer), 0)
+	assert.Equal(t, len(query("nas.other.lan.").Answer), 0)
+}
+
+func TestHostsRecords(t *testing.T) {
+	text := "10.0.0.5 *.internal.lan\nCNAME www.lan nas.internal.lan\nCNAME cdn.lan edge.example.com\n" +
+		"TXT nas.internal.lan hello"
+	c := &config.Config{HostsReaders: []hosts.Reader{hosts.NewTextReader(text)}}
+	// 别名目标不在hosts中时查询目标
+	resolve := middleware.Chain(func(ctx *middleware.Context) {
+		ctx.Response = new(dns.Msg)
+		rr, _ := dns.NewRR(ctx.Request.Question[0].Name + " 60 IN A 1.1.1.1")
+		ctx.Response.Answer = append(ctx.Response.Answer, rr)
+	}, hostsStage(c))
+	query := func(name string, qtype uint16) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion(name, qtype)
+		ctx := &middleware.Context{Request: request}
+		resolve(ctx)
+		assert.Equal(t, request.Question[0].Name, name)
+		return ctx.Response
+	}
+	r := query("a.internal.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "10.0.0.5")
+	r = query("www.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].(*dns.CNAME).Target, "nas.internal.lan.")
+	assert.Equal(t, r.Answer[1].(*dns.A).A.String(), "10.0.0.5")
+	r = query("www.lan.", dns.TypeTXT)
+	assert.Equal(t, r.Answer[1].(*dns.TXT).Txt, []string{"hello"})
+	r = query("www.lan.", dns.TypeCNAME)
+	assert.Equal(t, len(r.Answer), 1)
+	r = query("cdn.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].(*dns.CNAME).Target, "edge.example.com.")
+	assert.Equal(t, r.Answer[1].Header().Name, "edge.example.com.")
+	assert.Equal(t, r.Answer[1].(*dns.A).A.String(), "1.1.1.1")
+	r = query("other.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// hosts生成的记录使用hosts_ttl，上游的记录不受影响
+	assert.Equal(t, query("www.lan.", dns.TypeA).Answer[1].Header().Ttl, uint32(0))
+	c.HostsTTL = 300
+	r = query("cdn.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].Header().Ttl, uint32(300))
+	assert.Equal(t, r.Answer[1].Header().Ttl, uint32(60))
+	r = query("www.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].Header().Ttl, uint32(300))
+	assert.Equal(t, r.Answer[1].Header().Ttl, uint32(300))
+	// hosts地址的反向查询同样使用hosts_ttl
+	request := new(dns.Msg)
+	request.SetQuestion("6.0.0.10.in-addr.arpa.", dns.TypePTR)
+	c.HostsReaders = append(c.HostsReaders, hosts.NewTextReader("10.0.0.6 nas.lan"))
+	ctx := &middleware.Context{Request: request}
+	middleware.Chain(func(ctx *middleware.Context) {}, localStage(c))(ctx)
+	assert.Equal(t, ctx.Response.Answer[0].(*dns.PTR).Ptr, "nas.lan.")
+	assert.Equal(t, ctx.Response.Answer[0].Header().Ttl, uint32(300))
+}
+
+func TestGroupLimiter(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	c := &config.Config{}
+	group := config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{Address: addr}},
+		Limiter: ratelimit.NewLimiter(1, 50*time.Millisecond)}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	assert.Equal(t, callDNS(c, group, request, nil).Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 达到上限且排队超时时无响应
+	assert.True(t, group.Limiter.Acquire())
+	assert.True(t, callDNS(c, group, request, nil) == nil)
+	// 排队期间释放名额
+	time.AfterFunc(10*time.Millisecond, group.Limiter.Release)
+	assert.True(t, callDNS(c, group, request, nil) != nil)
+}
+
+// 返回100条A记录的插件，用于生成超出UDP缓冲区的响应
+func init() {
+	middleware.Register("test-many", func(map[string]interface{}) (middleware.Middleware, error) {
+		return middleware.Func(func(ctx *middleware.Context, next middleware.Handler) {
+			ctx.Response = new(dns.Msg).SetReply(ctx.Request)
+			for i := 0; i < 100; i++ {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.0.%d", ctx.Request.Question[0].Name, i))
+				ctx.Response.Answer = append(ctx.Response.Answer, rr)
+			}
+		}), nil
+	})
+}
+
+func TestKeepalive(t *testing.T) {
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}}, TCPIdle: 30 * time.Second}
+	c.Pipeline, _ = buildPipeline(c, []pluginStruct{{Name: "test-empty"}})
+	snapshot.Store(c)
+	// 经TCP请求时声明空闲超时时间并保持连接
+	writer := &tcpWriter{}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	request.SetEdns0(4096, false)
+	edns.SetKeepalive(request, -1)
+	(&handler{}).ServeDNS(writer, request)
+	timeout, ok, _ := edns.GetKeepalive(writer.msg)
+	assert.True(t, ok)
+	assert.Equal(t, timeout, 30*time.Second)
+	assert.False(t, writer.closed)
+	// 请求中携带超时时间时返回FORMERR
+	writer = &tcpWriter{}
+	edns.SetKeepalive(request, time.Second)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeFormatError)
+	assert.True(t, writer.closed)
+	// 经UDP请求时忽略
+	udpWriter := &mockWriter{}
+	(&handler{}).ServeDNS(udpWriter, request)
+	assert.Equal(t, udpWriter.msg.Rcode, dns.RcodeSuccess)
+	_, ok, _ = edns.GetKeepalive(udpWriter.msg)
+	assert.False(t, ok)
+	// 未请求keepalive的TCP连接在响应后关闭
+	writer = &tcpWriter{}
+	edns.RemoveOption(request, dns.EDNS0TCPKEEPALIVE)
+	(&handler{}).ServeDNS(writer, request)
+	_, ok, _ = edns.GetKeepalive(writer.msg)
+	assert.False(t, ok)
+	assert.True(t, writer.closed)
+	assert.Equal(t, tcpIdleTimeout(&config.Config{}), 10*time.Second)
+}
+
+func TestPayloadSize(t *testing.T) {
+	c := &config.Config{GroupMap: map[string]config.Group{"clean": {}, "dirty": {}}, EDNSSize: 1232}
+	c.Pipeline, _ = buildPipeline(c, []pluginStruct{{Name: "test-many"}})
+	snapshot.Store(c)
+	writer, request := &mockWriter{}, new(dns.Msg)
+	// 无OPT记录的UDP请求按512字节截断，响应不含OPT记录
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	(&handler{}).ServeDNS(writer, request)
+	assert.True(t, writer.msg.Truncated)
+	assert.True(t, writer.msg.IsEdns0() == nil)
+	data, _ := writer.msg.Pack()
+	assert.True(t, len(data) <= dns.MinMsgSize)
+	// 按客户端声明的大小截断，但不超过edns_udp_size
+	request.SetQuestion("ip.cn.", dns.TypeA).SetEdns0(4096, false)
+	(&handler{}).ServeDNS(writer, request)
+	assert.True(t, writer.msg.Truncated)
+	assert.Equal(t, writer.msg.IsEdns0().UDPSize(), uint16(1232))
+	data, _ = writer.msg.Pack()
+	assert.True(t, len(data) > dns.MinMsgSize && len(data) <= 1232)
+	// 响应未超出客户端缓冲区时不截断
+	request.Extra = nil
+	request.SetQuestion("ip.cn.", dns.TypeA).SetEdns0(65535, false)
+	c.EDNSSize = 0
+	(&handler{}).ServeDNS(writer, request)
+	assert.False(t, writer.msg.Truncated)
+	assert.Equal(t, len(writer.msg.Answer), 100)
+	assert.Equal(t, writer.msg.IsEdns0().UDPSize(), uint16(dns.DefaultMsgSize))
+}
+
+// 可切换是否可用的上游服务器，可能在后台刷新缓存时被并发调用
+type switchCaller struct {
+	outbound.Caller
+	down  int32
+	calls int32
+}
+
+func (caller *switchCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt32(&caller.calls, 1)
+	if atomic.LoadInt32(&caller.down) == 1 {
+		return nil, fmt.Errorf("upstream down")
+	}
+	return caller.Caller.Call(request)
+}
+
+func (caller *switchCaller) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&caller.down, 1)
+	} else {
+		atomic.StoreInt32(&caller.down, 0)
+	}
+}
+
+func (caller *switchCaller) count() int {
+	return int(atomic.LoadInt32(&caller.calls))
+}
+
+func TestGroupFailover(t *testing.T) {
+	vpnAddr, stopVPN := startUpstream(t, "10.0.0.1")
+	defer stopVPN()
+	publicAddr, stopPublic := startUpstream(t, "1.1.1.1")
+	defer stopPublic()
+	vpn := &switchCaller{Caller: &outbound.UDPCaller{Address: vpnAddr}}
+	c := &config.Config{GroupMap: map[string]config.Group{
+		"office-vpn": {Callers: []outbound.Caller{vpn}, Failover: []string{"backup", "public"},
+			State: failover.New("office-vpn", 2, 50*time.Millisecond)},
+		"backup": {},
+		"public": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: publicAddr}}},
+	}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	query := func() string {
+		return callDNS(c, c.GroupMap["office-vpn"], request, nil).Answer[0].(*dns.A).A.String()
+	}
+	assert.Equal(t, query(), "10.0.0.1")
+	// 主组无有效响应时依次尝试备用组，连续失败达到阈值后不再查询主组
+	vpn.setDown(true)
+	assert.Equal(t, query(), "1.1.1.1")
+	assert.Equal(t, query(), "1.1.1.1")
+	assert.True(t, c.GroupMap["office-vpn"].State.Down())
+	calls := vpn.count()
+	assert.Equal(t, query(), "1.1.1.1")
+	assert.Equal(t, vpn.count(), calls)
+	// 探测成功后切换回主组
+	vpn.setDown(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, query(), "10.0.0.1")
+	assert.False(t, c.GroupMap["office-vpn"].State.Down())
+}
+
+// 直至被取消才返回的上游
+type slowCaller struct {
+	cancelled chan struct{}
+}
+
+func (caller *slowCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	return caller.CallContext(context.Background(), request)
+}
+
+func (caller *slowCaller) CallContext(ctx context.Context, _ *dns.Msg) (*dns.Msg, error) {
+	<-ctx.Done()
+	close(caller.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestParallelGroup(t *testing.T) {
+	pollutedAddr, stopPolluted := startUpstream(t, "10.0.0.1")
+	defer stopPolluted()
+	cleanAddr, stopClean := startUpstream(t, "1.1.1.1")
+	defer stopClean()
+	down := &switchCaller{Caller: &outbound.UDPCaller{Address: cleanAddr}, down: 1}
+	callers := []outbound.Caller{down, &outbound.UDPCaller{Address: pollutedAddr},
+		&outbound.UDPCaller{Address: cleanAddr}, &outbound.UDPCaller{Address: cleanAddr}}
+	c := &config.Config{GroupMap: map[string]config.Group{}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// first：返回首个有效响应
+	r := callDNS(c, config.Group{Callers: callers, Parallel: true}, request, nil)
+	assert.Equal(t, len(r.Answer), 1)
+	// 返回首个有效响应后取消其余查询
+	slow := &slowCaller{cancelled: make(chan struct{})}
+	r = callDNS(c, config.Group{Callers: []outbound.Caller{slow, callers[2]}, Parallel: true}, request, nil)
+	assert.Equal(t, len(r.Answer), 1)
+	select {
+	case <-slow.cancelled:
+	default:
+		t.Fatal("losing query not cancelled")
+	}
+	// compare：等待所有响应，使用多数服务器一致的响应
+	trace := middleware.NewTrace()
+	r = callDNS(c, config.Group{Callers: callers, Compare: true}, request, trace)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	assert.True(t, strings.Contains(fmt.Sprint(trace.Steps()), "2 different answers"))
+	// 无有效响应
+	r = callDNS(c, config.Group{Callers: callers[:1], Compare: true}, request, nil)
+	assert.True(t, r == nil)
+}
+
+func TestDNS64(t *testing.T) {
+	// 上游仅返回v6.example.com及ipv4only.arpa的AAAA记录
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+		r, name := new(dns.Msg).SetReply(request), request.Question[0].Name
+		var answer string
+		switch {
+		case request.Question[0].Qtype == dns.TypeA:
+			answer = name + " 60 IN A 1.2.3.4"
+		case name == dns64.DiscoveryName:
+			answer = name + " 60 IN AAAA 64:ff9b::c000:aa"
+		case name == "v6.example.com.":
+			answer = name + " 60 IN AAAA 2001:db8::1"
+		}
+		if answer != "" {
+			rr, _ := dns.NewRR(answer)
+			r.Answer = append(r.Answer, rr)
+		}
+		_ = w.WriteMsg(r)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour)}
+	group := config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{Address: conn.LocalAddr().String()}}}
+	group.DNS64, _ = dns64.New("auto")
+	query := func(name string) string {
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeAAAA)
+		r := callDNS(c, group, request, nil)
+		assert.Equal(t, len(r.Answer), 1)
+		return r.Answer[0].(*dns.AAAA).AAAA.String()
+	}
+	assert.Equal(t, query("example.com."), "64:ff9b::102:304")
+	assert.Equal(t, query("v6.example.com."), "2001:db8::1")
+}
+
+// 记录收到的请求是否携带环路标记的上游，视为公共上游
+type markCaller struct {
+	outbound.Caller
+	marked []bool
+}
+
+func (caller *markCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	caller.marked = append(caller.marked, edns.FindOption(request, loop.OptionCode) != nil)
+	return new(dns.Msg).SetReply(request), nil
+}
+
+func TestLoopProtection(t *testing.T) {
+	// 上游指向本服务器在本机的监听地址，模拟上游配置成环
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Equal(t, err, nil)
+	var calls int32
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, request *dns.Msg) {
+		atomic.AddInt32(&calls, 1)
+		(&handler{}).ServeDNS(w, request)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+	time.Sleep(50 * time.Millisecond)
+	group := config.Group{Callers: []outbound.Caller{&outbound.UDPCaller{Address: conn.LocalAddr().String()}},
+		Matcher: matcher.NewABPByText("")}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		GroupMap: map[string]config.Group{"clean": group, "dirty": group}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	// 转发回本服务器的请求被拒绝，不再继续转发
+	writer, request := &mockWriter{}, new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Rcode, dns.RcodeRefused)
+	assert.Equal(t, atomic.LoadInt32(&calls), int32(1))
+	// 处理完成后还原请求
+	assert.True(t, request.IsEdns0() == nil)
+	// 公共上游不接收环路标记，包括经其它实例转发而来的请求
+	caller := &markCaller{}
+	group = config.Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("")}
+	c = &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		GroupMap: map[string]config.Group{"clean": group, "dirty": group}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	(&handler{}).ServeDNS(&mockWriter{}, request)
+	request = new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+	edns.SetOption(request, &dns.EDNS0_LOCAL{Code: loop.OptionCode, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8, 2}})
+	(&handler{}).ServeDNS(&mockWriter{}, request)
+	assert.Equal(t, caller.marked, []bool{false, false})
+}
+
+func TestQueryLog(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	dir, _ := ioutil.TempDir("", "querylog")
+	defer func() { _ = os.RemoveAll(dir) }()
+	logger, _ := querylog.New(filepath.Join(dir, "query.log"), "json")
+	caller := &outbound.UDPCaller{Address: addr}
+	group := config.Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("ip.cn")}
+	c := &config.Config{Cache: cache.NewDNSCache(16, time.Minute, time.Hour), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs: ipset.NewRamSetByText(""), QueryLogger: logger,
+		GroupMap: map[string]config.Group{"clean": {Matcher: matcher.NewABPByText("")}, "dirty": group}}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	(&handler{}).ServeDNS(&mockWriter{}, request)
+	(&handler{}).ServeDNS(&mockWriter{}, request)     // 命中缓存
+	c.Pipeline(&middleware.Context{Request: request}) // 内部查询不记录
+	_ = logger.Close()
+	raw, _ := ioutil.ReadFile(filepath.Join(dir, "query.log"))
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	assert.Equal(t, len(lines), 2)
+	var entry querylog.Entry
+	assert.Equal(t, json.Unmarshal([]byte(lines[0]), &entry), nil)
+	assert.Equal(t, entry.Name, "ip.cn.")
+	assert.Equal(t, entry.Group, "dirty")
+	assert.Equal(t, entry.Reason, "match group 'dirty' (rules)")
+	assert.Equal(t, entry.Upstream, caller.String())
+	assert.Equal(t, entry.Rcode, "NOERROR")
+	assert.Equal(t, entry.Answers, 1)
+	entry = querylog.Entry{}
+	assert.Equal(t, json.Unmarshal([]byte(lines[1]), &entry), nil)
+	assert.Equal(t, entry.Upstream, "")
+	assert.True(t, strings.Contains(entry.Reason, "cache"))
+}
+
+func TestServeStale(t *testing.T) {
+	addr, stop := startUpstream(t, "1.1.1.1")
+	defer stop()
+	caller := &switchCaller{Caller: &outbound.UDPCaller{Address: addr}}
+	group := config.Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("ip.cn")}
+	c := &config.Config{Cache: cache.NewDNSCache(16, 0, time.Second), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs:    ipset.NewRamSetByText(""),
+		GroupMap: map[string]config.Group{"clean": {Matcher: matcher.NewABPByText("")}, "dirty": group}}
+	c.Cache.SetServeStale(time.Hour)
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	writer := &mockWriter{}
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, caller.count(), 1)
+	// 过期后返回缓存的响应，并在后台刷新
+	time.Sleep(1100 * time.Millisecond)
+	caller.setDown(true)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].Header().Ttl, uint32(30))
+	assert.Eventually(t, func() bool { return caller.count() == 2 }, time.Second, time.Millisecond)
+	// 上游不可用时继续返回过期的响应
+	(&handler{}).ServeDNS(writer, request)
+	assert.Equal(t, writer.msg.Answer[0].Header().Ttl, uint32(30))
+	assert.Eventually(t, func() bool { return caller.count() == 3 }, time.Second, time.Millisecond)
+	// 刷新成功后缓存恢复
+	caller.setDown(false)
+	(&handler{}).ServeDNS(writer, request)
+	assert.Eventually(t, func() bool {
+		_, status := c.Cache.Lookup(request)
+		return status == cache.Hit
+	}, time.Second, time.Millisecond)
+}
+
+// 模拟验证解析器，记录收到的请求并在响应中设置AD标志
+type validatingCaller struct {
+	request *dns.Msg
+}
+
+func (caller *validatingCaller) Call(request *dns.Msg) (*dns.Msg, error) {
+	caller.request = request
+	r := new(dns.Msg).SetReply(request)
+	rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A 1.1.1.1")
+	r.Answer, r.AuthenticatedData = append(r.Answer, rr), true
+	return r, nil
+}
+
+func TestTrustAD(t *testing.T) {
+	caller := &validatingCaller{}
+	c := &config.Config{GroupMap: map[string]config.Group{}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 请求上游验证，并返回其AD标志
+	r := callDNS(c, config.Group{Callers: []outbound.Caller{caller}, TrustAD: true}, request, nil)
+	assert.True(t, r.AuthenticatedData)
+	assert.True(t, caller.request.AuthenticatedData && caller.request.IsEdns0().Do())
+	assert.True(t, request.IsEdns0() == nil)
+	// 客户端设置CD标志时不请求验证
+	request.CheckingDisabled = true
+	callDNS(c, config.Group{Callers: []outbound.Caller{caller}, TrustAD: true}, request, nil)
+	assert.True(t, caller.request.IsEdns0() == nil)
+}
+
+// 来自公网地址的客户端
+type publicWriter struct {
+	mockWriter
+}
+
+func (w *publicWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("8.8.4.4"), Port: 53}
+}
+
+func TestECS(t *testing.T) {
+	caller := &validatingCaller{}
+	group := config.Group{Callers: []outbound.Caller{caller}, Matcher: matcher.NewABPByText("ip.cn"), AutoECS: true}
+	c := &config.Config{Cache: cache.NewDNSCache(16, 0, time.Minute), GFWMatcher: matcher.NewABPByText(""),
+		CNIPs:    ipset.NewRamSetByText(""),
+		GroupMap: map[string]config.Group{"clean": {Matcher: matcher.NewABPByText("")}, "dirty": group},
+		AutoECS:  true}
+	c.Pipeline, _ = buildPipeline(c, nil)
+	snapshot.Store(c)
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	// 由客户端地址派生ECS，不回显给客户端，缓存按派生的子网区分
+	writer := &publicWriter{}
+	(&handler{}).ServeDNS(writer, request)
+	subnet := edns.GetSubnet(caller.request)
+	assert.Equal(t, subnet.Address.String(), "8.8.4.0")
+	assert.Equal(t, subnet.SourceNetmask, uint8(24))
+	assert.True(t, edns.FindOption(caller.request, edns.DerivedSubnet) == nil)
+	assert.True(t, edns.GetSubnet(writer.msg) == nil)
+	assert.True(t, request.IsEdns0() == nil)
+	assert.True(t, c.Cache.Get(request) == nil)
+	// 内网客户端不派生
+	caller.request = nil
+	(&handler{}).ServeDNS(&mockWriter{}, request)
+	assert.True(t, edns.GetSubnet(caller.request) == nil)
+
+	// 固定子网覆盖客户端的ECS
+	group.AutoECS, group.ECS = false, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		Address: net.ParseIP("1.2.3.0").To4()}
+	edns.SetOption(request, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24,
+		Address: net.ParseIP("5.6.7.0").To4()})
+	callDNS(c, group, request, nil)
+	assert.Equal(t, edns.GetSubnet(caller.request).Address.String(), "1.2.3.0")
+	assert.Equal(t, edns.GetSubnet(request).Address.String(), "5.6.7.0")
+	// 派生的ECS不转发至未配置ecs的组，客户端携带的ECS照常转发
+	group.ECS = nil
+	edns.SetOption(request, &dns.EDNS0_LOCAL{Code: edns.DerivedSubnet})
+	callDNS(c, group, request, nil)
+	assert.True(t, edns.GetSubnet(caller.request) == nil)
+	edns.RemoveOption(request, edns.DerivedSubnet)
+	callDNS(c, group, request, nil)
+	assert.Equal(t, edns.GetSubnet(caller.request).Address.String(), "5.6.7.0")
+}
+
+func TestVerifyCNIP(t *testing.T) {
+	clean, stopClean := startUpstream(t, "1.1.1.1")
+	defer stopClean()
+	dirty, stopDirty := startUpstream(t, "2.2.2.2")
+	defer stopDirty()
+	dirtyCaller := &switchCaller{Caller: &outbound.UDPCaller{Address: dirty}}
+	c := &config.Config{GFWMatcher: matcher.NewABPByText(""), CNIPs: ipset.NewRamSetByText("114.0.0.0/8"),
+		GroupMap: map[string]config.Group{
+			"clean": {Callers: []outbound.Caller{&outbound.UDPCaller{Address: clean}}, Matcher: matcher.NewABPByText("")},
+			"dirty": {Callers: []outbound.Caller{dirtyCaller}, Matcher: matcher.NewABPByText("")},
+		}}
+	request := new(dns.Msg)
+	request.SetQuestion("ip.cn.", dns.TypeA)
+	ctx := &middleware.Context{Request: request}
+	// 未开启时不在gfwlist中的域名使用clean组的响应
+	r, name := route(c, ctx)
+	assert.Equal(t, name, "clean")
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 响应中无中国ip时转由dirty组解析
+	c.VerifyCNIP = true
+	r, name = route(c, ctx)
+	assert.Equal(t, name, "dirty")
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "2.2.2.2")
+	// dirty组无有效响应时使用clean组的响应
+	dirtyCaller.setDown(true)
+	r, name = route(c, ctx)
+	assert.Equal(t, name, "clean")
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "1.1.1.1")
+	// 响应中有中国ip时使用clean组
+	c.CNIPs = ipset.NewRamSetByText("1.1.1.1")
+	dirtyCaller.setDown(false)
+	atomic.StoreInt32(&dirtyCaller.calls, 0)
+	_, name = route(c, ctx)
+	assert.Equal(t, name, "clean")
+	assert.Equal(t, dirtyCaller.count(), 0)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/miekg/dns"
+	"hash"
+	"strings"
+)
+
+// 使用当前配置中的TSIG密钥签名及校验报文，密钥名称不区分大小写，重载配置后立即生效
+type tsigProvider struct{}
+
+func (tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	var secret string
+	if c := currentConfig(); c != nil {
+		secret = c.TsigSecrets[strings.ToLower(t.Hdr.Name)]
+	}
+	if secret == "" {
+		return nil, dns.ErrSecret
+	}
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	var h func() hash.Hash
+	switch dns.CanonicalName(t.Algorithm) {
+	case dns.HmacSHA1:
+		h = sha1.New
+	case dns.HmacSHA224:
+		h = sha256.New224
+	case dns.HmacSHA256:
+		h = sha256.New
+	case dns.HmacSHA384:
+		h = sha512.New384
+	case dns.HmacSHA512:
+		h = sha512.New
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	mac := hmac.New(h, raw)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (p tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	sum, err := p.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sum, mac) {
+		return dns.ErrSig
+	}
+	return nil
+}
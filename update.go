@@ -0,0 +1,317 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coreos/go-semver/semver"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// GitHub release信息
+type release struct {
+	TagName string         `json:"tag_name"`
+	Assets  []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// 下载url的内容
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download %s error: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// 判断是否为校验和文件或签名文件
+func isChecksumAsset(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.Contains(lower, "sha256") || strings.Contains(lower, "checksum") ||
+		strings.HasSuffix(lower, ".sig") || strings.HasSuffix(lower, ".asc")
+}
+
+// 目标平台在发行包名称中可能使用的架构名，按优先级排列。goreleaser默认将amd64替换为x86_64、
+// 386替换为i386，arm按GOARM命名为armv6、armv7等，系统名的大小写差异在匹配时忽略
+func archNames(goarch, goarm string) []string {
+	switch goarch {
+	case "amd64":
+		return []string{"amd64", "x86_64"}
+	case "386":
+		return []string{"386", "i386"}
+	case "arm":
+		names := []string{"armv" + goarm, "arm"}
+		for v := goarm; v > "5"; { // 低版本的arm程序可在高版本上运行
+			v = string(v[0] - 1)
+			names = append(names, "armv"+v)
+		}
+		return names
+	}
+	return []string{goarch}
+}
+
+// 查找与目标平台匹配的发行包，名称中需包含"系统_架构"或"系统-架构"，如linux_mipsle、Linux_x86_64
+func matchAsset(assets []releaseAsset, goos, goarch, goarm string) *releaseAsset {
+	for _, arch := range archNames(goarch, goarm) {
+		for i, asset := range assets {
+			if isChecksumAsset(asset.Name) {
+				continue
+			}
+			name := strings.ToLower(asset.Name)
+			for _, token := range []string{goos + "_" + arch, goos + "-" + arch} {
+				pos := strings.Index(name, token)
+				if pos == -1 {
+					continue
+				}
+				// 避免linux_arm匹配linux_arm64、linux_armv7
+				if end := pos + len(token); end == len(name) || !isAlnum(name[end]) {
+					return &assets[i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 当前程序编译时的GOARM，未记录时使用默认值7
+func buildGOARM() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "GOARM" && setting.Value != "" {
+				return setting.Value[:1]
+			}
+		}
+	}
+	return "7"
+}
+
+// 判断latest是否比current新，版本号无法按语义化版本解析时（如开发版本）仅比较是否相同
+func newerVersion(latest, current string) bool {
+	latest, current = strings.TrimPrefix(latest, "v"), strings.TrimPrefix(current, "v")
+	l, err1 := semver.NewVersion(latest)
+	c, err2 := semver.NewVersion(current)
+	if err1 != nil || err2 != nil {
+		return latest != current
+	}
+	return c.LessThan(*l)
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// 从sha256sum格式的校验和文件中查找文件的校验和
+func findChecksum(text, filename string) string {
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == filename {
+			return strings.ToLower(fields[0])
+		}
+	}
+	return ""
+}
+
+// 从发行包中提取可执行文件，支持zip、tar.gz及未打包的可执行文件
+func extractBinary(name string, data []byte) ([]byte, error) {
+	isBinary := func(path string) bool {
+		base := filepath.Base(path)
+		return base == "ts-dns" || base == "ts-dns.exe"
+	}
+	switch lower := strings.ToLower(name); {
+	case strings.HasSuffix(lower, ".zip"):
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range reader.File {
+			if isBinary(file.Name) {
+				rc, err := file.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer func() { _ = rc.Close() }()
+				return ioutil.ReadAll(rc)
+			}
+		}
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reader := tar.NewReader(gz)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if header.Typeflag == tar.TypeReg && isBinary(header.Name) {
+				return ioutil.ReadAll(reader)
+			}
+		}
+	default:
+		return data, nil
+	}
+	return nil, errors.New("executable not found in " + name)
+}
+
+// 替换当前可执行文件：先写入同目录的临时文件，再通过重命名替换
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	tmp := exe + ".new"
+	if err = ioutil.WriteFile(tmp, binary, 0755); err != nil {
+		return err
+	}
+	// windows下无法覆盖运行中的可执行文件，但可以将其重命名
+	old := exe + ".old"
+	_ = os.Remove(old)
+	if err = os.Rename(exe, old); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, exe); err != nil {
+		_ = os.Rename(old, exe)
+		return err
+	}
+	_ = os.Remove(old)
+	return nil
+}
+
+// update子命令：检查GitHub上的最新版本，下载对应平台的发行包，校验后替换当前可执行文件
+func runUpdate(args []string) {
+	fs := flag.NewFlagSet("update", flag.ExitOnError)
+	repo := fs.String("repo", "wolf-joe/ts-dns", "github repository to check for releases")
+	check := fs.Bool("check", false, "only check for a new version")
+	force := fs.Bool("force", false, "update even if already on the latest version")
+	pubKey := fs.String("pubkey", "", "base64 ed25519 public key; if set, the checksum file must have a valid .sig "+
+		"(without it the checksum only detects corrupted downloads, not tampered releases)")
+	restart := fs.String("restart", "", "command to run after updating, e.g. \"systemctl restart ts-dns\"")
+	_ = fs.Parse(args)
+	fail := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+		os.Exit(1)
+	}
+
+	raw, err := download("https://api.github.com/repos/" + *repo + "/releases/latest")
+	if err != nil {
+		fail("check release error: %v", err)
+	}
+	var latest release
+	if err = json.Unmarshal(raw, &latest); err != nil {
+		fail("parse release error: %v", err)
+	}
+	fmt.Printf("current version: %s, latest version: %s\n", VERSION, latest.TagName)
+	if !newerVersion(latest.TagName, VERSION) && !*force {
+		fmt.Println("already up to date")
+		return
+	}
+	asset := matchAsset(latest.Assets, runtime.GOOS, runtime.GOARCH, buildGOARM())
+	if asset == nil {
+		fail("no release asset for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	if *check {
+		fmt.Printf("new version available: %s\n", asset.URL)
+		return
+	}
+	// 下载校验和文件及签名
+	var sums *releaseAsset
+	for i := range latest.Assets {
+		if name := latest.Assets[i].Name; isChecksumAsset(name) && !strings.HasSuffix(name, ".sig") &&
+			!strings.HasSuffix(name, ".asc") {
+			sums = &latest.Assets[i]
+			break
+		}
+	}
+	if sums == nil {
+		fail("checksum file not found in release %s", latest.TagName)
+	}
+	sumText, err := download(sums.URL)
+	if err != nil {
+		fail("%v", err)
+	}
+	if *pubKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*pubKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			fail("invalid public key")
+		}
+		sig, err := download(sums.URL + ".sig")
+		if err != nil {
+			fail("%v", err)
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+			sig = decoded // 签名可为base64编码
+		}
+		if !ed25519.Verify(key, sumText, sig) {
+			fail("signature verification failed for %s", sums.Name)
+		}
+	} else {
+		// 校验和文件与发行包来自同一来源，未验证签名时无法发现被篡改的发行包
+		fmt.Fprintln(os.Stderr, "warning: no -pubkey given, the checksum only detects corrupted downloads")
+	}
+	expect := findChecksum(string(sumText), asset.Name)
+	if expect == "" {
+		fail("checksum of %s not found", asset.Name)
+	}
+	// 下载并校验发行包
+	fmt.Printf("downloading %s\n", asset.URL)
+	data, err := download(asset.URL)
+	if err != nil {
+		fail("%v", err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != expect {
+		fail("checksum mismatch for %s", asset.Name)
+	}
+	binary, err := extractBinary(asset.Name, data)
+	if err != nil {
+		fail("extract error: %v", err)
+	}
+	if err = replaceExecutable(binary); err != nil {
+		fail("replace executable error: %v", err)
+	}
+	fmt.Printf("updated to %s\n", latest.TagName)
+	if *restart != "" {
+		fields := strings.Fields(*restart)
+		cmd := exec.Command(fields[0], fields[1:]...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err = cmd.Run(); err != nil {
+			fail("restart error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMatchAsset(t *testing.T) {
+	assets := []releaseAsset{
+		{Name: "sha256sums.txt"},
+		{Name: "ts-dns_1.0_linux_arm64.tar.gz"},
+		{Name: "ts-dns_1.0_linux_arm.tar.gz"},
+		{Name: "ts-dns_1.0_windows-amd64.zip"},
+	}
+	assert.Equal(t, matchAsset(assets, "linux", "arm", "7").Name, "ts-dns_1.0_linux_arm.tar.gz")
+	assert.Equal(t, matchAsset(assets, "linux", "arm64", "7").Name, "ts-dns_1.0_linux_arm64.tar.gz")
+	assert.Equal(t, matchAsset(assets, "windows", "amd64", "7").Name, "ts-dns_1.0_windows-amd64.zip")
+	assert.True(t, matchAsset(assets, "darwin", "amd64", "7") == nil)
+	// goreleaser默认的名称替换
+	assets = []releaseAsset{
+		{Name: "ts-dns_1.0_Linux_armv6.tar.gz"},
+		{Name: "ts-dns_1.0_Linux_armv7.tar.gz"},
+		{Name: "ts-dns_1.0_Linux_x86_64.tar.gz"},
+		{Name: "ts-dns_1.0_Windows_i386.zip"},
+		{Name: "ts-dns_1.0_Darwin_arm64.tar.gz"},
+	}
+	assert.Equal(t, matchAsset(assets, "linux", "amd64", "7").Name, "ts-dns_1.0_Linux_x86_64.tar.gz")
+	assert.Equal(t, matchAsset(assets, "windows", "386", "7").Name, "ts-dns_1.0_Windows_i386.zip")
+	assert.Equal(t, matchAsset(assets, "darwin", "arm64", "7").Name, "ts-dns_1.0_Darwin_arm64.tar.gz")
+	assert.Equal(t, matchAsset(assets, "linux", "arm", "7").Name, "ts-dns_1.0_Linux_armv7.tar.gz")
+	assert.Equal(t, matchAsset(assets, "linux", "arm", "6").Name, "ts-dns_1.0_Linux_armv6.tar.gz")
+	assert.True(t, matchAsset(assets, "linux", "arm", "5") == nil)
+	assert.Equal(t, matchAsset(assets[1:], "linux", "arm", "7").Name, "ts-dns_1.0_Linux_armv7.tar.gz")
+	assert.Equal(t, matchAsset(assets[:1], "linux", "arm", "7").Name, "ts-dns_1.0_Linux_armv6.tar.gz")
+}
+
+func TestNewerVersion(t *testing.T) {
+	assert.True(t, newerVersion("v1.10.0", "v1.9.0"))
+	assert.False(t, newerVersion("v1.9.0", "v1.10.0"))
+	assert.False(t, newerVersion("v1.9.0", "1.9.0"))
+	assert.False(t, newerVersion("v1.9.0", "v1.10.0-rc.1"))
+	assert.True(t, newerVersion("v1.10.0", "v1.10.0-rc.1"))
+	assert.True(t, newerVersion("v1.9.0", "Unknown")) // 开发版本
+	assert.False(t, newerVersion("Unknown", "Unknown"))
+}
+
+func TestFindChecksum(t *testing.T) {
+	text := "abc123  ts-dns_linux_amd64.tar.gz\ndef456 *ts-dns_windows_amd64.zip\n"
+	assert.Equal(t, findChecksum(text, "ts-dns_linux_amd64.tar.gz"), "abc123")
+	assert.Equal(t, findChecksum(text, "ts-dns_windows_amd64.zip"), "def456")
+	assert.Equal(t, findChecksum(text, "ts-dns_darwin_amd64.zip"), "")
+}
+
+func TestExtractBinary(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{"README.md": "readme", "ts-dns/ts-dns": "binary"} {
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		_, _ = tw.Write([]byte(content))
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+	binary, err := extractBinary("ts-dns_linux_amd64.tar.gz", buf.Bytes())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(binary), "binary")
+	// 未打包的可执行文件
+	binary, err = extractBinary("ts-dns_linux_amd64", []byte("raw"))
+	assert.Equal(t, string(binary), "raw")
+	_, err = extractBinary("ts-dns.zip", []byte("invalid"))
+	assert.NotEqual(t, err, nil)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/wolf-joe/ts-dns/control"
+	"golang.org/x/net/websocket"
+	"os"
+	"path"
+	"strings"
+)
+
+// watch子命令的过滤条件，为空时不限制
+type watchFilter struct {
+	client  string
+	domain  string // 域名及其子域名，包含"*"时按通配符匹配完整域名
+	group   string
+	blocked bool // 仅显示被屏蔽列表拦截的查询
+}
+
+func (f watchFilter) match(event control.Event) bool {
+	if f.client != "" && f.client != event.Client || f.group != "" && f.group != event.Group ||
+		f.blocked && event.Blocked == "" {
+		return false
+	}
+	if f.domain == "" {
+		return true
+	}
+	domain, pattern := strings.ToLower(strings.TrimSuffix(event.Name, ".")), strings.ToLower(f.domain)
+	pattern = strings.TrimSuffix(pattern, ".")
+	if strings.Contains(pattern, "*") {
+		matched, _ := path.Match(pattern, domain)
+		return matched
+	}
+	return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+}
+
+// 将查询事件格式化为一行输出
+func formatEvent(event control.Event) string {
+	group := event.Group
+	if event.Blocked != "" {
+		group = "blocked:" + event.Blocked
+	} else if group == "" {
+		group = "-"
+	}
+	rcode := event.Rcode
+	if rcode == "" {
+		rcode = "NORESPONSE"
+	}
+	var answers []string
+	for _, answer := range event.Answer { // 仅保留记录数据部分
+		if fields := strings.Fields(answer); len(fields) >= 5 {
+			answers = append(answers, strings.Join(fields[4:], " "))
+		}
+	}
+	return fmt.Sprintf("%s %-15s %-5s %s %s %s %.1fms %s", event.Time.Format("15:04:05.000"), event.Client,
+		event.Qtype, event.Name, group, rcode, event.Elapsed, strings.Join(answers, ", "))
+}
+
+// watch子命令：经控制接口实时输出运行中实例的查询，可按客户端、域名、组及是否被屏蔽过滤
+func runWatch(args []string) {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	cfgPath := fs.String("c", "ts-dns.toml", "config file path, used to locate the control api")
+	server := fs.String("s", "", "control api address, e.g. 127.0.0.1:5380")
+	token := fs.String("token", "", "control api token")
+	var filter watchFilter
+	fs.StringVar(&filter.client, "client", "", "only show queries from this client ip")
+	fs.StringVar(&filter.domain, "domain", "", "only show this domain and its subdomains, or names matching a wildcard pattern")
+	fs.StringVar(&filter.group, "group", "", "only show queries resolved by this group")
+	fs.BoolVar(&filter.blocked, "blocked", false, "only show queries blocked by blocklists")
+	asJSON := fs.Bool("json", false, "print raw json events")
+	_ = fs.Parse(args)
+
+	addr, secret, err := controlTarget(*cfgPath, *server, *token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "locate control api error: %v\n", err)
+		os.Exit(1)
+	}
+	wsConfig, err := websocket.NewConfig("ws"+strings.TrimPrefix(addr, "http")+"/ws", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid control api address: %v\n", err)
+		os.Exit(1)
+	}
+	if secret != "" {
+		wsConfig.Header.Set("Authorization", "Bearer "+secret)
+	}
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "connect control api error: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() { _ = ws.Close() }()
+	if err = websocket.JSON.Send(ws, control.Command{ID: 1, Op: "subscribe"}); err != nil {
+		fmt.Fprintf(os.Stderr, "subscribe error: %v\n", err)
+		os.Exit(1)
+	}
+	for {
+		var raw []byte
+		if err = websocket.Message.Receive(ws, &raw); err != nil {
+			fmt.Fprintf(os.Stderr, "receive event error: %v\n", err)
+			os.Exit(1)
+		}
+		var event control.Event
+		if err = json.Unmarshal(raw, &event); err != nil || event.Type != "query" || !filter.match(event) {
+			continue
+		}
+		if *asJSON {
+			fmt.Println(string(raw))
+		} else {
+			fmt.Println(formatEvent(event))
+		}
+	}
+}
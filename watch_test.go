@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/wolf-joe/ts-dns/control"
+	"testing"
+	"time"
+)
+
+func TestWatchFilter(t *testing.T) {
+	event := control.Event{Type: "query", Client: "192.168.1.5", Name: "www.YouTube.com.", Group: "dirty"}
+	assert.True(t, watchFilter{}.match(event))
+	assert.True(t, watchFilter{client: "192.168.1.5", domain: "youtube.com", group: "dirty"}.match(event))
+	assert.True(t, watchFilter{domain: "*.youtube.*"}.match(event))
+	assert.False(t, watchFilter{domain: "tube.com"}.match(event))
+	assert.False(t, watchFilter{domain: "*.google.*"}.match(event))
+	assert.False(t, watchFilter{client: "192.168.1.6"}.match(event))
+	assert.False(t, watchFilter{group: "clean"}.match(event))
+	assert.False(t, watchFilter{blocked: true}.match(event))
+	event.Blocked = "ads"
+	assert.True(t, watchFilter{blocked: true}.match(event))
+
+	event.Time, event.Qtype, event.Rcode, event.Elapsed = time.Date(2020, 1, 1, 8, 0, 0, 0, time.Local), "A", "NOERROR", 1.25
+	event.Answer = []string{"www.youtube.com.\t60\tIN\tA\t0.0.0.0"}
+	assert.Equal(t, formatEvent(event), "08:00:00.000 192.168.1.5     A     www.YouTube.com. blocked:ads NOERROR 1.2ms 0.0.0.0")
+	event.Blocked, event.Group, event.Rcode, event.Answer = "", "", "", nil
+	assert.Equal(t, formatEvent(event), "08:00:00.000 192.168.1.5     A     www.YouTube.com. - NORESPONSE 1.2ms ")
+}
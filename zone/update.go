@@ -0,0 +1,266 @@
+package zone
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// 判断是否为不能出现在更新记录中的元类型
+func metaType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeANY, dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+		return true
+	}
+	return false
+}
+
+// 删除名称下满足条件的记录，返回是否有记录被删除。调用方需持有写锁或操作的是副本
+func (z *Zone) remove(name string, match func(rr dns.RR) bool) (removed bool) {
+	var kept []dns.RR
+	for _, rr := range z.names[name] {
+		if !match(rr) {
+			kept = append(kept, rr)
+			continue
+		}
+		removed = true
+		for n := name; ; {
+			if z.nodes[n]--; z.nodes[n] <= 0 {
+				delete(z.nodes, n)
+			}
+			if n == z.Origin {
+				break
+			}
+			i, _ := dns.NextLabel(n, 0)
+			n = n[i:]
+		}
+	}
+	if len(kept) > 0 {
+		z.names[name] = kept
+	} else {
+		delete(z.names, name)
+	}
+	return
+}
+
+// 判断rrs与期望的记录集合是否完全相同（忽略TTL）
+func sameSet(rrs, expected []dns.RR) bool {
+	if len(rrs) != len(expected) {
+		return false
+	}
+	for _, want := range expected {
+		found := false
+		for _, rr := range rrs {
+			if found = dns.IsDuplicate(rr, want); found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// 检查更新请求的先决条件（RFC 2136 3.2），返回rcode
+func (z *Zone) checkPrereq(prereqs []dns.RR) int {
+	values := map[[2]string][]dns.RR{} // 依赖记录值的先决条件，按名称、类型分组
+	for _, rr := range prereqs {
+		h := rr.Header()
+		name := strings.ToLower(h.Name)
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !z.Contains(name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassANY: // 名称或记录集合存在
+			if h.Rrtype == dns.TypeANY && len(z.names[name]) == 0 {
+				return dns.RcodeNameError
+			} else if h.Rrtype != dns.TypeANY && len(z.lookup(name, h.Rrtype)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE: // 名称或记录集合不存在
+			if h.Rrtype == dns.TypeANY && len(z.names[name]) > 0 {
+				return dns.RcodeYXDomain
+			} else if h.Rrtype != dns.TypeANY && len(z.lookup(name, h.Rrtype)) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			key := [2]string{name, dns.TypeToString[h.Rrtype]}
+			values[key] = append(values[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	for key, expected := range values {
+		if !sameSet(z.lookup(key[0], expected[0].Header().Rrtype), expected) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// 预检查更新记录（RFC 2136 3.4.1），返回rcode
+func (z *Zone) prescan(updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+		if !z.Contains(h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			if metaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rrtype != dns.TypeANY && metaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		case dns.ClassNONE:
+			if h.Ttl != 0 || metaType(h.Rrtype) {
+				return dns.RcodeFormatError
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// 应用单条更新记录（RFC 2136 3.4.2），返回区域是否有变化。区域顶点的SOA及最后一条NS记录不会被删除
+func (z *Zone) apply(rr dns.RR) bool {
+	h := rr.Header()
+	name := strings.ToLower(h.Name)
+	apex := name == z.Origin
+	switch h.Class {
+	case dns.ClassINET: // 添加记录
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		if soa, ok := rr.(*dns.SOA); ok {
+			if !apex || soa.Serial <= z.soa.Serial {
+				return false
+			}
+			z.remove(name, func(rr dns.RR) bool { return rr.Header().Rrtype == dns.TypeSOA })
+			z.soa = soa
+			z.add(soa)
+			return true
+		}
+		// CNAME不能与其它类型的记录共存
+		for _, old := range z.names[name] {
+			isCNAME := old.Header().Rrtype == dns.TypeCNAME
+			if isCNAME != (h.Rrtype == dns.TypeCNAME) {
+				return false
+			}
+		}
+		z.remove(name, func(old dns.RR) bool {
+			return h.Rrtype == dns.TypeCNAME && old.Header().Rrtype == dns.TypeCNAME || dns.IsDuplicate(old, rr)
+		})
+		z.add(rr)
+		return true
+	case dns.ClassANY: // 删除记录集合或名称下的所有记录
+		return z.remove(name, func(old dns.RR) bool {
+			rrtype := old.Header().Rrtype
+			if apex && (rrtype == dns.TypeSOA || rrtype == dns.TypeNS) {
+				return false
+			}
+			return h.Rrtype == dns.TypeANY || h.Rrtype == rrtype
+		})
+	case dns.ClassNONE: // 删除单条记录
+		if h.Rrtype == dns.TypeSOA || apex && h.Rrtype == dns.TypeNS && len(z.lookup(name, dns.TypeNS)) <= 1 {
+			return false
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name, rr.Header().Class = name, dns.ClassINET
+		return z.remove(name, func(old dns.RR) bool { return dns.IsDuplicate(old, rr) })
+	}
+	return false
+}
+
+// 将区域写回区域文件，先写临时文件再重命名。原文件中的注释及$INCLUDE等指令不会保留
+func (z *Zone) save() error {
+	if z.file == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("$ORIGIN " + z.Origin + "\n")
+	buf.WriteString(z.soa.String() + "\n")
+	for _, rr := range z.records() {
+		buf.WriteString(rr.String() + "\n")
+	}
+	tmp := z.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, z.file)
+}
+
+// 复制区域的记录，用于在副本上应用更新。调用方需持有读锁
+func (z *Zone) clone() *Zone {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	work := &Zone{Origin: z.Origin, file: z.file, soa: soa,
+		names: make(map[string][]dns.RR, len(z.names)), nodes: make(map[string]int, len(z.nodes))}
+	for name, rrs := range z.names {
+		rrs = append([]dns.RR(nil), rrs...)
+		for i, rr := range rrs {
+			if rr == dns.RR(z.soa) { // 递增序列号时不修改原区域的SOA
+				rrs[i] = soa
+			}
+		}
+		work.names[name] = rrs
+	}
+	for name, count := range z.nodes {
+		work.nodes[name] = count
+	}
+	return work
+}
+
+// 按RFC 2136处理动态更新请求，返回应答的rcode。先决条件均满足时在区域的副本上应用全部更新，
+// 区域有变化时递增SOA序列号，写回区域文件成功后再替换为副本，期间不阻塞查询
+func (z *Zone) Update(request *dns.Msg) int {
+	z.update.Lock()
+	defer z.update.Unlock()
+	z.mux.RLock()
+	work := z.clone()
+	z.mux.RUnlock()
+	if rcode := work.checkPrereq(request.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := work.prescan(request.Ns); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	changed := false
+	for _, rr := range request.Ns {
+		changed = work.apply(rr) || changed
+	}
+	if !changed {
+		return dns.RcodeSuccess
+	}
+	if !work.soaUpdated(request.Ns) {
+		work.soa.Serial++
+	}
+	if err := work.save(); err != nil {
+		log.Printf("[ERROR] save zone %s error: %v\n", z.Origin, err)
+		return dns.RcodeServerFailure
+	}
+	z.mux.Lock()
+	z.soa, z.names, z.nodes = work.soa, work.names, work.nodes
+	z.mux.Unlock()
+	return dns.RcodeSuccess
+}
+
+// 判断更新中是否包含了新的SOA记录，包含时不再自动递增序列号
+func (z *Zone) soaUpdated(updates []dns.RR) bool {
+	for _, rr := range updates {
+		if soa, ok := rr.(*dns.SOA); ok && soa.Hdr.Class == dns.ClassINET && soa.Serial == z.soa.Serial {
+			return true
+		}
+	}
+	return false
+}
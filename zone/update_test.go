@@ -0,0 +1,70 @@
+package zone
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newRR(s string) dns.RR {
+	rr, _ := dns.NewRR(s)
+	return rr
+}
+
+func TestUpdate(t *testing.T) {
+	filename, clean := writeZone(t, text)
+	defer clean()
+	z, _ := NewZone("home.lan", filename)
+	update := new(dns.Msg)
+	update.SetUpdate("home.lan.")
+	// 先决条件不满足时不应用任何更新
+	update.NameUsed([]dns.RR{newRR("pc.home.lan. 0 IN A 0.0.0.0")})
+	update.Insert([]dns.RR{newRR("pc.home.lan. 300 IN A 192.168.1.10")})
+	assert.Equal(t, z.Update(update), dns.RcodeNameError)
+	assert.Equal(t, query(z, "pc.home.lan.", dns.TypeA).Rcode, dns.RcodeNameError)
+
+	// 名称不存在时注册
+	update.Answer = nil
+	update.NameNotUsed([]dns.RR{newRR("pc.home.lan. 0 IN A 0.0.0.0")})
+	assert.Equal(t, z.Update(update), dns.RcodeSuccess)
+	assert.Equal(t, query(z, "PC.home.lan.", dns.TypeA).Answer[0].(*dns.A).A.String(), "192.168.1.10")
+	assert.Equal(t, z.Update(update), dns.RcodeYXDomain)
+	assert.Equal(t, z.soa.Serial, uint32(2))
+	// 区域外的记录
+	other := new(dns.Msg)
+	other.SetUpdate("home.lan.")
+	other.Insert([]dns.RR{newRR("pc.example.com. 300 IN A 1.1.1.1")})
+	assert.Equal(t, z.Update(other), dns.RcodeNotZone)
+
+	// 更新后写回区域文件，重新加载后保持一致
+	z, err := NewZone("home.lan", filename)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, query(z, "pc.home.lan.", dns.TypeA).Answer[0].(*dns.A).A.String(), "192.168.1.10")
+	assert.Equal(t, query(z, "x.dev.home.lan.", dns.TypeA).Answer[0].(*dns.A).A.String(), "192.168.1.4")
+
+	// 删除记录，区域顶点的SOA及最后一条NS记录不会被删除
+	del := new(dns.Msg)
+	del.SetUpdate("home.lan.")
+	del.Used([]dns.RR{newRR("pc.home.lan. 0 IN A 192.168.1.10")})
+	del.Remove([]dns.RR{newRR("pc.home.lan. 0 IN A 192.168.1.10"), newRR("home.lan. 0 IN NS ns.home.lan.")})
+	del.RemoveName([]dns.RR{newRR("www.home.lan. 0 IN A 0.0.0.0")})
+	del.RemoveRRset([]dns.RR{newRR("home.lan. 0 IN SOA . . 0 0 0 0 0")})
+	assert.Equal(t, z.Update(del), dns.RcodeSuccess)
+	assert.Equal(t, query(z, "pc.home.lan.", dns.TypeA).Rcode, dns.RcodeNameError)
+	assert.Equal(t, query(z, "www.home.lan.", dns.TypeA).Rcode, dns.RcodeNameError)
+	assert.Equal(t, len(query(z, "home.lan.", dns.TypeNS).Answer), 1)
+	assert.Equal(t, len(query(z, "home.lan.", dns.TypeSOA).Answer), 1)
+	// 值相关的先决条件不再满足
+	assert.Equal(t, z.Update(del), dns.RcodeNXRrset)
+
+	// 写回区域文件失败时区域保持不变
+	serial := z.soa.Serial
+	z.file = filename + ".missing/home.lan.zone"
+	add := new(dns.Msg)
+	add.SetUpdate("home.lan.")
+	add.Insert([]dns.RR{newRR("tv.home.lan. 300 IN A 192.168.1.20")})
+	assert.Equal(t, z.Update(add), dns.RcodeServerFailure)
+	assert.Equal(t, query(z, "tv.home.lan.", dns.TypeA).Rcode, dns.RcodeNameError)
+	assert.Equal(t, z.soa.Serial, serial)
+	assert.Equal(t, query(z, "home.lan.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial, serial)
+}
@@ -0,0 +1,218 @@
+package zone
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 本地权威区域，记录从RFC 1035格式的区域文件加载。区域内的查询直接应答，不转发至上游
+type Zone struct {
+	Origin string // 区域名称，小写FQDN
+	file   string
+	mux    sync.RWMutex
+	update sync.Mutex // 串行处理动态更新
+	soa    *dns.SOA
+	names  map[string][]dns.RR // 所有者名称（小写）到记录的映射
+	nodes  map[string]int      // 区域内存在的名称（含空的非终端名称）到其下记录数量的映射
+}
+
+// 判断域名是否属于该区域
+func (z *Zone) Contains(name string) bool {
+	return dns.IsSubDomain(z.Origin, strings.ToLower(name))
+}
+
+// 添加一条记录，调用方需持有写锁
+func (z *Zone) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	rr.Header().Name = name
+	z.names[name] = append(z.names[name], rr)
+	for n := name; ; {
+		z.nodes[n]++
+		if n == z.Origin {
+			break
+		}
+		i, _ := dns.NextLabel(n, 0)
+		n = n[i:]
+	}
+}
+
+// 获取名称的某一类型记录，调用方需持有读锁
+func (z *Zone) lookup(name string, qtype uint16) (rrs []dns.RR) {
+	for _, rr := range z.names[name] {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return
+}
+
+// 获取除SOA外的全部记录，按所有者名称排序，调用方需持有读锁
+func (z *Zone) records() (rrs []dns.RR) {
+	names := make([]string, 0, len(z.names))
+	for name := range z.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, rr := range z.names[name] {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// 查找name所在的委派点，返回委派点的NS记录
+func (z *Zone) delegation(name string) []dns.RR {
+	for n := name; n != z.Origin; {
+		if ns := z.lookup(n, dns.TypeNS); len(ns) > 0 {
+			return ns
+		}
+		i, _ := dns.NextLabel(n, 0)
+		n = n[i:]
+	}
+	return nil
+}
+
+// 查找与不存在的name匹配的通配符记录（RFC 4592），返回所有者改写为name的副本
+func (z *Zone) wildcard(name string) (rrs []dns.RR) {
+	for n := name; n != z.Origin; {
+		i, _ := dns.NextLabel(n, 0)
+		n = n[i:]
+		if z.nodes[n] > 0 { // 最近的存在的祖先名称
+			for _, rr := range z.names["*."+n] {
+				rr = dns.Copy(rr)
+				rr.Header().Name = name
+				rrs = append(rrs, rr)
+			}
+			return
+		}
+	}
+	return
+}
+
+// 区域内目标名称的A/AAAA记录，作为NS、MX等记录的附加记录
+func (z *Zone) glue(targets []dns.RR) (extra []dns.RR) {
+	for _, rr := range targets {
+		var target string
+		switch rr := rr.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+		target = strings.ToLower(target)
+		if z.Contains(target) {
+			extra = append(extra, z.lookup(target, dns.TypeA)...)
+			extra = append(extra, z.lookup(target, dns.TypeAAAA)...)
+		}
+	}
+	return
+}
+
+// 否定应答的SOA记录，TTL取SOA的TTL与MINIMUM中的较小值（RFC 2308）
+func (z *Zone) negative() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// 应答区域内域名的查询：返回对应记录，名称存在但无该类型记录时返回NODATA，名称不存在时返回NXDOMAIN，
+// 子域名被委派时返回NS引用。区域内的CNAME目标继续在区域内解析
+func (z *Zone) Query(request *dns.Msg) (r *dns.Msg) {
+	question := request.Question[0]
+	r = new(dns.Msg)
+	r.SetReply(request)
+	r.Authoritative = true
+	z.mux.RLock()
+	defer z.mux.RUnlock()
+	name := strings.ToLower(question.Name)
+	for depth := 0; depth < 8; depth++ {
+		if ns := z.delegation(name); ns != nil { // 子域名已委派，返回引用
+			r.Authoritative = len(r.Answer) > 0
+			r.Ns, r.Extra = ns, z.glue(ns)
+			return r
+		}
+		rrs := z.names[name]
+		if z.nodes[name] == 0 {
+			if rrs = z.wildcard(name); len(rrs) == 0 {
+				r.Rcode = dns.RcodeNameError // CNAME的目标不存在时同样返回NXDOMAIN（RFC 6604）
+				r.Ns = []dns.RR{z.negative()}
+				return r
+			}
+		}
+		var answer []dns.RR
+		var cname *dns.CNAME
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == question.Qtype {
+				answer = append(answer, rr)
+			} else if rr, ok := rr.(*dns.CNAME); ok {
+				cname = rr
+			}
+		}
+		if len(answer) > 0 {
+			r.Answer = append(r.Answer, answer...)
+			r.Extra = z.glue(answer)
+			return r
+		}
+		if cname == nil || question.Qtype == dns.TypeCNAME {
+			r.Ns = []dns.RR{z.negative()}
+			return r
+		}
+		r.Answer = append(r.Answer, cname)
+		if name = strings.ToLower(cname.Target); !z.Contains(name) {
+			return r // 区域外的CNAME目标由客户端自行解析
+		}
+	}
+	return r
+}
+
+// 区域传送（AXFR，RFC 5936）的全部记录，以区域顶点的SOA记录开始及结束
+func (z *Zone) Transfer() []dns.RR {
+	z.mux.RLock()
+	defer z.mux.RUnlock()
+	rrs := append([]dns.RR{z.soa}, z.records()...)
+	return append(rrs, z.soa)
+}
+
+// 从区域文件加载权威区域，文件中须包含区域顶点的SOA记录，区域外的记录将被忽略
+func NewZone(origin, filename string) (z *Zone, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	origin = dns.Fqdn(strings.ToLower(origin))
+	z = &Zone{Origin: origin, file: filename, names: map[string][]dns.RR{}, nodes: map[string]int{}}
+	zp := dns.NewZoneParser(f, origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if !z.Contains(rr.Header().Name) {
+			continue
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if !strings.EqualFold(soa.Hdr.Name, origin) || z.soa != nil {
+				return nil, fmt.Errorf("unexpected SOA record: %s", soa)
+			}
+			z.soa = soa
+		}
+		z.add(rr)
+	}
+	if err = zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, fmt.Errorf("missing SOA record for zone %s", origin)
+	}
+	return z, nil
+}
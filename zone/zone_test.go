@@ -0,0 +1,84 @@
+package zone
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const text = `$TTL 3600
+@       IN SOA ns.home.lan. admin.home.lan. 1 7200 3600 1209600 300
+@       IN NS  ns
+ns      IN A   192.168.1.1
+nas     IN A   192.168.1.2
+www     IN CNAME nas
+ext     IN CNAME example.com.
+a.b     IN A   192.168.1.3
+*.dev   IN A   192.168.1.4
+sub     IN NS  ns.sub
+ns.sub  IN A   192.168.1.5
+`
+
+func writeZone(t *testing.T, content string) (string, func()) {
+	dir, _ := ioutil.TempDir("", "zone")
+	filename := filepath.Join(dir, "home.lan.zone")
+	assert.Equal(t, ioutil.WriteFile(filename, []byte(content), 0644), nil)
+	return filename, func() { _ = os.RemoveAll(dir) }
+}
+
+func query(z *Zone, name string, qtype uint16) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	return z.Query(request)
+}
+
+func TestZone(t *testing.T) {
+	filename, clean := writeZone(t, "nas IN A 192.168.1.2")
+	_, err := NewZone("home.lan", filename)
+	assert.NotEqual(t, err, nil) // 缺少SOA记录
+	clean()
+	filename, clean = writeZone(t, text)
+	defer clean()
+	z, err := NewZone("Home.Lan", filename)
+	assert.Equal(t, err, nil)
+	assert.True(t, z.Contains("NAS.home.lan."))
+	assert.False(t, z.Contains("home.lan.cn."))
+
+	r := query(z, "NAS.home.lan.", dns.TypeA)
+	assert.True(t, r.Authoritative)
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "192.168.1.2")
+	// 区域顶点的NS记录附带glue
+	r = query(z, "home.lan.", dns.TypeNS)
+	assert.Equal(t, len(r.Answer), 1)
+	assert.Equal(t, r.Extra[0].(*dns.A).A.String(), "192.168.1.1")
+	// 区域内的CNAME继续解析，区域外的CNAME仅返回CNAME记录
+	r = query(z, "www.home.lan.", dns.TypeA)
+	assert.Equal(t, len(r.Answer), 2)
+	r = query(z, "ext.home.lan.", dns.TypeA)
+	assert.Equal(t, len(r.Answer), 1)
+	assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+	// 名称存在但无对应记录、空的非终端名称返回NODATA
+	for _, name := range []string{"nas.home.lan.", "b.home.lan."} {
+		r = query(z, name, dns.TypeAAAA)
+		assert.Equal(t, r.Rcode, dns.RcodeSuccess)
+		assert.Equal(t, len(r.Answer), 0)
+		assert.Equal(t, r.Ns[0].Header().Ttl, uint32(300))
+	}
+	// 名称不存在时返回NXDOMAIN
+	r = query(z, "none.home.lan.", dns.TypeA)
+	assert.Equal(t, r.Rcode, dns.RcodeNameError)
+	assert.Equal(t, r.Ns[0].Header().Rrtype, dns.TypeSOA)
+	// 通配符
+	r = query(z, "x.dev.home.lan.", dns.TypeA)
+	assert.Equal(t, r.Answer[0].Header().Name, "x.dev.home.lan.")
+	assert.Equal(t, r.Answer[0].(*dns.A).A.String(), "192.168.1.4")
+	// 委派的子域名返回引用
+	r = query(z, "host.sub.home.lan.", dns.TypeA)
+	assert.False(t, r.Authoritative)
+	assert.Equal(t, len(r.Answer), 0)
+	assert.Equal(t, r.Ns[0].(*dns.NS).Ns, "ns.sub.home.lan.")
+	assert.Equal(t, r.Extra[0].(*dns.A).A.String(), "192.168.1.5")
+}